@@ -214,17 +214,40 @@ angular.module('ga', ['ngRoute','ngResource', 'ga.service'])
   };
 });
 
-var LoginCtrl = function ($scope, $rootScope, $http, $location, GaServer) {
+var LoginCtrl = function ($scope, $rootScope, $http, $location, $timeout, GaServer) {
+  var useTokens = function (tokens) {
+    $http.defaults.headers.common['Authorization'] = 'Bearer ' + tokens.accessToken;
+    $timeout(function () {
+      $http.post('/refresh', {refreshToken: tokens.refreshToken}).success(useTokens);
+    }, tokens.expiresIn * 900);
+  };
   $scope.login = function () {
-    $http.defaults.headers.common['Authorization'] = 'Basic ' + btoa($scope.user + ':' + $scope.password);
-    $http.get('/ping').success(function(data, status, headers, config) {
+    $http.post('/login', {user: $scope.user, password: $scope.password, code: $scope.code}).success(function(data, status, headers, config) {
+      $scope.password = undefined;
+      $scope.code = undefined;
+      $scope.codeRequired = false;
+      useTokens(data);
       $rootScope.loggedIn = true;
-      $location.path($rootScope.previousPath).replace();
+      $rootScope.mustChangePassword = data.mustChangePassword === true;
+      $location.path($rootScope.mustChangePassword ? '/password' : $rootScope.previousPath).replace();
     }).error(function(data, status, headers, config) {
-      $http.defaults.headers.common['Authorization'] = undefined;
-      $scope.errorMessage = "Login ou senha incorretos";
+      if (String(data).indexOf("Code required") === 0) {
+        $scope.codeRequired = true;
+        $scope.errorMessage = "Informe o código de verificação";
+      } else {
+        $scope.errorMessage = $scope.codeRequired ? "Login, senha ou código incorretos" : "Login ou senha incorretos";
+      }
     });
   }
+  $scope.resetPassword = function () {
+    $http.post('/password-reset', {token: $scope.token, password: $scope.password}).success(function () {
+      $scope.token = undefined;
+      $scope.resetting = false;
+      $scope.login();
+    }).error(function () {
+      $scope.errorMessage = "Token de redefinição de senha inválido ou expirado";
+    });
+  };
 };
 
 var NavigatorCtrl = function ($scope, $rootScope, $location, $http, $cacheFactory, GaServer) {
@@ -355,7 +378,8 @@ var AccountsCtrl = function ($scope, $routeParams, $cacheFactory, $window, GaSer
   if ($routeParams.account) {
     account = GaServer.account({coa: $routeParams.coa, account: $routeParams.account}, function () {
       var accounts, i, j;
-      $scope.account = { _id: account._id, name: account.name, number: account.number };
+      $scope.account = { _id: account._id, name: account.name, number: account.number,
+        currency: account.currency };
       for (i = 0; i < account.tags.length; i += 1) {
         if (/Balance$/.test(account.tags[i])) {
           $scope.balanceNature = account.tags[i];
@@ -598,10 +622,11 @@ var TransactionCtrl = function ($scope, $rootScope, $routeParams, $window, GaSer
   $scope.addEntry = function () {
     var entry;
     var evalIfExpression = function (value) {
-      if (typeof value === 'number') {
-        return value;
+      if (typeof value !== 'number') {
+        value = $scope.$eval(value.replace('.', '').replace(/,/g, '.'));
       }
-      return $scope.$eval(value.replace('.', '').replace(/,/g, '.'));
+      // The server refuses fractions of cents.
+      return Math.round(value * 100) / 100;
     }
     if (!$scope.account) {
       $rootScope.$broadcast("error_message", "A conta deve ser informada");
@@ -676,15 +701,18 @@ var TransactionCtrl = function ($scope, $rootScope, $routeParams, $window, GaSer
   };
 }
 
-var PasswordCtrl = function ($scope, $rootScope, $window, $http, $timeout, UserServer) {
+var PasswordCtrl = function ($scope, $rootScope, $window, $location, $http, $timeout, UserServer) {
   $scope.change = function () {
     if ($scope.newPassword != $scope.newPasswordRetyped) {
       $rootScope.$broadcast("error_message", "A senha nova é diferente de sua confirmação");
     }
     UserServer.password({oldPassword: $scope.oldPassword, newPassword: $scope.newPassword}, function () {
-      var user = atob($http.defaults.headers.common['Authorization'].substring(6)).split(':')[0];
-      $http.defaults.headers.common['Authorization'] = 'Basic ' + btoa(user + ':' + $scope.newPassword);
-      $window.history.back();
+      if ($rootScope.mustChangePassword) {
+        $rootScope.mustChangePassword = false;
+        $location.path('/').replace();
+      } else {
+        $window.history.back();
+      }
     });
   };
 }
@@ -695,6 +723,7 @@ var UserCtrl = function ($scope, $window, $routeParams, $http, UserServer) {
     user = UserServer.user({user: $routeParams.user}, function () {
       $scope.user = user.user;
       $scope.name = user.name;
+      $scope.locked = user.locked;
     });
   } else {
     $scope.users = UserServer.users();
@@ -703,12 +732,6 @@ var UserCtrl = function ($scope, $window, $routeParams, $http, UserServer) {
     user = {user: $scope.user, name: $scope.name, password: $scope.password};
     if ($routeParams.user) {
       UserServer.updateUser({user: $routeParams.user}, user, function () {
-        if (!!$scope.password && $scope.password.length > 0) {
-          var user = atob($http.defaults.headers.common['Authorization'].substring(6)).split(':')[0];
-          if (user.toLowerCase() === $scope.user.toLowerCase()) {
-            $http.defaults.headers.common['Authorization'] = 'Basic ' + btoa(user + ':' + $scope.password);
-          }
-        }
         $window.history.back();
       });
     } else {
@@ -724,6 +747,16 @@ var UserCtrl = function ($scope, $window, $routeParams, $http, UserServer) {
       $window.history.back();
     });
   };
+  $scope.resetPassword = function () {
+    $http.post('/users/' + $routeParams.user + '/password-reset', {}).success(function (data) {
+      $scope.resetToken = data.token;
+    });
+  };
+  $scope.unlock = function () {
+    $http.delete('/users/' + $routeParams.user + '/lockout').success(function () {
+      $scope.locked = false;
+    });
+  };
   $scope.userId = function () {
     return $routeParams.user;
   };
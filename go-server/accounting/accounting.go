@@ -3,37 +3,65 @@ package accounting
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
 
 	"github.com/mcesarhm/geek-accounting/go-server/context"
 	"github.com/mcesarhm/geek-accounting/go-server/core"
 	"github.com/mcesarhm/geek-accounting/go-server/db"
 	"github.com/mcesarhm/geek-accounting/go-server/extensions/collections"
-	xmath "github.com/mcesarhm/geek-accounting/go-server/extensions/math"
 
 	"sort"
 	"strings"
 	"time"
 
 	"mcesar.io/deb"
+)
 
-	"appengine"
+var (
+	ChartOfAccountsRepository = db.NewRepository[ChartOfAccounts]("ChartOfAccounts")
+	AccountRepository         = db.NewRepository[Account]("Account")
+	TransactionRepository     = db.NewRepository[Transaction]("Transaction")
 )
 
+func init() {
+	gob.Register((*ChartOfAccounts)(nil))
+	gob.Register((*Account)(nil))
+	gob.Register((*Transaction)(nil))
+	gob.Register(([]*ChartOfAccounts)(nil))
+	gob.Register(([]*Account)(nil))
+	gob.Register(([]*Transaction)(nil))
+	db.RegisterIndex("Account", "Number")
+	db.RegisterIndex("Transaction", "Date")
+	db.RegisterIndex("Transaction", "AsOf")
+	db.RegisterIndex("Transaction", "AccountsKeysAsString")
+}
+
 type ChartOfAccounts struct {
 	db.Identifiable
 	Name                    string       `json:"name"`
 	RetainedEarningsAccount db.CKey      `json:"retainedEarningsAccount"`
 	Space                   db.CKey      `json:"space"`
 	User                    core.UserKey `json:"user"`
-	AsOf                    time.Time    `json:"timestamp"`
+	// Organization is the one the chart of accounts was created in, or zero for the charts
+	// created before organizations, which belong to the default organization.
+	Organization db.CKey   `json:"organization"`
+	AsOf         time.Time `json:"timestamp"`
+	// Currency is the functional currency of the chart of accounts, the one of the values of the
+	// entries, or empty for the charts created before currencies.
+	Currency string `json:"currency"`
 }
 
 func (coa *ChartOfAccounts) ValidationMessage(_ db.Db, _ map[string]string) string {
 	if len(strings.TrimSpace(coa.Name)) == 0 {
 		return "The name must be informed"
 	}
+	if len(coa.Currency) > 0 && !validCurrency(coa.Currency) {
+		return "The currency must be an ISO 4217 code"
+	}
 	return ""
 }
 
@@ -47,6 +75,9 @@ type Account struct {
 	AsOf    time.Time    `json:"timestamp"`
 	Created time.Time    `json:"-"`
 	Removed bool         `json:"-"`
+	// Currency is the one of the amounts of the entries of the account, if it is not the one of
+	// the chart of accounts.
+	Currency string `json:"currency,omitempty"`
 }
 
 var inheritedProperties = map[string]string{
@@ -96,12 +127,15 @@ func (account *Account) ValidationMessage(db db.Db, param map[string]string) str
 	if count > 1 {
 		return "Only one income statement attribute is allowed"
 	}
+	if len(account.Currency) > 0 && !validCurrency(account.Currency) {
+		return "The currency must be an ISO 4217 code"
+	}
 	coaKey, err := db.DecodeKey(param["coa"])
 	if err != nil {
 		return err.Error()
 	}
 	if account.Key.IsZero() {
-		if key, err := accountKeyWithNumber(db, context.Context{nil, nil}, account.Number,
+		if key, err := accountKeyWithNumber(db, context.Context{}, account.Number,
 			param["coa"]); err != nil {
 			return err.Error()
 		} else if !key.IsZero() {
@@ -128,7 +162,7 @@ func (account *Account) ValidationMessage(db db.Db, param map[string]string) str
 	return ""
 }
 
-func (account *Account) Debit(value float64) float64 {
+func (account *Account) Debit(value Money) Money {
 	if collections.Contains(account.Tags, "debitBalance") {
 		return value
 	} else {
@@ -136,7 +170,7 @@ func (account *Account) Debit(value float64) float64 {
 	}
 }
 
-func (account *Account) Credit(value float64) float64 {
+func (account *Account) Credit(value Money) Money {
 	if collections.Contains(account.Tags, "creditBalance") {
 		return value
 	} else {
@@ -162,9 +196,58 @@ type Transaction struct {
 	Key_                 interface{}  `datastore:"-" json:"_id"`
 }
 
+// An Entry of an account whose currency is not the one of the chart of accounts has the amount in
+// the currency of the account, and the rate the value was converted with, unless the value was
+// informed.
 type Entry struct {
-	Account db.CKey `json:"account"`
-	Value   float64 `json:"value"`
+	Account  db.CKey `json:"account"`
+	Value    Money   `json:"value"`
+	Currency string  `json:"currency,omitempty"`
+	Amount   Money   `json:"amount,omitempty"`
+	Rate     Rate    `json:"rate,omitempty"`
+}
+
+// MarshalJSON encodes the amount with the scale of its currency.
+func (entry Entry) MarshalJSON() ([]byte, error) {
+	type plain Entry
+	if len(entry.Currency) == 0 {
+		return json.Marshal(plain(entry))
+	}
+	return json.Marshal(struct {
+		plain
+		Amount json.Number `json:"amount"`
+	}{plain(entry), json.Number(entry.Amount.Format(Scale(entry.Currency)))})
+}
+
+// UnmarshalJSON decodes the amount with the scale of its currency, as MarshalJSON encodes it.
+func (entry *Entry) UnmarshalJSON(b []byte) error {
+	type plain Entry
+	var aux struct {
+		plain
+		Amount json.RawMessage `json:"amount"`
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	*entry = Entry(aux.plain)
+	entry.Amount = 0
+	s := string(aux.Amount)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if len(s) == 0 || s == "null" {
+		return nil
+	}
+	amount, err := ParseMoney(s, Scale(entry.Currency))
+	if err != nil {
+		return err
+	}
+	entry.Amount = amount
+	return nil
+}
+
+type logger interface {
+	Infof(format string, args ...interface{})
 }
 
 type transactionMetadata struct {
@@ -187,17 +270,17 @@ func (transaction *Transaction) ValidationMessage(db db.Db, param map[string]str
 	if len(strings.TrimSpace(transaction.Memo)) == 0 {
 		return "The memo must be informed"
 	}
-	ev := func(arr []Entry) (string, float64) {
-		sum := 0.0
+	ev := func(arr []Entry) (string, Money) {
+		var sum Money
 		for _, e := range arr {
 			if m := e.ValidationMessage(db, param); len(m) > 0 {
-				return m, 0.0
+				return m, 0
 			}
 			sum += e.Value
 		}
 		return "", sum
 	}
-	var debitsSum, creditsSum float64
+	var debitsSum, creditsSum Money
 	var m string
 	if m, debitsSum = ev(transaction.Debits); len(m) > 0 {
 		return m
@@ -205,7 +288,7 @@ func (transaction *Transaction) ValidationMessage(db db.Db, param map[string]str
 	if m, creditsSum = ev(transaction.Credits); len(m) > 0 {
 		return m
 	}
-	if xmath.Round(debitsSum*100) != xmath.Round(creditsSum*100) {
+	if debitsSum != creditsSum {
 		return "The sum of debit values must be equals to the sum of credit values"
 	}
 	return ""
@@ -229,8 +312,8 @@ func (transaction *Transaction) updateAccountsKeysAsString() {
 }
 
 func (transaction *Transaction) incrementValue(lookupAccount func(db.Key) *Account,
-	addValue func(db.Key, float64)) {
-	f := func(entries []Entry, f func(*Account, float64) float64) {
+	addValue func(db.Key, Money)) {
+	f := func(entries []Entry, f func(*Account, Money) Money) {
 		for _, e := range entries {
 			var accountKey db.Key
 			accountKey, value := e.Account, e.Value
@@ -270,15 +353,55 @@ func (entry *Entry) ValidationMessage(db db.Db, param map[string]string) string
 	if entry.Account.Parent().String() != coaKey.String() {
 		return "The account must belong to the same chart of accounts of the transaction"
 	}
+	if entry.Currency != account.Currency {
+		if len(entry.Currency) == 0 {
+			return "The amount must be informed for the accounts in other currencies"
+		}
+		return "The currency of the entry must be the one of the account"
+	}
 
 	return ""
 }
 
+// AllChartsOfAccounts returns the charts of accounts of the current organization of the user that
+// the user is a member of, or every chart of the organization if
+// the user is an admin.
 func AllChartsOfAccounts(c context.Context, m map[string]interface{}, _ map[string]string,
-	_ core.UserKey) (interface{}, error) {
-	_, chartsOfAccounts, err := c.Db.GetAll("ChartOfAccounts", "", &[]ChartOfAccounts{}, nil,
+	userKey core.UserKey) (interface{}, error) {
+	keys, chartsOfAccounts, err := ChartOfAccountsRepository.GetAll(c.Db, "", nil,
 		[]string{"Name"})
-	return chartsOfAccounts, err
+	if err != nil {
+		return nil, err
+	}
+	inOrganization, err := core.InCurrentOrganization(c, userKey)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := core.IsAdmin(c, userKey)
+	if err != nil {
+		return nil, err
+	}
+	member, err := chartsOfMember(c, userKey)
+	if err != nil {
+		return nil, err
+	}
+	result := []*ChartOfAccounts{}
+	for i, coa := range chartsOfAccounts {
+		if !inOrganization(coa.Organization) {
+			continue
+		}
+		if admin || member[keys[i].Encode()] {
+			result = append(result, coa)
+		} else if coa.User.Encode() == userKey.Encode() {
+			// The creator of a chart without memberships is its owner.
+			if _, memberships, err := chartMemberships(c, keys[i].Encode()); err != nil {
+				return nil, err
+			} else if len(memberships) == 0 {
+				result = append(result, coa)
+			}
+		}
+	}
+	return result, nil
 }
 
 func SaveChartOfAccounts(c context.Context, m map[string]interface{}, param map[string]string,
@@ -287,25 +410,59 @@ func SaveChartOfAccounts(c context.Context, m map[string]interface{}, param map[
 		Name: m["name"].(string),
 		User: userKey,
 		AsOf: time.Now()}
+	if currency, ok := m["currency"].(string); ok {
+		coa.Currency = strings.ToUpper(strings.TrimSpace(currency))
+	}
+	var before interface{}
 	if coaKeyAsString, ok := param["coa"]; ok {
 		if k, err := c.Db.DecodeKey(coaKeyAsString); err != nil {
 			return nil, err
 		} else {
 			coa.SetKey(k)
 		}
-		var coa2 ChartOfAccounts
-		if _, err := c.Db.Get(&coa2, param["coa"]); err != nil {
+		if coa2, err := ChartOfAccountsRepository.Get(c.Db, param["coa"]); err != nil {
 			return nil, err
+		} else {
+			coa.Space = coa2.Space
+			coa.User = coa2.User
+			coa.Organization = coa2.Organization
+			coa.RetainedEarningsAccount = coa2.RetainedEarningsAccount
+			if len(coa2.Currency) > 0 || len(coa.Currency) == 0 {
+				coa.Currency = coa2.Currency
+			}
+			before = coa2
 		}
-		coa.Space = coa2.Space
 	} else {
-		if k, err := c.Db.DecodeKey(param["space"]); err != nil {
+		if spaceKeyAsString, ok := param["space"]; ok {
+			if k, err := c.Db.DecodeKey(spaceKeyAsString); err != nil {
+				return nil, err
+			} else {
+				coa.Space = k.(db.CKey)
+			}
+		}
+		if organization, err := core.CurrentOrganization(c, userKey); err != nil {
 			return nil, err
 		} else {
-			coa.Space = k.(db.CKey)
+			coa.Organization = organization
 		}
 	}
-	_, err := c.Db.Save(coa, "ChartOfAccounts", "", param)
+	err := c.Db.Execute(func(tdb db.Db) error {
+		key, err := ChartOfAccountsRepository.Save(tdb, coa, "", param)
+		if err != nil {
+			return err
+		}
+		if err = core.Audit(c, tdb, key.Encode(), userKey, key.Encode(), before, coa); err != nil {
+			return err
+		}
+		if _, ok := param["coa"]; ok {
+			return nil
+		}
+		membership := &Membership{User: userKey, Role: Owner, AsOf: coa.AsOf}
+		if _, err = MembershipRepository.Save(tdb, membership, key.Encode(), nil); err != nil {
+			return err
+		}
+		return core.Audit(c, tdb, key.Encode(), userKey, membership.Key.Encode(), nil, membership)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -313,26 +470,59 @@ func SaveChartOfAccounts(c context.Context, m map[string]interface{}, param map[
 	return coa, err
 }
 
+// accountCurrency returns the currency of a new account, which is empty if it is the one of the
+// chart of accounts.
+func accountCurrency(c context.Context, currency string, m map[string]interface{},
+	param map[string]string) (string, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	coa, err := ChartOfAccountsRepository.Get(c.Db, param["coa"])
+	if err != nil {
+		return "", err
+	}
+	if currency == coa.Currency {
+		return "", nil
+	}
+	if len(coa.Currency) == 0 {
+		return "", errors.New("The currency of the chart of accounts must be informed")
+	}
+	if _, ok := m["space"]; ok {
+		return "", errors.New(
+			"Accounts in other currencies are not supported by charts of accounts kept in spaces")
+	}
+	return currency, nil
+}
+
 func AllAccounts(c context.Context, m map[string]interface{}, param map[string]string,
 	_ core.UserKey) (interface{}, error) {
-	_, accounts, err := c.Db.GetAll("Account", param["coa"], &[]Account{}, nil, []string{"Number"})
-	aa := accounts.(*[]Account)
-	result := make([]Account, 0, len(*aa))
-	for _, a := range *aa {
-		if !a.Removed {
-			result = result[0 : len(result)+1]
-			result[len(result)-1] = a
-		}
+	limit, cursor, err := db.PageParams(param)
+	if err != nil {
+		return nil, err
+	}
+	_, accounts, next, err := AccountRepository.GetPage(c.Db, param["coa"],
+		db.Field("Removed").Eq(false), []string{"Number"}, limit, cursor)
+	if err != nil {
+		return nil, err
 	}
-	return result, err
+	return db.Paged(param, accounts, next), nil
+}
+
+// inChart reports whether the key is of an item of the chart of accounts of the "coa" param, whose
+// permissions are the only ones checked.
+func inChart(key db.Key, param map[string]string) bool {
+	return key.Parent().Encode() == param["coa"]
 }
 
 func GetAccount(c context.Context, m map[string]interface{}, param map[string]string,
 	_ core.UserKey) (result interface{}, err error) {
-	if a, err := c.Db.Get(&Account{}, param["account"]); err != nil {
+	if key, err := c.Db.DecodeKey(param["account"]); err != nil {
+		return nil, err
+	} else if !inChart(key, param) {
+		return nil, fmt.Errorf("Account not found")
+	}
+	if a, err := AccountRepository.Get(c.Db, param["account"]); err != nil {
 		return nil, err
 	} else {
-		if a.(*Account).Removed {
+		if a.Removed {
 			return nil, fmt.Errorf("Account not found")
 		}
 		return a, nil
@@ -358,38 +548,46 @@ func SaveAccount(c context.Context, m map[string]interface{}, param map[string]s
 		isUpdate = true
 		if k, err := c.Db.DecodeKey(accountKeyAsString); err != nil {
 			return nil, err
+		} else if !inChart(k, param) {
+			return nil, fmt.Errorf("Account not found")
 		} else {
 			account.SetKey(k)
 		}
 	}
 
 	parent := &Account{}
+	var before interface{}
 	if isUpdate {
-		var a Account
-		if _, err = c.Db.Get(&a, account.Key.Encode()); err != nil {
+		var a *Account
+		if a, err = AccountRepository.Get(c.Db, account.Key.Encode()); err != nil {
 			return
 		}
+		before = a
 		if !a.Parent.IsZero() {
-			if _, err = c.Db.Get(parent, a.Parent.Encode()); err != nil {
+			if parent, err = AccountRepository.Get(c.Db, a.Parent.Encode()); err != nil {
 				return
 			}
 		}
 		account.Parent = a.Parent
 		account.Number = a.Number
+		account.Currency = a.Currency
 		account.Created = a.Created
+	} else if currency, ok := m["currency"].(string); ok && len(currency) > 0 {
+		if account.Currency, err = accountCurrency(c, currency, m, param); err != nil {
+			return
+		}
 	}
 	if parentNumber, ok := m["parent"]; ok {
-		var accounts []Account
-		keys, _, err := c.Db.GetAll("Account", param["coa"], &accounts,
-			db.M{"Number = ": parentNumber}, nil)
+		keys, accounts, err := AccountRepository.GetAll(c.Db, param["coa"],
+			db.Field("Number").Eq(parentNumber), nil)
 		if err != nil {
 			return nil, err
 		}
 		if keys.Len() == 0 {
 			return nil, fmt.Errorf("Parent not found: %v", parentNumber)
 		}
-		account.Parent = keys.KeyAt(0).(db.CKey)
-		parent = &accounts[0]
+		account.Parent = keys[0]
+		parent = accounts[0]
 		delete(m, "parent")
 	}
 
@@ -413,23 +611,34 @@ func SaveAccount(c context.Context, m map[string]interface{}, param map[string]s
 
 	err = c.Db.Execute(func(tdb db.Db) (err error) {
 
-		accountKey, err := tdb.Save(account, "Account", param["coa"], param)
+		accountKey, err := AccountRepository.Save(tdb, account, param["coa"], param)
 		if err != nil {
 			return
 		}
+		if err = core.Audit(c, tdb, param["coa"], userKey, accountKey.Encode(), before,
+			account); err != nil {
+			return
+		}
 
 		if retainedEarningsAccount {
-			coa := new(ChartOfAccounts)
-			if _, err = tdb.Get(coa, param["coa"]); err != nil {
+			var coa *ChartOfAccounts
+			if coa, err = ChartOfAccountsRepository.Get(tdb, param["coa"]); err != nil {
 				return
 			}
+			coaBefore := *coa
 			coa.RetainedEarningsAccount = accountKey.(db.CKey)
-			if _, err = tdb.Save(coa, "ChartOfAccounts", "", param); err != nil {
+			if _, err = ChartOfAccountsRepository.Save(tdb, coa, "", param); err != nil {
+				return
+			}
+			if err = core.Audit(c, tdb, param["coa"], userKey, param["coa"], &coaBefore,
+				coa); err != nil {
 				return
 			}
 		}
 
 		if !account.Parent.IsZero() && !isUpdate {
+			parentBefore := *parent
+			parentBefore.Tags = append([]string{}, parent.Tags...)
 			changed := false
 			i := collections.IndexOf(parent.Tags, "analytic")
 			if i != -1 {
@@ -441,7 +650,11 @@ func SaveAccount(c context.Context, m map[string]interface{}, param map[string]s
 				changed = true
 			}
 			if changed {
-				if _, err = tdb.Save(parent, "Account", param["coa"], param); err != nil {
+				if _, err = AccountRepository.Save(tdb, parent, param["coa"], param); err != nil {
+					return
+				}
+				if err = core.Audit(c, tdb, param["coa"], userKey, parent.Key.Encode(),
+					&parentBefore, parent); err != nil {
 					return
 				}
 			}
@@ -465,34 +678,37 @@ func DeleteAccount(c context.Context, m map[string]interface{}, param map[string
 	if err != nil {
 		return
 	}
+	if !inChart(key, param) {
+		return nil, fmt.Errorf("Account not found")
+	}
 
 	coaKey, err := c.Db.DecodeKey(param["coa"])
 	if err != nil {
 		return
 	}
 
-	checkReferences := func(kind, property, errorMessage string) error {
-		if keys, _, err := c.Db.GetAllWithLimit(kind, param["coa"], nil,
-			db.M{property: key}, nil, 1); err != nil {
+	checkReferences := func(keys func(db.Db, string, db.Query, int) (db.Keys, error),
+		field db.Field, errorMessage string) error {
+		if keys, err := keys(c.Db, param["coa"], field.Eq(key), 1); err != nil {
 			return err
 		} else {
 			if keys.Len() > 0 {
-				return fmt.Errorf(errorMessage)
+				return errors.New(errorMessage)
 			}
 		}
 		return nil
 	}
 
-	err = checkReferences("Account", "Parent = ", "Child accounts found")
+	err = checkReferences(AccountRepository.Keys, "Parent", "Child accounts found")
 	if err != nil {
 		return
 	}
-	err = checkReferences("Transaction", "Debits.Account = ",
+	err = checkReferences(TransactionRepository.Keys, "Debits.Account",
 		"Transactions referencing this account was found")
 	if err != nil {
 		return
 	}
-	err = checkReferences("Transaction", "Credits.Account = ",
+	err = checkReferences(TransactionRepository.Keys, "Credits.Account",
 		"Transactions referencing this account was found")
 	if err != nil {
 		return
@@ -503,15 +719,15 @@ func DeleteAccount(c context.Context, m map[string]interface{}, param map[string
 		}
 	*/
 	err = c.Db.Execute(func(tdb db.Db) error {
-		var a Account
-		if _, err := tdb.Get(&a, key.Encode()); err != nil {
+		a, err := AccountRepository.Get(tdb, key.Encode())
+		if err != nil {
 			return err
 		}
 		a.Removed = true
-		if _, err := tdb.Save(&a, "Account", coaKey.Encode(), param); err != nil {
+		if _, err := AccountRepository.Save(tdb, a, coaKey.Encode(), param); err != nil {
 			return err
 		}
-		return nil
+		return core.Audit(c, tdb, coaKey.Encode(), userKey, key.Encode(), a, nil)
 	})
 	if err != nil {
 		return
@@ -525,16 +741,73 @@ func DeleteAccount(c context.Context, m map[string]interface{}, param map[string
 
 func AllTransactions(c context.Context, m map[string]interface{}, param map[string]string,
 	_ core.UserKey) (interface{}, error) {
-	_, transactions, err := c.Db.GetAll("Transaction", param["coa"], &[]Transaction{}, nil,
-		[]string{"Date", "AsOf"})
-	return transactions, err
+	limit, cursor, err := db.PageParams(param)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 && len(cursor) == 0 {
+		return TransactionStream{c, param["coa"]}, nil
+	}
+	_, transactions, next, err := TransactionRepository.GetPage(c.Db, param["coa"], nil,
+		[]string{"Date", "AsOf"}, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return db.Paged(param, transactions, next), nil
+}
+
+// TransactionStream is the result of AllTransactions when no page is requested. The transactions
+// are read from the database as they are written, instead of being loaded in memory.
+type TransactionStream struct {
+	c      context.Context
+	coaKey string
+}
+
+// Each calls f with each transaction, in the order of their dates.
+func (s TransactionStream) Each(f func(*Transaction) error) error {
+	return TransactionRepository.Iterate(s.c.Db, s.coaKey, nil, []string{"Date", "AsOf"},
+		func(_ db.Key, t *Transaction) error {
+			return f(t)
+		})
+}
+
+// WriteJSON writes the transactions to w as a JSON array.
+func (s TransactionStream) WriteJSON(w io.Writer) error {
+	separator := "["
+	err := s.Each(func(t *Transaction) error {
+		b, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		separator = ","
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if separator == "[" {
+		_, err = io.WriteString(w, "[]\n")
+	} else {
+		_, err = io.WriteString(w, "]\n")
+	}
+	return err
 }
 
 func GetTransaction(c context.Context, m map[string]interface{}, param map[string]string,
 	_ core.UserKey) (result interface{}, err error) {
 	space, ok := m["space"].(deb.Space)
 	if !ok {
-		return c.Db.Get(&Transaction{}, param["transaction"])
+		if t, err := TransactionRepository.Get(c.Db, param["transaction"]); err != nil {
+			return nil, err
+		} else if !inChart(t.Key, param) {
+			return nil, fmt.Errorf("Transaction not found")
+		} else {
+			return t, nil
+		}
 	} else {
 		var moment deb.Moment
 		if key, err := strconv.ParseUint(param["transaction"], 10, 64); err != nil {
@@ -571,7 +844,15 @@ func SaveTransaction(c context.Context, maps []map[string]interface{}, param map
 		return SaveTransactions(c, maps, param, userKey)
 	}
 
-	m := maps[0]
+	return saveTransaction(c, maps[0], param, userKey, nil)
+}
+
+// saveTransaction saves the transaction of m and then calls then, if not nil, with the database of
+// the transaction in which the transaction is saved, so that both changes are saved or none. A
+// transaction appended to the space of m is kept even if then fails, as spaces are not rolled back.
+func saveTransaction(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey, then func(d db.Db, transaction *Transaction) error) (item interface{},
+	err error) {
 
 	asOf := time.Now()
 	transaction := &Transaction{
@@ -582,11 +863,22 @@ func SaveTransaction(c context.Context, maps []map[string]interface{}, param map
 	if err != nil {
 		return
 	}
+	if tags, ok := m["tags"].([]interface{}); ok {
+		for _, t := range tags {
+			if s, ok := t.(string); ok {
+				transaction.Tags = append(transaction.Tags, s)
+			}
+		}
+	}
 
 	coaKey, err := c.Db.DecodeKey(param["coa"])
 	if err != nil {
 		return
 	}
+	coa, err := ChartOfAccountsRepository.Get(c.Db, param["coa"])
+	if err != nil {
+		return
+	}
 
 	entriesArray := func(entriesMapArray []interface{}) (result []Entry, err error) {
 		result = make([]Entry, len(entriesMapArray))
@@ -606,11 +898,19 @@ func SaveTransaction(c context.Context, maps []map[string]interface{}, param map
 				return nil, err
 			} else if key.IsZero() {
 				return nil, fmt.Errorf("Account '%v' not found", entryMap["account"])
-			} else {
-				result[i] = Entry{
-					Account: key.(db.CKey),
-					Value:   xmath.Round(entryMap["value"].(float64)*100) / 100}
 			}
+			if _, ok := entryMap["amount"]; ok {
+				if result[i], err = foreignEntry(c, key, entryMap, transaction.Date,
+					Scale(coa.Currency), param); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			value, err := MoneyOf(entryMap["value"], Scale(coa.Currency))
+			if err != nil {
+				return nil, err
+			}
+			result[i] = Entry{Account: key.(db.CKey), Value: value}
 		}
 		return
 	}
@@ -631,18 +931,37 @@ func SaveTransaction(c context.Context, maps []map[string]interface{}, param map
 
 	space, ok := m["space"].(deb.Space)
 	if !ok {
+		var before interface{}
+		dates := []time.Time{transaction.Date}
 		if isUpdate {
-			if k, err := c.Db.DecodeKey(param["transaction"]); err != nil {
+			if t, err := TransactionRepository.Get(c.Db, param["transaction"]); err != nil {
 				return nil, err
+			} else if !inChart(t.Key, param) {
+				return nil, fmt.Errorf("Transaction not found")
 			} else {
-				transaction.SetKey(k)
+				transaction.SetKey(t.Key)
+				before = t
+				dates = append(dates, t.Date)
 			}
 		}
 		var transactionKey db.Key
-		if k, err := c.Db.Save(transaction, "Transaction", param["coa"], param); err != nil {
+		err = c.Db.Execute(func(tdb db.Db) (err error) {
+			if err = checkPeriods(c, tdb, coaKey.Encode(), userKey, dates...); err != nil {
+				return
+			}
+			if transactionKey, err = TransactionRepository.Save(tdb, transaction, param["coa"],
+				param); err != nil {
+				return
+			}
+			if err = core.Audit(c, tdb, coaKey.Encode(), userKey, transactionKey.Encode(), before,
+				transaction); err != nil || then == nil {
+				return
+			}
+			transaction.SetKey(transactionKey)
+			return then(tdb, transaction)
+		})
+		if err != nil {
 			return nil, err
-		} else {
-			transactionKey = k
 		}
 		if isUpdate {
 			if err = c.Cache.Delete("transactions_asof_" + coaKey.Encode()); err != nil {
@@ -660,13 +979,32 @@ func SaveTransaction(c context.Context, maps []map[string]interface{}, param map
 		err = c.Cache.Delete("transactions_" + coaKey.Encode())
 		transaction.SetKey(transactionKey)
 	} else {
-		if isUpdate {
-			DeleteTransaction(c, m, param, userKey)
-		}
 		accounts, _ := m["accounts_sorted_by_creation"].([]*Account)
 		accountsKeys, _ := m["accounts_keys_sorted_by_creation"].(db.Keys)
-		err = appendTransactionOnSpace(c, coaKey.Encode(), space, transaction, -1,
-			accounts, accountsKeys)
+		err = c.Db.Execute(func(tdb db.Db) (err error) {
+			if err = checkPeriods(c, tdb, coaKey.Encode(), userKey, transaction.Date); err != nil {
+				return
+			}
+			if isUpdate {
+				if err = deleteTransactionOnSpace(c, tdb, space, m, param, userKey,
+					nil); err != nil {
+					return
+				}
+			}
+			if err = appendTransactionOnSpace(c, coaKey.Encode(), space, transaction, -1,
+				accounts, accountsKeys); err != nil {
+				return
+			}
+			if err = core.Audit(c, tdb, coaKey.Encode(), userKey,
+				strconv.FormatInt(asOf.UnixNano(), 10), nil,
+				transaction); err != nil || then == nil {
+				return
+			}
+			return then(tdb, transaction)
+		})
+		if err != nil {
+			return
+		}
 	}
 
 	item = transaction
@@ -674,6 +1012,49 @@ func SaveTransaction(c context.Context, maps []map[string]interface{}, param map
 	return
 }
 
+// foreignEntry returns the entry of an account in another currency, whose amount is converted to
+// its value, with the scale of the chart of accounts, at the rate of the entry, or of the exchange
+// rates at the date, unless the value is informed.
+func foreignEntry(c context.Context, key db.Key, entryMap map[string]interface{}, date time.Time,
+	valueScale int, param map[string]string) (entry Entry, err error) {
+	account, err := AccountRepository.Get(c.Db, key.Encode())
+	if err != nil {
+		return
+	}
+	if len(account.Currency) == 0 {
+		err = fmt.Errorf("The account %v is in the currency of the chart of accounts",
+			account.Number)
+		return
+	}
+	entry = Entry{Account: key.(db.CKey), Currency: account.Currency}
+	if entry.Amount, err = MoneyOf(entryMap["amount"], Scale(account.Currency)); err != nil {
+		return
+	}
+	switch rate := entryMap["rate"].(type) {
+	case nil:
+	case Rate:
+		entry.Rate = rate
+	case string:
+		entry.Rate, err = ParseRate(rate)
+	default:
+		entry.Rate, err = ParseRate(fmt.Sprint(rate))
+	}
+	if err != nil {
+		return
+	}
+	if _, ok := entryMap["value"]; ok {
+		entry.Value, err = MoneyOf(entryMap["value"], valueScale)
+		return
+	}
+	if len(entry.Rate) == 0 {
+		if entry.Rate, err = rateAt(c, param["coa"], account.Currency, date); err != nil {
+			return
+		}
+	}
+	entry.Value, err = entry.Rate.Convert(entry.Amount, Scale(account.Currency), valueScale)
+	return
+}
+
 func SaveTransactions(c context.Context, maps []map[string]interface{}, param map[string]string,
 	userKey core.UserKey) (item interface{}, err error) {
 	if len(maps) == 0 {
@@ -685,71 +1066,113 @@ func SaveTransactions(c context.Context, maps []map[string]interface{}, param ma
 	}
 	now := time.Now().UnixNano()
 	transactions := make([]*deb.Transaction, len(maps))
-	_, accounts, err := accountsSortedByCreation(c, param["coa"])
+	accountsMap, err := accountsIndexes(c, param["coa"])
 	if err != nil {
 		return nil, err
 	}
-	accountsMap := map[string]int{}
-	for i, a := range accounts {
-		accountsMap[a.Number] = i + 1
+	coa, err := ChartOfAccountsRepository.Get(c.Db, param["coa"])
+	if err != nil {
+		return nil, err
 	}
+	entries := make([]*core.AuditEntry, len(maps))
+	dates := make([]time.Time, len(maps))
 	for i, m := range maps {
-		date, err := time.Parse(time.RFC3339, m["date"].(string))
-		if err != nil {
+		if transactions[i], err = newDebTransaction(m, accountsMap, userKey,
+			deb.Moment(now+int64(i)), Scale(coa.Currency)); err != nil {
 			return nil, err
 		}
-		entries := deb.Entries{}
-		addEntry := func(e interface{}, signal int) error {
-			em := e.(map[string]interface{})
-			account, ok := accountsMap[em["account"].(string)]
-			if !ok {
-				return fmt.Errorf("Account not found %v", em["account"])
-			}
-			if _, ok := entries[deb.Account(account)]; !ok {
-				entries[deb.Account(account)] = int64(0)
-			}
-			entries[deb.Account(account)] +=
-				int64(signal) * int64(xmath.Round(em["value"].(float64)*100))
-			return nil
+		dates[i], _ = time.Parse(time.RFC3339, m["date"].(string))
+		if entries[i], err = core.NewAuditEntry(c, userKey, strconv.FormatInt(now+int64(i), 10),
+			nil, map[string]interface{}{"date": m["date"], "memo": m["memo"],
+				"debits": m["debits"], "credits": m["credits"]}); err != nil {
+			return nil, err
 		}
-		for _, e := range m["debits"].([]interface{}) {
-			if err = addEntry(e, 1); err != nil {
-				return nil, err
-			}
+	}
+	if l, ok := maps[0]["_appengine_context"].(logger); ok {
+		deb.RegisterLogger(func(s string) { l.Infof(s) })
+	}
+	return nil, c.Db.Execute(func(tdb db.Db) error {
+		if err := checkPeriods(c, tdb, param["coa"], userKey, dates...); err != nil {
+			return err
 		}
-		for _, e := range m["credits"].([]interface{}) {
-			if err = addEntry(e, -1); err != nil {
-				return nil, err
+		ch := make(chan *deb.Transaction)
+		go func() {
+			for _, t := range transactions {
+				//log.Println(t)
+				//ctx.Infof("%v\n", t)
+				ch <- t
 			}
+			close(ch)
+		}()
+		if err := space.Append(deb.ChannelSpace(ch)); err != nil {
+			return err
 		}
-		memo, ok := m["memo"].(string)
+		_, err := core.AuditEntryRepository.SaveMulti(tdb, entries, param["coa"])
+		return err
+	})
+}
+
+// accountsIndexes maps the numbers of the accounts to their indexes in spaces, which follow the
+// order of creation of the accounts.
+func accountsIndexes(c context.Context, coaKey string) (map[string]int, error) {
+	_, accounts, err := accountsSortedByCreation(c, coaKey)
+	if err != nil {
+		return nil, err
+	}
+	accountsMap := map[string]int{}
+	for i, a := range accounts {
+		accountsMap[a.Number] = i + 1
+	}
+	return accountsMap, nil
+}
+
+// newDebTransaction converts the map of a transaction, whose entries reference accounts by
+// number and whose values have the scale, to a transaction of a space.
+func newDebTransaction(m map[string]interface{}, accountsMap map[string]int, userKey core.UserKey,
+	moment deb.Moment, scale int) (*deb.Transaction, error) {
+	date, err := time.Parse(time.RFC3339, m["date"].(string))
+	if err != nil {
+		return nil, err
+	}
+	entries := deb.Entries{}
+	addEntry := func(e interface{}, signal int) error {
+		em := e.(map[string]interface{})
+		account, ok := accountsMap[em["account"].(string)]
 		if !ok {
-			return nil, fmt.Errorf("Memo must be informed")
+			return fmt.Errorf("Account not found %v", em["account"])
+		}
+		value, err := MoneyOf(em["value"], scale)
+		if err != nil {
+			return err
 		}
-		metadata := transactionMetadata{memo, nil, userKey, -1}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		if err := enc.Encode(metadata); err != nil {
+		entries[deb.Account(account)] += int64(signal) * int64(value)
+		return nil
+	}
+	for _, e := range m["debits"].([]interface{}) {
+		if err = addEntry(e, 1); err != nil {
 			return nil, err
 		}
-		transactions[i] = &deb.Transaction{
-			Moment:   deb.Moment(now + int64(i)),
-			Date:     SerializedDate(date),
-			Entries:  entries,
-			Metadata: buf.Bytes()}
 	}
-	ch := make(chan *deb.Transaction)
-	ctx := maps[0]["_appengine_context"].(appengine.Context)
-	deb.RegisterLogger(func(s string) { ctx.Infof(s) })
-	go func() {
-		for _, t := range transactions {
-			//log.Println(t)
-			//ctx.Infof("%v\n", t)
-			ch <- t
+	for _, e := range m["credits"].([]interface{}) {
+		if err = addEntry(e, -1); err != nil {
+			return nil, err
 		}
-		close(ch)
-	}()
-	return nil, space.Append(deb.ChannelSpace(ch))
+	}
+	memo, ok := m["memo"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Memo must be informed")
+	}
+	metadata := transactionMetadata{memo, nil, userKey, -1}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(metadata); err != nil {
+		return nil, err
+	}
+	return &deb.Transaction{
+		Moment:   moment,
+		Date:     SerializedDate(date),
+		Entries:  entries,
+		Metadata: buf.Bytes()}, nil
 }
 
 func PopTransaction(c context.Context, m map[string]interface{}, param map[string]string,
@@ -770,14 +1193,45 @@ func PopTransaction(c context.Context, m map[string]interface{}, param map[strin
 	if !ok {
 		return nil, fmt.Errorf("Space does not implements popper") //ret[0].Interface().(error)
 	}
-	d, v, err := p.Pop()
+	var result map[string]interface{}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if date, ok, err := lastTransactionDate(space); err != nil {
+			return err
+		} else if ok {
+			if err = checkPeriods(c, tdb, param["coa"], userKey, date); err != nil {
+				return err
+			}
+		}
+		d, v, err := p.Pop()
+		if err != nil {
+			return err
+		}
+		result = map[string]interface{}{"date": d, "values": v}
+		return core.Audit(c, tdb, param["coa"], userKey, "", result, nil)
+	})
 	if err != nil {
 		return nil, err
 	}
-	result := map[string]interface{}{"date": d, "values": v}
 	return result, nil
 }
 
+// lastTransactionDate returns the date of the transaction appended last to the space, which is the
+// one Pop removes, and whether the space has any transaction.
+func lastTransactionDate(space deb.Space) (date time.Time, ok bool, err error) {
+	var last *deb.Transaction
+	ch, errc := space.Transactions()
+	for t := range ch {
+		if last == nil || t.Moment > last.Moment {
+			last = t
+		}
+	}
+	if err = <-errc; err != nil || last == nil {
+		return
+	}
+	return time.Date(int(last.Date%100000000/10000), time.Month(last.Date%10000/100),
+		int(last.Date%100), 0, 0, 0, 0, time.UTC), true, nil
+}
+
 func appendTransactionOnSpace(c context.Context, coaKey string, space deb.Space,
 	transaction *Transaction, removes int64, accounts []*Account, accountKeys db.Keys) error {
 	if accounts == nil {
@@ -792,7 +1246,7 @@ func appendTransactionOnSpace(c context.Context, coaKey string, space deb.Space,
 		found := false
 		for i, k := range accountKeys {
 			if k.Encode() == e.Account.Encode() {
-				values[i] += int64(xmath.Round(e.Value * 100))
+				values[i] += int64(e.Value)
 				found = true
 				break
 			}
@@ -805,7 +1259,7 @@ func appendTransactionOnSpace(c context.Context, coaKey string, space deb.Space,
 		found := false
 		for i, k := range accountKeys {
 			if k.Encode() == e.Account.Encode() {
-				values[i] += -int64(xmath.Round(e.Value * 100))
+				values[i] += -int64(e.Value)
 				found = true
 				break
 			}
@@ -826,66 +1280,109 @@ func appendTransactionOnSpace(c context.Context, coaKey string, space deb.Space,
 }
 
 func accountsSortedByCreation(c context.Context, coaKey string) (db.Keys, []*Account, error) {
-	var accounts []*Account
-	keys, _, err := c.Db.GetAllFromCache("Account", coaKey, &accounts, nil,
-		[]string{"Created"}, c.Cache, "accounts_"+coaKey)
-	if err != nil {
-		return nil, nil, err
-	}
-	return keys, accounts, nil
+	return AccountRepository.GetAllFromCache(c.Db, coaKey, nil, []string{"Created"}, c.Cache,
+		"accounts_"+coaKey)
 }
 
 func DeleteTransaction(c context.Context, m map[string]interface{}, param map[string]string,
-	userKey core.UserKey) (_ interface{}, err error) {
+	userKey core.UserKey) (interface{}, error) {
+	return nil, deleteTransaction(c, m, param, userKey, nil)
+}
+
+// deleteTransaction deletes the transaction of the "transaction" param and then calls then, if not
+// nil, with the database of the transaction in which the transaction is deleted, so that both
+// changes are saved or none.
+func deleteTransaction(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey, then func(d db.Db) error) (err error) {
 
 	space, ok := m["space"].(deb.Space)
 	if !ok {
-		key, err := c.Db.DecodeKey(param["transaction"])
+		t, err := TransactionRepository.Get(c.Db, param["transaction"])
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if err = c.Db.Delete(key); err != nil {
-			return nil, err
+		if !inChart(t.Key, param) {
+			return fmt.Errorf("Transaction not found")
+		}
+		key := t.Key
+		err = c.Db.Execute(func(tdb db.Db) error {
+			if err := checkPeriods(c, tdb, key.Parent().Encode(), userKey, t.Date); err != nil {
+				return err
+			}
+			if err := TransactionRepository.Delete(tdb, key); err != nil {
+				return err
+			}
+			if err := core.Audit(c, tdb, key.Parent().Encode(), userKey, key.Encode(), t,
+				nil); err != nil || then == nil {
+				return err
+			}
+			return then(tdb)
+		})
+		if err != nil {
+			return err
 		}
 		if err = c.Cache.Delete("transactions_asof_" + key.Parent().Encode()); err != nil {
-			return nil, err
+			return err
 		}
 		if err = c.Cache.Delete("balances_asof_" + key.Parent().Encode()); err != nil {
-			return nil, err
+			return err
 		}
 		if err = c.Cache.Delete("transactions_" + key.Parent().Encode()); err != nil {
-			return nil, err
+			return err
 		}
-
-		err = nil
 	} else {
-		t, err := GetTransaction(c, m, param, userKey)
-		if err != nil {
-			return nil, err
-		}
-		tx := t.(*Transaction)
-		deb := make([]Entry, len(tx.Credits))
-		cre := make([]Entry, len(tx.Debits))
-		for i, e := range tx.Debits {
-			cre[i] = Entry{Account: e.Account, Value: e.Value}
-		}
-		for i, e := range tx.Credits {
-			deb[i] = Entry{Account: e.Account, Value: e.Value}
-		}
-		tx.Debits = deb
-		tx.Credits = cre
-		var removes int64
-		if removes, err = strconv.ParseInt(param["transaction"], 10, 64); err != nil {
-			return nil, err
-		}
-
-		appendTransactionOnSpace(c, param["coa"], space, tx, removes, nil, nil)
+		return c.Db.Execute(func(tdb db.Db) error {
+			return deleteTransactionOnSpace(c, tdb, space, m, param, userKey, then)
+		})
 	}
 
-	return
+	return nil
 
 }
 
+// deleteTransactionOnSpace deletes the transaction of the "transaction" param from the space, by
+// appending its reversal, within the transaction of d, and then calls then, if not nil, with d.
+func deleteTransactionOnSpace(c context.Context, d db.Db, space deb.Space,
+	m map[string]interface{}, param map[string]string, userKey core.UserKey,
+	then func(d db.Db) error) error {
+	t, err := GetTransaction(c, m, param, userKey)
+	if err != nil {
+		return err
+	}
+	tx := t.(*Transaction)
+	if err = checkPeriods(c, d, param["coa"], userKey, tx.Date); err != nil {
+		return err
+	}
+	before := *tx
+	deb := make([]Entry, len(tx.Credits))
+	cre := make([]Entry, len(tx.Debits))
+	for i, e := range tx.Debits {
+		cre[i] = Entry{Account: e.Account, Value: e.Value}
+	}
+	for i, e := range tx.Credits {
+		deb[i] = Entry{Account: e.Account, Value: e.Value}
+	}
+	tx.Debits = deb
+	tx.Credits = cre
+	var removes int64
+	if removes, err = strconv.ParseInt(param["transaction"], 10, 64); err != nil {
+		return err
+	}
+
+	if err = appendTransactionOnSpace(c, param["coa"], space, tx, removes, nil,
+		nil); err != nil {
+		return err
+	}
+	if err = core.Audit(c, d, param["coa"], userKey, param["transaction"], &before,
+		nil); err != nil {
+		return err
+	}
+	if then != nil {
+		return then(d)
+	}
+	return nil
+}
+
 type byCreation struct {
 	a []*Account
 	k db.Keys
@@ -919,9 +1416,9 @@ func NewTransactionFromSpace(t *deb.Transaction, keys db.Keys) (*Transaction,
 	cre := []Entry{}
 	for k, v := range t.Entries {
 		if v > 0 {
-			deb = append(deb, Entry{Account: keys[k-1], Value: float64(v) / 100})
+			deb = append(deb, Entry{Account: keys[k-1], Value: Money(v)})
 		} else {
-			cre = append(cre, Entry{Account: keys[k-1], Value: -float64(v) / 100})
+			cre = append(cre, Entry{Account: keys[k-1], Value: -Money(v)})
 		}
 	}
 	transaction := &Transaction{Date: d, AsOf: m, Debits: deb, Credits: cre,
@@ -980,54 +1477,44 @@ func SerializedDate(d time.Time) deb.Date {
 	return deb.Date(d.Year()*10000 + int(d.Month())*100 + d.Day())
 }
 
-func Accounts(c context.Context, coaKey string, filters map[string]interface{}) (keys db.Keys,
+func Accounts(c context.Context, coaKey string, query db.Query) (keys db.Keys,
 	accounts []*Account, err error) {
-	if filters == nil {
-		filters = map[string]interface{}{}
-	}
-	filters["Removed ="] = false
-	keys, _, err = c.Db.GetAllFromCache("Account", coaKey, &accounts, filters, []string{"Number"},
-		c.Cache, "accounts_"+coaKey)
-	if err != nil {
-		return
-	}
-	return
+	return AccountRepository.GetAllFromCache(c.Db, coaKey,
+		db.And(db.Field("Removed").Eq(false), query), []string{"Number"}, c.Cache, "accounts_"+coaKey)
 }
 
-func Transactions(c context.Context, coaKey string, filters map[string]interface{}) (keys db.Keys,
-	transactions []*Transaction, err error) {
-	keys, _, err = c.Db.GetAll("Transaction", coaKey, &transactions, filters,
-		[]string{"Date", "AsOf"})
-	if err != nil {
-		return
-	}
-	return
+// Transactions returns a page of the transactions satisfying the query, in the order of their
+// dates, and the cursor of the next page.
+func Transactions(c context.Context, coaKey string, query db.Query, limit int,
+	cursor string) (keys db.Keys, transactions []*Transaction, next string, err error) {
+	return TransactionRepository.GetPage(c.Db, coaKey, query, []string{"Date", "AsOf"}, limit,
+		cursor)
 }
 
 type TransactionWithValue struct {
 	Transaction
-	Value float64
+	Value Money
 	Key   interface{}
 }
 
 func TransactionsWithValue(c context.Context, coaKey string, account *Account, from,
-	to time.Time) (transactionsWithValue []*TransactionWithValue, balance float64, err error) {
+	to time.Time) (transactionsWithValue []*TransactionWithValue, balance Money, err error) {
 
 	b, err := Balances(c, coaKey, time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC),
-		from.AddDate(0, 0, -1), map[string]interface{}{"Number =": account.Number})
+		from.AddDate(0, 0, -1), db.Field("Number").Eq(account.Number))
 	if err != nil {
 		return
 	}
-	balance = 0.0
+	balance = 0
 	if len(b) > 0 {
-		balance = b[0]["value"].(float64)
+		balance = b[0]["value"].(Money)
 	}
 
-	var dbkeys db.Keys
-	var transactions []*Transaction
-	if dbkeys, _, err = c.Db.GetAll("Transaction", coaKey, &transactions,
-		db.M{"AccountsKeysAsString =": account.Key.Encode(), "Date >=": from, "Date <=": to},
-		[]string{"Date", "AsOf"}); err != nil {
+	dbkeys, transactions, err := TransactionRepository.GetAll(c.Db, coaKey,
+		db.And(db.Field("AccountsKeysAsString").Eq(account.Key.Encode()),
+			db.Field("Date").Ge(from), db.Field("Date").Le(to)),
+		[]string{"Date", "AsOf"})
+	if err != nil {
 		return
 	}
 	keys := make([]interface{}, len(dbkeys))
@@ -1047,7 +1534,7 @@ func TransactionsWithValueFromTransactions(transactions []*Transaction, keys []i
 		}
 		return nil
 	}
-	addValue := func(key db.Key, value float64) {
+	addValue := func(key db.Key, value Money) {
 		t.Value += value
 	}
 	transactionsWithValue := []*TransactionWithValue{}
@@ -1068,7 +1555,18 @@ func (a ByDateAndAsOf) Less(i, j int) bool {
 		(a[i].Date.Equal(a[j].Date) && a[i].AsOf.Before(a[j].AsOf))
 }
 
-func Balances(c context.Context, coaKey string, from, to time.Time, accountFilters db.M) (result []db.M, err error) {
+// Balances computes the balances against a consistent snapshot of the database, if it supports
+// them.
+func Balances(c context.Context, coaKey string, from, to time.Time, accountQuery db.Query) (result []db.M, err error) {
+	err = db.View(c.Db, func(d db.Db) (err error) {
+		c.Db = d
+		result, err = balances(c, coaKey, from, to, accountQuery)
+		return
+	})
+	return
+}
+
+func balances(c context.Context, coaKey string, from, to time.Time, accountQuery db.Query) (result []db.M, err error) {
 
 	var transactionsAsOf, balancesAsOf time.Time
 
@@ -1077,8 +1575,8 @@ func Balances(c context.Context, coaKey string, from, to time.Time, accountFilte
 		return
 	}
 	if transactionsAsOf.IsZero() {
-		var transactions []*Transaction
-		_, _, err = c.Db.GetAllWithLimit("Transaction", coaKey, &transactions, nil, []string{"-AsOf"}, 1)
+		_, transactions, err := TransactionRepository.GetAllWithLimit(c.Db, coaKey, nil,
+			[]string{"-AsOf"}, 1)
 		if err != nil {
 			return nil, err
 		}
@@ -1112,34 +1610,25 @@ func Balances(c context.Context, coaKey string, from, to time.Time, accountFilte
 
 		resultMap := map[string]map[string]interface{}{}
 
-		filter := db.M{}
+		var query db.Query
 
 		if transactionsAsOf != balancesAsOf &&
 			!transactionsAsOf.IsZero() && !balancesAsOf.IsZero() {
-			filter["AsOf >"] = balancesAsOf
-			filter["AsOf <="] = transactionsAsOf
+			query = db.And(db.Field("AsOf").Gt(balancesAsOf), db.Field("AsOf").Le(transactionsAsOf))
 			for _, item := range result {
 				resultMap[item["account"].(*Account).Key.String()] = item
 			}
 		} else {
-			filter["Date >="] = from
-			filter["Date <="] = to
+			query = db.And(db.Field("Date").Ge(from), db.Field("Date").Le(to))
 			result = []db.M{}
 			for i, a := range accounts {
 				a.SetKey(accountKeys.KeyAt(i))
-				item := db.M{"account": a, "value": 0.0}
+				item := db.M{"account": a, "value": Money(0)}
 				result = append(result, item)
 				resultMap[accountKeys.KeyAt(i).String()] = item
 			}
 		}
 
-		var transactions []*Transaction
-		if _, _, err = c.Db.GetAll("Transaction", coaKey, &transactions, filter, nil); err != nil {
-			return nil, err
-		}
-
-		sort.Sort(ByDateAndAsOf(transactions))
-
 		lookupAccount := func(key db.Key) *Account {
 			if key.IsZero() {
 				return nil
@@ -1151,15 +1640,18 @@ func Balances(c context.Context, coaKey string, from, to time.Time, accountFilte
 				return item["account"].(*Account)
 			}
 		}
-		addValue := func(key db.Key, value float64) {
+		addValue := func(key db.Key, value Money) {
 			item := resultMap[key.String()]
-			item["value"] = item["value"].(float64) + value
-			item["value"] = xmath.Round(item["value"].(float64)*100) / 100
+			item["value"] = item["value"].(Money) + value
 		}
-		for _, t := range transactions {
+		err = TransactionRepository.Iterate(c.Db, coaKey, query, nil, func(_ db.Key, t *Transaction) error {
 			if !t.Date.Before(from) && !t.Date.After(to) {
 				t.incrementValue(lookupAccount, addValue)
 			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
 
 		if err = c.Cache.Set("balances_"+coaKey+"_"+timespanAsString, result); err != nil {
@@ -1176,10 +1668,10 @@ func Balances(c context.Context, coaKey string, from, to time.Time, accountFilte
 		return nil, err
 	}
 
-	if accountFilters != nil {
+	if accountQuery != nil {
 		filteredResult := []db.M{}
 		for _, item := range result {
-			if ok, err := db.Matches(item["account"].(*Account), accountFilters); err != nil {
+			if ok, err := db.Matches(item["account"].(*Account), accountQuery); err != nil {
 				return nil, err
 			} else if ok {
 				filteredResult = append(filteredResult, item)
@@ -1197,10 +1689,11 @@ func accountKeyWithNumber(d db.Db, c context.Context, number, coa string) (db.Ke
 		err  error
 	)
 	if d != nil {
-		keys, _, err = d.GetAll("Account", coa, nil,
-			db.M{"Number = ": number, "Removed = ": false}, nil)
+		keys, err = AccountRepository.Keys(d, coa,
+			db.And(db.Field("Number").Eq(number), db.Field("Removed").Eq(false)), 0)
 	} else {
-		keys, _, err = Accounts(c, coa, db.M{"Number = ": number, "Removed = ": false})
+		keys, _, err = Accounts(c, coa, db.Field("Number").Eq(number))
+		d = c.Db
 	}
 	if err != nil {
 		return d.NewKey(), err
@@ -1211,116 +1704,169 @@ func accountKeyWithNumber(d db.Db, c context.Context, number, coa string) (db.Ke
 	}
 }
 
+// copyAccounts saves copies of the accounts that were not removed in the chart of accounts, a
+// level of the tree of accounts at a time, so that the keys of the parents are known when their
+// children are saved.
+func copyAccounts(c context.Context, accounts []*Account, coaKey string, userKey core.UserKey) error {
+	keys := map[string]db.CKey{}
+	pending := []*Account{}
+	for _, a := range accounts {
+		if !a.Removed {
+			pending = append(pending, a)
+		}
+	}
+	for len(pending) > 0 {
+		var level, copies, next []*Account
+		for _, a := range pending {
+			var parent db.CKey
+			if !a.Parent.IsZero() {
+				var ok bool
+				if parent, ok = keys[a.Parent.Encode()]; !ok {
+					next = append(next, a)
+					continue
+				}
+			}
+			tags := make([]string, len(a.Tags))
+			copy(tags, a.Tags)
+			level = append(level, a)
+			copies = append(copies, &Account{
+				Number:  a.Number,
+				Name:    a.Name,
+				Tags:    tags,
+				Parent:  parent,
+				User:    userKey,
+				AsOf:    time.Now(),
+				Created: time.Now()})
+		}
+		if len(level) == 0 {
+			return fmt.Errorf("Parent not found: %v", next[0].Number)
+		}
+		newKeys, err := AccountRepository.SaveMulti(c.Db, copies, coaKey)
+		if err != nil {
+			return err
+		}
+		for i, a := range level {
+			keys[a.Key.Encode()] = newKeys[i]
+		}
+		pending = next
+	}
+	return c.Cache.Delete("accounts_" + coaKey)
+}
+
 func Migrate(c context.Context, coa *ChartOfAccounts, coaKey, coa2Key string, space deb.Space,
 	key db.Key, userKey core.UserKey) (interface{}, error) {
 
 	var (
 		coa2     *ChartOfAccounts
-		accounts *[]*Account
+		accounts []*Account
 	)
 
 	am := map[string]*Account{}
-	am2 := map[string]db.Key{}
 	param := map[string]string{}
 
-	if ak, aa, err := c.Db.GetAll("Account", coaKey, &[]*Account{}, nil,
-		[]string{"Number"}); err != nil {
+	if ak, aa, err := AccountRepository.GetAll(c.Db, coaKey, nil, []string{"Number"}); err != nil {
 		return nil, err
 	} else {
-		accounts = aa.(*[]*Account)
-		for i, a := range *accounts {
+		accounts = aa
+		for i, a := range accounts {
+			if len(a.Currency) > 0 && !a.Removed {
+				return nil, errors.New(
+					"Accounts in other currencies are not supported by charts of accounts kept in spaces")
+			}
 			am[ak[i].Encode()] = a
 		}
 	}
 
 	if coa2Key == "" {
 		coa2 = &ChartOfAccounts{
-			Name:  coa.Name + "/2",
-			Space: key.(db.CKey),
-			User:  userKey,
-			AsOf:  time.Now()}
-
-		_, err := c.Db.Save(coa2, "ChartOfAccounts", "", nil)
+			Name:         coa.Name + "/2",
+			Space:        key.(db.CKey),
+			User:         userKey,
+			Organization: coa.Organization,
+			AsOf:         time.Now(),
+			Currency:     coa.Currency}
+
+		_, err := ChartOfAccountsRepository.Save(c.Db, coa2, "", nil)
 		if err != nil {
 			return nil, err
 		}
+		if err = core.Audit(c, c.Db, coa2.Key.Encode(), userKey, coa2.Key.Encode(), nil,
+			coa2); err != nil {
+			return nil, err
+		}
 		err = c.Cache.Delete("ChartOfAccounts")
 		param["coa"] = coa2.Key.Encode()
 		coa2Key = coa2.Key.Encode()
-		for _, a := range *accounts {
-			if a.Removed {
-				continue
-			}
-			m := map[string]interface{}{}
-			m["name"] = a.Name
-			m["number"] = a.Number
-			if !a.Parent.IsZero() {
-				m["parent"] = am[a.Parent.Encode()].Number
-			}
-			if a.Tags != nil {
-				for _, t := range a.Tags {
-					m[t] = true
-				}
-			}
-			if account, err := SaveAccount(c, m, param, userKey); err != nil {
-				return nil, err
-			} else {
-				am2[a.Number] = account.(*Account).GetKey()
-			}
+		if err := copyMemberships(c, coaKey, coa2Key); err != nil {
+			return nil, err
 		}
-	} else {
-		param["coa"] = coa2Key
-		coa2 = &ChartOfAccounts{}
-		if _, err := c.Db.Get(coa2, coa2Key); err != nil {
+		if err := copyFiscalPeriods(c, coaKey, coa2Key); err != nil {
 			return nil, err
 		}
-		ak2, aa2, err := c.Db.GetAll("Account", coa2Key, &[]*Account{}, nil, []string{"Number"})
-		if err != nil {
+		if err := copyAccounts(c, accounts, coa2Key, userKey); err != nil {
 			return nil, err
 		}
-		accounts2 := aa2.(*[]*Account)
-		for i, a := range *accounts2 {
-			am2[a.Number] = ak2[i]
+	} else {
+		param["coa"] = coa2Key
+		var err error
+		if coa2, err = ChartOfAccountsRepository.Get(c.Db, coa2Key); err != nil {
+			return nil, err
 		}
 	}
-	_, tt, err := c.Db.GetAll("Transaction", coaKey, &[]*Transaction{}, nil, []string{"AsOf"})
-	if err != nil {
-		return nil, err
-	}
-	transactions := tt.(*[]*Transaction)
-	accountsSortedKeys, accountsSorted, err := accountsSortedByCreation(c, coa2Key)
+	accountsMap, err := accountsIndexes(c, coa2Key)
 	if err != nil {
 		return nil, err
 	}
-	maps := []map[string]interface{}{}
-	for _, t := range *transactions {
-		m := map[string]interface{}{}
-		debits := make([]interface{}, len(t.Debits))
-		credits := make([]interface{}, len(t.Credits))
-		for i, e := range t.Debits {
-			m := map[string]interface{}{}
-			m["account"] = am[e.Account.Encode()].Number
-			m["value"] = e.Value
-			debits[i] = m
-		}
-		for i, e := range t.Credits {
-			m := map[string]interface{}{}
-			m["account"] = am[e.Account.Encode()].Number
-			m["value"] = e.Value
-			credits[i] = m
-		}
-		m["memo"] = t.Memo
-		m["date"] = t.Date.Format(time.RFC3339)
-		m["debits"] = debits
-		m["credits"] = credits
-		m["space"] = space
-		m["accounts_map"] = am2
-		m["accounts_sorted_by_creation"] = accountsSorted
-		m["accounts_keys_sorted_by_creation"] = accountsSortedKeys
-		maps = append(maps, m)
-	}
-	if _, err := SaveTransactions(c, maps, param, userKey); err != nil {
+	// The transactions are streamed to the space as they are read, so that they are never all in
+	// memory.
+	ch := make(chan *deb.Transaction)
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	now := time.Now().UnixNano()
+	go func() {
+		defer close(ch)
+		i := 0
+		errc <- TransactionRepository.Iterate(c.Db, coaKey, nil, []string{"AsOf"},
+			func(_ db.Key, t *Transaction) error {
+				m := map[string]interface{}{}
+				debits := make([]interface{}, len(t.Debits))
+				credits := make([]interface{}, len(t.Credits))
+				for i, e := range t.Debits {
+					m := map[string]interface{}{}
+					m["account"] = am[e.Account.Encode()].Number
+					m["value"] = e.Value
+					debits[i] = m
+				}
+				for i, e := range t.Credits {
+					m := map[string]interface{}{}
+					m["account"] = am[e.Account.Encode()].Number
+					m["value"] = e.Value
+					credits[i] = m
+				}
+				m["memo"] = t.Memo
+				m["date"] = t.Date.Format(time.RFC3339)
+				m["debits"] = debits
+				m["credits"] = credits
+				dt, err := newDebTransaction(m, accountsMap, userKey, deb.Moment(now+int64(i)),
+					Scale(coa.Currency))
+				if err != nil {
+					return err
+				}
+				i++
+				select {
+				case ch <- dt:
+					return nil
+				case <-done:
+					return errors.New("Migration aborted")
+				}
+			})
+	}()
+	err = space.Append(deb.ChannelSpace(ch))
+	close(done)
+	if iterErr := <-errc; iterErr != nil {
+		return nil, iterErr
+	} else if err != nil {
 		return nil, err
 	}
-	return fmt.Sprintf("Migrated to %v. %v accounts", coa2.Name, len(*accounts)), nil
+	return fmt.Sprintf("Migrated to %v. %v accounts", coa2.Name, len(accounts)), nil
 }
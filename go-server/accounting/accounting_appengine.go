@@ -3,23 +3,36 @@
 package accounting
 
 import (
+	"math"
+
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+
 	"appengine"
 	"appengine/datastore"
 )
 
+// UpdateSchema saves every transaction again, in batches, so that they are stored with the
+// current schema.
 func UpdateSchema(c appengine.Context) (err error) {
-	q := datastore.NewQuery("Transaction")
+	d := db.NewAppengineDb(c)
 	transactions := []*Transaction{}
-	keys, err := q.GetAll(c, &transactions)
-	if err != nil {
-		return err
-	}
-	for i, tx := range transactions {
-		if _, err := datastore.Put(c, keys[i], tx); err != nil {
+	save := func() error {
+		if _, err := TransactionRepository.SaveMulti(d, transactions, ""); err != nil {
 			return err
 		}
+		transactions = transactions[:0]
+		return nil
 	}
-	return nil
+	err = TransactionRepository.Iterate(d, "", nil, nil, func(_ db.Key, t *Transaction) error {
+		if transactions = append(transactions, t); len(transactions) == 500 {
+			return save()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return save()
 }
 
 func (coa *ChartOfAccounts) Load(c <-chan datastore.Property) (err error) {
@@ -65,6 +78,11 @@ func (transaction *Transaction) Load(c <-chan datastore.Property) (err error) {
 			if p.Name == "User" || p.Name == "Debits.Account" || p.Name == "Credits.Account" {
 				p.Name += ".DsKey"
 			}
+			// The values were stored as float64 before they were money.
+			if v, ok := p.Value.(float64); ok &&
+				(p.Name == "Debits.Value" || p.Name == "Credits.Value") {
+				p.Value = int64(math.Round(v * math.Pow10(DefaultScale)))
+			}
 			f <- p
 		}
 		close(f)
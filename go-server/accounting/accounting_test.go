@@ -1,9 +1,13 @@
 package accounting
 
 import (
-	_ "fmt"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/mcesarhm/geek-accounting/go-server/context"
 	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"github.com/mcesarhm/geek-accounting/go-server/extensions/collections"
 	"testing"
 	"time"
 )
@@ -27,10 +31,10 @@ func TestSaveChartOfAccounts(t *testing.T) {
 	}
 	time.Sleep(100 * time.Millisecond)
 	var obj interface{}
-	if obj, err = AllChartsOfAccounts(c, nil, core.NewUserKey()); err != nil {
+	if obj, err = AllChartsOfAccounts(c, nil, nil, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
-	coas := *obj.(*[]ChartOfAccounts)
+	coas := obj.([]*ChartOfAccounts)
 	if len(coas) == 0 {
 		t.Error("The chart of accounts must be persisted")
 	}
@@ -61,15 +65,67 @@ func TestSaveAccount(t *testing.T) {
 		t.Errorf("The name (%v) must be 'account'", a.Name)
 	}
 	var obj interface{}
-	if obj, err = AllAccounts(c, map[string]string{"coa": coa.Key.Encode()}, core.NewUserKey()); err != nil {
+	if obj, err = AllAccounts(c, nil, map[string]string{"coa": coa.Key.Encode()}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
-	accounts := *obj.(*[]Account)
+	accounts := obj.([]*Account)
 	if len(accounts) == 0 {
 		t.Error("The account must be persisted")
 	}
 }
 
+func TestAllAccountsPages(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	var coa *ChartOfAccounts
+	if coa, err = SaveChartOfAccountsSample(c); err != nil {
+		t.Fatal(err)
+	}
+	var removed *Account
+	for _, n := range []string{"3", "1", "4", "2"} {
+		if a, err := SaveAccountSample(c, coa, n, "a"+n, []string{"balanceSheet", "debitBalance"}); err != nil {
+			t.Fatal(err)
+		} else if n == "3" {
+			removed = a
+		}
+	}
+	param := map[string]string{"coa": coa.Key.Encode(), "account": removed.Key.Encode()}
+	if _, err = DeleteAccount(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	delete(param, "account")
+	param["limit"] = "2"
+	numbers := ""
+	for pages := 1; ; pages++ {
+		obj, err := AllAccounts(c, nil, param, core.NewUserKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := obj.(db.Page)
+		for _, a := range page.Items.([]*Account) {
+			numbers += a.Number
+		}
+		if len(page.Next) == 0 {
+			if pages != 2 {
+				t.Errorf("Accounts must have 2 pages, but had %v", pages)
+			}
+			break
+		}
+		param["cursor"] = page.Next
+	}
+	if numbers != "124" {
+		t.Errorf("Accounts pages must have 124, but had %v", numbers)
+	}
+	param["limit"] = "-1"
+	if _, err := AllAccounts(c, nil, param, core.NewUserKey()); err == nil {
+		t.Error("A negative limit must be rejected")
+	}
+}
+
 func TestSaveTransaction(t *testing.T) {
 	c := context.Context{}
 	ac, err := context.NewContext(&c)
@@ -106,11 +162,174 @@ func TestSaveTransaction(t *testing.T) {
 	}
 
 	var obj interface{}
-	if obj, err = AllTransactions(c, map[string]string{"coa": coa.Key.Encode()}, core.NewUserKey()); err != nil {
+	if obj, err = AllTransactions(c, nil, map[string]string{"coa": coa.Key.Encode()}, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = obj.(TransactionStream).WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var transactions []Transaction
+	if err = json.Unmarshal(buf.Bytes(), &transactions); err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 1 || transactions[0].Memo != tx.Memo {
+		t.Error("The transaction must be persisted, but was", buf.String())
+	}
+}
+
+// failingDb makes the transactions fail right after the nth save of the kind, so that the tests
+// can check that the writes made until then are discarded.
+type failingDb struct {
+	db.Db
+	kind string
+	n    int
+}
+
+type failingTx struct {
+	db.Db
+	kind  string
+	n     int
+	saves *int
+}
+
+func (d failingDb) Execute(f func(db.Db) error) error {
+	saves := 0
+	return d.Db.Execute(func(tdb db.Db) error {
+		return f(failingTx{tdb, d.kind, d.n, &saves})
+	})
+}
+
+func (d failingTx) Save(item interface{}, kind string, ancestor string,
+	param map[string]string) (db.Key, error) {
+	key, err := d.Db.Save(item, kind, ancestor, param)
+	if err == nil && kind == d.kind {
+		if *d.saves++; *d.saves == d.n {
+			return nil, fmt.Errorf("Save number %v of %v failed", d.n, kind)
+		}
+	}
+	return key, err
+}
+
+func TestSaveAccountIsAtomic(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	coa, err := SaveChartOfAccountsSample(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveAccountSample(c, coa, "1", "Assets", []string{"balanceSheet", "debitBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	param := map[string]string{"coa": coa.Key.Encode()}
+	m := map[string]interface{}{"number": "1.1", "name": "Cash", "parent": "1"}
+	fc := c
+	fc.Db = failingDb{c.Db, "Account", 2}
+	if _, err = SaveAccount(fc, m, param, core.NewUserKey()); err == nil {
+		t.Fatal("The update of the parent must fail")
+	}
+	var obj interface{}
+	if obj, err = AllAccounts(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	accounts := obj.([]*Account)
+	if len(accounts) != 1 {
+		t.Fatalf("The child account must not be persisted: %v", accounts)
+	}
+	if !collections.Contains(accounts[0].Tags, "analytic") ||
+		collections.Contains(accounts[0].Tags, "synthetic") {
+		t.Errorf("The parent tags (%v) must not change", accounts[0].Tags)
+	}
+	m = map[string]interface{}{"number": "1.1", "name": "Cash", "parent": "1"}
+	if _, err = SaveAccount(c, m, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err = AllAccounts(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	accounts = obj.([]*Account)
+	if len(accounts) != 2 || !collections.Contains(accounts[0].Tags, "synthetic") {
+		t.Errorf("The parent must become synthetic: %v", accounts)
+	}
+}
+
+func TestSaveRetainedEarningsAccountIsAtomic(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	coa, err := SaveChartOfAccountsSample(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	param := map[string]string{"coa": coa.Key.Encode()}
+	m := map[string]interface{}{"number": "3", "name": "Retained earnings",
+		"balanceSheet": true, "creditBalance": true, "retainedEarnings": true}
+	fc := c
+	fc.Db = failingDb{c.Db, "ChartOfAccounts", 1}
+	if _, err = SaveAccount(fc, m, param, core.NewUserKey()); err == nil {
+		t.Fatal("The update of the chart of accounts must fail")
+	}
+	var obj interface{}
+	if obj, err = AllAccounts(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	if accounts := obj.([]*Account); len(accounts) != 0 {
+		t.Errorf("The account must not be persisted: %v", accounts)
+	}
+	var coa2 ChartOfAccounts
+	if _, err = c.Db.Get(&coa2, coa.Key.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !coa2.RetainedEarningsAccount.IsZero() {
+		t.Errorf("The retained earnings account (%v) must not be set", coa2.RetainedEarningsAccount)
+	}
+	if obj, err = SaveAccount(c, m, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Db.Get(&coa2, coa.Key.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if coa2.RetainedEarningsAccount.String() != obj.(*Account).Key.String() {
+		t.Errorf("The retained earnings account (%v) must be %v", coa2.RetainedEarningsAccount,
+			obj.(*Account).Key)
+	}
+}
+
+func TestDeleteAccountIsAtomic(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	coa, err := SaveChartOfAccountsSample(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := SaveAccountSample(c, coa, "1", "Assets", []string{"balanceSheet", "debitBalance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	param := map[string]string{"coa": coa.Key.Encode(), "account": a.Key.Encode()}
+	fc := c
+	fc.Db = failingDb{c.Db, "Account", 1}
+	if _, err = DeleteAccount(fc, nil, param, core.NewUserKey()); err == nil {
+		t.Fatal("The removal must fail")
+	}
+	if _, err = GetAccount(c, nil, param, core.NewUserKey()); err != nil {
+		t.Errorf("The account must not be removed: %v", err)
+	}
+	if _, err = DeleteAccount(c, nil, param, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
-	transactions := *obj.(*[]Transaction)
-	if len(transactions) == 0 {
-		t.Error("The transaction must be persisted")
+	if _, err = GetAccount(c, nil, param, core.NewUserKey()); err == nil {
+		t.Error("The account must be removed")
 	}
 }
@@ -13,7 +13,6 @@ func SaveChartOfAccountsSample(c context.Context) (*ChartOfAccounts, error) {
 	} else {
 		return obj.(*ChartOfAccounts), nil
 	}
-	return nil, nil
 }
 
 func SaveAccountSample(c context.Context, coa *ChartOfAccounts, number, name string, tags []string) (*Account, error) {
@@ -26,7 +25,6 @@ func SaveAccountSample(c context.Context, coa *ChartOfAccounts, number, name str
 	} else {
 		return obj.(*Account), nil
 	}
-	return nil, nil
 }
 
 func SaveTransactionSample(c context.Context, coa *ChartOfAccounts, a1, a2, tx string) (*Transaction, error) {
@@ -38,10 +36,9 @@ func SaveTransactionSample(c context.Context, coa *ChartOfAccounts, a1, a2, tx s
 	if len(tx) > 0 {
 		param["transaction"] = tx
 	}
-	if obj, err := SaveTransaction(c, txMap, param, core.NewUserKey()); err != nil {
+	if obj, err := SaveTransaction(c, []map[string]interface{}{txMap}, param, core.NewUserKey()); err != nil {
 		return nil, err
 	} else {
 		return obj.(*Transaction), nil
 	}
-	return nil, nil
 }
@@ -0,0 +1,22 @@
+package accounting
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+)
+
+// AuditLog returns the changes to the chart of accounts, the newest first, filtered by the "user",
+// "entity", "from" and "to" params.
+func AuditLog(c context.Context, _ map[string]interface{}, param map[string]string,
+	_ core.UserKey) (interface{}, error) {
+	limit, cursor, err := db.PageParams(param)
+	if err != nil {
+		return nil, err
+	}
+	entries, next, err := core.AuditLog(c, param["coa"], param, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return db.Paged(param, entries, next), nil
+}
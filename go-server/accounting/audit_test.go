@@ -0,0 +1,151 @@
+package accounting
+
+import (
+	"encoding/json"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	c.Endpoint = "POST /charts-of-accounts"
+	coa, err := SaveChartOfAccountsSample(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coaKey := coa.Key.Encode()
+	if _, err = SaveAccountSample(c, coa, "1", "A", []string{"balanceSheet",
+		"debitBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveAccountSample(c, coa, "2", "B", []string{"balanceSheet",
+		"creditBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := SaveTransactionSample(c, coa, "1", "2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txKey := tx.Key.Encode()
+	if tx, err = SaveTransactionSample(c, coa, "2", "1", txKey); err != nil {
+		t.Fatal(err)
+	}
+	c.Endpoint = "DELETE /charts-of-accounts/" + coaKey + "/transactions/" + txKey
+	if _, err = DeleteTransaction(c, map[string]interface{}{}, map[string]string{"coa": coaKey,
+		"transaction": txKey}, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	param := map[string]string{"coa": coaKey}
+	obj, err := AuditLog(c, nil, param, core.NewUserKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The chart, its owner, two accounts and the three changes of the transaction.
+	if entries := obj.([]*core.AuditEntry); len(entries) != 7 {
+		t.Error("7 audit entries expected got", len(entries))
+	}
+
+	param["entity"] = txKey
+	if obj, err = AuditLog(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	entries := obj.([]*core.AuditEntry)
+	if len(entries) != 3 {
+		t.Fatal("3 audit entries of the transaction expected got", len(entries))
+	}
+	for i, action := range []core.Action{core.Delete, core.Update, core.Create} {
+		if entries[i].Action != action {
+			t.Errorf("%v expected got %v", action, entries[i].Action)
+		}
+	}
+	if entries[0].Endpoint != c.Endpoint || len(entries[0].After) > 0 {
+		t.Error("The deletion must be recorded with its endpoint", entries[0])
+	}
+	var before Transaction
+	if err = json.Unmarshal([]byte(entries[1].Before), &before); err != nil {
+		t.Fatal(err)
+	}
+	if before.Debits[0].Account.Encode() == tx.Debits[0].Account.Encode() {
+		t.Error("The transaction before the update expected got", entries[1].Before)
+	}
+	if b, err := json.Marshal(entries[2]); err != nil {
+		t.Fatal(err)
+	} else {
+		var m map[string]interface{}
+		if err = json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m["after"].(map[string]interface{}); !ok || m["before"] != nil {
+			t.Error("The snapshots must be returned as JSON got", string(b))
+		}
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	delete(param, "entity")
+	param["from"] = tomorrow
+	if obj, err = AuditLog(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	} else if entries := obj.([]*core.AuditEntry); len(entries) != 0 {
+		t.Error("No audit entries expected from tomorrow got", len(entries))
+	}
+	delete(param, "from")
+	param["to"] = tomorrow
+	param["limit"] = "2"
+	if obj, err = AuditLog(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	} else if page := obj.(db.Page); len(page.Items.([]*core.AuditEntry)) != 2 ||
+		len(page.Next) == 0 {
+		t.Error("A page of 2 audit entries expected got", page)
+	}
+}
+
+func TestAuditOfMemberships(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	users := saveUsers(t, c, "owner", "u")
+	owner, u := users[0], users[1]
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa"},
+		map[string]string{}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	param := map[string]string{"coa": obj.(*ChartOfAccounts).Key.Encode(), "user": u.Encode()}
+	if obj, err = GrantMembership(c, map[string]interface{}{"role": "editor"}, param,
+		owner); err != nil {
+		t.Fatal(err)
+	}
+	membershipKey := obj.(*Membership).Key.Encode()
+	if _, err = GrantMembership(c, map[string]interface{}{"role": "viewer"}, param,
+		owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RevokeMembership(c, nil, param, owner); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err = AuditLog(c, nil, map[string]string{"coa": param["coa"],
+		"entity": membershipKey}, owner); err != nil {
+		t.Fatal(err)
+	}
+	entries := obj.([]*core.AuditEntry)
+	if len(entries) != 3 {
+		t.Fatal("The grant, change and revocation of the role expected got", len(entries))
+	}
+	for i, action := range []core.Action{core.Delete, core.Update, core.Create} {
+		if entries[i].Action != action || entries[i].User.Encode() != owner.Encode() {
+			t.Errorf("%v by the owner expected got %v", action, entries[i])
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package accounting
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"github.com/mcesarhm/geek-accounting/go-server/extensions/collections"
+	"mcesar.io/deb"
+)
+
+// CloseFiscalPeriod closes the income statement accounts of the fiscal period of the "period"
+// param into the retained earnings account of the chart of accounts: it posts, at the end of the
+// period, a transaction tagged "closing" that zeroes their balances in the period, closes the
+// period and returns the transaction. The transaction and the period are saved together, except in
+// spaces, which keep the transaction if the period is not saved: closing the period again then
+// takes the transaction instead of posting another one.
+func CloseFiscalPeriod(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey) (interface{}, error) {
+	period, err := fiscalPeriod(c, param)
+	if err != nil {
+		return nil, err
+	}
+	if len(period.ClosingTransaction) > 0 {
+		return nil, fmt.Errorf("The period %v is already closed into retained earnings",
+			period.Name)
+	}
+	coa, err := ChartOfAccountsRepository.Get(c.Db, param["coa"])
+	if err != nil {
+		return nil, err
+	}
+	if coa.RetainedEarningsAccount.IsZero() {
+		return nil, errors.New("The retained earnings account must be informed")
+	}
+	retainedEarnings, err := AccountRepository.Get(c.Db, coa.RetainedEarningsAccount.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if space, ok := m["space"].(deb.Space); ok {
+		closing, key, err := closingOnSpace(c, space, param["coa"], period.End)
+		if err != nil {
+			return nil, err
+		} else if closing != nil {
+			err = c.Db.Execute(func(tdb db.Db) error {
+				if err := core.Audit(c, tdb, param["coa"], userKey, key, nil,
+					closing); err != nil {
+					return err
+				}
+				before := *period
+				period.ClosingTransaction = key
+				period.Status = Closed
+				return saveFiscalPeriod(c, tdb, param["coa"], userKey, &before, period)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return closing, nil
+		}
+	}
+	balances, err := incomeStatementBalances(c, m, param["coa"], period.Start, period.End)
+	if err != nil {
+		return nil, err
+	}
+	var debits, credits []interface{}
+	var net Money
+	for _, b := range balances {
+		account, value := b["account"].(*Account), b["value"].(Money)
+		if value == 0 {
+			continue
+		}
+		// The balance is zeroed by an entry of the value on the side opposite to the normal
+		// balance of the account.
+		if collections.Contains(account.Tags, "debitBalance") {
+			value = -value
+		}
+		entry := map[string]interface{}{"account": account.Number, "value": value.Abs()}
+		if len(account.Currency) > 0 {
+			entry["amount"] = Money(0)
+		}
+		if value > 0 {
+			debits = append(debits, entry)
+		} else {
+			credits = append(credits, entry)
+		}
+		net += value
+	}
+	if len(debits)+len(credits) == 0 {
+		return nil, fmt.Errorf("The income statement accounts of %v have no balances", period.Name)
+	}
+	if net > 0 {
+		credits = append(credits, map[string]interface{}{"account": retainedEarnings.Number,
+			"value": net})
+	} else if net < 0 {
+		debits = append(debits, map[string]interface{}{"account": retainedEarnings.Number,
+			"value": -net})
+	}
+	t := map[string]interface{}{
+		"date":    period.End.Format(time.RFC3339),
+		"memo":    "Closing of " + period.Name,
+		"tags":    []interface{}{"closing"},
+		"debits":  debits,
+		"credits": credits,
+	}
+	if space, ok := m["space"]; ok {
+		t["space"] = space
+	}
+	return saveTransaction(c, t, map[string]string{"coa": param["coa"]}, userKey,
+		func(d db.Db, transaction *Transaction) error {
+			before := *period
+			if _, ok := m["space"]; ok {
+				period.ClosingTransaction = strconv.FormatInt(transaction.AsOf.UnixNano(), 10)
+			} else {
+				period.ClosingTransaction = transaction.Key.Encode()
+			}
+			period.Status = Closed
+			return saveFiscalPeriod(c, d, param["coa"], userKey, &before, period)
+		})
+}
+
+// closingOnSpace returns the closing transaction dated the day that the space keeps, and its key,
+// or nil if there is none.
+func closingOnSpace(c context.Context, space deb.Space, coaKey string,
+	day time.Time) (*Transaction, string, error) {
+	slice, err := space.Slice(nil,
+		[]deb.DateRange{{Start: SerializedDate(day), End: SerializedDate(day)}}, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	accountKeys, accounts, err := Accounts(c, coaKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	transactions, keys, err := TransactionsFromSpace(slice, accounts, accountKeys)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, t := range transactions {
+		if collections.Contains(t.Tags, "closing") {
+			t.Key_ = keys[i]
+			return t, keys[i].(string), nil
+		}
+	}
+	return nil, "", nil
+}
+
+// ReopenFiscalPeriod reverses the closing of the fiscal period of the "period" param, deleting its
+// closing transaction, and opens the period. The period is opened first, for the transaction to be
+// deleted, and keeps the closing transaction until it is deleted, so that reopening it again
+// finishes what a failure left undone.
+func ReopenFiscalPeriod(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey) (interface{}, error) {
+	period, err := fiscalPeriod(c, param)
+	if err != nil {
+		return nil, err
+	}
+	if len(period.ClosingTransaction) == 0 {
+		return nil, fmt.Errorf("The period %v is not closed into retained earnings", period.Name)
+	}
+	if period.Status != Open {
+		before := *period
+		period.Status = Open
+		if err = saveFiscalPeriod(c, c.Db, param["coa"], userKey, &before, period); err != nil {
+			return nil, err
+		}
+	}
+	err = deleteTransaction(c, m, map[string]string{"coa": param["coa"],
+		"transaction": period.ClosingTransaction}, userKey, func(d db.Db) error {
+		before := *period
+		period.ClosingTransaction = ""
+		return saveFiscalPeriod(c, d, param["coa"], userKey, &before, period)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return period, nil
+}
+
+// ExcludeClosings takes the closing transactions of the fiscal periods ending from..to out of the
+// balances, so that the income statement of a closed period shows its results.
+func ExcludeClosings(c context.Context, m map[string]interface{}, coaKey string, from,
+	to time.Time, balances []db.M) error {
+	_, periods, err := fiscalPeriods(c, coaKey)
+	if err != nil {
+		return err
+	}
+	items := map[string]db.M{}
+	for _, b := range balances {
+		items[b["account"].(*Account).Key.String()] = b
+	}
+	lookupAccount := func(key db.Key) *Account {
+		if item, ok := items[key.String()]; ok {
+			return item["account"].(*Account)
+		}
+		return nil
+	}
+	subtractValue := func(key db.Key, value Money) {
+		items[key.String()]["value"] = items[key.String()]["value"].(Money) - value
+	}
+	for _, p := range periods {
+		if len(p.ClosingTransaction) == 0 || p.End.Before(from) || p.End.After(to) {
+			continue
+		}
+		obj, err := GetTransaction(c, m, map[string]string{"coa": coaKey,
+			"transaction": p.ClosingTransaction}, core.UserKey{})
+		if err != nil {
+			return err
+		}
+		obj.(*Transaction).incrementValue(lookupAccount, subtractValue)
+	}
+	return nil
+}
+
+// incomeStatementBalances returns the balances of the analytic income statement accounts from..to,
+// positive on the side of their normal balances.
+func incomeStatementBalances(c context.Context, m map[string]interface{}, coaKey string, from,
+	to time.Time) ([]db.M, error) {
+	space, ok := m["space"].(deb.Space)
+	if !ok {
+		balances, err := Balances(c, coaKey, from, to, db.And(
+			db.Field("Tags").Eq("incomeStatement"), db.Field("Tags").Eq("analytic")))
+		if err != nil {
+			return nil, err
+		}
+		return balances, nil
+	}
+	balanceSpace, err := space.Projection(nil,
+		[]deb.DateRange{{Start: SerializedDate(from), End: SerializedDate(to)}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	accountKeys, accounts, err := Accounts(c, coaKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	sortedAccounts, sortedKeys := AccountsByCreation(accounts, accountKeys)
+	balances := []db.M{}
+	ch, errc := balanceSpace.Transactions()
+	for t := range ch {
+		for k, v := range t.Entries {
+			account := sortedAccounts[k-1]
+			account.SetKey(sortedKeys[k-1])
+			if collections.Contains(account.Tags, "incomeStatement") {
+				value := Money(v)
+				if collections.Contains(account.Tags, "creditBalance") {
+					value = -value
+				}
+				balances = append(balances, db.M{"account": account, "value": value})
+			}
+		}
+	}
+	if err = <-errc; err != nil {
+		return nil, err
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i]["account"].(*Account).Number < balances[j]["account"].(*Account).Number
+	})
+	return balances, nil
+}
@@ -0,0 +1,256 @@
+package accounting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"mcesar.io/deb"
+)
+
+func TestCloseFiscalPeriod(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	user := core.NewUserKey()
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa"}, nil, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coa := obj.(*ChartOfAccounts)
+	param := map[string]string{"coa": coa.Key.Encode()}
+	for _, a := range []map[string]interface{}{
+		{"number": "1", "name": "Cash", "balanceSheet": true, "debitBalance": true},
+		{"number": "3", "name": "Revenue", "incomeStatement": true, "creditBalance": true},
+		{"number": "4", "name": "Expenses", "incomeStatement": true, "debitBalance": true},
+	} {
+		if _, err = SaveAccount(c, a, param, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save := func(date, debit, credit, value string) error {
+		_, err := SaveTransaction(c, []map[string]interface{}{{"memo": "m",
+			"date":    date + "T00:00:00Z",
+			"debits":  []interface{}{map[string]interface{}{"account": debit, "value": value}},
+			"credits": []interface{}{map[string]interface{}{"account": credit, "value": value}}}},
+			param, user)
+		return err
+	}
+	for _, tx := range [][]string{
+		{"2014-03-01", "1", "3", "100"}, {"2014-12-31", "4", "1", "30"}, {"2015-01-01", "1", "3", "7"},
+	} {
+		if err = save(tx[0], tx[1], tx[2], tx[3]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj, err = SaveFiscalPeriod(c, map[string]interface{}{"name": "2014", "start": "2014-01-01",
+		"end": "2014-12-31"}, param, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	periodParam := map[string]string{"coa": coa.Key.Encode(),
+		"period": obj.(*FiscalPeriod).Key.Encode()}
+	if _, err = CloseFiscalPeriod(c, map[string]interface{}{}, periodParam, user); err == nil {
+		t.Error("The retained earnings account must be informed")
+	}
+	if _, err = SaveAccount(c, map[string]interface{}{"number": "2", "name": "Retained earnings",
+		"balanceSheet": true, "creditBalance": true, "retainedEarnings": true}, param,
+		user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveChartOfAccounts(c, map[string]interface{}{"name": "renamed"}, param,
+		user); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err = CloseFiscalPeriod(c, map[string]interface{}{}, periodParam, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closing := obj.(*Transaction)
+	if len(closing.Tags) != 1 || closing.Tags[0] != "closing" {
+		t.Error("The closing must be tagged", closing.Tags)
+	}
+	if message := closing.ValidationMessage(c.Db, param); len(message) > 0 {
+		t.Error(message)
+	}
+	if _, err = CloseFiscalPeriod(c, map[string]interface{}{}, periodParam, user); err == nil {
+		t.Error("The period must not be closed twice")
+	}
+	if err = save("2014-06-01", "1", "3", "1"); err == nil {
+		t.Error("The closed period must not allow transactions")
+	}
+	period, err := fiscalPeriod(c, periodParam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period.Status != Closed || period.ClosingTransaction != closing.Key.Encode() {
+		t.Error("The period must be closed by the transaction", period)
+	}
+
+	from := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2014, 12, 31, 0, 0, 0, 0, time.UTC)
+	checkBalances := func(expected map[string]Money) []db.M {
+		balances, err := Balances(c, coa.Key.Encode(), from, to, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range balances {
+			account := b["account"].(*Account)
+			if b["value"] != expected[account.Number] {
+				t.Errorf("The balance of %v must be %v, but was %v", account.Number,
+					expected[account.Number], b["value"])
+			}
+		}
+		return balances
+	}
+	balances := checkBalances(map[string]Money{"1": 7000, "2": 7000, "3": 0, "4": 0})
+	if err = ExcludeClosings(c, nil, coa.Key.Encode(), from, to, balances); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range balances {
+		if n := b["account"].(*Account).Number; n == "3" && b["value"] != Money(10000) ||
+			n == "4" && b["value"] != Money(3000) {
+			t.Errorf("The income statement of 2014 must exclude the closing: %v %v", n, b["value"])
+		}
+	}
+
+	// A reopening that failed after opening the period is finished by reopening it again.
+	before := *period
+	period.Status = Open
+	if err = saveFiscalPeriod(c, c.Db, coa.Key.Encode(), user, &before, period); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReopenFiscalPeriod(c, map[string]interface{}{}, periodParam, user); err != nil {
+		t.Fatal(err)
+	}
+	if period, err = fiscalPeriod(c, periodParam); err != nil {
+		t.Fatal(err)
+	}
+	if period.Status != Open || len(period.ClosingTransaction) > 0 {
+		t.Error("The period must be reopened", period)
+	}
+	checkBalances(map[string]Money{"1": 7000, "2": 0, "3": 10000, "4": 3000})
+	if _, err = ReopenFiscalPeriod(c, map[string]interface{}{}, periodParam, user); err == nil {
+		t.Error("The period is not closed anymore")
+	}
+}
+
+// memorySpace keeps in memory the transactions appended to it, which are never rolled back.
+type memorySpace struct {
+	deb.Space
+	transactions []*deb.Transaction
+}
+
+func (s *memorySpace) Append(space deb.Space) error {
+	ch, errc := space.Transactions()
+	for t := range ch {
+		s.transactions = append(s.transactions, t)
+	}
+	return <-errc
+}
+
+func (s *memorySpace) Slice(_ []deb.Account, dates []deb.DateRange,
+	moments []deb.MomentRange) (deb.Space, error) {
+	slice := &memorySpace{}
+	for _, t := range s.transactions {
+		if (len(dates) == 0 || t.Date >= dates[0].Start && t.Date <= dates[0].End) &&
+			(len(moments) == 0 || t.Moment >= moments[0].Start && t.Moment <= moments[0].End) {
+			slice.transactions = append(slice.transactions, t)
+		}
+	}
+	return slice, nil
+}
+
+func (s *memorySpace) Projection(accounts []deb.Account, dates []deb.DateRange,
+	moments []deb.MomentRange) (deb.Space, error) {
+	slice, _ := s.Slice(accounts, dates, moments)
+	projection := &deb.Transaction{Entries: deb.Entries{}}
+	for _, t := range slice.(*memorySpace).transactions {
+		for k, v := range t.Entries {
+			projection.Entries[k] += v
+		}
+	}
+	return &memorySpace{transactions: []*deb.Transaction{projection}}, nil
+}
+
+func (s *memorySpace) Transactions() (chan *deb.Transaction, chan error) {
+	ch, errc := make(chan *deb.Transaction, len(s.transactions)), make(chan error, 1)
+	for _, t := range s.transactions {
+		ch <- t
+	}
+	close(ch)
+	errc <- nil
+	return ch, errc
+}
+
+func TestCloseFiscalPeriodOnSpaceAgain(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	user := core.NewUserKey()
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa"}, nil, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coa := obj.(*ChartOfAccounts)
+	param := map[string]string{"coa": coa.Key.Encode()}
+	for _, a := range []map[string]interface{}{
+		{"number": "1", "name": "Cash", "balanceSheet": true, "debitBalance": true},
+		{"number": "2", "name": "Retained earnings", "balanceSheet": true,
+			"creditBalance": true, "retainedEarnings": true},
+		{"number": "3", "name": "Revenue", "incomeStatement": true, "creditBalance": true},
+	} {
+		if _, err = SaveAccount(c, a, param, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	space := &memorySpace{}
+	if _, err = SaveTransaction(c, []map[string]interface{}{{"memo": "m",
+		"date": "2014-03-01T00:00:00Z", "space": space,
+		"debits":  []interface{}{map[string]interface{}{"account": "1", "value": "100"}},
+		"credits": []interface{}{map[string]interface{}{"account": "3", "value": "100"}}}},
+		param, user); err != nil {
+		t.Fatal(err)
+	}
+	obj, err = SaveFiscalPeriod(c, map[string]interface{}{"name": "2014", "start": "2014-01-01",
+		"end": "2014-12-31"}, param, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	periodParam := map[string]string{"coa": coa.Key.Encode(),
+		"period": obj.(*FiscalPeriod).Key.Encode()}
+
+	fc := c
+	fc.Db = failingDb{c.Db, "FiscalPeriod", 1}
+	if _, err = CloseFiscalPeriod(fc, map[string]interface{}{"space": space}, periodParam,
+		user); err == nil {
+		t.Fatal("The closing must fail with the period")
+	}
+	if len(space.transactions) != 2 {
+		t.Fatal("The space must keep the closing, but had", len(space.transactions))
+	}
+	obj, err = CloseFiscalPeriod(c, map[string]interface{}{"space": space}, periodParam, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closing := obj.(*Transaction)
+	if len(space.transactions) != 2 {
+		t.Error("The closing kept by the space must not be posted again")
+	}
+	period, err := fiscalPeriod(c, periodParam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period.Status != Closed || period.ClosingTransaction != closing.Key_ {
+		t.Error("The period must be closed by the transaction kept by the space", period)
+	}
+}
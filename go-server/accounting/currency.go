@@ -0,0 +1,380 @@
+package accounting
+
+import (
+	"encoding/csv"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"github.com/mcesarhm/geek-accounting/go-server/extensions/collections"
+)
+
+// Rate is the value, in the currency of a chart of accounts, of a unit of another currency. It is
+// a decimal string, like "5.1234", so that conversions are exact before they are rounded.
+type Rate string
+
+// An ExchangeRate is the rate of a currency from its date on, until the date of the next rate of
+// the currency. Exchange rates are kept per chart of accounts.
+type ExchangeRate struct {
+	db.Identifiable
+	Currency string       `json:"currency"`
+	Date     time.Time    `json:"date"`
+	Rate     Rate         `json:"rate"`
+	User     core.UserKey `json:"user"`
+	AsOf     time.Time    `json:"timestamp"`
+}
+
+var ExchangeRateRepository = db.NewRepository[ExchangeRate]("ExchangeRate")
+
+func init() {
+	gob.Register((*ExchangeRate)(nil))
+	db.RegisterIndex("ExchangeRate", "Currency")
+}
+
+func (rate *ExchangeRate) ValidationMessage(_ db.Db, _ map[string]string) string {
+	if !validCurrency(rate.Currency) {
+		return "The currency must be an ISO 4217 code"
+	}
+	if rate.Date.IsZero() {
+		return "The date must be informed"
+	}
+	if _, err := ParseRate(string(rate.Rate)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// validCurrency tells whether the currency is an ISO 4217 code, like "USD".
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseRate converts a positive decimal string to a rate.
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	integer, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		integer, fraction = s[:i], s[i+1:]
+	}
+	if len(integer)+len(fraction) == 0 || !onlyDigits(integer) || !onlyDigits(fraction) {
+		return "", fmt.Errorf("Invalid rate: %v", s)
+	}
+	if r, ok := new(big.Rat).SetString(s); !ok || r.Sign() <= 0 {
+		return "", fmt.Errorf("The rate must be greater than zero: %v", s)
+	}
+	return Rate(s), nil
+}
+
+func (r Rate) rat() *big.Rat {
+	if rat, ok := new(big.Rat).SetString(string(r)); ok {
+		return rat
+	}
+	return new(big.Rat)
+}
+
+// Convert returns the value, in the currency of the chart of accounts, whose scale is valueScale,
+// of an amount of a currency of the scale at the rate.
+func (r Rate) Convert(amount Money, scale, valueScale int) (Money, error) {
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(amount)), r.rat())
+	return round(v.Mul(v, pow10(valueScale-scale)))
+}
+
+// Invert returns the amount, in the currency of the rate, whose scale is scale, of a value of the
+// chart of accounts, whose scale is valueScale.
+func (r Rate) Invert(value Money, valueScale, scale int) (Money, error) {
+	if r.rat().Sign() == 0 {
+		return 0, fmt.Errorf("Invalid rate: %v", r)
+	}
+	v := new(big.Rat).Quo(new(big.Rat).SetInt64(int64(value)), r.rat())
+	return round(v.Mul(v, pow10(scale-valueScale)))
+}
+
+func pow10(n int) *big.Rat {
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(n))), nil)
+	if n < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), p)
+	}
+	return new(big.Rat).SetInt(p)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// round rounds the value to the nearest minor unit, and halves away from zero.
+func round(v *big.Rat) (Money, error) {
+	q, r := new(big.Int).QuoRem(new(big.Int).Abs(v.Num()), v.Denom(), new(big.Int))
+	if r.Lsh(r, 1).Cmp(v.Denom()) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if !q.IsInt64() {
+		return 0, fmt.Errorf("The amount %v is too large", v.FloatString(DefaultScale))
+	}
+	if v.Sign() < 0 {
+		return Money(-q.Int64()), nil
+	}
+	return Money(q.Int64()), nil
+}
+
+// rateAt returns the rate of the currency at the date: the one of the latest exchange rate dated
+// up to the date.
+func rateAt(c context.Context, coaKey, currency string, date time.Time) (Rate, error) {
+	_, rates, err := ExchangeRateRepository.GetAllWithLimit(c.Db, coaKey,
+		db.And(db.Field("Currency").Eq(currency), db.Field("Date").Le(date)), []string{"-Date"}, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(rates) == 0 {
+		return "", fmt.Errorf("There is no exchange rate of %v at %v", currency,
+			date.Format("2006-01-02"))
+	}
+	return rates[0].Rate, nil
+}
+
+// Converter returns the function that converts the values of the chart of accounts to the
+// currency of the "currency" param at the date, which keeps the values if the param is not
+// informed or is the currency of the chart of accounts, and the scale of the converted values.
+func Converter(c context.Context, param map[string]string, date time.Time) (func(Money) (Money,
+	error), int, error) {
+	coa, err := ChartOfAccountsRepository.Get(c.Db, param["coa"])
+	if err != nil {
+		return nil, 0, err
+	}
+	valueScale := Scale(coa.Currency)
+	keep := func(value Money) (Money, error) { return value, nil }
+	currency := strings.ToUpper(param["currency"])
+	if len(currency) == 0 || currency == coa.Currency {
+		return keep, valueScale, nil
+	}
+	rate, err := rateAt(c, param["coa"], currency, date)
+	if err != nil {
+		return nil, 0, err
+	}
+	scale := Scale(currency)
+	return func(value Money) (Money, error) {
+		return rate.Invert(value, valueScale, scale)
+	}, scale, nil
+}
+
+// AllExchangeRates returns the exchange rates of the chart of accounts, by currency and date, or
+// only the ones of the "currency" param.
+func AllExchangeRates(c context.Context, _ map[string]interface{}, param map[string]string,
+	_ core.UserKey) (interface{}, error) {
+	var query db.Query
+	if currency, ok := param["currency"]; ok {
+		query = db.Field("Currency").Eq(strings.ToUpper(currency))
+	}
+	_, rates, err := ExchangeRateRepository.GetAll(c.Db, param["coa"], query, nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Currency < rates[j].Currency || rates[i].Currency == rates[j].Currency &&
+			rates[i].Date.Before(rates[j].Date)
+	})
+	return rates, nil
+}
+
+// ImportExchangeRates saves the exchange rates of the CSV in m["csv"], whose lines are the
+// currency, the date, as in 2014-05-31, and the rate, after an optional header. A rate replaces
+// the one of the same currency and date. The number of rates saved is returned.
+func ImportExchangeRates(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey) (interface{}, error) {
+	text, ok := m["csv"].(string)
+	if !ok || len(strings.TrimSpace(text)) == 0 {
+		return nil, errors.New("The exchange rates must be informed")
+	}
+	coa, err := ChartOfAccountsRepository.Get(c.Db, param["coa"])
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	keys, existing, err := ExchangeRateRepository.GetAll(c.Db, param["coa"], nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	rates := map[string]*ExchangeRate{}
+	for i, r := range existing {
+		r.SetKey(keys.KeyAt(i))
+		rates[r.Currency+r.Date.Format("2006-01-02")] = r
+	}
+	var changed []*ExchangeRate
+	asOf := time.Now()
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "currency") {
+			continue
+		}
+		rate := &ExchangeRate{Currency: strings.ToUpper(strings.TrimSpace(record[0])),
+			Rate: Rate(strings.TrimSpace(record[2])), User: userKey, AsOf: asOf}
+		if rate.Date, err = time.Parse("2006-01-02", strings.TrimSpace(record[1])); err != nil {
+			return nil, fmt.Errorf("Line %d: invalid date %v", i+1, record[1])
+		}
+		if message := rate.ValidationMessage(c.Db, param); len(message) > 0 {
+			return nil, fmt.Errorf("Line %d: %v", i+1, message)
+		}
+		if rate.Currency == coa.Currency {
+			return nil, fmt.Errorf("Line %d: %v is the currency of the chart of accounts", i+1,
+				rate.Currency)
+		}
+		k := rate.Currency + rate.Date.Format("2006-01-02")
+		if old, ok := rates[k]; ok {
+			if old.Rate == rate.Rate {
+				continue
+			}
+			rate.SetKey(old.GetKey())
+		}
+		rates[k] = rate
+		changed = append(changed, rate)
+	}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		for _, rate := range changed {
+			var before *ExchangeRate
+			if !rate.Key.IsZero() {
+				if before, err = ExchangeRateRepository.Get(tdb, rate.Key.Encode()); err != nil {
+					return err
+				}
+			}
+			key, err := ExchangeRateRepository.Save(tdb, rate, param["coa"], param)
+			if err != nil {
+				return err
+			}
+			if before == nil {
+				err = core.Audit(c, tdb, param["coa"], userKey, key.Encode(), nil, rate)
+			} else {
+				err = core.Audit(c, tdb, param["coa"], userKey, key.Encode(), before, rate)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"imported": len(changed)}, nil
+}
+
+// Revalue posts the unrealized exchange gains and losses, at the "date" of m, of the accounts
+// whose currency is not the one of the chart of accounts: the difference between the balance of
+// each account converted at the rate of the date and its value in the chart of accounts. The
+// gains are credited to the account numbered m["gain"] and the losses are debited to the account
+// numbered m["loss"], in a single transaction tagged "revaluation", which is returned, or nil if
+// every account is already at the rate of the date.
+func Revalue(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey) (interface{}, error) {
+	if _, ok := m["space"]; ok {
+		return nil, errors.New("Revaluation is not supported by charts of accounts kept in spaces")
+	}
+	dateAsString, _ := m["date"].(string)
+	date, err := time.Parse(time.RFC3339, dateAsString)
+	if err != nil {
+		return nil, err
+	}
+	gain, _ := m["gain"].(string)
+	loss, _ := m["loss"].(string)
+	if len(gain) == 0 || len(loss) == 0 {
+		return nil, errors.New("The gain and loss accounts must be informed")
+	}
+	coa, err := ChartOfAccountsRepository.Get(c.Db, param["coa"])
+	if err != nil {
+		return nil, err
+	}
+	valueScale := Scale(coa.Currency)
+	keys, accounts, err := Accounts(c, param["coa"], nil)
+	if err != nil {
+		return nil, err
+	}
+	foreign := map[string]*Account{}
+	for i, a := range accounts {
+		if len(a.Currency) > 0 && collections.Contains(a.Tags, "analytic") {
+			a.SetKey(keys.KeyAt(i))
+			foreign[a.Key.String()] = a
+		}
+	}
+	amounts, values := map[string]Money{}, map[string]Money{}
+	err = TransactionRepository.Iterate(c.Db, param["coa"], db.Field("Date").Le(date), nil,
+		func(_ db.Key, t *Transaction) error {
+			add := func(entries []Entry, signal Money) {
+				for _, e := range entries {
+					if _, ok := foreign[e.Account.String()]; ok {
+						amounts[e.Account.String()] += signal * e.Amount
+						values[e.Account.String()] += signal * e.Value
+					}
+				}
+			}
+			add(t.Debits, 1)
+			add(t.Credits, -1)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]*Account, 0, len(foreign))
+	for _, a := range foreign {
+		sorted = append(sorted, a)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Number < sorted[j].Number })
+	var debits, credits []interface{}
+	var gains, losses Money
+	for _, a := range sorted {
+		rate, err := rateAt(c, param["coa"], a.Currency, date)
+		if err != nil {
+			return nil, err
+		}
+		value, err := rate.Convert(amounts[a.Key.String()], Scale(a.Currency), valueScale)
+		if err != nil {
+			return nil, err
+		}
+		entry := map[string]interface{}{"account": a.Number, "amount": Money(0), "rate": rate}
+		if diff := value - values[a.Key.String()]; diff > 0 {
+			entry["value"] = diff
+			debits = append(debits, entry)
+			gains += diff
+		} else if diff < 0 {
+			entry["value"] = -diff
+			credits = append(credits, entry)
+			losses -= diff
+		}
+	}
+	if gains == 0 && losses == 0 {
+		return nil, nil
+	}
+	if gains > 0 {
+		credits = append(credits, map[string]interface{}{"account": gain, "value": gains})
+	}
+	if losses > 0 {
+		debits = append(debits, map[string]interface{}{"account": loss, "value": losses})
+	}
+	return SaveTransaction(c, []map[string]interface{}{{
+		"date":    dateAsString,
+		"memo":    "Revaluation at " + date.Format("2006-01-02"),
+		"tags":    []interface{}{"revaluation"},
+		"debits":  debits,
+		"credits": credits,
+	}}, param, userKey)
+}
@@ -0,0 +1,267 @@
+package accounting
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+)
+
+func TestRate(t *testing.T) {
+	for _, c := range []struct {
+		rate       Rate
+		amount     Money
+		scale      int
+		valueScale int
+		value      Money
+	}{
+		{"2", 100, 2, 2, 200}, {"5.1234", 100, 2, 2, 512}, {"5.125", 100, 2, 2, 513},
+		{"5.125", -100, 2, 2, -513}, {"0.0325", 1000, 0, 2, 3250}, {"3.7", 1001, 3, 2, 370},
+		{"150.25", 100, 2, 0, 150}, {"150.5", 100, 2, 0, 151}, {"0.0066", 1000, 0, 3, 6600},
+	} {
+		if v, err := c.rate.Convert(c.amount, c.scale, c.valueScale); err != nil || v != c.value {
+			t.Errorf("%d at %v must be %d, but was %d %v", c.amount, c.rate, c.value, v, err)
+		}
+	}
+	if v, err := Rate("3").Invert(1000, 2, 2); err != nil || v != 333 {
+		t.Error("10.00 / 3 must be 3.33, but was", v, err)
+	}
+	if v, err := Rate("150.25").Invert(15025, 0, 2); err != nil || v != 10000 {
+		t.Error("15025 JPY / 150.25 must be 100.00 USD, but was", v, err)
+	}
+	if v, err := Rate("0.0066").Invert(6600, 3, 0); err != nil || v != 1000 {
+		t.Error("6.600 KWD / 0.0066 must be 1000 JPY, but was", v, err)
+	}
+	for _, s := range []string{"", "0", "-1", "1/3", "1e3", "."} {
+		if r, err := ParseRate(s); err == nil {
+			t.Errorf("%q must be refused, but was %v", s, r)
+		}
+	}
+}
+
+func TestMultiCurrency(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	user := core.NewUserKey()
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa", "currency": "brl"},
+		nil, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coa := obj.(*ChartOfAccounts)
+	if coa.Currency != "BRL" {
+		t.Fatal("The currency must be BRL, but was", coa.Currency)
+	}
+	param := map[string]string{"coa": coa.Key.Encode()}
+	for _, a := range []map[string]interface{}{
+		{"number": "1", "name": "Cash", "balanceSheet": true, "debitBalance": true,
+			"currency": "BRL"},
+		{"number": "2", "name": "Bank", "balanceSheet": true, "debitBalance": true,
+			"currency": "USD"},
+		{"number": "3", "name": "Tokyo", "balanceSheet": true, "debitBalance": true,
+			"currency": "JPY"},
+		{"number": "4", "name": "FX gain", "incomeStatement": true, "creditBalance": true},
+		{"number": "5", "name": "FX loss", "incomeStatement": true, "debitBalance": true},
+	} {
+		if _, err = SaveAccount(c, a, param, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, accounts, err := Accounts(c, coa.Key.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accounts[0].Currency != "" || accounts[1].Currency != "USD" {
+		t.Error("Only the accounts in other currencies must have one", accounts[0].Currency,
+			accounts[1].Currency)
+	}
+
+	if _, err = ImportExchangeRates(c, map[string]interface{}{"csv": "currency,date,rate\n" +
+		"BRL,2014-05-01,1\n"}, param, user); err == nil {
+		t.Error("The currency of the chart of accounts must not have rates")
+	}
+	obj, err = ImportExchangeRates(c, map[string]interface{}{"csv": "currency,date,rate\n" +
+		"USD,2014-05-01,2.00\nusd,2014-05-31,2.2\nJPY,2014-05-01,0.02\n"}, param, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ImportExchangeRates(c, map[string]interface{}{"csv": "USD,2014-05-31,2.10\n" +
+		"JPY,2014-05-01,0.02\n"}, param, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := obj.(map[string]interface{})["imported"]; n != 1 {
+		t.Error("Only the changed rate must be imported, but were", n)
+	}
+	obj, err = AllExchangeRates(c, nil, map[string]string{"coa": coa.Key.Encode(),
+		"currency": "usd"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates := obj.([]*ExchangeRate); len(rates) != 2 || rates[1].Rate != "2.10" {
+		t.Error("The rate of USD at 2014-05-31 must be replaced", rates)
+	}
+
+	save := func(date string, debit, credit map[string]interface{}) (*Transaction, error) {
+		obj, err := SaveTransaction(c, []map[string]interface{}{{"memo": "m",
+			"date": date + "T00:00:00Z", "debits": []interface{}{debit},
+			"credits": []interface{}{credit}}}, param, user)
+		if err != nil {
+			return nil, err
+		}
+		tx := obj.(*Transaction)
+		if message := tx.ValidationMessage(c.Db, param); len(message) > 0 {
+			t.Error(message)
+		}
+		return tx, nil
+	}
+	tx, err := save("2014-05-10",
+		map[string]interface{}{"account": "2", "amount": "100"},
+		map[string]interface{}{"account": "1", "value": "200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := tx.Debits[0]; e.Value != 20000 || e.Amount != 10000 || e.Rate != "2.00" ||
+		e.Currency != "USD" {
+		t.Error("100 USD at 2.00 must be 200 BRL", e)
+	}
+	cash, bank := keys.KeyAt(0).(db.CKey), keys.KeyAt(1).(db.CKey)
+	invalid := &Transaction{Memo: "m", Date: tx.Date,
+		Debits: []Entry{{Account: bank, Value: 25000, Currency: "USD", Amount: 10000,
+			Rate: "2.5"}},
+		Credits: []Entry{{Account: cash, Value: 20000}}}
+	if message := invalid.ValidationMessage(c.Db, param); len(message) == 0 {
+		t.Error("The transaction must balance in BRL")
+	}
+	invalid.Debits = []Entry{{Account: bank, Value: 20000}}
+	if message := invalid.ValidationMessage(c.Db, param); !strings.Contains(message, "amount") {
+		t.Error("The amount in USD must be informed", message)
+	}
+	if _, err = save("2014-04-30",
+		map[string]interface{}{"account": "2", "amount": "100"},
+		map[string]interface{}{"account": "1", "value": "200"}); err == nil {
+		t.Error("There is no rate before 2014-05-01")
+	}
+	if tx, err = save("2014-05-20",
+		map[string]interface{}{"account": "3", "amount": "10001"},
+		map[string]interface{}{"account": "1", "value": "200.02"}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := json.Marshal(tx.Debits[0]); err != nil ||
+		!strings.Contains(string(b), `"amount":10001`) {
+		t.Error("The amount in JPY has no decimals", string(b), err)
+	}
+
+	obj, err = Revalue(c, map[string]interface{}{"date": "2014-05-31T00:00:00Z", "gain": "4",
+		"loss": "5"}, param, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revaluation := obj.(*Transaction)
+	if len(revaluation.Tags) != 1 || revaluation.Tags[0] != "revaluation" {
+		t.Error("The revaluation must be tagged", revaluation.Tags)
+	}
+	if message := revaluation.ValidationMessage(c.Db, param); len(message) > 0 {
+		t.Error(message)
+	}
+	if obj, err = Revalue(c, map[string]interface{}{"date": "2014-05-31T00:00:00Z",
+		"gain": "4", "loss": "5"}, param, user); err != nil || obj != nil {
+		t.Error("The accounts were already revalued", obj, err)
+	}
+	from := time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2014, 5, 31, 0, 0, 0, 0, time.UTC)
+	balances, err := Balances(c, coa.Key.Encode(), from, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Money{"1": -40002, "2": 21000, "3": 20002, "4": 1000, "5": 0}
+	for _, b := range balances {
+		account := b["account"].(*Account)
+		if b["value"] != expected[account.Number] {
+			t.Errorf("The balance of %v must be %v, but was %v", account.Number,
+				expected[account.Number], b["value"])
+		}
+	}
+	convert, scale, err := Converter(c, map[string]string{"coa": coa.Key.Encode(),
+		"currency": "USD"}, to)
+	if err != nil || scale != 2 {
+		t.Fatal("The scale of USD must be 2, but was", scale, err)
+	}
+	if v, err := convert(21000); err != nil || v != 10000 {
+		t.Error("210 BRL at 2.10 must be 100 USD, but was", v, err)
+	}
+	if _, _, err = Converter(c, map[string]string{"coa": coa.Key.Encode(), "currency": "EUR"},
+		to); err == nil {
+		t.Error("There are no rates of EUR")
+	}
+}
+
+func TestChartOfAccountsScale(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	user := core.NewUserKey()
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa", "currency": "JPY"},
+		nil, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coa := obj.(*ChartOfAccounts)
+	param := map[string]string{"coa": coa.Key.Encode()}
+	for _, a := range []map[string]interface{}{
+		{"number": "1", "name": "Cash", "balanceSheet": true, "debitBalance": true},
+		{"number": "2", "name": "Bank", "balanceSheet": true, "debitBalance": true,
+			"currency": "USD"},
+	} {
+		if _, err = SaveAccount(c, a, param, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = ImportExchangeRates(c, map[string]interface{}{"csv": "currency,date,rate\n" +
+		"USD,2014-05-01,150.25\n"}, param, user); err != nil {
+		t.Fatal(err)
+	}
+	save := func(debit, credit map[string]interface{}) (*Transaction, error) {
+		obj, err := SaveTransaction(c, []map[string]interface{}{{"memo": "m",
+			"date": "2014-05-10T00:00:00Z", "debits": []interface{}{debit},
+			"credits": []interface{}{credit}}}, param, user)
+		if err != nil {
+			return nil, err
+		}
+		return obj.(*Transaction), nil
+	}
+	tx, err := save(map[string]interface{}{"account": "2", "amount": "1.00"},
+		map[string]interface{}{"account": "1", "value": "150"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := tx.Debits[0]; e.Value != 150 || e.Amount != 100 {
+		t.Error("1.00 USD at 150.25 must be 150 JPY", e)
+	}
+	if _, err = save(map[string]interface{}{"account": "1", "value": "10.5"},
+		map[string]interface{}{"account": "2", "value": "10.5"}); err == nil {
+		t.Error("Values in JPY must not have decimal places")
+	}
+	convert, scale, err := Converter(c, map[string]string{"coa": coa.Key.Encode(),
+		"currency": "USD"}, tx.Date)
+	if err != nil || scale != 2 {
+		t.Fatal("The scale of USD must be 2, but was", scale, err)
+	}
+	if v, err := convert(15025); err != nil || v != 10000 {
+		t.Error("15025 JPY at 150.25 must be 100.00 USD, but was", v, err)
+	}
+	if _, scale, err = Converter(c, param, tx.Date); err != nil || scale != 0 {
+		t.Error("The scale of JPY must be 0, but was", scale, err)
+	}
+}
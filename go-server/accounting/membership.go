@@ -0,0 +1,293 @@
+package accounting
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+)
+
+// Role is what a member can do with a chart of accounts.
+type Role string
+
+const (
+	Owner      Role = "owner"
+	Controller Role = "controller"
+	Editor     Role = "editor"
+	Viewer     Role = "viewer"
+	Auditor    Role = "auditor"
+)
+
+// Permission is checked by the handlers of a chart of accounts.
+type Permission int
+
+const (
+	// Read allows reading the accounts, transactions and reports.
+	Read Permission = iota
+	// Write allows changing the accounts and transactions.
+	Write
+	// Audit allows reading the history of the changes.
+	Audit
+	// Manage allows changing the chart of accounts, migrating it and granting memberships.
+	Manage
+	// Override allows changing the transactions dated in soft-closed fiscal periods.
+	Override
+)
+
+var permissions = map[Role][]Permission{
+	Owner:      {Read, Write, Audit, Manage, Override},
+	Controller: {Read, Write, Audit, Override},
+	Editor:     {Read, Write},
+	Viewer:     {Read},
+	Auditor:    {Read, Audit},
+}
+
+// A Membership gives a role on a chart of accounts, its parent, to a user. Charts created before
+// memberships, which have none, are owned by the user who created them.
+type Membership struct {
+	db.Identifiable
+	User core.UserKey `json:"user"`
+	Role Role         `json:"role"`
+	AsOf time.Time    `json:"timestamp"`
+}
+
+var MembershipRepository = db.NewRepository[Membership]("Membership")
+
+func init() {
+	gob.Register((*Membership)(nil))
+	gob.Register(([]*Membership)(nil))
+	db.RegisterIndex("Membership", "User")
+}
+
+func (m *Membership) ValidationMessage(_ db.Db, _ map[string]string) string {
+	if _, ok := permissions[m.Role]; !ok {
+		return "The role must be owner, controller, editor, viewer or auditor"
+	}
+	return ""
+}
+
+// Allowed returns the check of the permission on the chart of accounts of the "coa" param.
+func Allowed(p Permission) core.Check {
+	return func(c context.Context, param map[string]string, userKey core.UserKey) error {
+		if ok, err := HasPermission(c, param["coa"], userKey, p); err != nil {
+			return err
+		} else if !ok {
+			return core.ErrForbidden
+		}
+		return nil
+	}
+}
+
+// HasPermission reports whether the user has the permission on the chart of accounts, either by
+// a membership or by being an admin. Only the admins keep their memberships on the charts of the
+// organizations they no longer belong to.
+func HasPermission(c context.Context, coaKey string, userKey core.UserKey,
+	p Permission) (bool, error) {
+	if admin, err := core.IsAdmin(c, userKey); err != nil || admin {
+		return admin, err
+	}
+	if ok, err := inOrganizationOf(c, coaKey, userKey); err != nil || !ok {
+		return false, err
+	}
+	role, err := roleOf(c, coaKey, userKey)
+	if err != nil {
+		return false, err
+	}
+	for _, each := range permissions[role] {
+		if each == p {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// roleOf returns the role of the user on the chart of accounts, or an empty role if the user is
+// not a member.
+func roleOf(c context.Context, coaKey string, userKey core.UserKey) (Role, error) {
+	_, memberships, err := chartMemberships(c, coaKey)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range memberships {
+		if m.User.Encode() == userKey.Encode() {
+			return m.Role, nil
+		}
+	}
+	if len(memberships) > 0 {
+		return "", nil
+	}
+	keys, coas, err := ChartOfAccountsRepository.GetAllFromCache(c.Db, "", nil, nil, c.Cache,
+		"ChartOfAccounts")
+	if err != nil {
+		return "", err
+	}
+	for i, coa := range coas {
+		if keys[i].Encode() == coaKey && coa.User.Encode() == userKey.Encode() {
+			return Owner, nil
+		}
+	}
+	return "", nil
+}
+
+// inOrganizationOf reports whether the user belongs to the organization of the chart of accounts.
+func inOrganizationOf(c context.Context, coaKey string, userKey core.UserKey) (bool, error) {
+	keys, coas, err := ChartOfAccountsRepository.GetAllFromCache(c.Db, "", nil, nil, c.Cache,
+		"ChartOfAccounts")
+	if err != nil {
+		return false, err
+	}
+	for i, coa := range coas {
+		if keys[i].Encode() == coaKey {
+			return core.BelongsTo(c, userKey, coa.Organization)
+		}
+	}
+	return false, nil
+}
+
+func chartMemberships(c context.Context, coaKey string) (db.Keys, []*Membership, error) {
+	return MembershipRepository.GetAllFromCache(c.Db, coaKey, nil, nil, c.Cache,
+		"memberships_"+coaKey)
+}
+
+func AllMemberships(c context.Context, _ map[string]interface{}, param map[string]string,
+	_ core.UserKey) (interface{}, error) {
+	_, memberships, err := chartMemberships(c, param["coa"])
+	return memberships, err
+}
+
+// GrantMembership gives the role of the request to the user of the "user" param, replacing the
+// role the user had.
+func GrantMembership(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey) (interface{}, error) {
+	role, _ := m["role"].(string)
+	user, err := core.UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	membership := &Membership{User: core.UserKey(user.Key), Role: Role(role), AsOf: time.Now()}
+	if m := membership.ValidationMessage(c.Db, param); len(m) > 0 {
+		return nil, errors.New(m)
+	}
+	keys, memberships, err := chartMemberships(c, param["coa"])
+	if err != nil {
+		return nil, err
+	}
+	var before interface{}
+	for i, each := range memberships {
+		if each.User.Encode() == param["user"] {
+			if each.Role == Owner && membership.Role != Owner &&
+				owners(memberships) == 1 {
+				return nil, fmt.Errorf("The chart of accounts must have an owner")
+			}
+			membership.SetKey(keys[i])
+			before = each
+		}
+	}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if len(memberships) == 0 {
+			// The creator of a chart without memberships stays its owner.
+			if err := addCreatorAsOwner(c, tdb, param["coa"], param["user"], Role(role),
+				userKey); err != nil {
+				return err
+			}
+		}
+		key, err := MembershipRepository.Save(tdb, membership, param["coa"], param)
+		if err != nil {
+			return err
+		}
+		return core.Audit(c, tdb, param["coa"], userKey, key.Encode(), before, membership)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return membership, c.Cache.Delete("memberships_" + param["coa"])
+}
+
+// RevokeMembership removes the membership of the user of the "user" param.
+func RevokeMembership(c context.Context, _ map[string]interface{}, param map[string]string,
+	userKey core.UserKey) (interface{}, error) {
+	keys, memberships, err := chartMemberships(c, param["coa"])
+	if err != nil {
+		return nil, err
+	}
+	for i, each := range memberships {
+		if each.User.Encode() == param["user"] {
+			if each.Role == Owner && owners(memberships) == 1 {
+				return nil, fmt.Errorf("The chart of accounts must have an owner")
+			}
+			if err = c.Db.Execute(func(tdb db.Db) error {
+				if err := MembershipRepository.Delete(tdb, keys[i]); err != nil {
+					return err
+				}
+				return core.Audit(c, tdb, param["coa"], userKey, keys[i].Encode(), each, nil)
+			}); err != nil {
+				return nil, err
+			}
+			return nil, c.Cache.Delete("memberships_" + param["coa"])
+		}
+	}
+	return nil, fmt.Errorf("The user is not a member of the chart of accounts")
+}
+
+// addCreatorAsOwner gives the creator of the chart of accounts the membership of an owner, unless
+// the creator is the user of the grant, saving it with d on behalf of the user granting it.
+func addCreatorAsOwner(c context.Context, d db.Db, coaKey, userKey string, role Role,
+	grantedBy core.UserKey) error {
+	coa, err := ChartOfAccountsRepository.Get(d, coaKey)
+	if err != nil {
+		return err
+	}
+	if coa.User.Encode() == userKey && role != Owner {
+		return fmt.Errorf("The chart of accounts must have an owner")
+	}
+	if db.CKey(coa.User).IsZero() || coa.User.Encode() == userKey {
+		return nil
+	}
+	membership := &Membership{User: coa.User, Role: Owner, AsOf: time.Now()}
+	key, err := MembershipRepository.Save(d, membership, coaKey, nil)
+	if err != nil {
+		return err
+	}
+	return core.Audit(c, d, coaKey, grantedBy, key.Encode(), nil, membership)
+}
+
+func owners(memberships []*Membership) (count int) {
+	for _, m := range memberships {
+		if m.Role == Owner {
+			count++
+		}
+	}
+	return
+}
+
+// chartsOfMember returns the keys of the charts of accounts the user is a member of.
+func chartsOfMember(c context.Context, userKey core.UserKey) (map[string]bool, error) {
+	keys, err := MembershipRepository.Keys(c.Db, "", db.Field("User").Eq(userKey), 0)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]bool{}
+	for _, k := range keys {
+		result[k.Parent().Encode()] = true
+	}
+	return result, nil
+}
+
+// copyMemberships gives the members of a chart of accounts the same roles on another one.
+func copyMemberships(c context.Context, from, to string) error {
+	_, memberships, err := chartMemberships(c, from)
+	if err != nil || len(memberships) == 0 {
+		return err
+	}
+	for _, m := range memberships {
+		m.Key = db.CKey{}
+	}
+	if _, err = MembershipRepository.SaveMulti(c.Db, memberships, to); err != nil {
+		return err
+	}
+	return c.Cache.Delete("memberships_" + to)
+}
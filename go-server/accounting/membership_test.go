@@ -0,0 +1,262 @@
+package accounting
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"testing"
+	"time"
+)
+
+func saveUsers(t *testing.T, c context.Context, logins ...string) (keys []core.UserKey) {
+	for _, login := range logins {
+		if obj, err := core.SaveUser(c, map[string]interface{}{"user": login, "name": login,
+			"password": login}, map[string]string{}, core.NewUserKey()); err != nil {
+			t.Fatal(err)
+		} else {
+			keys = append(keys, core.UserKey(obj.(*core.User).Key))
+		}
+	}
+	return
+}
+
+// initAdmin creates the admin user with the "admin" password.
+func initAdmin(t *testing.T, c context.Context) {
+	t.Setenv(core.AdminPasswordVariable, "admin")
+	if _, err := core.InitUserManagement(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkPermissions(t *testing.T, c context.Context, coaKey string, userKey core.UserKey,
+	expected ...bool) {
+	for p, e := range expected {
+		if ok, err := HasPermission(c, coaKey, userKey, Permission(p)); err != nil {
+			t.Fatal(err)
+		} else if ok != e {
+			t.Errorf("Permission %v of %v must be %v", p, userKey.Encode(), e)
+		}
+	}
+}
+
+func TestMemberships(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	users := saveUsers(t, c, "owner", "member", "other")
+	owner, member, other := users[0], users[1], users[2]
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa"},
+		map[string]string{}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coaKey := obj.(*ChartOfAccounts).Key.Encode()
+	checkPermissions(t, c, coaKey, owner, true, true, true, true)
+	checkPermissions(t, c, coaKey, member, false, false, false, false)
+
+	param := map[string]string{"coa": coaKey, "user": member.Encode()}
+	for _, test := range []struct {
+		role     Role
+		expected []bool
+	}{
+		{Viewer, []bool{true, false, false, false}},
+		{Editor, []bool{true, true, false, false}},
+		{Auditor, []bool{true, false, true, false}},
+		{Controller, []bool{true, true, true, false, true}},
+	} {
+		if _, err = GrantMembership(c, map[string]interface{}{"role": string(test.role)}, param,
+			owner); err != nil {
+			t.Fatal(err)
+		}
+		checkPermissions(t, c, coaKey, member, test.expected...)
+	}
+	if _, err = GrantMembership(c, map[string]interface{}{"role": "boss"}, param,
+		owner); err == nil {
+		t.Error("An unknown role must be rejected")
+	}
+	if obj, err = AllMemberships(c, nil, param, owner); err != nil {
+		t.Fatal(err)
+	} else if memberships := obj.([]*Membership); len(memberships) != 2 {
+		t.Error("2 memberships expected got", len(memberships))
+	}
+
+	for user, expected := range map[core.UserKey]int{member: 1, other: 0} {
+		if obj, err = AllChartsOfAccounts(c, nil, nil, user); err != nil {
+			t.Fatal(err)
+		} else if coas := obj.([]*ChartOfAccounts); len(coas) != expected {
+			t.Errorf("%v charts of accounts expected for %v got %v", expected, user.Encode(),
+				len(coas))
+		}
+	}
+
+	ownerParam := map[string]string{"coa": coaKey, "user": owner.Encode()}
+	if _, err = RevokeMembership(c, nil, ownerParam, owner); err == nil {
+		t.Error("The last owner must not be revoked")
+	}
+	if _, err = GrantMembership(c, map[string]interface{}{"role": "viewer"}, ownerParam,
+		owner); err == nil {
+		t.Error("The last owner must not be demoted")
+	}
+	if _, err = RevokeMembership(c, nil, param, owner); err != nil {
+		t.Fatal(err)
+	}
+	checkPermissions(t, c, coaKey, member, false, false, false, false)
+
+	_, _, admin := core.Login(c, "admin", "admin")
+	checkPermissions(t, c, coaKey, admin, true, true, true, true)
+	if err = Allowed(Read)(c, param, other); err != core.ErrForbidden {
+		t.Error("Forbidden expected got", err)
+	}
+}
+
+func TestMembershipsOfOldCharts(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	users := saveUsers(t, c, "creator", "member")
+	creator, member := users[0], users[1]
+	key, err := ChartOfAccountsRepository.Save(c.Db, &ChartOfAccounts{Name: "coa", User: creator,
+		AsOf: time.Now()}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coaKey := key.Encode()
+	checkPermissions(t, c, coaKey, creator, true, true, true, true)
+	if obj, err := AllChartsOfAccounts(c, nil, nil, creator); err != nil {
+		t.Fatal(err)
+	} else if len(obj.([]*ChartOfAccounts)) != 1 {
+		t.Error("The chart of accounts of the creator expected")
+	}
+	if _, err = GrantMembership(c, map[string]interface{}{"role": "editor"},
+		map[string]string{"coa": coaKey, "user": member.Encode()}, creator); err != nil {
+		t.Fatal(err)
+	}
+	checkPermissions(t, c, coaKey, creator, true, true, true, true)
+	checkPermissions(t, c, coaKey, member, true, true, false, false)
+}
+
+func TestChartsOfOrganizations(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := core.Login(c, "admin", "admin")
+	users := saveUsers(t, c, "owner", "accountant")
+	owner, accountant := users[0], users[1]
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa"},
+		map[string]string{}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coaKey := obj.(*ChartOfAccounts).Key.Encode()
+	if obj, err = core.SaveOrganization(c, map[string]interface{}{"name": "client"},
+		map[string]string{}, admin); err != nil {
+		t.Fatal(err)
+	}
+	client := obj.(*core.Organization).Key.Encode()
+	if _, err = core.AddUserToOrganization(c, nil, map[string]string{"organization": client,
+		"user": accountant.Encode()}, admin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GrantMembership(c, map[string]interface{}{"role": "viewer"},
+		map[string]string{"coa": coaKey, "user": accountant.Encode()}, owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = core.SwitchOrganization(c, map[string]interface{}{"organization": client}, nil,
+		accountant); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveChartOfAccounts(c, map[string]interface{}{"name": "coa2"},
+		map[string]string{}, accountant); err != nil {
+		t.Fatal(err)
+	}
+	for user, expected := range map[core.UserKey]string{owner: "coa", accountant: "coa2"} {
+		if obj, err = AllChartsOfAccounts(c, nil, nil, user); err != nil {
+			t.Fatal(err)
+		} else if coas := obj.([]*ChartOfAccounts); len(coas) != 1 || coas[0].Name != expected {
+			t.Errorf("Only %v expected for %v", expected, user.Encode())
+		}
+	}
+	checkPermissions(t, c, coaKey, accountant, true, false, false, false)
+	def, err := core.DefaultOrganization(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = core.RemoveUserFromOrganization(c, nil, map[string]string{
+		"organization": def.Encode(), "user": accountant.Encode()}, admin); err != nil {
+		t.Fatal(err)
+	}
+	checkPermissions(t, c, coaKey, accountant, false, false, false, false)
+}
+
+func TestMembershipsAcrossCharts(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	var coas [2]*ChartOfAccounts
+	for i := range coas {
+		if coas[i], err = SaveChartOfAccountsSample(c); err != nil {
+			t.Fatal(err)
+		}
+		for _, number := range []string{"1", "2"} {
+			if _, err = SaveAccountSample(c, coas[i], number, number,
+				[]string{"balanceSheet", "debitBalance"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	other, err := SaveAccountSample(c, coas[1], "3", "Other", []string{"balanceSheet",
+		"debitBalance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := SaveTransactionSample(c, coas[1], "1", "2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coaKey := coas[0].Key.Encode()
+	user := core.NewUserKey()
+
+	param := map[string]string{"coa": coaKey, "account": other.Key.Encode()}
+	if _, err = GetAccount(c, nil, param, user); err == nil {
+		t.Error("The account of another chart must not be read")
+	}
+	if _, err = SaveAccount(c, map[string]interface{}{"number": "3", "name": "Changed"}, param,
+		user); err == nil {
+		t.Error("The account of another chart must not be changed")
+	}
+	if _, err = DeleteAccount(c, nil, param, user); err == nil {
+		t.Error("The account of another chart must not be removed")
+	}
+	if a, err := AccountRepository.Get(c.Db, other.Key.Encode()); err != nil {
+		t.Fatal(err)
+	} else if a.Name != "Other" || a.Removed {
+		t.Error("The account of the other chart must be kept", a)
+	}
+
+	param = map[string]string{"coa": coaKey, "transaction": tx.Key.Encode()}
+	if _, err = GetTransaction(c, nil, param, user); err == nil {
+		t.Error("The transaction of another chart must not be read")
+	}
+	if _, err = SaveTransactionSample(c, coas[0], "1", "2", tx.Key.Encode()); err == nil {
+		t.Error("The transaction of another chart must not be changed")
+	}
+	if _, err = DeleteTransaction(c, nil, param, user); err == nil {
+		t.Error("The transaction of another chart must not be deleted")
+	}
+	if _, err = TransactionRepository.Get(c.Db, tx.Key.Encode()); err != nil {
+		t.Error("The transaction of the other chart must be kept", err)
+	}
+}
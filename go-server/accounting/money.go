@@ -0,0 +1,161 @@
+package accounting
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in the minor units of its currency, like cents, so that sums and comparisons
+// are exact. It is informed as a decimal string or number and encoded in JSON as a decimal number,
+// with the scale of the currency: the number of digits after the decimal point.
+type Money int64
+
+// Scales are the scales of the currencies, by ISO 4217 code, whose minor unit is not the cent.
+var Scales = map[string]int{
+	"BHD": 3, "CLP": 0, "IQD": 3, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "LYD": 3,
+	"OMR": 3, "PYG": 0, "TND": 3, "UGX": 0, "VND": 0,
+}
+
+// DefaultScale is the scale of the other currencies, and the one of the amounts of a chart of
+// accounts.
+var DefaultScale = 2
+
+func init() {
+	gob.Register(Money(0))
+}
+
+// Scale returns the scale of the currency.
+func Scale(currency string) int {
+	if s, ok := Scales[strings.ToUpper(currency)]; ok {
+		return s
+	}
+	return DefaultScale
+}
+
+// ParseMoney converts a decimal string, like "-1234.5", to the minor units of a currency of the
+// scale. Amounts with more significant decimal places than the scale are refused, instead of
+// rounded.
+func ParseMoney(s string, scale int) (Money, error) {
+	s = strings.TrimSpace(s)
+	digits := strings.TrimLeft(s, "+-")
+	if len(s)-len(digits) > 1 {
+		return 0, fmt.Errorf("Invalid amount: %v", s)
+	}
+	integer, fraction := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		integer, fraction = digits[:i], digits[i+1:]
+	}
+	if len(integer)+len(fraction) == 0 || !onlyDigits(integer) || !onlyDigits(fraction) {
+		return 0, fmt.Errorf("Invalid amount: %v", s)
+	}
+	if trimmed := strings.TrimRight(fraction, "0"); len(trimmed) > scale {
+		return 0, fmt.Errorf("The amount %v has more than %d decimal places", s, scale)
+	} else {
+		fraction = trimmed + strings.Repeat("0", scale-len(trimmed))
+	}
+	var units int64
+	if len(integer+fraction) > 0 {
+		var err error
+		if units, err = strconv.ParseInt(integer+fraction, 10, 64); err != nil {
+			return 0, fmt.Errorf("Invalid amount: %v", s)
+		}
+	}
+	if strings.HasPrefix(s, "-") {
+		units = -units
+	}
+	return Money(units), nil
+}
+
+func onlyDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MoneyOf converts an amount of a request, a decimal string or a JSON number, to money of the
+// scale. Numbers are converted by their shortest decimal representation, which is the one they
+// were written with, so that 0.1 is 10 cents and not the binary fraction closest to it.
+func MoneyOf(v interface{}, scale int) (Money, error) {
+	switch v := v.(type) {
+	case Money:
+		return v, nil
+	case string:
+		return ParseMoney(v, scale)
+	case json.Number:
+		return ParseMoney(string(v), scale)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, fmt.Errorf("Invalid amount: %v", v)
+		}
+		return ParseMoney(strconv.FormatFloat(v, 'f', -1, 64), scale)
+	}
+	return 0, fmt.Errorf("Invalid amount: %v", v)
+}
+
+// Format returns the decimal string of the money in a currency of the scale.
+func (m Money) Format(scale int) string {
+	units := strconv.FormatInt(int64(m), 10)
+	sign := ""
+	if m < 0 {
+		sign, units = "-", units[1:]
+	}
+	if scale <= 0 {
+		return sign + units
+	}
+	if len(units) <= scale {
+		units = strings.Repeat("0", scale-len(units)+1) + units
+	}
+	return sign + units[:len(units)-scale] + "." + units[len(units)-scale:]
+}
+
+func (m Money) String() string {
+	return m.Format(DefaultScale)
+}
+
+// Abs returns the absolute value of the money.
+func (m Money) Abs() Money {
+	if m < 0 {
+		return -m
+	}
+	return m
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.Format(DefaultScale)), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) (err error) {
+	s := string(b)
+	if unquoted, e := strconv.Unquote(s); e == nil {
+		s = unquoted
+	}
+	*m, err = ParseMoney(s, DefaultScale)
+	return
+}
+
+// ScaledMoney is money with the scale it is encoded in JSON with, like the values of the reports,
+// which are in the currency of the chart of accounts or in the one they are converted to.
+type ScaledMoney struct {
+	Value Money
+	Scale int
+}
+
+// WithScale returns the money with the scale of its currency.
+func (m Money) WithScale(scale int) ScaledMoney {
+	return ScaledMoney{m, scale}
+}
+
+func (m ScaledMoney) String() string {
+	return m.Value.Format(m.Scale)
+}
+
+func (m ScaledMoney) MarshalJSON() ([]byte, error) {
+	return []byte(m.Value.Format(m.Scale)), nil
+}
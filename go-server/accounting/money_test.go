@@ -0,0 +1,81 @@
+package accounting
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	for _, c := range []struct {
+		s     string
+		scale int
+		m     Money
+	}{
+		{"0", 2, 0}, {"1", 2, 100}, {"1.5", 2, 150}, {"-1.05", 2, -105}, {"+.5", 2, 50},
+		{"12.340", 2, 1234}, {"1234", 0, 1234}, {"1.000", 0, 1}, {"1.234", 3, 1234},
+		{"92233720368547758.07", 2, 9223372036854775807},
+	} {
+		if m, err := ParseMoney(c.s, c.scale); err != nil || m != c.m {
+			t.Errorf("%v with scale %v must be %d, but was %d %v", c.s, c.scale, c.m, m, err)
+		}
+	}
+	for _, s := range []string{"", "-", ".", "1.2.3", "1e2", "--1", "1,5", "0.001",
+		"92233720368547758.08"} {
+		if m, err := ParseMoney(s, 2); err == nil {
+			t.Errorf("%q must be refused, but was %d", s, m)
+		}
+	}
+}
+
+func TestMoneyOf(t *testing.T) {
+	for _, v := range []interface{}{0.1 + 0.2 - 0.2, "0.10", json.Number("0.1"), Money(10)} {
+		if m, err := MoneyOf(v, 2); err != nil || m != 10 {
+			t.Errorf("%v must be 10 cents, but was %d %v", v, m, err)
+		}
+	}
+	if m, err := MoneyOf(1.005, 2); err == nil {
+		t.Error("1.005 must be refused, but was", m)
+	}
+	if m, err := MoneyOf(true, 2); err == nil {
+		t.Error("A bool must be refused, but was", m)
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	for _, c := range []struct {
+		m     Money
+		scale int
+		s     string
+	}{
+		{0, 2, "0.00"}, {5, 2, "0.05"}, {-5, 2, "-0.05"}, {-12345, 2, "-123.45"}, {7, 0, "7"},
+		{1234, 3, "1.234"},
+	} {
+		if s := c.m.Format(c.scale); s != c.s {
+			t.Errorf("%d with scale %v must be %v, but was %v", c.m, c.scale, c.s, s)
+		}
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(`{"value":"10.1"}`), &entry); err != nil ||
+		entry.Value != 1010 {
+		t.Error("Entry's value must be 1010, but was", int64(entry.Value), err)
+	}
+	if b, err := json.Marshal(entry); err != nil || !strings.Contains(string(b), `"value":10.10}`) {
+		t.Error("Unexpected JSON", string(b), err)
+	}
+	entry = Entry{Value: 1000, Currency: "JPY", Amount: 1234}
+	b, err := json.Marshal(entry)
+	if err != nil || !strings.Contains(string(b), `"amount":1234}`) {
+		t.Error("Unexpected JSON", string(b), err)
+	}
+	var decoded Entry
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded != entry {
+		t.Errorf("Entry must be decoded as %+v, but was %+v %v", entry, decoded, err)
+	}
+	if err := json.Unmarshal([]byte(`{"currency":"JPY","amount":"12.5"}`), &decoded); err == nil {
+		t.Error("Amounts of JPY with decimal places must be refused")
+	}
+	if Scale("jpy") != 0 || Scale("BRL") != 2 {
+		t.Error("JPY has no minor unit and BRL has cents")
+	}
+}
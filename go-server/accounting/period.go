@@ -0,0 +1,233 @@
+package accounting
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+)
+
+// PeriodStatus tells which changes are allowed to the transactions dated in a fiscal period.
+type PeriodStatus string
+
+const (
+	// Open periods allow every change.
+	Open PeriodStatus = "open"
+	// SoftClosed periods only allow the changes of the users with the Override permission.
+	SoftClosed PeriodStatus = "soft-closed"
+	// Closed periods allow no change, until they are opened again.
+	Closed PeriodStatus = "closed"
+)
+
+// A FiscalPeriod is a range of dates of a chart of accounts, like a fiscal year, from Start to End,
+// both inclusive. The transactions dated in the periods that are not open cannot be created,
+// changed or deleted, so that the books of a period stay as they were filed.
+type FiscalPeriod struct {
+	db.Identifiable
+	Name   string       `json:"name"`
+	Start  time.Time    `json:"start"`
+	End    time.Time    `json:"end"`
+	Status PeriodStatus `json:"status"`
+	User   core.UserKey `json:"user"`
+	AsOf   time.Time    `json:"timestamp"`
+	// ClosingTransaction is the key of the transaction that closed the income statement accounts
+	// of the period into the retained earnings account, if it was closed.
+	ClosingTransaction string `json:"closingTransaction,omitempty"`
+}
+
+var FiscalPeriodRepository = db.NewRepository[FiscalPeriod]("FiscalPeriod")
+
+func init() {
+	gob.Register((*FiscalPeriod)(nil))
+	gob.Register(([]*FiscalPeriod)(nil))
+}
+
+func (period *FiscalPeriod) ValidationMessage(_ db.Db, _ map[string]string) string {
+	if len(strings.TrimSpace(period.Name)) == 0 {
+		return "The name must be informed"
+	}
+	if period.Start.IsZero() || period.End.IsZero() {
+		return "The start and the end must be informed"
+	}
+	if period.End.Before(period.Start) {
+		return "The end must not be before the start"
+	}
+	if period.Status != Open && period.Status != SoftClosed && period.Status != Closed {
+		return "The status must be open, soft-closed or closed"
+	}
+	return ""
+}
+
+// Contains tells whether the date is in the period, whatever its time of the day.
+func (period *FiscalPeriod) Contains(date time.Time) bool {
+	return !date.Before(period.Start) && date.Before(period.End.AddDate(0, 0, 1))
+}
+
+func fiscalPeriods(c context.Context, coaKey string) (db.Keys, []*FiscalPeriod, error) {
+	return FiscalPeriodRepository.GetAllFromCache(c.Db, coaKey, nil, nil, c.Cache,
+		"periods_"+coaKey)
+}
+
+// checkPeriods returns an error if the transactions dated at the dates cannot be changed by the
+// user, because they are in a closed period, or in a soft-closed one and the user cannot override
+// it. The periods are read with d, the database of the transaction in which the transactions are
+// changed, instead of from the cache, so that no period is closed between the check and the
+// change.
+func checkPeriods(c context.Context, d db.Db, coaKey string, userKey core.UserKey,
+	dates ...time.Time) error {
+	c.Db = d
+	_, periods, err := FiscalPeriodRepository.GetAll(d, coaKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	for _, p := range periods {
+		for _, d := range dates {
+			if !p.Contains(d) {
+				continue
+			}
+			switch p.Status {
+			case Closed:
+				return fmt.Errorf("The period %v is closed", p.Name)
+			case SoftClosed:
+				if ok, err := HasPermission(c, coaKey, userKey, Override); err != nil {
+					return err
+				} else if !ok {
+					return fmt.Errorf("The period %v is soft-closed", p.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// AllFiscalPeriods returns the fiscal periods of the chart of accounts, in the order of their
+// dates.
+func AllFiscalPeriods(c context.Context, _ map[string]interface{}, param map[string]string,
+	_ core.UserKey) (interface{}, error) {
+	keys, periods, err := fiscalPeriods(c, param["coa"])
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range periods {
+		p.SetKey(keys.KeyAt(i))
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Start.Before(periods[j].Start) })
+	return periods, nil
+}
+
+// SaveFiscalPeriod creates a fiscal period with the name, start, end, as in 2014-12-31, and
+// status of the request, open if not informed, or changes the name and status of the period of
+// the "period" param. The dates of a period do not change, and periods do not overlap.
+func SaveFiscalPeriod(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey core.UserKey) (interface{}, error) {
+	period := &FiscalPeriod{Status: Open, User: userKey, AsOf: time.Now()}
+	period.Name, _ = m["name"].(string)
+	var before *FiscalPeriod
+	if _, ok := param["period"]; ok {
+		var err error
+		if before, err = fiscalPeriod(c, param); err != nil {
+			return nil, err
+		}
+		period.SetKey(before.Key)
+		period.Start, period.End, period.Status = before.Start, before.End, before.Status
+		period.ClosingTransaction = before.ClosingTransaction
+		if _, ok := m["name"]; !ok {
+			period.Name = before.Name
+		}
+	} else {
+		for _, k := range []string{"start", "end"} {
+			s, _ := m[k].(string)
+			date, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return nil, fmt.Errorf("The %v must be a date like 2014-12-31", k)
+			}
+			if k == "start" {
+				period.Start = date
+			} else {
+				period.End = date
+			}
+		}
+	}
+	if status, ok := m["status"].(string); ok {
+		period.Status = PeriodStatus(status)
+	}
+	if message := period.ValidationMessage(c.Db, param); len(message) > 0 {
+		return nil, errors.New(message)
+	}
+	// The periods are read in the transaction that saves the new one, so that periods created
+	// concurrently can't overlap.
+	err := c.Db.Execute(func(tdb db.Db) error {
+		if before == nil {
+			_, periods, err := FiscalPeriodRepository.GetAll(tdb, param["coa"], nil, nil)
+			if err != nil {
+				return err
+			}
+			for _, p := range periods {
+				if !p.Start.After(period.End) && !period.Start.After(p.End) {
+					return fmt.Errorf("The period overlaps %v", p.Name)
+				}
+			}
+		}
+		return saveFiscalPeriod(c, tdb, param["coa"], userKey, before, period)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return period, nil
+}
+
+// fiscalPeriod returns the fiscal period of the "period" param.
+func fiscalPeriod(c context.Context, param map[string]string) (*FiscalPeriod, error) {
+	keys, periods, err := fiscalPeriods(c, param["coa"])
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range periods {
+		if keys.KeyAt(i).Encode() == param["period"] {
+			p.SetKey(keys.KeyAt(i))
+			return p, nil
+		}
+	}
+	return nil, errors.New("Fiscal period not found")
+}
+
+// saveFiscalPeriod saves the period with d, which was before, if not nil, and audits the change.
+func saveFiscalPeriod(c context.Context, d db.Db, coaKey string, userKey core.UserKey,
+	before, period *FiscalPeriod) error {
+	key, err := FiscalPeriodRepository.Save(d, period, coaKey, nil)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		err = core.Audit(c, d, coaKey, userKey, key.Encode(), nil, period)
+	} else {
+		err = core.Audit(c, d, coaKey, userKey, key.Encode(), before, period)
+	}
+	if err != nil {
+		return err
+	}
+	period.SetKey(key)
+	return c.Cache.Delete("periods_" + coaKey)
+}
+
+// copyFiscalPeriods gives a chart of accounts the fiscal periods of another one.
+func copyFiscalPeriods(c context.Context, from, to string) error {
+	_, periods, err := fiscalPeriods(c, from)
+	if err != nil || len(periods) == 0 {
+		return err
+	}
+	for _, p := range periods {
+		p.Key = db.CKey{}
+		p.ClosingTransaction = ""
+	}
+	if _, err = FiscalPeriodRepository.SaveMulti(c.Db, periods, to); err != nil {
+		return err
+	}
+	return c.Cache.Delete("periods_" + to)
+}
@@ -0,0 +1,317 @@
+package accounting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"mcesar.io/deb"
+)
+
+// appendCounter is a space that only counts the appends.
+type appendCounter struct {
+	deb.Space
+	appends int
+}
+
+func (s *appendCounter) Append(deb.Space) error {
+	s.appends++
+	return nil
+}
+
+// popCounter is a space whose single transaction is dated the day, and that only counts the pops.
+type popCounter struct {
+	deb.Space
+	day  time.Time
+	pops int
+}
+
+func (s *popCounter) Transactions() (chan *deb.Transaction, chan error) {
+	ch, errc := make(chan *deb.Transaction, 1), make(chan error, 1)
+	ch <- &deb.Transaction{Moment: 1, Date: SerializedDate(s.day)}
+	close(ch)
+	errc <- nil
+	return ch, errc
+}
+
+func (s *popCounter) Pop() (int32, []int64, error) {
+	s.pops++
+	return int32(SerializedDate(s.day)), nil, nil
+}
+
+func TestFiscalPeriods(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := core.Login(c, "admin", "admin")
+	users := saveUsers(t, c, "owner", "editor", "controller")
+	owner, editor, controller := users[0], users[1], users[2]
+	obj, err := SaveChartOfAccounts(c, map[string]interface{}{"name": "coa"},
+		map[string]string{}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coa := obj.(*ChartOfAccounts)
+	coaKey := coa.Key.Encode()
+	for i, role := range []Role{Editor, Controller} {
+		if _, err = GrantMembership(c, map[string]interface{}{"role": string(role)},
+			map[string]string{"coa": coaKey, "user": users[i+1].Encode()}, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = SaveAccountSample(c, coa, "1", "a1", []string{"balanceSheet", "debitBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveAccountSample(c, coa, "2", "a2", []string{"balanceSheet", "creditBalance"}); err != nil {
+		t.Fatal(err)
+	}
+
+	param := map[string]string{"coa": coaKey}
+	obj, err = SaveFiscalPeriod(c, map[string]interface{}{"name": "2014", "start": "2014-01-01",
+		"end": "2014-12-31"}, param, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	period := obj.(*FiscalPeriod)
+	if period.Status != Open {
+		t.Error("A new period must be open, but was", period.Status)
+	}
+	for _, m := range []map[string]interface{}{
+		{"name": "overlap", "start": "2014-12-31", "end": "2015-12-31"},
+		{"name": "backwards", "start": "2015-12-31", "end": "2015-01-01"},
+		{"name": "unknown", "start": "2015-01-01", "end": "2015-12-31", "status": "locked"},
+		{"name": "undated"},
+	} {
+		if _, err = SaveFiscalPeriod(c, m, param, owner); err == nil {
+			t.Error("The period must be refused", m)
+		}
+	}
+
+	save := func(date, tx string, userKey core.UserKey, space deb.Space) (*Transaction, error) {
+		m := map[string]interface{}{"memo": "m", "date": date + "T00:00:00Z",
+			"debits":  []interface{}{map[string]interface{}{"account": "1", "value": "1"}},
+			"credits": []interface{}{map[string]interface{}{"account": "2", "value": "1"}}}
+		if space != nil {
+			m["space"] = space
+		}
+		param := map[string]string{"coa": coaKey}
+		if len(tx) > 0 {
+			param["transaction"] = tx
+		}
+		obj, err := SaveTransaction(c, []map[string]interface{}{m}, param, userKey)
+		if err != nil {
+			return nil, err
+		}
+		return obj.(*Transaction), nil
+	}
+	filed, err := save("2014-05-01", "", editor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := save("2015-01-01", "", editor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	periodParam := map[string]string{"coa": coaKey, "period": period.Key.Encode()}
+	if obj, err = SaveFiscalPeriod(c, map[string]interface{}{"status": "soft-closed"},
+		periodParam, owner); err != nil {
+		t.Fatal(err)
+	}
+	if p := obj.(*FiscalPeriod); p.Name != "2014" || p.Status != SoftClosed ||
+		!p.End.Equal(period.End) {
+		t.Error("Only the status must change", p)
+	}
+	if _, err = save("2014-12-31", "", editor, nil); err == nil {
+		t.Error("An editor must not post in a soft-closed period")
+	}
+	if _, err = save("2014-05-01", later.Key.Encode(), editor, nil); err == nil {
+		t.Error("A transaction must not be moved into a soft-closed period")
+	}
+	for _, userKey := range []core.UserKey{controller, owner, admin} {
+		if _, err = save("2014-12-31", "", userKey, nil); err != nil {
+			t.Error("The override must allow posting in a soft-closed period", err)
+		}
+	}
+
+	if _, err = SaveFiscalPeriod(c, map[string]interface{}{"status": "closed"}, periodParam,
+		owner); err != nil {
+		t.Fatal(err)
+	}
+	for _, userKey := range []core.UserKey{editor, controller, admin} {
+		if _, err = save("2014-05-02", "", userKey, nil); err == nil {
+			t.Error("Nobody must post in a closed period")
+		}
+	}
+	if _, err = save("2015-01-02", filed.Key.Encode(), admin, nil); err == nil {
+		t.Error("A transaction must not be moved out of a closed period")
+	}
+	if _, err = DeleteTransaction(c, map[string]interface{}{}, map[string]string{
+		"coa": coaKey, "transaction": filed.Key.Encode()}, admin); err == nil {
+		t.Error("A transaction of a closed period must not be deleted")
+	}
+	if _, err = DeleteTransaction(c, map[string]interface{}{}, map[string]string{
+		"coa": coaKey, "transaction": later.Key.Encode()}, editor); err != nil {
+		t.Error("The transactions of open periods may be deleted", err)
+	}
+	space := &appendCounter{}
+	if _, err = save("2014-05-02", "", admin, space); err == nil || space.appends > 0 {
+		t.Error("Nobody must post in a closed period kept in a space", err)
+	}
+	if _, err = SaveTransactions(c, []map[string]interface{}{
+		{"memo": "m", "date": "2015-01-01T00:00:00Z", "space": space,
+			"debits":  []interface{}{map[string]interface{}{"account": "1", "value": "1"}},
+			"credits": []interface{}{map[string]interface{}{"account": "2", "value": "1"}}},
+		{"memo": "m", "date": "2014-01-01T00:00:00Z", "space": space,
+			"debits":  []interface{}{map[string]interface{}{"account": "1", "value": "1"}},
+			"credits": []interface{}{map[string]interface{}{"account": "2", "value": "1"}}},
+	}, param, admin); err == nil || space.appends > 0 {
+		t.Error("A batch with a transaction of a closed period must be refused", err)
+	}
+	popped := &popCounter{day: filed.Date}
+	if _, err = PopTransaction(c, map[string]interface{}{"space": popped}, param,
+		admin); err == nil || popped.pops > 0 {
+		t.Error("The last transaction of a closed period must not be popped", err)
+	}
+	popped.day = later.Date
+	if _, err = PopTransaction(c, map[string]interface{}{"space": popped}, param,
+		admin); err != nil || popped.pops != 1 {
+		t.Error("The last transaction of an open period may be popped", err)
+	}
+
+	if _, err = SaveFiscalPeriod(c, map[string]interface{}{"status": "open"}, periodParam,
+		owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = save("2014-05-02", "", editor, nil); err != nil {
+		t.Error("A reopened period must allow posting", err)
+	}
+	obj, err = AllFiscalPeriods(c, nil, param, editor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if periods := obj.([]*FiscalPeriod); len(periods) != 1 || periods[0].Status != Open {
+		t.Error("The period must be listed", periods)
+	}
+}
+
+// closingDb closes the period right before each transaction, as a closing committed between the
+// check of the periods and the change of the transactions would.
+type closingDb struct {
+	db.Db
+	coaKey string
+	period *FiscalPeriod
+}
+
+func (d closingDb) Execute(f func(db.Db) error) error {
+	d.period.Status = Closed
+	if _, err := FiscalPeriodRepository.Save(d.Db, d.period, d.coaKey, nil); err != nil {
+		return err
+	}
+	return d.Db.Execute(f)
+}
+
+func TestFiscalPeriodsClosedAfterCheck(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	coa, err := SaveChartOfAccountsSample(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveAccountSample(c, coa, "1", "a1", []string{"balanceSheet", "debitBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveAccountSample(c, coa, "2", "a2", []string{"balanceSheet", "creditBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := SaveTransactionSample(c, coa, "1", "2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coaKey := coa.Key.Encode()
+	obj, err := SaveFiscalPeriod(c, map[string]interface{}{"name": "2014", "start": "2014-01-01",
+		"end": "2014-12-31"}, map[string]string{"coa": coaKey}, core.NewUserKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	period := obj.(*FiscalPeriod)
+	cc := c
+	cc.Db = closingDb{c.Db, coaKey, period}
+	if _, err = SaveTransactionSample(cc, coa, "1", "2", ""); err == nil {
+		t.Error("Nobody must post in a period closed after it was checked")
+	}
+	period.Status = Open
+	if _, err = FiscalPeriodRepository.Save(c.Db, period, coaKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = DeleteTransaction(cc, map[string]interface{}{}, map[string]string{
+		"coa": coaKey, "transaction": tx.Key.Encode()}, core.NewUserKey()); err == nil {
+		t.Error("A transaction of a period closed after it was checked must not be deleted")
+	}
+}
+
+// creatingDb creates the period right before each transaction, as a period created concurrently
+// between the check of the overlaps and the save of a new period would.
+type creatingDb struct {
+	db.Db
+	coaKey string
+	period *FiscalPeriod
+}
+
+func (d creatingDb) Execute(f func(db.Db) error) error {
+	if _, err := FiscalPeriodRepository.Save(d.Db, d.period, d.coaKey, nil); err != nil {
+		return err
+	}
+	return d.Db.Execute(f)
+}
+
+func TestFiscalPeriodCreatedAfterCheck(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	coa, err := SaveChartOfAccountsSample(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coaKey := coa.Key.Encode()
+	_, entries, err := core.AuditEntryRepository.GetAll(c.Db, coaKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audited := len(entries)
+	cc := c
+	cc.Db = creatingDb{c.Db, coaKey, &FiscalPeriod{Name: "2014", Status: Open,
+		Start: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2014, 12, 31, 0, 0, 0, 0, time.UTC)}}
+	if _, err = SaveFiscalPeriod(cc, map[string]interface{}{"name": "2014b",
+		"start": "2014-07-01", "end": "2015-06-30"}, map[string]string{"coa": coaKey},
+		core.NewUserKey()); err == nil {
+		t.Error("A period overlapping one created after the check must be refused")
+	}
+	_, periods, err := FiscalPeriodRepository.GetAll(c.Db, coaKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(periods) != 1 {
+		t.Error("Only the period created first must be kept, but were", len(periods))
+	}
+	if _, entries, err = core.AuditEntryRepository.GetAll(c.Db, coaKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != audited {
+		t.Error("The refused period must not be audited, but were", len(entries)-audited)
+	}
+}
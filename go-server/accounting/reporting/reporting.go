@@ -1,9 +1,9 @@
 package reporting
 
 import (
+	"encoding/json"
 	"fmt"
 
-	"math"
 	"sort"
 	"strings"
 	"time"
@@ -36,7 +36,7 @@ func Balance(c context.Context, m map[string]interface{}, param map[string]strin
 	space, ok := m["space"].(deb.Space)
 	if !ok {
 		b, err := accounting.Balances(c, param["coa"], from, to,
-			map[string]interface{}{"Tags =": "balanceSheet"})
+			db.Field("Tags").Eq("balanceSheet"))
 		if err != nil {
 			return nil, err
 		}
@@ -66,7 +66,7 @@ func Balance(c context.Context, m map[string]interface{}, param map[string]strin
 			for k, v := range t.Entries {
 				account := sortedAccounts[k-1]
 				if collections.Contains(account.Tags, "balanceSheet") {
-					value := float64(v) / 100
+					value := accounting.Money(v)
 					if collections.Contains(account.Tags, "creditBalance") {
 						value = -value
 					}
@@ -87,7 +87,7 @@ func Balance(c context.Context, m map[string]interface{}, param map[string]strin
 				collections.Contains(sortedAccounts[i].Tags, "balanceSheet") {
 				accountsInserted[k.Encode()] = len(arr)
 				arr = append(arr,
-					db.M{"account": accountToMap(k, sortedAccounts[i]), "value": float64(0)})
+					db.M{"account": accountToMap(k, sortedAccounts[i]), "value": accounting.Money(0)})
 			}
 		}
 		lookupAccount := func(key db.Key) *accounting.Account {
@@ -105,7 +105,7 @@ func Balance(c context.Context, m map[string]interface{}, param map[string]strin
 			p := v.Parent
 			for !p.IsZero() {
 				idx := accountsInserted[p.Encode()]
-				value := arr[accountsInserted[k]]["value"].(float64)
+				value := arr[accountsInserted[k]]["value"].(accounting.Money)
 				if a := lookupAccount(p); a != nil {
 					if (collections.Contains(a.Tags, "creditBalance") &&
 						collections.Contains(v.Tags, "debitBalance")) ||
@@ -115,7 +115,7 @@ func Balance(c context.Context, m map[string]interface{}, param map[string]strin
 					}
 					p = a.Parent
 				}
-				arr[idx]["value"] = arr[idx]["value"].(float64) + value
+				arr[idx]["value"] = arr[idx]["value"].(accounting.Money) + value
 			}
 		}
 		less := func(m1, m2 db.M) bool {
@@ -125,6 +125,17 @@ func Balance(c context.Context, m map[string]interface{}, param map[string]strin
 		}
 		sort.Sort(sorter{arr, less})
 	}
+	convert, scale, err := accounting.Converter(c, param, to)
+	if err != nil {
+		return
+	}
+	for _, e := range arr {
+		value, err := convert(e["value"].(accounting.Money))
+		if err != nil {
+			return nil, err
+		}
+		e["value"] = value.WithScale(scale)
+	}
 	result = arr
 	return
 }
@@ -141,6 +152,11 @@ func Journal(c context.Context, m map[string]interface{}, param map[string]strin
 		return
 	}
 
+	limit, cursor, err := db.PageParams(param)
+	if err != nil {
+		return
+	}
+
 	accountKeys, accounts, err := accounting.Accounts(c, param["coa"], nil)
 	if err != nil {
 		return
@@ -150,10 +166,11 @@ func Journal(c context.Context, m map[string]interface{}, param map[string]strin
 
 	var transactions []*accounting.Transaction
 	var transactionKeys []interface{}
+	var next string
 	if !ok {
 		var keys db.Keys
-		keys, transactions, err = accounting.Transactions(c, param["coa"],
-			map[string]interface{}{"Date >=": from, "Date <=": to})
+		keys, transactions, next, err = accounting.Transactions(c, param["coa"],
+			db.And(db.Field("Date").Ge(from), db.Field("Date").Le(to)), limit, cursor)
 		if err != nil {
 			return nil, err
 		}
@@ -173,6 +190,11 @@ func Journal(c context.Context, m map[string]interface{}, param map[string]strin
 		if err != nil {
 			return nil, err
 		}
+		var start, end int
+		if start, end, next, err = page(transactionKeys, limit, cursor); err != nil {
+			return nil, err
+		}
+		transactions, transactionKeys = transactions[start:end], transactionKeys[start:end]
 	}
 
 	accountsMap := map[string]*accounting.Account{}
@@ -180,34 +202,51 @@ func Journal(c context.Context, m map[string]interface{}, param map[string]strin
 		accountsMap[accountKeys.KeyAt(i).String()] = a
 	}
 
+	convert, scale, err := accounting.Converter(c, param, to)
+	if err != nil {
+		return
+	}
+
 	resultMap := []map[string]interface{}{}
 
-	addEntries := func(entries []accounting.Entry) (result []map[string]interface{}) {
+	addEntries := func(entries []accounting.Entry) (result []map[string]interface{}, err error) {
 		for _, e := range entries {
 			account := accountsMap[e.Account.String()]
+			value, err := convert(e.Value)
+			if err != nil {
+				return nil, err
+			}
 			result = append(result, map[string]interface{}{
 				"account": map[string]interface{}{
 					"number": account.Number,
 					"name":   account.Name,
 				},
-				"value": e.Value,
+				"value": value.WithScale(scale),
 			})
 		}
 		return
 	}
 
 	for i, t := range transactions {
+		debits, err := addEntries(t.Debits)
+		if err != nil {
+			return nil, err
+		}
+		credits, err := addEntries(t.Credits)
+		if err != nil {
+			return nil, err
+		}
 		m := map[string]interface{}{
 			"_id":     transactionKeys[i],
 			"date":    t.Date,
 			"memo":    t.Memo,
-			"debits":  addEntries(t.Debits),
-			"credits": addEntries(t.Credits),
+			"debits":  debits,
+			"credits": credits,
 		}
 		resultMap = append(resultMap, m)
 	}
 
-	result = resultMap
+	result = db.Paged(param, resultMap, next)
 
 	return
 }
@@ -224,6 +263,11 @@ func Ledger(c context.Context, m map[string]interface{}, param map[string]string
 		return
 	}
 
+	limit, cursor, err := db.PageParams(param)
+	if err != nil {
+		return
+	}
+
 	accountKeys, accounts, err := accounting.Accounts(c, param["coa"], nil)
 	if err != nil {
 		return
@@ -244,7 +288,7 @@ func Ledger(c context.Context, m map[string]interface{}, param map[string]string
 	}
 
 	var transactions []*accounting.TransactionWithValue
-	var balance float64
+	var balance accounting.Money
 	space, ok := m["space"].(deb.Space)
 	if !ok {
 		transactions, balance, err =
@@ -270,7 +314,7 @@ func Ledger(c context.Context, m map[string]interface{}, param map[string]string
 		}
 		ch, errc := balanceSpace.Transactions()
 		for t := range ch {
-			balance = float64(t.Entries[accountIndex]) / 100
+			balance = accounting.Money(t.Entries[accountIndex])
 		}
 		if err = <-errc; err != nil {
 			return nil, err
@@ -294,6 +338,19 @@ func Ledger(c context.Context, m map[string]interface{}, param map[string]string
 			account)
 	}
 
+	convert, scale, err := accounting.Converter(c, param, to)
+	if err != nil {
+		return
+	}
+	if balance, err = convert(balance); err != nil {
+		return
+	}
+	for _, t := range transactions {
+		if t.Value, err = convert(t.Value); err != nil {
+			return
+		}
+	}
+
 	resultEntries := []interface{}{}
 	runningBalance := balance
 	addEntries := func(t *accounting.TransactionWithValue, entries []accounting.Entry,
@@ -312,9 +369,9 @@ func Ledger(c context.Context, m map[string]interface{}, param map[string]string
 			"_id":     t.Key,
 			"date":    t.Date,
 			"memo":    t.Memo,
-			"balance": runningBalance,
+			"balance": runningBalance.WithScale(scale),
 		}
-		entryMap[kind] = math.Abs(t.Value)
+		entryMap[kind] = t.Value.Abs().WithScale(scale)
 		counterpart := map[string]interface{}{}
 		entryMap["counterpart"] = counterpart
 		if len(counterpartEntries) == 1 {
@@ -333,15 +390,61 @@ func Ledger(c context.Context, m map[string]interface{}, param map[string]string
 		addEntries(t, t.Credits, t.Debits, "credit")
 	}
 
-	result = map[string]interface{}{
-		"account": accountToMap(account.Key, account),
-		"entries": resultEntries,
-		"balance": balance,
+	// The running balances depend on every previous entry, so the entries are paged only after
+	// they are computed.
+	entryKeys := make([]interface{}, len(resultEntries))
+	for i, e := range resultEntries {
+		entryKeys[i] = e.(map[string]interface{})["_id"]
 	}
+	start, end, next, err := page(entryKeys, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	result = db.Paged(param, map[string]interface{}{
+		"account": accountToMap(account.Key, account),
+		"entries": resultEntries[start:end],
+		"balance": balance.WithScale(scale),
+	}, next)
 
 	return
 }
 
+// page returns the range of the items of a page computed in memory, which starts after the last
+// item whose key is the cursor, and the cursor of the next page. Items with the same key, like the
+// debit and credit entries of a transaction in a ledger, are kept in the same page.
+func page(keys []interface{}, limit int, cursor string) (start, end int, next string, err error) {
+	if len(cursor) > 0 {
+		start = -1
+		for i, k := range keys {
+			if keyAsString(k) == cursor {
+				start = i + 1
+			}
+		}
+		if start < 0 {
+			return 0, 0, "", fmt.Errorf("Invalid cursor: %v", cursor)
+		}
+	}
+	end = len(keys)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+		for end < len(keys) && keyAsString(keys[end]) == keyAsString(keys[end-1]) {
+			end++
+		}
+		if end < len(keys) {
+			next = keyAsString(keys[end-1])
+		}
+	}
+	return
+}
+
+func keyAsString(key interface{}) string {
+	if k, ok := key.(db.Key); ok {
+		return k.Encode()
+	}
+	return fmt.Sprint(key)
+}
+
 func IncomeStatement(c context.Context, m map[string]interface{}, param map[string]string,
 	_ core.UserKey) (result interface{}, err error) {
 	from, err := time.Parse(time.RFC3339, param["from"]+"T00:00:00Z")
@@ -376,7 +479,7 @@ func IncomeStatement(c context.Context, m map[string]interface{}, param map[stri
 	var balances []db.M
 	if !ok {
 		balances, err = accounting.Balances(c, param["coa"], from, to,
-			map[string]interface{}{"Tags =": "incomeStatement"})
+			db.Field("Tags").Eq("incomeStatement"))
 		if err != nil {
 			return nil, err
 		}
@@ -409,7 +512,7 @@ func IncomeStatement(c context.Context, m map[string]interface{}, param map[stri
 				account := sortedAccounts[k-1]
 				account.Key = sortedKeys[k-1]
 				if collections.Contains(account.Tags, "incomeStatement") {
-					value := float64(v) / 100
+					value := accounting.Money(v)
 					if collections.Contains(account.Tags, "creditBalance") {
 						value = -value
 					}
@@ -439,37 +542,51 @@ func IncomeStatement(c context.Context, m map[string]interface{}, param map[stri
 		}
 	}
 
-	type entryType struct {
-		Balance float64       `json:"balance"`
-		Details []interface{} `json:"details"`
+	if err = accounting.ExcludeClosings(c, m, param["coa"], from, to, balances); err != nil {
+		return
+	}
+
+	convert, scale, err := accounting.Converter(c, param, to)
+	if err != nil {
+		return
+	}
+	for _, b := range balances {
+		if b["value"], err = convert(b["value"].(accounting.Money)); err != nil {
+			return
+		}
 	}
+
 	type resultType struct {
-		GrossRevenue          *entryType `json:"grossRevenue"`
-		Deduction             *entryType `json:"deduction"`
-		SalesTax              *entryType `json:"salesTax"`
-		NetRevenue            *entryType `json:"netRevenue"`
-		Cost                  *entryType `json:"cost"`
-		GrossProfit           *entryType `json:"grossProfit"`
-		OperatingExpense      *entryType `json:"operatingExpense"`
-		NetOperatingIncome    *entryType `json:"netOperatingIncome"`
-		NonOperatingRevenue   *entryType `json:"nonOperatingRevenue"`
-		NonOperatingExpense   *entryType `json:"nonOperatingExpense"`
-		NonOperatingTax       *entryType `json:"nonOperatingTax"`
-		IncomeBeforeIncomeTax *entryType `json:"incomeBeforeIncomeTax"`
-		IncomeTax             *entryType `json:"incomeTax"`
-		Dividends             *entryType `json:"dividends"`
-		NetIncome             *entryType `json:"netIncome"`
+		GrossRevenue          *incomeStatementEntry `json:"grossRevenue"`
+		Deduction             *incomeStatementEntry `json:"deduction"`
+		SalesTax              *incomeStatementEntry `json:"salesTax"`
+		NetRevenue            *incomeStatementEntry `json:"netRevenue"`
+		Cost                  *incomeStatementEntry `json:"cost"`
+		GrossProfit           *incomeStatementEntry `json:"grossProfit"`
+		OperatingExpense      *incomeStatementEntry `json:"operatingExpense"`
+		NetOperatingIncome    *incomeStatementEntry `json:"netOperatingIncome"`
+		NonOperatingRevenue   *incomeStatementEntry `json:"nonOperatingRevenue"`
+		NonOperatingExpense   *incomeStatementEntry `json:"nonOperatingExpense"`
+		NonOperatingTax       *incomeStatementEntry `json:"nonOperatingTax"`
+		IncomeBeforeIncomeTax *incomeStatementEntry `json:"incomeBeforeIncomeTax"`
+		IncomeTax             *incomeStatementEntry `json:"incomeTax"`
+		Dividends             *incomeStatementEntry `json:"dividends"`
+		NetIncome             *incomeStatementEntry `json:"netIncome"`
 	}
 
 	var resultTyped resultType
 
-	addBalance := func(entry *entryType, balance map[string]interface{}) *entryType {
+	newEntry := func(balance accounting.Money) *incomeStatementEntry {
+		return &incomeStatementEntry{Balance: balance, scale: scale}
+	}
+
+	addBalance := func(entry *incomeStatementEntry, balance map[string]interface{}) *incomeStatementEntry {
 		if collections.Contains(balance["account"].(*accounting.Account).Tags, "analytic") &&
-			balance["value"].(float64) > 0 {
+			balance["value"].(accounting.Money) > 0 {
 			if entry == nil {
-				entry = &entryType{}
+				entry = newEntry(0)
 			}
-			entry.Balance += balance["value"].(float64)
+			entry.Balance += balance["value"].(accounting.Money)
 			entry.Details = append(entry.Details, balance)
 		}
 		return entry
@@ -519,8 +636,8 @@ func IncomeStatement(c context.Context, m map[string]interface{}, param map[stri
 		}
 	}
 
-	ze := &entryType{}
-	z := func(e *entryType) *entryType {
+	ze := newEntry(0)
+	z := func(e *incomeStatementEntry) *incomeStatementEntry {
 		if e == nil {
 			return ze
 		} else {
@@ -528,22 +645,17 @@ func IncomeStatement(c context.Context, m map[string]interface{}, param map[stri
 		}
 	}
 
-	resultTyped.NetRevenue = &entryType{
-		Balance: z(resultTyped.GrossRevenue).Balance - z(resultTyped.Deduction).Balance -
-			z(resultTyped.SalesTax).Balance}
-	resultTyped.GrossProfit = &entryType{
-		Balance: z(resultTyped.NetRevenue).Balance -
-			z(resultTyped.Cost).Balance}
-	resultTyped.NetOperatingIncome = &entryType{
-		Balance: z(resultTyped.GrossProfit).Balance -
-			z(resultTyped.OperatingExpense).Balance}
-	resultTyped.IncomeBeforeIncomeTax = &entryType{
-		Balance: z(resultTyped.NetOperatingIncome).Balance +
-			z(resultTyped.NonOperatingRevenue).Balance -
-			z(resultTyped.NonOperatingExpense).Balance - z(resultTyped.NonOperatingTax).Balance}
-	resultTyped.NetIncome = &entryType{
-		Balance: z(resultTyped.IncomeBeforeIncomeTax).Balance -
-			z(resultTyped.IncomeTax).Balance - z(resultTyped.Dividends).Balance}
+	resultTyped.NetRevenue = newEntry(z(resultTyped.GrossRevenue).Balance -
+		z(resultTyped.Deduction).Balance - z(resultTyped.SalesTax).Balance)
+	resultTyped.GrossProfit = newEntry(z(resultTyped.NetRevenue).Balance -
+		z(resultTyped.Cost).Balance)
+	resultTyped.NetOperatingIncome = newEntry(z(resultTyped.GrossProfit).Balance -
+		z(resultTyped.OperatingExpense).Balance)
+	resultTyped.IncomeBeforeIncomeTax = newEntry(z(resultTyped.NetOperatingIncome).Balance +
+		z(resultTyped.NonOperatingRevenue).Balance -
+		z(resultTyped.NonOperatingExpense).Balance - z(resultTyped.NonOperatingTax).Balance)
+	resultTyped.NetIncome = newEntry(z(resultTyped.IncomeBeforeIncomeTax).Balance -
+		z(resultTyped.IncomeTax).Balance - z(resultTyped.Dividends).Balance)
 
 	if resultTyped.NetRevenue.Balance == 0 || (z(resultTyped.Deduction).Balance == 0 &&
 		z(resultTyped.SalesTax).Balance == 0) {
@@ -560,11 +672,31 @@ func IncomeStatement(c context.Context, m map[string]interface{}, param map[stri
 		resultTyped.IncomeBeforeIncomeTax = nil
 	}
 
+	// The details are the balances, whose values are formatted only after they are added up.
+	for _, b := range balances {
+		b["value"] = b["value"].(accounting.Money).WithScale(scale)
+	}
+
 	result = resultTyped
 
 	return
 }
 
+// incomeStatementEntry is an entry of the income statement, whose balance is encoded in JSON with
+// the scale of the values of the report.
+type incomeStatementEntry struct {
+	Balance accounting.Money
+	Details []interface{}
+	scale   int
+}
+
+func (e *incomeStatementEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Balance accounting.ScaledMoney `json:"balance"`
+		Details []interface{}          `json:"details"`
+	}{e.Balance.WithScale(e.scale), e.Details})
+}
+
 func accountToMap(key interface{}, account *accounting.Account) map[string]interface{} {
 	return map[string]interface{}{
 		"_id":           key,
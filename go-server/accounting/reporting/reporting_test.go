@@ -1,11 +1,14 @@
 package reporting
 
 import (
-	_ "fmt"
+	"encoding/json"
+	"fmt"
 	"github.com/mcesarhm/geek-accounting/go-server/accounting"
 	"github.com/mcesarhm/geek-accounting/go-server/context"
 	"github.com/mcesarhm/geek-accounting/go-server/core"
 	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -33,7 +36,7 @@ func TestJournal(t *testing.T) {
 	}
 
 	var obj interface{}
-	if obj, err = Journal(c, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01"}, core.NewUserKey()); err != nil {
+	if obj, err = Journal(c, nil, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	journal := obj.([]map[string]interface{})
@@ -47,7 +50,7 @@ func TestJournal(t *testing.T) {
 	if tx2, err = accounting.SaveTransactionSample(c, coa, "2", "1", ""); err != nil {
 		t.Fatal(err)
 	}
-	if obj, err = Journal(c, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01"}, core.NewUserKey()); err != nil {
+	if obj, err = Journal(c, nil, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	journal = obj.([]map[string]interface{})
@@ -60,7 +63,7 @@ func TestJournal(t *testing.T) {
 	if journal[1]["_id"].(db.Key).Encode() != tx2.Key.Encode() {
 		t.Error("Journal's entry must encode transaction's key")
 	}
-	if obj, err = Journal(c, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-02", "to": "2014-05-02"}, core.NewUserKey()); err != nil {
+	if obj, err = Journal(c, nil, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-02", "to": "2014-05-02"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	journal = obj.([]map[string]interface{})
@@ -92,7 +95,7 @@ func TestLedger(t *testing.T) {
 	}
 
 	var obj interface{}
-	if obj, err = Ledger(c, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01", "account": "1"}, core.NewUserKey()); err != nil {
+	if obj, err = Ledger(c, nil, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01", "account": "1"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	ledger := obj.(map[string]interface{})
@@ -107,15 +110,15 @@ func TestLedger(t *testing.T) {
 		if entry["counterpart"].(map[string]interface{})["number"] != "2" {
 			t.Error("Counterpart must be account #2")
 		}
-		if entry["balance"] != 1.0 {
+		if entry["balance"] != accounting.Money(100).WithScale(2) {
 			t.Error("Entry's balance must be 1")
 		}
 	}
-	if ledger["balance"] != 0.0 {
+	if ledger["balance"] != accounting.Money(0).WithScale(2) {
 		t.Error("Ledger's balance must be 0")
 	}
 
-	if obj, err = Ledger(c, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01", "account": "1"}, core.NewUserKey()); err != nil {
+	if obj, err = Ledger(c, nil, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01", "account": "1"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	ledger = obj.(map[string]interface{})
@@ -129,15 +132,15 @@ func TestLedger(t *testing.T) {
 		if entry["counterpart"].(map[string]interface{})["number"] != "2" {
 			t.Error("Counterpart must be account #2")
 		}
-		if entry["balance"] != 1.0 {
+		if entry["balance"] != accounting.Money(100).WithScale(2) {
 			t.Error("Entry's balance must be 1")
 		}
 	}
-	if ledger["balance"] != 0.0 {
+	if ledger["balance"] != accounting.Money(0).WithScale(2) {
 		t.Error("Ledger's balance must be 0")
 	}
 
-	if obj, err = Ledger(c, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-02", "to": "2014-05-02", "account": "1"}, core.NewUserKey()); err != nil {
+	if obj, err = Ledger(c, nil, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-02", "to": "2014-05-02", "account": "1"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	ledger = obj.(map[string]interface{})
@@ -147,7 +150,7 @@ func TestLedger(t *testing.T) {
 	if len(ledger["entries"].([]interface{})) != 0 {
 		t.Error("Ledger must have zero entries")
 	}
-	if ledger["balance"] != 1.0 {
+	if ledger["balance"] != accounting.Money(100).WithScale(2) {
 		t.Errorf("Ledger's balance must be 1, but was %v", ledger["balance"])
 	}
 
@@ -156,7 +159,7 @@ func TestLedger(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
-	if obj, err = Ledger(c, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-02", "account": "1"}, core.NewUserKey()); err != nil {
+	if obj, err = Ledger(c, nil, map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-02", "account": "1"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	ledger = obj.(map[string]interface{})
@@ -166,6 +169,87 @@ func TestLedger(t *testing.T) {
 
 }
 
+func TestJournalAndLedgerPages(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+
+	var coa *accounting.ChartOfAccounts
+	if coa, err = accounting.SaveChartOfAccountsSample(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accounting.SaveAccountSample(c, coa, "1", "Assets", []string{"balanceSheet", "debitBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accounting.SaveAccountSample(c, coa, "2", "Liabilities", []string{"balanceSheet", "creditBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for i := 0; i < 5; i++ {
+		if tx, err := accounting.SaveTransactionSample(c, coa, "1", "2", ""); err != nil {
+			t.Fatal(err)
+		} else {
+			keys = append(keys, tx.Key.Encode())
+		}
+	}
+
+	param := map[string]string{"coa": coa.Key.Encode(), "from": "2014-05-01", "to": "2014-05-01",
+		"account": "1", "limit": "2"}
+	ids := []string{}
+	for pages := 1; ; pages++ {
+		obj, err := Journal(c, nil, param, core.NewUserKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := obj.(db.Page)
+		journal := page.Items.([]map[string]interface{})
+		if len(journal) > 2 {
+			t.Fatalf("Journal page %v has %v entries", pages, len(journal))
+		}
+		for _, e := range journal {
+			ids = append(ids, e["_id"].(db.Key).Encode())
+		}
+		if len(page.Next) == 0 {
+			if pages != 3 {
+				t.Errorf("Journal must have 3 pages, but had %v", pages)
+			}
+			break
+		}
+		param["cursor"] = page.Next
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(keys) {
+		t.Errorf("Journal pages must have %v, but had %v", keys, ids)
+	}
+
+	delete(param, "cursor")
+	balances := []accounting.ScaledMoney{}
+	for {
+		obj, err := Ledger(c, nil, param, core.NewUserKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := obj.(db.Page)
+		for _, e := range page.Items.(map[string]interface{})["entries"].([]interface{}) {
+			balances = append(balances, e.(map[string]interface{})["balance"].(accounting.ScaledMoney))
+		}
+		if len(page.Next) == 0 {
+			break
+		}
+		param["cursor"] = page.Next
+	}
+	if fmt.Sprint(balances) != "[1.00 2.00 3.00 4.00 5.00]" {
+		t.Errorf("Ledger pages must have balances [1 2 3 4 5], but had %v", balances)
+	}
+
+	param["cursor"] = "x"
+	if _, err := Ledger(c, nil, param, core.NewUserKey()); err == nil {
+		t.Error("Ledger must reject an invalid cursor")
+	}
+}
+
 func TestBalance(t *testing.T) {
 	c := context.Context{}
 	ac, err := context.NewContext(&c)
@@ -190,7 +274,7 @@ func TestBalance(t *testing.T) {
 		t.Fatal(err)
 	}
 	var obj interface{}
-	if obj, err = Balance(c, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
+	if obj, err = Balance(c, nil, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	balance := obj.([]db.M)
@@ -203,10 +287,10 @@ func TestBalance(t *testing.T) {
 	if balance[1]["account"].(map[string]interface{})["number"] != a2.Number {
 		t.Error("Balance's entry must have account number")
 	}
-	if balance[0]["value"] != 1.0 {
+	if balance[0]["value"] != accounting.Money(100).WithScale(2) {
 		t.Error("Balance's value must be 1")
 	}
-	if balance[1]["value"] != 1.0 {
+	if balance[1]["value"] != accounting.Money(100).WithScale(2) {
 		t.Error("Balance's value must be 1")
 	}
 
@@ -214,7 +298,7 @@ func TestBalance(t *testing.T) {
 	if tx, err = accounting.SaveTransactionSample(c, coa, "2", "1", ""); err != nil {
 		t.Fatal(err)
 	}
-	if obj, err = Balance(c, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
+	if obj, err = Balance(c, nil, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	balance = obj.([]db.M)
@@ -227,16 +311,16 @@ func TestBalance(t *testing.T) {
 	if balance[1]["account"].(map[string]interface{})["number"] != a2.Number {
 		t.Error("Balance's entry must have account number")
 	}
-	if balance[0]["value"] != 0.0 {
+	if balance[0]["value"] != accounting.Money(0).WithScale(2) {
 		t.Error("Balance's value must be 0")
 	}
-	if balance[1]["value"] != 0.0 {
+	if balance[1]["value"] != accounting.Money(0).WithScale(2) {
 		t.Error("Balance's value must be 0")
 	}
 	if tx, err = accounting.SaveTransactionSample(c, coa, "1", "2", tx.Key.Encode()); err != nil {
 		t.Fatal(err)
 	}
-	if obj, err = Balance(c, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
+	if obj, err = Balance(c, nil, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	balance = obj.([]db.M)
@@ -249,10 +333,10 @@ func TestBalance(t *testing.T) {
 	if balance[1]["account"].(map[string]interface{})["number"] != a2.Number {
 		t.Error("Balance's entry must have account number")
 	}
-	if balance[0]["value"] != 2.0 {
+	if balance[0]["value"] != accounting.Money(200).WithScale(2) {
 		t.Error("Balance's value must be 2, but was", balance[0]["value"])
 	}
-	if balance[1]["value"] != 2.0 {
+	if balance[1]["value"] != accounting.Money(200).WithScale(2) {
 		t.Error("Balance's value must be 2, but was", balance[1]["value"])
 	}
 	if err = c.Cache.Flush(); err != nil {
@@ -261,7 +345,7 @@ func TestBalance(t *testing.T) {
 	if tx, err = accounting.SaveTransactionSample(c, coa, "2", "1", tx.Key.Encode()); err != nil {
 		t.Fatal(err)
 	}
-	if obj, err = Balance(c, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
+	if obj, err = Balance(c, nil, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	balance = obj.([]db.M)
@@ -274,16 +358,16 @@ func TestBalance(t *testing.T) {
 	if balance[1]["account"].(map[string]interface{})["number"] != a2.Number {
 		t.Error("Balance's entry must have account number")
 	}
-	if balance[0]["value"] != 0.0 {
+	if balance[0]["value"] != accounting.Money(0).WithScale(2) {
 		t.Error("Balance's value must be 0")
 	}
-	if balance[1]["value"] != 0.0 {
+	if balance[1]["value"] != accounting.Money(0).WithScale(2) {
 		t.Error("Balance's value must be 0")
 	}
-	if _, err = accounting.DeleteTransaction(c, nil, map[string]string{"transaction": tx.Key.Encode()}, core.NewUserKey()); err != nil {
+	if _, err = accounting.DeleteTransaction(c, nil, map[string]string{"coa": coa.Key.Encode(), "transaction": tx.Key.Encode()}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
-	if obj, err = Balance(c, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
+	if obj, err = Balance(c, nil, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
 		t.Fatal(err)
 	}
 	balance = obj.([]db.M)
@@ -296,10 +380,132 @@ func TestBalance(t *testing.T) {
 	if balance[1]["account"].(map[string]interface{})["number"] != a2.Number {
 		t.Error("Balance's entry must have account number")
 	}
-	if balance[0]["value"] != 1.0 {
+	if balance[0]["value"] != accounting.Money(100).WithScale(2) {
 		t.Error("Balance's value must be 1")
 	}
-	if balance[1]["value"] != 1.0 {
+	if balance[1]["value"] != accounting.Money(100).WithScale(2) {
 		t.Error("Balance's value must be 1")
 	}
 }
+
+func TestBalanceWithScaleOfChartOfAccounts(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+
+	obj, err := accounting.SaveChartOfAccounts(c, map[string]interface{}{"name": "coa",
+		"currency": "JPY"}, nil, core.NewUserKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coa := obj.(*accounting.ChartOfAccounts)
+	if _, err = accounting.SaveAccountSample(c, coa, "1", "Assets", []string{"balanceSheet", "debitBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accounting.SaveAccountSample(c, coa, "2", "Liabilities", []string{"balanceSheet", "creditBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accounting.SaveTransactionSample(c, coa, "1", "2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err = Balance(c, nil, map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01"}, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := json.Marshal(obj); err != nil || !strings.Contains(string(b), `"value":1}`) {
+		t.Error("Balance's values in JPY must have no decimal places", string(b), err)
+	}
+}
+
+func TestConcurrentTransactionsAndReports(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+
+	var coa *accounting.ChartOfAccounts
+	if coa, err = accounting.SaveChartOfAccountsSample(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accounting.SaveAccountSample(c, coa, "1", "Assets", []string{"balanceSheet", "debitBalance"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accounting.SaveAccountSample(c, coa, "2", "Liabilities", []string{"balanceSheet", "creditBalance"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, reads = 20, 10
+	param := map[string]string{"coa": coa.Key.Encode(), "at": "2014-05-01",
+		"from": "2014-05-01", "to": "2014-05-01", "account": "1"}
+	errs := make(chan error, writers+4*reads)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := accounting.SaveTransactionSample(c, coa, "1", "2", "")
+			errs <- err
+		}()
+	}
+	for i := 0; i < reads; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			obj, err := Balance(c, nil, param, core.NewUserKey())
+			if err == nil {
+				// Debits and credits must match in every snapshot
+				if balance := obj.([]db.M); balance[0]["value"] != balance[1]["value"] {
+					err = fmt.Errorf("Unbalanced balance sheet: %v", balance)
+				}
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := Journal(c, nil, param, core.NewUserKey())
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := Ledger(c, nil, param, core.NewUserKey())
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := IncomeStatement(c, nil, param, core.NewUserKey())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	var obj interface{}
+	if obj, err = accounting.AllTransactions(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err = obj.(accounting.TransactionStream).Each(func(*accounting.Transaction) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != writers {
+		t.Errorf("%v transactions expected, but was %v", writers, count)
+	}
+	if obj, err = Journal(c, nil, param, core.NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	if journal := obj.([]map[string]interface{}); len(journal) != writers {
+		t.Errorf("%v journal entries expected, but was %v", writers, len(journal))
+	}
+}
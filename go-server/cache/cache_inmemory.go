@@ -1,37 +1,60 @@
-// +build inmemory
+// +build !appengine
 
 package cache
 
 import (
+	"bytes"
+	"encoding/gob"
 	"reflect"
+	"sync"
 )
 
+// inMemoryCache keeps the items gob encoded, like the App Engine memcache, so that the items
+// returned by Get are copies that can be changed without affecting other readers.
 type inMemoryCache struct{}
 
-var cache = map[string]interface{}{}
+var (
+	mu    sync.RWMutex
+	cache = map[string][]byte{}
+)
 
 func NewInMemoryCache() Cache {
 	return inMemoryCache{}
 }
 
 func (c inMemoryCache) Get(key string, item interface{}) error {
-	if v, ok := cache[key]; ok {
-		reflect.Indirect(reflect.ValueOf(item)).Set(reflect.ValueOf(v))
+	mu.RLock()
+	b, ok := cache[key]
+	mu.RUnlock()
+	if !ok {
+		return nil
 	}
-	return nil
+	v := reflect.Indirect(reflect.ValueOf(item))
+	v.Set(reflect.Zero(v.Type()))
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(item)
 }
 
 func (c inMemoryCache) Set(key string, item interface{}) error {
-	cache[key] = item
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(item); err != nil {
+		return err
+	}
+	mu.Lock()
+	cache[key] = buf.Bytes()
+	mu.Unlock()
 	return nil
 }
 
 func (c inMemoryCache) Delete(key string) error {
+	mu.Lock()
 	delete(cache, key)
+	mu.Unlock()
 	return nil
 }
 
 func (c inMemoryCache) Flush() error {
-	cache = map[string]interface{}{}
+	mu.Lock()
+	cache = map[string][]byte{}
+	mu.Unlock()
 	return nil
 }
@@ -0,0 +1,134 @@
+// +build !appengine
+
+// Command ga-server serves the geek accounting API with net/http, without depending on the App
+// Engine SDK.
+//
+// The configuration is read from the JSON file given by the -config flag (or the GA_CONFIG
+// environment variable) and every setting can be overridden by an environment variable:
+//
+//	{
+//		"address": ":8001",       // GA_ADDRESS
+//		"ssl": true,              // GA_SSL
+//		"certFile": "cert.pem",   // GA_CERT_FILE
+//		"keyFile": "key.pem",     // GA_KEY_FILE
+//		"db": "bolt",             // GA_DB: inmemory, bolt or sql
+//		"dbPath": "ga.db",        // GA_DB_PATH: file of the bolt database
+//		"dbDriver": "sqlite3",    // GA_DB_DRIVER: sqlite3 or postgres
+//		"dbSource": "ga.sqlite"   // GA_DB_SOURCE: data source of the sql database
+//	}
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/mcesarhm/geek-accounting/go-server/cache"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"github.com/mcesarhm/geek-accounting/go-server/server"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type config struct {
+	Address  string `json:"address"`
+	SSL      bool   `json:"ssl"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	Db       string `json:"db"`
+	DbPath   string `json:"dbPath"`
+	DbDriver string `json:"dbDriver"`
+	DbSource string `json:"dbSource"`
+}
+
+func main() {
+	configFile := flag.String("config", os.Getenv("GA_CONFIG"), "configuration file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalln("Error reading configuration:", err)
+	}
+
+	d, err := newDb(cfg)
+	if err != nil {
+		log.Fatalln("Error opening database:", err)
+	}
+	c := context.Context{Db: d, Cache: cache.NewInMemoryCache()}
+	if password, err := core.InitUserManagement(c); err != nil {
+		log.Fatalln("Error initializing user management:", err)
+	} else if len(password) > 0 {
+		log.Println("The password of the admin user is", password)
+	}
+
+	http.Handle("/", server.NewRouter(server.NewLocalEnvironment(c)))
+	log.Println("server listening on", cfg.Address)
+	if cfg.SSL {
+		err = http.ListenAndServeTLS(cfg.Address, cfg.CertFile, cfg.KeyFile, nil)
+	} else {
+		err = http.ListenAndServe(cfg.Address, nil)
+	}
+	log.Fatalln(err)
+}
+
+func loadConfig(filename string) (*config, error) {
+	cfg := &config{
+		Address:  ":8001",
+		CertFile: "config/certificate.pem",
+		KeyFile:  "config/privatekey.pem",
+		Db:       "inmemory",
+		DbPath:   "geek-accounting.db",
+		DbDriver: "sqlite3",
+		DbSource: "geek-accounting.sqlite"}
+	if filename != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(cfg); err != nil {
+			return nil, err
+		}
+	}
+	for env, value := range map[string]*string{
+		"GA_ADDRESS":   &cfg.Address,
+		"GA_CERT_FILE": &cfg.CertFile,
+		"GA_KEY_FILE":  &cfg.KeyFile,
+		"GA_DB":        &cfg.Db,
+		"GA_DB_PATH":   &cfg.DbPath,
+		"GA_DB_DRIVER": &cfg.DbDriver,
+		"GA_DB_SOURCE": &cfg.DbSource,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*value = v
+		}
+	}
+	if v := os.Getenv("GA_SSL"); v != "" {
+		ssl, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid GA_SSL: %v", v)
+		}
+		cfg.SSL = ssl
+	}
+	return cfg, nil
+}
+
+func newDb(cfg *config) (db.Db, error) {
+	switch cfg.Db {
+	case "inmemory":
+		return db.NewInMemoryDb(), nil
+	case "bolt":
+		return db.NewBoltDb(cfg.DbPath)
+	case "sql":
+		return db.NewSqlDb(cfg.DbDriver, cfg.DbSource)
+	default:
+		return nil, fmt.Errorf("Unknown database: %v", cfg.Db)
+	}
+}
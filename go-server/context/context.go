@@ -8,4 +8,8 @@ import (
 type Context struct {
 	Db    db.Db
 	Cache cache.Cache
+	// Endpoint is the method and path of the request being handled, recorded in the audit log.
+	Endpoint string
+	// Address is the IP address of the client, whose failed logins are limited.
+	Address string
 }
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"strings"
+	"time"
+)
+
+// An APIKey authenticates the tools run without a person to type the password, like cron jobs. It
+// is stored next to the users and is sent as "Authorization: Bearer gak_...". Only the SHA-256 of
+// the key is stored, so the key itself is returned once, when it is created.
+type APIKey struct {
+	db.Identifiable
+	User    UserKey   `json:"user"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"-"`
+	Created time.Time `json:"created"`
+	// Secret is the key itself, only filled in when the key is created.
+	Secret string `json:"key,omitempty" datastore:"-"`
+}
+
+// APIKeyPrefix starts every API key, distinguishing them from access tokens.
+const APIKeyPrefix = "gak_"
+
+var APIKeyRepository = db.NewRepository[APIKey]("APIKey")
+
+func init() {
+	gob.Register((*APIKey)(nil))
+	db.RegisterIndex("APIKey", "User")
+}
+
+func (k *APIKey) ValidationMessage(_ db.Db, _ map[string]string) string {
+	if len(strings.TrimSpace(k.Name)) == 0 {
+		return "The name must be informed"
+	}
+	return ""
+}
+
+func AllAPIKeys(c context.Context, _ map[string]interface{}, param map[string]string,
+	_ UserKey) (interface{}, error) {
+	user, err := c.Db.DecodeKey(param["user"])
+	if err != nil {
+		return nil, err
+	}
+	_, keys, err := APIKeyRepository.GetAll(c.Db, realm(c.Db), db.Field("User").Eq(user),
+		[]string{"Name"})
+	return keys, err
+}
+
+// SaveAPIKey creates a key for the user and returns it with the key itself.
+func SaveAPIKey(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	name, _ := m["name"].(string)
+	random, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	apiKey := &APIKey{User: UserKey(user.Key), Name: name, Hash: tokenHash(random),
+		Created: time.Now()}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if _, err := APIKeyRepository.Save(tdb, apiKey, realm(tdb), nil); err != nil {
+			return err
+		}
+		return auditUser(c, tdb, userKey, apiKey.Key, nil, apiKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	apiKey.Secret = APIKeyPrefix + encodeKey(apiKey.Key) + "." + random
+	return apiKey, nil
+}
+
+// DeleteAPIKey revokes a key of the user.
+func DeleteAPIKey(c context.Context, _ map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	apiKey, err := APIKeyRepository.Get(c.Db, param["apiKey"])
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.User.Encode() != param["user"] {
+		return nil, fmt.Errorf("The API key does not belong to the user")
+	}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if err := APIKeyRepository.Delete(tdb, apiKey.Key); err != nil {
+			return err
+		}
+		return auditUser(c, tdb, userKey, apiKey.Key, apiKey, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nil, c.Cache.Delete("apikey_" + apiKey.Key.Encode())
+}
+
+// AuthenticateAPIKey returns the user of a valid API key.
+func AuthenticateAPIKey(c context.Context, apiKey string) (error, bool, UserKey) {
+	parts := strings.Split(strings.TrimPrefix(apiKey, APIKeyPrefix), ".")
+	if !strings.HasPrefix(apiKey, APIKeyPrefix) || len(parts) != 2 {
+		return nil, false, UserKey{}
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false, UserKey{}
+	}
+	keyAsString := string(b)
+	if key, err := c.Db.DecodeKey(keyAsString); err != nil ||
+		key.Kind() != APIKeyRepository.Kind() {
+		return nil, false, UserKey{}
+	}
+	var k *APIKey
+	if err = c.Cache.Get("apikey_"+keyAsString, &k); err != nil {
+		return err, false, UserKey{}
+	}
+	if k == nil {
+		if k, err = APIKeyRepository.Get(c.Db, keyAsString); err != nil {
+			return nil, false, UserKey{}
+		}
+		if err = c.Cache.Set("apikey_"+keyAsString, k); err != nil {
+			return err, false, UserKey{}
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(tokenHash(parts[1]))) != 1 {
+		return nil, false, UserKey{}
+	}
+	return nil, true, k.User
+}
+
+// deleteAPIKeys deletes the keys of a user being deleted by userKey.
+func deleteAPIKeys(c context.Context, userKey UserKey, user db.Key) error {
+	keys, apiKeys, err := APIKeyRepository.GetAll(c.Db, realm(c.Db), db.Field("User").Eq(user),
+		nil)
+	if err != nil {
+		return err
+	}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if err := APIKeyRepository.DeleteMulti(tdb, keys); err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if err := auditUser(c, tdb, userKey, key, apiKeys[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = c.Cache.Delete("apikey_" + key.Encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
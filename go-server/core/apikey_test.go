@@ -0,0 +1,84 @@
+package core
+
+import (
+	"encoding/base64"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	var users []*User
+	for _, login := range []string{"u", "v"} {
+		if obj, err := SaveUser(c, map[string]interface{}{"user": login, "name": login,
+			"password": login}, map[string]string{}, NewUserKey()); err != nil {
+			t.Fatal(err)
+		} else {
+			users = append(users, obj.(*User))
+		}
+	}
+	u, v := UserKey(users[0].Key), UserKey(users[1].Key)
+	param := map[string]string{"user": u.Encode()}
+	if err = SelfOrAdmin(c, param, v); err != ErrForbidden {
+		t.Error("A user must not manage the keys of another user, got", err)
+	}
+	obj, err := SaveAPIKey(c, map[string]interface{}{"name": "cron"}, param, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey := obj.(*APIKey)
+	if !strings.HasPrefix(apiKey.Secret, APIKeyPrefix) {
+		t.Fatal("The key must be returned when created, got", apiKey.Secret)
+	}
+	if err, ok, k := AuthenticateAPIKey(c, apiKey.Secret); err != nil || !ok {
+		t.Error("The key must be accepted", err)
+	} else if k.Encode() != u.Encode() {
+		t.Errorf("User %v expected got %v", u.Encode(), k.Encode())
+	}
+	if err, ok, _ := AuthenticateAPIKey(c, apiKey.Secret+"x"); err != nil || ok {
+		t.Error("A wrong key must be rejected", err)
+	}
+	if err, ok, _ := AuthenticateAPIKey(c, APIKeyPrefix+
+		base64.RawURLEncoding.EncodeToString([]byte(u.Encode()))+".x"); err != nil || ok {
+		t.Error("The key of a user must be rejected", err)
+	}
+
+	_, _, admin := userByLogin(c, "admin")
+	if err = SelfOrAdmin(c, param, admin); err != nil {
+		t.Error("The admin must manage the keys of other users", err)
+	}
+	if _, err = SaveAPIKey(c, map[string]interface{}{"name": "ci"}, param, admin); err != nil {
+		t.Error("The admin must create keys for other users", err)
+	}
+	if obj, err = AllAPIKeys(c, nil, param, u); err != nil {
+		t.Fatal(err)
+	} else if keys := obj.([]*APIKey); len(keys) != 2 || keys[0].Name != "ci" ||
+		keys[1].Name != "cron" || keys[1].Secret != "" {
+		t.Error("ci and cron without their secrets expected got", keys)
+	}
+
+	param["apiKey"] = apiKey.Key.Encode()
+	if _, err = DeleteAPIKey(c, nil, param, u); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := AuthenticateAPIKey(c, apiKey.Secret); err != nil || ok {
+		t.Error("A revoked key must be rejected", err)
+	}
+
+	if obj, err = SaveAPIKey(c, map[string]interface{}{"name": "cron"}, param, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = DeleteUser(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := AuthenticateAPIKey(c, obj.(*APIKey).Secret); err != nil || ok {
+		t.Error("The keys of a deleted user must be rejected", err)
+	}
+}
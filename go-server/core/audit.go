@@ -0,0 +1,164 @@
+package core
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"time"
+)
+
+// An AuditEntry records a change made through the API: who made it, when, through which endpoint
+// and the JSON of the entity before and after it. Entries are only appended, never changed. The
+// entries of the changes to a chart of accounts are its children and the others are stored next
+// to the users.
+type AuditEntry struct {
+	db.Identifiable
+	User     UserKey   `json:"user"`
+	AsOf     time.Time `json:"timestamp"`
+	Endpoint string    `json:"endpoint"`
+	Action   Action    `json:"action"`
+	// Entity is the key of the entity changed, or its moment in the space of a chart of accounts.
+	Entity string `json:"entity"`
+	// The snapshots are not indexed, so that App Engine saves the ones longer than 1500 bytes.
+	Before Snapshot `datastore:",noindex" json:"before"`
+	After  Snapshot `datastore:",noindex" json:"after"`
+}
+
+type Action string
+
+const (
+	Create Action = "create"
+	Update Action = "update"
+	Delete Action = "delete"
+)
+
+// Snapshot is the JSON of an entity, returned as is instead of as a string.
+type Snapshot string
+
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	if len(s) == 0 {
+		return []byte("null"), nil
+	}
+	return []byte(s), nil
+}
+
+func (s *Snapshot) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*s = ""
+	} else {
+		*s = Snapshot(b)
+	}
+	return nil
+}
+
+var AuditEntryRepository = db.NewRepository[AuditEntry]("AuditEntry")
+
+func init() {
+	gob.Register((*AuditEntry)(nil))
+	gob.Register(([]*AuditEntry)(nil))
+	db.RegisterIndex("AuditEntry", "User")
+	db.RegisterIndex("AuditEntry", "Entity")
+	db.RegisterIndex("AuditEntry", "AsOf")
+}
+
+// NewAuditEntry returns the entry of the change of the entity by the user through the endpoint of
+// the context. Before is nil for creations and after is nil for deletions.
+func NewAuditEntry(c context.Context, userKey UserKey, entity string,
+	before, after interface{}) (*AuditEntry, error) {
+	entry := &AuditEntry{User: userKey, AsOf: time.Now(), Endpoint: c.Endpoint, Action: Update,
+		Entity: entity}
+	if before == nil {
+		entry.Action = Create
+	} else if after == nil {
+		entry.Action = Delete
+	}
+	var err error
+	if entry.Before, err = snapshot(before); err != nil {
+		return nil, err
+	}
+	if entry.After, err = snapshot(after); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Audit appends the change of the entity to the audit log under the ancestor, using the database
+// d, so that the entry is saved in the transaction of the change.
+func Audit(c context.Context, d db.Db, ancestor string, userKey UserKey, entity string,
+	before, after interface{}) error {
+	entry, err := NewAuditEntry(c, userKey, entity, before, after)
+	if err != nil {
+		return err
+	}
+	_, err = AuditEntryRepository.Save(d, entry, ancestor, nil)
+	return err
+}
+
+// auditUser appends the change of a user, an API key or an organization to the audit log, using
+// the database d of the transaction of the change.
+func auditUser(c context.Context, d db.Db, userKey UserKey, entity db.Key, before,
+	after interface{}) error {
+	return Audit(c, d, realm(d), userKey, entity.Encode(), before, after)
+}
+
+func snapshot(entity interface{}) (Snapshot, error) {
+	if entity == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(entity)
+	return Snapshot(b), err
+}
+
+// AuditLog returns a page of the audit entries under the ancestor, the newest first, filtered by
+// the "user" and "entity" params and by the "from" and "to" dates, inclusive.
+func AuditLog(c context.Context, ancestor string, param map[string]string, limit int,
+	cursor string) ([]*AuditEntry, string, error) {
+	var queries []db.Query
+	if userKeyAsString, ok := param["user"]; ok {
+		if k, err := c.Db.DecodeKey(userKeyAsString); err != nil {
+			return nil, "", err
+		} else {
+			queries = append(queries, db.Field("User").Eq(k))
+		}
+	}
+	if entity, ok := param["entity"]; ok {
+		queries = append(queries, db.Field("Entity").Eq(entity))
+	}
+	if from, ok := param["from"]; ok {
+		if t, err := time.Parse(time.RFC3339, from+"T00:00:00Z"); err != nil {
+			return nil, "", err
+		} else {
+			queries = append(queries, db.Field("AsOf").Ge(t))
+		}
+	}
+	if to, ok := param["to"]; ok {
+		if t, err := time.Parse(time.RFC3339, to+"T00:00:00Z"); err != nil {
+			return nil, "", err
+		} else {
+			queries = append(queries, db.Field("AsOf").Lt(t.AddDate(0, 0, 1)))
+		}
+	}
+	var query db.Query
+	if len(queries) > 0 {
+		query = db.And(queries...)
+	}
+	_, entries, next, err := AuditEntryRepository.GetPage(c.Db, ancestor, query,
+		[]string{"-AsOf"}, limit, cursor)
+	return entries, next, err
+}
+
+// AllAuditEntries returns a page of the audit log of the users, API keys and organizations,
+// filtered like AuditLog.
+func AllAuditEntries(c context.Context, _ map[string]interface{}, param map[string]string,
+	_ UserKey) (interface{}, error) {
+	limit, cursor, err := db.PageParams(param)
+	if err != nil {
+		return nil, err
+	}
+	entries, next, err := AuditLog(c, realm(c.Db), param, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return db.Paged(param, entries, next), nil
+}
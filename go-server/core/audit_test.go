@@ -0,0 +1,81 @@
+package core
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"strings"
+	"testing"
+)
+
+func TestAuditOfUsers(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := Login(c, "admin", "admin")
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "u", "password": "p"},
+		map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := UserKey(obj.(*User).Key)
+	if _, err = ChangePassword(c, map[string]interface{}{"oldPassword": "p", "newPassword": "p2"},
+		nil, u); err != nil {
+		t.Fatal(err)
+	}
+	param := map[string]string{"user": u.Encode()}
+	if obj, err = SaveAPIKey(c, map[string]interface{}{"name": "cron"}, param, u); err != nil {
+		t.Fatal(err)
+	}
+	secret := obj.(*APIKey).Secret
+	if _, err = DeleteUser(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj, err = AllAuditEntries(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	entries := obj.([]*AuditEntry)
+	if len(entries) != 2 {
+		t.Fatal("The password and API key changes of the user expected got", len(entries))
+	}
+	if entries[0].Entity == u.Encode() || entries[1].Entity != u.Encode() {
+		t.Error("The API key and the user expected got", entries[0].Entity, entries[1].Entity)
+	}
+	if obj, err = AllAuditEntries(c, nil, map[string]string{"entity": u.Encode()},
+		admin); err != nil {
+		t.Fatal(err)
+	}
+	entries = obj.([]*AuditEntry)
+	if len(entries) != 3 || entries[0].Action != Delete || entries[2].Action != Create {
+		t.Fatal("The creation, update and deletion of the user expected got", len(entries))
+	}
+	obj, err = AllAuditEntries(c, nil, map[string]string{"entity": u.Encode(), "limit": "2"},
+		admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := obj.(db.Page)
+	if len(page.Items.([]*AuditEntry)) != 2 || len(page.Next) == 0 {
+		t.Fatal("A page of 2 entries and the cursor of the next one expected got", page)
+	}
+	if obj, err = AllAuditEntries(c, nil, map[string]string{"entity": u.Encode(), "limit": "2",
+		"cursor": page.Next}, admin); err != nil {
+		t.Fatal(err)
+	} else if page = obj.(db.Page); len(page.Items.([]*AuditEntry)) != 1 || len(page.Next) > 0 {
+		t.Error("The last entry expected got", page)
+	}
+	obj, err = AllAuditEntries(c, nil, map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range obj.([]*AuditEntry) {
+		if strings.Contains(string(e.Before)+string(e.After), "$2a$") ||
+			strings.Contains(string(e.Before)+string(e.After), secret) {
+			t.Error("Passwords and API keys must not be audited", e)
+		}
+	}
+}
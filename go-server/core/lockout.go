@@ -0,0 +1,175 @@
+package core
+
+import (
+	"encoding/gob"
+	"errors"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"math"
+	"time"
+)
+
+// Failed logins are counted per login, whether the user exists or not, and per client address.
+// Once the free attempts are over, every failure locks the login or the address out for twice as
+// long as the previous one, starting at Base and up to Max, and no password is checked until the
+// lockout ends. The failures are forgotten after FailureWindow without any, and those of a login
+// when it succeeds, but not those of its address, which may be shared.
+type Limits struct {
+	Free int
+	Base time.Duration
+	Max  time.Duration
+}
+
+var (
+	LoginLimits   = Limits{Free: 3, Base: time.Second, Max: 15 * time.Minute}
+	AddressLimits = Limits{Free: 20, Base: time.Second, Max: 15 * time.Minute}
+	FailureWindow = 24 * time.Hour
+)
+
+// ErrLocked is returned instead of checking the password of a login or address locked out.
+var ErrLocked = errors.New("Too many failed logins, try again later")
+
+// A Lockout is the state of the failed logins of a login or address. The lockouts are stored next
+// to the users, as the cache cannot count the failures atomically.
+type Lockout struct {
+	db.Identifiable
+	// Name is the hashed login or address whose failures are counted.
+	Name     string    `json:"-"`
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`
+	Until    time.Time `json:"until"`
+}
+
+var lockoutRepository = db.NewRepository[Lockout]("Lockout")
+
+func init() {
+	gob.Register((*Lockout)(nil))
+	db.RegisterIndex("Lockout", "Name")
+}
+
+// userWithLockout is a user as the admins see it.
+type userWithLockout struct {
+	*User
+	Lockout *Lockout `json:"lockout,omitempty"`
+	Locked  bool     `json:"locked"`
+}
+
+// Locked reports whether the lockout is in force.
+func (l *Lockout) Locked() bool {
+	return l != nil && time.Now().Before(l.Until)
+}
+
+// lock locks the lockout out for as long as its failures beyond the free ones require.
+func (l *Lockout) lock(limits Limits) {
+	if n := l.Failures - limits.Free; n > 0 {
+		d := time.Duration(math.Min(float64(limits.Base)*math.Pow(2, float64(n-1)),
+			float64(limits.Max)))
+		l.Until = l.Last.Add(d)
+	}
+}
+
+// checkLockout returns ErrLocked if the login or the address of the context is locked out, and
+// otherwise counts the attempt as a failure of both until loginSucceeded forgets it. The attempt
+// is counted before the password is checked and in a transaction, so that parallel guesses are
+// limited like consecutive ones.
+func checkLockout(c context.Context, login string) error {
+	return c.Db.Execute(func(tdb db.Db) error {
+		names := lockoutNames(c, login)
+		lockouts := make([]*Lockout, len(names))
+		for i, name := range names {
+			l, err := lockout(tdb, name)
+			if err != nil {
+				return err
+			} else if l.Locked() {
+				return ErrLocked
+			}
+			if l == nil {
+				l = &Lockout{Name: name}
+			} else if time.Since(l.Last) > FailureWindow {
+				l.Failures = 0
+			}
+			lockouts[i] = l
+		}
+		for i, l := range lockouts {
+			l.Failures++
+			l.Last = time.Now()
+			l.lock(lockoutLimits(i))
+			if _, err := lockoutRepository.Save(tdb, l, realm(tdb), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loginSucceeded forgets the failures of the login and the attempt counted for the address.
+func loginSucceeded(c context.Context, login string) error {
+	return c.Db.Execute(func(tdb db.Db) error {
+		names := lockoutNames(c, login)
+		if err := forgetLockout(tdb, names[0]); err != nil || len(names) == 1 {
+			return err
+		}
+		l, err := lockout(tdb, names[1])
+		if err != nil || l == nil || l.Failures == 0 {
+			return err
+		}
+		// The address was not locked out when the attempt was counted.
+		l.Failures--
+		l.Until = time.Time{}
+		_, err = lockoutRepository.Save(tdb, l, realm(tdb), nil)
+		return err
+	})
+}
+
+// forgetFailures forgets the failures of the login, but not those of the address of the context.
+func forgetFailures(c context.Context, login string) error {
+	return c.Db.Execute(func(tdb db.Db) error {
+		return forgetLockout(tdb, lockoutNames(c, login)[0])
+	})
+}
+
+// lockoutNames returns the names of the lockouts of the login and, if known, of the address of
+// the context. Logins are hashed, as they may be of any length.
+func lockoutNames(c context.Context, login string) []string {
+	names := []string{"login_" + tokenHash(login)}
+	if len(c.Address) > 0 {
+		names = append(names, "address_"+tokenHash(c.Address))
+	}
+	return names
+}
+
+// lockoutLimits returns the limits of the ith name of lockoutNames.
+func lockoutLimits(i int) Limits {
+	if i > 0 {
+		return AddressLimits
+	}
+	return LoginLimits
+}
+
+// lockout returns the lockout of the name, or nil if there are no failures.
+func lockout(d db.Db, name string) (*Lockout, error) {
+	keys, lockouts, err := lockoutRepository.GetAll(d, realm(d), db.Field("Name").Eq(name), nil)
+	if err != nil || len(lockouts) == 0 {
+		return nil, err
+	}
+	lockouts[0].SetKey(keys.KeyAt(0))
+	return lockouts[0], nil
+}
+
+func forgetLockout(d db.Db, name string) error {
+	keys, err := lockoutRepository.Keys(d, realm(d), db.Field("Name").Eq(name), 0)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return lockoutRepository.DeleteMulti(d, keys)
+}
+
+// UnlockUser forgets the failed logins of the user of the "user" param.
+func UnlockUser(c context.Context, _ map[string]interface{}, param map[string]string,
+	_ UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	return nil, forgetFailures(c, user.User)
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	defer func(login, address Limits) {
+		LoginLimits, AddressLimits = login, address
+	}(LoginLimits, AddressLimits)
+	LoginLimits = Limits{Free: 2, Base: 50 * time.Millisecond, Max: time.Hour}
+	AddressLimits = Limits{Free: 4, Base: time.Hour, Max: time.Hour}
+	_, _, admin := Login(c, "admin", "admin")
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "u", "password": "p"},
+		map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	param := map[string]string{"user": obj.(*User).Key.Encode()}
+	c.Address = "10.0.0.1"
+
+	for i := 0; i < 3; i++ {
+		if err, ok, _ := Login(c, "u", "wrong"); err != nil || ok {
+			t.Fatal("A wrong password must be rejected", err)
+		}
+	}
+	if err, _, _ := Login(c, "u", "p"); err != ErrLocked {
+		t.Error("The login must be locked out, got", err)
+	}
+	if obj, err = GetUser(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	} else if u := obj.(*userWithLockout); !u.Locked || u.Lockout.Failures != 3 {
+		t.Error("The lockout must be shown to the admins got", u.Lockout)
+	}
+	if obj, err = GetUser(c, nil, param, UserKey(obj.(*userWithLockout).Key)); err != nil {
+		t.Fatal(err)
+	} else if _, ok := obj.(*User); !ok {
+		t.Error("The lockout must only be shown to the admins")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err, ok, _ := Login(c, "u", "wrong"); err != nil || ok {
+		t.Fatal("A wrong password must be rejected after the lockout", err)
+	}
+	if err, _, _ := Login(c, "u", "p"); err != ErrLocked {
+		t.Error("The lockout must double, got", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err, _, _ := Login(c, "u", "p"); err != ErrLocked {
+		t.Error("The lockout must last twice as long, got", err)
+	}
+	if _, err = UnlockUser(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Login(c, "u", "p"); err != nil || !ok {
+		t.Error("The user must be unlocked", err)
+	}
+
+	// The fifth failure of the address locks it out for every login.
+	if err, ok, _ := Login(c, "nobody", "x"); err != nil || ok {
+		t.Fatal("An unknown login must be rejected", err)
+	}
+	if err, _, _ := Login(c, "admin", "admin"); err != ErrLocked {
+		t.Error("The address must be locked out, got", err)
+	}
+	c.Address = "10.0.0.2"
+	if err, ok, _ := Login(c, "admin", "admin"); err != nil || !ok {
+		t.Error("Other addresses must not be locked out", err)
+	}
+}
+
+func TestConcurrentLockout(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	// The password is checked slowly, for the guesses to run in parallel.
+	defer func(cost int) { passwordCost = cost }(passwordCost)
+	passwordCost = bcrypt.DefaultCost
+	initAdmin(t, c)
+	defer func(login Limits) { LoginLimits = login }(LoginLimits)
+	LoginLimits = Limits{Free: 2, Base: time.Hour, Max: time.Hour}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		checked int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err, ok, _ := Login(c, "admin", "wrong")
+			if ok {
+				t.Error("A wrong password must be rejected")
+			} else if err == nil {
+				mu.Lock()
+				checked++
+				mu.Unlock()
+			} else if err != ErrLocked {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if checked != 3 {
+		t.Error("Only the free attempts and the one locking out must be checked, got", checked)
+	}
+	if err, _, _ := Login(c, "admin", "admin"); err != ErrLocked {
+		t.Error("The login must be locked out, got", err)
+	}
+}
@@ -0,0 +1,301 @@
+package core
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"strings"
+	"time"
+)
+
+// An Organization is a tenant: its users only see each other and the charts of accounts created
+// in it. A user may belong to several organizations, like an accountant serving many clients,
+// and works in one of them at a time, its current organization.
+//
+// The users and charts of accounts of the databases created before organizations belong to the
+// default organization, the oldest one.
+type Organization struct {
+	db.Identifiable
+	Name string    `json:"name"`
+	AsOf time.Time `json:"timestamp"`
+}
+
+var OrganizationRepository = db.NewRepository[Organization]("Organization")
+
+func init() {
+	gob.Register((*Organization)(nil))
+	gob.Register(([]*Organization)(nil))
+}
+
+func (o *Organization) ValidationMessage(_ db.Db, _ map[string]string) string {
+	if len(strings.TrimSpace(o.Name)) == 0 {
+		return "The name must be informed"
+	}
+	return ""
+}
+
+// DefaultOrganization returns the key of the default organization, creating it if needed.
+func DefaultOrganization(c context.Context) (db.CKey, error) {
+	keys, _, err := OrganizationRepository.GetAllFromCache(c.Db, "", nil, []string{"AsOf"},
+		c.Cache, "organizations")
+	if err != nil {
+		return db.CKey{}, err
+	}
+	if len(keys) > 0 {
+		return keys[0], nil
+	}
+	key, err := OrganizationRepository.Save(c.Db, &Organization{Name: "Default",
+		AsOf: time.Now()}, "", nil)
+	if err != nil {
+		return db.CKey{}, err
+	}
+	return key.(db.CKey), c.Cache.Delete("organizations")
+}
+
+// organizations returns the keys of the organizations of the user. The users created before
+// organizations belong to the default one.
+func (u *User) organizations(c context.Context) ([]db.CKey, error) {
+	if len(u.Organizations) > 0 {
+		return u.Organizations, nil
+	}
+	key, err := DefaultOrganization(c)
+	if err != nil {
+		return nil, err
+	}
+	return []db.CKey{key}, nil
+}
+
+func (u *User) belongsTo(c context.Context, organization string) (bool, error) {
+	orgs, err := u.organizations(c)
+	if err != nil {
+		return false, err
+	}
+	for _, o := range orgs {
+		if o.Encode() == organization {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CurrentOrganization returns the key of the organization the user is working in: the one the
+// user switched to or else the first one the user belongs to. Admins may switch to any of them.
+func CurrentOrganization(c context.Context, userKey UserKey) (db.CKey, error) {
+	if db.CKey(userKey).IsZero() {
+		return DefaultOrganization(c)
+	}
+	user, err := UserRepository.Get(c.Db, userKey.Encode())
+	if err != nil {
+		return db.CKey{}, err
+	}
+	if !user.Organization.IsZero() {
+		if ok, err := user.belongsTo(c, user.Organization.Encode()); err != nil {
+			return db.CKey{}, err
+		} else if ok || user.Admin {
+			return user.Organization, nil
+		}
+	}
+	orgs, err := user.organizations(c)
+	if err != nil {
+		return db.CKey{}, err
+	}
+	return orgs[0], nil
+}
+
+// BelongsTo reports whether the user belongs to the organization, whose key is zero for the
+// things created before organizations.
+func BelongsTo(c context.Context, userKey UserKey, organization db.CKey) (bool, error) {
+	if db.CKey(userKey).IsZero() {
+		return false, nil
+	}
+	if organization.IsZero() {
+		var err error
+		if organization, err = DefaultOrganization(c); err != nil {
+			return false, err
+		}
+	}
+	user, err := UserRepository.Get(c.Db, userKey.Encode())
+	if err != nil {
+		return false, err
+	}
+	return user.belongsTo(c, organization.Encode())
+}
+
+// InCurrentOrganization returns a function that reports whether an organization, whose key is
+// zero for the things created before organizations, is the current organization of the user.
+func InCurrentOrganization(c context.Context, userKey UserKey) (func(db.CKey) bool, error) {
+	current, err := CurrentOrganization(c, userKey)
+	if err != nil {
+		return nil, err
+	}
+	def, err := DefaultOrganization(c)
+	if err != nil {
+		return nil, err
+	}
+	return func(organization db.CKey) bool {
+		if organization.IsZero() {
+			organization = def
+		}
+		return organization.Encode() == current.Encode()
+	}, nil
+}
+
+// AllOrganizations returns the organizations of the user, or every organization if the user is
+// an admin.
+func AllOrganizations(c context.Context, _ map[string]interface{}, _ map[string]string,
+	userKey UserKey) (interface{}, error) {
+	if _, err := DefaultOrganization(c); err != nil {
+		return nil, err
+	}
+	keys, orgs, err := OrganizationRepository.GetAll(c.Db, "", nil, []string{"Name"})
+	if err != nil {
+		return nil, err
+	}
+	user, err := UserRepository.Get(c.Db, userKey.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if user.Admin {
+		return orgs, nil
+	}
+	result := []*Organization{}
+	for i, o := range orgs {
+		if ok, err := user.belongsTo(c, keys[i].Encode()); err != nil {
+			return nil, err
+		} else if ok {
+			result = append(result, o)
+		}
+	}
+	return result, nil
+}
+
+// SaveOrganization creates or renames an organization. The admin creating an organization
+// belongs to it.
+func SaveOrganization(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	name, _ := m["name"].(string)
+	org := &Organization{Name: name, AsOf: time.Now()}
+	var before interface{}
+	if keyAsString, ok := param["organization"]; ok {
+		if o, err := OrganizationRepository.Get(c.Db, keyAsString); err != nil {
+			return nil, err
+		} else {
+			org.SetKey(o.Key)
+			org.AsOf = o.AsOf
+			before = o
+		}
+	} else if _, err := DefaultOrganization(c); err != nil {
+		// The default organization must be older than the new one.
+		return nil, err
+	}
+	if m := org.ValidationMessage(c.Db, param); len(m) > 0 {
+		return nil, errors.New(m)
+	}
+	var key db.Key
+	err := c.Db.Execute(func(tdb db.Db) (err error) {
+		if key, err = OrganizationRepository.Save(tdb, org, "", param); err != nil {
+			return
+		}
+		org.SetKey(key)
+		return auditUser(c, tdb, userKey, key, before, org)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Cache.Delete("organizations"); err != nil {
+		return nil, err
+	}
+	if _, ok := param["organization"]; !ok {
+		if err = addToOrganization(c, userKey, userKey.Encode(), key.(db.CKey)); err != nil {
+			return nil, err
+		}
+	}
+	return org, nil
+}
+
+// AddUserToOrganization makes the user of the "user" param belong to the organization of the
+// "organization" param.
+func AddUserToOrganization(c context.Context, _ map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	org, err := OrganizationRepository.Get(c.Db, param["organization"])
+	if err != nil {
+		return nil, err
+	}
+	return nil, addToOrganization(c, userKey, param["user"], org.Key)
+}
+
+// addToOrganization makes the user of memberKey belong to the organization on behalf of userKey.
+func addToOrganization(c context.Context, userKey UserKey, memberKey string,
+	organization db.CKey) error {
+	user, err := UserRepository.Get(c.Db, memberKey)
+	if err != nil {
+		return err
+	}
+	before := *user
+	if ok, err := user.belongsTo(c, organization.Encode()); err != nil || ok {
+		return err
+	}
+	orgs, err := user.organizations(c)
+	if err != nil {
+		return err
+	}
+	user.Organizations = append(orgs, organization)
+	return updateUser(c, userKey, &before, user)
+}
+
+// RemoveUserFromOrganization makes the user of the "user" param no longer belong to the
+// organization of the "organization" param. Users must belong to an organization.
+func RemoveUserFromOrganization(c context.Context, _ map[string]interface{},
+	param map[string]string, userKey UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	before := *user
+	orgs, err := user.organizations(c)
+	if err != nil {
+		return nil, err
+	}
+	var rest []db.CKey
+	for _, o := range orgs {
+		if o.Encode() != param["organization"] {
+			rest = append(rest, o)
+		}
+	}
+	if len(rest) == len(orgs) {
+		return nil, fmt.Errorf("The user does not belong to the organization")
+	}
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("The user must belong to an organization")
+	}
+	user.Organizations = rest
+	return nil, updateUser(c, userKey, &before, user)
+}
+
+// SwitchOrganization changes the current organization of the user to the one of the request,
+// which the user must belong to, unless the user is an admin.
+func SwitchOrganization(c context.Context, m map[string]interface{}, _ map[string]string,
+	userKey UserKey) (interface{}, error) {
+	keyAsString, _ := m["organization"].(string)
+	org, err := OrganizationRepository.Get(c.Db, keyAsString)
+	if err != nil {
+		return nil, err
+	}
+	user, err := UserRepository.Get(c.Db, userKey.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := user.belongsTo(c, keyAsString); err != nil {
+		return nil, err
+	} else if !ok && !user.Admin {
+		return nil, ErrForbidden
+	}
+	before := *user
+	user.Organization = org.Key
+	if err = updateUser(c, userKey, &before, user); err != nil {
+		return nil, err
+	}
+	return org, nil
+}
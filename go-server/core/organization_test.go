@@ -0,0 +1,102 @@
+package core
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"testing"
+)
+
+func checkUsers(t *testing.T, c context.Context, userKey UserKey, expected int) {
+	if obj, err := AllUsers(c, nil, nil, userKey); err != nil {
+		t.Fatal(err)
+	} else if users := obj.([]*User); len(users) != expected {
+		t.Errorf("%v users expected for %v got %v", expected, userKey.Encode(), len(users))
+	}
+}
+
+func TestOrganizations(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := Login(c, "admin", "admin")
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u1", "name": "u1", "password": "u1"},
+		map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1 := UserKey(obj.(*User).Key)
+	checkUsers(t, c, u1, 2)
+
+	if obj, err = SaveOrganization(c, map[string]interface{}{"name": "client"},
+		map[string]string{}, admin); err != nil {
+		t.Fatal(err)
+	}
+	client := obj.(*Organization).Key.Encode()
+	if _, err = SaveOrganization(c, map[string]interface{}{"name": " "}, map[string]string{},
+		admin); err == nil {
+		t.Error("An organization without a name must be rejected")
+	}
+	if _, err = SwitchOrganization(c, map[string]interface{}{"organization": client}, nil,
+		admin); err != nil {
+		t.Fatal(err)
+	}
+	checkUsers(t, c, admin, 1)
+	obj, err = SaveUser(c, map[string]interface{}{"user": "u2", "name": "u2", "password": "u2"},
+		map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2 := UserKey(obj.(*User).Key)
+	checkUsers(t, c, admin, 2)
+	checkUsers(t, c, u1, 2)
+	if obj, err = AllOrganizations(c, nil, nil, u2); err != nil {
+		t.Fatal(err)
+	} else if orgs := obj.([]*Organization); len(orgs) != 1 || orgs[0].Name != "client" {
+		t.Error("Only the organization of the user expected got", orgs)
+	}
+	if obj, err = AllOrganizations(c, nil, nil, admin); err != nil {
+		t.Fatal(err)
+	} else if orgs := obj.([]*Organization); len(orgs) != 2 {
+		t.Error("Every organization expected for an admin got", len(orgs))
+	}
+
+	if _, err = SwitchOrganization(c, map[string]interface{}{"organization": client}, nil,
+		u1); err != ErrForbidden {
+		t.Error("Forbidden expected got", err)
+	}
+	param := map[string]string{"organization": client, "user": u1.Encode()}
+	if _, err = AddUserToOrganization(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SwitchOrganization(c, map[string]interface{}{"organization": client}, nil,
+		u1); err != nil {
+		t.Fatal(err)
+	}
+	checkUsers(t, c, u1, 3)
+	if _, err = SaveUser(c, map[string]interface{}{"user": "u1", "name": "u1b"}, param,
+		u1); err != nil {
+		t.Fatal(err)
+	}
+	if organization, err := CurrentOrganization(c, u1); err != nil {
+		t.Fatal(err)
+	} else if organization.Encode() != client {
+		t.Error("The organizations must be kept when the user is changed")
+	}
+
+	if _, err = RemoveUserFromOrganization(c, nil, map[string]string{"organization": client,
+		"user": u2.Encode()}, admin); err == nil {
+		t.Error("A user must belong to an organization")
+	}
+	if _, err = RemoveUserFromOrganization(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if organization, err := CurrentOrganization(c, u1); err != nil {
+		t.Fatal(err)
+	} else if organization.Encode() == client {
+		t.Error("The user must leave the organization it was removed from")
+	}
+	checkUsers(t, c, u1, 2)
+}
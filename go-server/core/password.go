@@ -0,0 +1,190 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"strings"
+	"time"
+)
+
+// ErrPasswordChangeRequired is returned for every request of a user who must change the password,
+// but the change itself.
+var ErrPasswordChangeRequired = errors.New("Password change required")
+
+// A PasswordReset lets a user who forgot the password choose a new one without the old one. It is
+// issued by an admin, who hands the token to the user, and is used once before it expires. Like
+// the API keys, it is stored next to the users as the SHA-256 of the token, which is returned
+// once, when it is issued.
+type PasswordReset struct {
+	db.Identifiable
+	User    UserKey   `json:"user"`
+	Hash    string    `json:"-"`
+	Expires time.Time `json:"expires"`
+	// Token is the token itself, only filled in when the reset is issued.
+	Token string `json:"token,omitempty" datastore:"-"`
+}
+
+// PasswordResetLifetime is how long a password reset can be used.
+var PasswordResetLifetime = 24 * time.Hour
+
+var PasswordResetRepository = db.NewRepository[PasswordReset]("PasswordReset")
+
+func init() {
+	gob.Register((*PasswordReset)(nil))
+	db.RegisterIndex("PasswordReset", "User")
+}
+
+// CheckPasswordChange returns ErrPasswordChangeRequired if the user must change the password, or
+// ErrUnauthorized if the user was deleted. Whether the user must change it is cached, so that the
+// requests are checked without querying the users.
+func CheckPasswordChange(c context.Context, userKey UserKey) error {
+	var mustChange *bool
+	if err := c.Cache.Get("password_change_"+userKey.Encode(), &mustChange); err != nil {
+		return err
+	}
+	if mustChange == nil {
+		user, err := UserRepository.Get(c.Db, userKey.Encode())
+		if err != nil {
+			return ErrUnauthorized
+		}
+		mustChange = &user.MustChangePassword
+		if err = c.Cache.Set("password_change_"+userKey.Encode(), mustChange); err != nil {
+			return err
+		}
+	}
+	if *mustChange {
+		return ErrPasswordChangeRequired
+	}
+	return nil
+}
+
+// forgetPasswordChange removes from the cache whether the user must change the password, when it
+// changes or the user is deleted.
+func forgetPasswordChange(c context.Context, user db.Key) error {
+	return c.Cache.Delete("password_change_" + user.Encode())
+}
+
+// IssuePasswordReset returns a new password reset for the user of the "user" param, with the
+// token itself. The resets issued before for the user are revoked.
+func IssuePasswordReset(c context.Context, _ map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	if err = deletePasswordResets(c, user.Key); err != nil {
+		return nil, err
+	}
+	random, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	reset := &PasswordReset{User: UserKey(user.Key), Hash: tokenHash(random),
+		Expires: time.Now().Add(PasswordResetLifetime)}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if _, err := PasswordResetRepository.Save(tdb, reset, realm(tdb), nil); err != nil {
+			return err
+		}
+		return auditUser(c, tdb, userKey, reset.Key, nil, reset)
+	})
+	if err != nil {
+		return nil, err
+	}
+	reset.Token = encodeKey(reset.Key) + "." + random
+	return reset, nil
+}
+
+// ResetPassword sets the password of the user of a valid password reset token, which cannot be
+// used again, revokes the sessions of the user and forgets the failed logins of the user. The
+// reset is read again in the transaction that deletes it, as deleting a missing entity does not
+// fail on App Engine.
+func ResetPassword(c context.Context, token, password string) error {
+	if len(password) == 0 {
+		return errors.New("The password must be informed")
+	}
+	reset, err := passwordReset(c, token)
+	if err != nil {
+		return err
+	}
+	user, err := UserRepository.Get(c.Db, reset.User.Encode())
+	if err != nil {
+		return ErrUnauthorized
+	}
+	before := *user
+	if user.Password, err = hash(password); err != nil {
+		return err
+	}
+	user.MustChangePassword = false
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if _, err := PasswordResetRepository.Get(tdb, reset.Key.Encode()); err != nil {
+			return ErrUnauthorized
+		}
+		if err := PasswordResetRepository.Delete(tdb, reset.Key); err != nil {
+			return err
+		}
+		if err := auditUser(c, tdb, reset.User, reset.Key, reset, nil); err != nil {
+			return err
+		}
+		if _, err := UserRepository.Save(tdb, user, realm(tdb), nil); err != nil {
+			return err
+		}
+		return auditUser(c, tdb, reset.User, user.Key, &before, user)
+	})
+	if err != nil {
+		return err
+	}
+	if err = revokeSessions(c, user.Key); err != nil {
+		return err
+	}
+	if err = forgetPasswordChange(c, user.Key); err != nil {
+		return err
+	}
+	return forgetFailures(c, user.User)
+}
+
+// passwordReset returns the unexpired password reset of the token.
+func passwordReset(c context.Context, token string) (*PasswordReset, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrUnauthorized
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	if key, err := c.Db.DecodeKey(string(b)); err != nil ||
+		key.Kind() != PasswordResetRepository.Kind() {
+		return nil, ErrUnauthorized
+	}
+	reset, err := PasswordResetRepository.Get(c.Db, string(b))
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(reset.Hash), []byte(tokenHash(parts[1]))) != 1 ||
+		!time.Now().Before(reset.Expires) {
+		return nil, ErrUnauthorized
+	}
+	return reset, nil
+}
+
+func deletePasswordResets(c context.Context, user db.Key) error {
+	keys, err := PasswordResetRepository.Keys(c.Db, realm(c.Db), db.Field("User").Eq(user), 0)
+	if err != nil {
+		return err
+	}
+	return PasswordResetRepository.DeleteMulti(c.Db, keys)
+}
+
+// randomPassword returns a password of 16 letters and digits.
+func randomPassword() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32Encoding.EncodeToString(b)), nil
+}
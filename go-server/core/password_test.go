@@ -0,0 +1,200 @@
+package core
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInitUserManagement(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	t.Setenv(AdminPasswordVariable, "")
+	password, err := InitUserManagement(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(password) != 16 {
+		t.Fatal("A random password expected got", password)
+	}
+	if err, ok, _ := Login(c, "admin", "admin"); err != nil || ok {
+		t.Error("The admin password must not be admin", err)
+	}
+	if again, err := InitUserManagement(c); err != nil || len(again) > 0 {
+		t.Error("The admin user must be created only once", again, err)
+	}
+	tokens, err := NewSession(c, "admin", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tokens.MustChangePassword {
+		t.Error("The tokens must tell the admin to change the password")
+	}
+	_, _, admin := Login(c, "admin", password)
+	if err = CheckPasswordChange(c, admin); err != ErrPasswordChangeRequired {
+		t.Error("Password change required expected got", err)
+	}
+	if _, err = ChangePassword(c, map[string]interface{}{"oldPassword": password,
+		"newPassword": password}, nil, admin); err == nil {
+		t.Error("The new password must be different")
+	}
+	if _, err = ChangePassword(c, map[string]interface{}{"oldPassword": password,
+		"newPassword": "secret"}, nil, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckPasswordChange(c, admin); err != nil {
+		t.Error("The password was changed", err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := Login(c, "admin", "admin")
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "u", "password": "u",
+		"mustChangePassword": true}, map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := UserKey(obj.(*User).Key)
+	param := map[string]string{"user": u.Encode()}
+	if err = CheckPasswordChange(c, u); err != ErrPasswordChangeRequired {
+		t.Error("Password change required expected got", err)
+	}
+	if _, err = SaveUser(c, map[string]interface{}{"user": "u", "name": "u",
+		"mustChangePassword": false}, param, u); err != ErrForbidden {
+		t.Error("Forbidden expected got", err)
+	}
+	tokens, err := NewSession(c, "u", "u", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = IssuePasswordReset(c, nil, param, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := obj.(*PasswordReset).Token
+	obj, err = IssuePasswordReset(c, nil, param, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := obj.(*PasswordReset).Token
+	if err = ResetPassword(c, first, "new"); err != ErrUnauthorized {
+		t.Error("A new reset must revoke the older ones", err)
+	}
+	if err = ResetPassword(c, token+"x", "new"); err != ErrUnauthorized {
+		t.Error("Unauthorized expected got", err)
+	}
+	if err = ResetPassword(c, encodeKey(db.CKey(u))+".x", "new"); err != ErrUnauthorized {
+		t.Error("The key of a user must be refused as a reset, got", err)
+	}
+	if err = ResetPassword(c, token, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Login(c, "u", "new"); err != nil || !ok {
+		t.Error("The new password must be accepted", err)
+	}
+	if _, err = Refresh(c, tokens.RefreshToken); err != ErrUnauthorized {
+		t.Error("The sessions opened before the reset must be revoked, got", err)
+	}
+	if err = CheckPasswordChange(c, u); err != nil {
+		t.Error("The password was reset", err)
+	}
+	if err = ResetPassword(c, token, "again"); err != ErrUnauthorized {
+		t.Error("A reset must be used once", err)
+	}
+	defer func(lifetime time.Duration) { PasswordResetLifetime = lifetime }(PasswordResetLifetime)
+	PasswordResetLifetime = -time.Second
+	if obj, err = IssuePasswordReset(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err = ResetPassword(c, obj.(*PasswordReset).Token, "again"); err != ErrUnauthorized {
+		t.Error("An expired reset must be refused", err)
+	}
+	if _, err = SaveUser(c, map[string]interface{}{"user": "u", "name": "u",
+		"mustChangePassword": true}, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckPasswordChange(c, u); err != ErrPasswordChangeRequired {
+		t.Error("Password change required expected got", err)
+	}
+	if _, err = DeleteUser(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckPasswordChange(c, u); err != ErrUnauthorized {
+		t.Error("A deleted user must be unauthorized, got", err)
+	}
+}
+
+// datastoreDb deletes like the App Engine datastore, which does not fail for missing entities.
+type datastoreDb struct {
+	db.Db
+}
+
+func (d datastoreDb) Execute(f func(db.Db) error) error {
+	return d.Db.Execute(func(tdb db.Db) error {
+		return f(datastoreDb{tdb})
+	})
+}
+
+func (d datastoreDb) Delete(key db.Key) error {
+	d.Db.Delete(key)
+	return nil
+}
+
+func TestConcurrentPasswordReset(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := Login(c, "admin", "admin")
+	obj, err := IssuePasswordReset(c, nil, map[string]string{"user": admin.Encode()}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := obj.(*PasswordReset).Token
+	// The passwords are hashed slowly, for the uses of the token to run in parallel.
+	defer func(cost int) { passwordCost = cost }(passwordCost)
+	passwordCost = bcrypt.DefaultCost
+	c.Db = datastoreDb{c.Db}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		reset int
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ResetPassword(c, token, "new"); err == nil {
+				mu.Lock()
+				reset++
+				mu.Unlock()
+			} else if err != ErrUnauthorized {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if reset != 1 {
+		t.Error("A reset must be used once, but was used", reset)
+	}
+	if err = ResetPassword(c, token, "again"); err != ErrUnauthorized {
+		t.Error("A used reset must be refused, got", err)
+	}
+}
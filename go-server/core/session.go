@@ -0,0 +1,343 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Session is opened by a login with the password and lasts until it is revoked by a logout or
+// its refresh token expires. It is identified by its key, which is part of its tokens:
+//
+//	access token:  base64(session key).expiration.base64(HMAC-SHA256 of both)
+//	refresh token: base64(session key).base64(random bytes)
+//
+// Access tokens are short lived and checked without querying the users. Refresh tokens are
+// stored as their SHA-256 and replaced every time they are used.
+type Session struct {
+	db.Identifiable
+	User         UserKey
+	RefreshToken string
+	Expires      time.Time
+	Revoked      bool
+}
+
+// secret is the key signing the access tokens, generated on the first login. Its value is kept
+// base64 encoded, as the SQL databases do not store byte slices.
+type secret struct {
+	db.Identifiable
+	Value string
+}
+
+// Tokens are the result of a login or a refresh.
+type Tokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	// ExpiresIn is the number of seconds the access token is valid.
+	ExpiresIn int64 `json:"expiresIn"`
+	// MustChangePassword tells the client that only the password can be changed with the tokens.
+	MustChangePassword bool `json:"mustChangePassword,omitempty"`
+}
+
+var (
+	AccessTokenLifetime  = 15 * time.Minute
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// ErrUnauthorized is returned when the credentials or tokens are wrong, expired or revoked.
+var ErrUnauthorized = errors.New("Unauthorized")
+
+var (
+	SessionRepository = db.NewRepository[Session]("Session")
+	secretRepository  = db.NewRepository[secret]("Secret")
+)
+
+func init() {
+	gob.Register((*Session)(nil))
+	gob.Register((*secret)(nil))
+	db.RegisterIndex("Session", "User")
+}
+
+// NewSession checks the login and password, and the code of the second factor of the users who
+// have one, and opens a session for the user.
+func NewSession(c context.Context, login, password, code string) (*Tokens, error) {
+	err, user, userKey := checkLogin(c, login, password)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUnauthorized
+	}
+	if user.TOTPEnabled {
+		if len(code) == 0 {
+			return nil, ErrCodeRequired
+		}
+		if ok, err := user.checkSecondFactor(c, code); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrUnauthorized
+		}
+	}
+	if err = loginSucceeded(c, login); err != nil {
+		return nil, err
+	}
+	session := &Session{User: userKey}
+	refreshToken, err := session.newRefreshToken(c.Db)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := session.tokens(c, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	tokens.MustChangePassword = user.MustChangePassword
+	return tokens, nil
+}
+
+// Refresh replaces the refresh token of a session and issues a new access token. The session is
+// read again in the transaction that replaces the token, so that a token is used only once and a
+// session revoked in the meantime is not brought back.
+func Refresh(c context.Context, refreshToken string) (*Tokens, error) {
+	session, err := sessionOfRefreshToken(c, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	key := session.Key
+	err = c.Db.Execute(func(tdb db.Db) (err error) {
+		if session, err = SessionRepository.Get(tdb, key.Encode()); err != nil {
+			return ErrUnauthorized
+		}
+		session.SetKey(key)
+		if session.Revoked || !time.Now().Before(session.Expires) ||
+			!session.hasRefreshToken(refreshToken) {
+			return ErrUnauthorized
+		}
+		refreshToken, err = session.newRefreshToken(tdb)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Cache.Delete("session_" + session.Key.Encode()); err != nil {
+		return nil, err
+	}
+	return session.tokens(c, refreshToken)
+}
+
+// Logout revokes the session of an access or refresh token.
+func Logout(c context.Context, token string) error {
+	var (
+		session *Session
+		err     error
+	)
+	if strings.Count(token, ".") == 2 {
+		session, err = sessionOfAccessToken(c, token)
+	} else {
+		session, err = sessionOfRefreshToken(c, token)
+	}
+	if err != nil {
+		return err
+	}
+	session.Revoked = true
+	if _, err = SessionRepository.Save(c.Db, session, realm(c.Db), nil); err != nil {
+		return err
+	}
+	return c.Cache.Delete("session_" + session.Key.Encode())
+}
+
+// revokeSessions revokes the sessions of the user, whose tokens are rejected from then on, as when
+// the user is deleted or the password changes.
+func revokeSessions(c context.Context, user db.Key) error {
+	keys, sessions, err := SessionRepository.GetAll(c.Db, realm(c.Db), db.Field("User").Eq(user),
+		nil)
+	if err != nil {
+		return err
+	}
+	for i, session := range sessions {
+		if session.Revoked || !time.Now().Before(session.Expires) {
+			continue
+		}
+		session.SetKey(keys.KeyAt(i))
+		session.Revoked = true
+		if _, err = SessionRepository.Save(c.Db, session, realm(c.Db), nil); err != nil {
+			return err
+		}
+		if err = c.Cache.Delete("session_" + session.Key.Encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the user of a valid access token.
+func Authenticate(c context.Context, accessToken string) (error, bool, UserKey) {
+	session, err := sessionOfAccessToken(c, accessToken)
+	if err == ErrUnauthorized {
+		return nil, false, UserKey{}
+	} else if err != nil {
+		return err, false, UserKey{}
+	}
+	return nil, true, session.User
+}
+
+func (s *Session) newRefreshToken(d db.Db) (string, error) {
+	random, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	s.RefreshToken = tokenHash(random)
+	s.Expires = time.Now().Add(RefreshTokenLifetime)
+	if _, err := SessionRepository.Save(d, s, realm(d), nil); err != nil {
+		return "", err
+	}
+	return encodeKey(s.Key) + "." + random, nil
+}
+
+func (s *Session) tokens(c context.Context, refreshToken string) (*Tokens, error) {
+	key, err := signingKey(c)
+	if err != nil {
+		return nil, err
+	}
+	payload := encodeKey(s.Key) + "." +
+		strconv.FormatInt(time.Now().Add(AccessTokenLifetime).Unix(), 10)
+	return &Tokens{
+		AccessToken:  payload + "." + sign(key, payload),
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(AccessTokenLifetime / time.Second),
+	}, nil
+}
+
+func sessionOfAccessToken(c context.Context, accessToken string) (*Session, error) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized
+	}
+	key, err := signingKey(c)
+	if err != nil {
+		return nil, err
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(key, payload))) {
+		return nil, ErrUnauthorized
+	}
+	if expires, err := strconv.ParseInt(parts[1], 10, 64); err != nil ||
+		time.Now().Unix() >= expires {
+		return nil, ErrUnauthorized
+	}
+	return session(c, parts[0])
+}
+
+func sessionOfRefreshToken(c context.Context, refreshToken string) (*Session, error) {
+	parts := strings.Split(refreshToken, ".")
+	if len(parts) != 2 {
+		return nil, ErrUnauthorized
+	}
+	s, err := session(c, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if !s.hasRefreshToken(refreshToken) {
+		return nil, ErrUnauthorized
+	}
+	return s, nil
+}
+
+// hasRefreshToken reports whether the refresh token is the current one of the session.
+func (s *Session) hasRefreshToken(refreshToken string) bool {
+	parts := strings.Split(refreshToken, ".")
+	return len(parts) == 2 &&
+		subtle.ConstantTimeCompare([]byte(s.RefreshToken), []byte(tokenHash(parts[1]))) == 1
+}
+
+// session returns the valid session of the encoded key, from the cache if possible, so that
+// requests with an access token do not query the database.
+func session(c context.Context, encodedKey string) (*Session, error) {
+	b, err := base64.RawURLEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	keyAsString := string(b)
+	if key, err := c.Db.DecodeKey(keyAsString); err != nil ||
+		key.Kind() != SessionRepository.Kind() {
+		return nil, ErrUnauthorized
+	}
+	var s *Session
+	if err = c.Cache.Get("session_"+keyAsString, &s); err != nil {
+		return nil, err
+	}
+	if s == nil {
+		if s, err = SessionRepository.Get(c.Db, keyAsString); err != nil {
+			return nil, ErrUnauthorized
+		}
+		if err = c.Cache.Set("session_"+keyAsString, s); err != nil {
+			return nil, err
+		}
+	}
+	if s.Revoked || !time.Now().Before(s.Expires) {
+		return nil, ErrUnauthorized
+	}
+	return s, nil
+}
+
+// signingKey returns the key signing the access tokens, creating it if needed.
+func signingKey(c context.Context) (key []byte, err error) {
+	if err = c.Cache.Get("token_secret", &key); err != nil || len(key) > 0 {
+		return
+	}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		_, secrets, err := secretRepository.GetAll(tdb, realm(tdb), nil, nil)
+		if err != nil {
+			return err
+		}
+		var value string
+		if len(secrets) > 0 {
+			value = secrets[0].Value
+		} else if value, err = randomToken(); err != nil {
+			return err
+		} else if _, err = secretRepository.Save(tdb, &secret{Value: value}, realm(tdb),
+			nil); err != nil {
+			return err
+		}
+		key, err = base64.RawURLEncoding.DecodeString(value)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Cache.Set("token_secret", key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func encodeKey(key db.Key) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key.Encode()))
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	if _, err = NewSession(c, "admin", "wrong", ""); err != ErrUnauthorized {
+		t.Error("A wrong password must be rejected, got", err)
+	}
+	tokens, err := NewSession(c, "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, ok, userKey := Authenticate(c, tokens.AccessToken)
+	if err != nil || !ok {
+		t.Fatal("The access token must be accepted", err)
+	}
+	if _, _, adminKey := userByLogin(c, "admin"); userKey.Encode() != adminKey.Encode() {
+		t.Errorf("User %v expected got %v", adminKey.Encode(), userKey.Encode())
+	}
+	forged := tokens.AccessToken[:strings.LastIndex(tokens.AccessToken, ".")+1] + "x"
+	if err, ok, _ := Authenticate(c, forged); err != nil || ok {
+		t.Error("A forged access token must be rejected", err)
+	}
+	if err, ok, _ := Authenticate(c, tokens.RefreshToken); err != nil || ok {
+		t.Error("A refresh token must not be accepted as an access token", err)
+	}
+	if _, err = Refresh(c, encodeKey(db.CKey(userKey))+".x"); err != ErrUnauthorized {
+		t.Error("A refresh token of a user must be rejected, got", err)
+	}
+	if err = Logout(c, encodeKey(db.CKey(userKey))+".x"); err != ErrUnauthorized {
+		t.Error("A logout token of a user must be rejected, got", err)
+	}
+
+	refreshed, err := Refresh(c, tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Refresh(c, tokens.RefreshToken); err != ErrUnauthorized {
+		t.Error("A used refresh token must be rejected, got", err)
+	}
+	if err, ok, _ := Authenticate(c, refreshed.AccessToken); err != nil || !ok {
+		t.Error("The refreshed access token must be accepted", err)
+	}
+
+	if err = Logout(c, refreshed.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Authenticate(c, tokens.AccessToken); err != nil || ok {
+		t.Error("The access tokens of a revoked session must be rejected", err)
+	}
+	if _, err = Refresh(c, refreshed.RefreshToken); err != ErrUnauthorized {
+		t.Error("The refresh token of a revoked session must be rejected, got", err)
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	tokens, err := NewSession(c, "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		refreshed int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Refresh(c, tokens.RefreshToken); err == nil {
+				mu.Lock()
+				refreshed++
+				mu.Unlock()
+			} else if err != ErrUnauthorized {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshed != 1 {
+		t.Error("A refresh token must be used once, but was used", refreshed)
+	}
+
+	// The session is revoked while the cache still has it valid, as by a logout that runs
+	// between the check of the token and its replacement.
+	if tokens, err = NewSession(c, "admin", "admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Authenticate(c, tokens.AccessToken); err != nil || !ok {
+		t.Fatal("The access token must be accepted", err)
+	}
+	keyAsString := strings.Split(tokens.RefreshToken, ".")[0]
+	revoked, err := session(c, keyAsString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked.Revoked = true
+	if _, err = SessionRepository.Save(c.Db, revoked, realm(c.Db), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Refresh(c, tokens.RefreshToken); err != ErrUnauthorized {
+		t.Error("The refresh token of a revoked session must be rejected, got", err)
+	}
+	if s, err := SessionRepository.Get(c.Db, revoked.Key.Encode()); err != nil {
+		t.Fatal(err)
+	} else if !s.Revoked {
+		t.Error("The revoked session must not be brought back")
+	}
+}
+
+func TestSessionsOfDeletedUser(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := Login(c, "admin", "admin")
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "u", "password": "u"},
+		map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewSession(c, "u", "u", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Authenticate(c, tokens.AccessToken); err != nil || !ok {
+		t.Fatal("The access token must be accepted", err)
+	}
+	if _, err = DeleteUser(c, nil, map[string]string{"user": obj.(*User).Key.Encode()},
+		admin); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Authenticate(c, tokens.AccessToken); err != nil || ok {
+		t.Error("The access tokens of a deleted user must be rejected", err)
+	}
+	if _, err = Refresh(c, tokens.RefreshToken); err != ErrUnauthorized {
+		t.Error("The refresh token of a deleted user must be rejected, got", err)
+	}
+}
+
+func TestSessionExpiration(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	defer func(access, refresh time.Duration) {
+		AccessTokenLifetime, RefreshTokenLifetime = access, refresh
+	}(AccessTokenLifetime, RefreshTokenLifetime)
+	AccessTokenLifetime, RefreshTokenLifetime = -time.Second, -time.Second
+	tokens, err := NewSession(c, "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Authenticate(c, tokens.AccessToken); err != nil || ok {
+		t.Error("An expired access token must be rejected", err)
+	}
+	if _, err = Refresh(c, tokens.RefreshToken); err != ErrUnauthorized {
+		t.Error("An expired refresh token must be rejected, got", err)
+	}
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The second factor of the users is a TOTP (RFC 6238) code, shown by authenticator apps: the
+// HMAC-SHA1 of the number of 30 seconds periods since the epoch, truncated to 6 digits. A user
+// enrolls by requesting a secret, which is added to the app by its provisioning URI, and
+// confirming it with a code. From then on, sessions are only opened with a code, or with one of
+// the recovery codes returned by the confirmation, each used once.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods a code is accepted before or after its own, to tolerate
+	// clocks that are not in sync.
+	totpSkew = 1
+	// TOTPIssuer is the name of the account in the authenticator apps.
+	TOTPIssuer = "Geek Accounting"
+	// RecoveryCodes is the number of recovery codes of a user.
+	RecoveryCodes = 10
+)
+
+// ErrCodeRequired is returned by NewSession when the password is right but the user has a second
+// factor and no code was informed.
+var ErrCodeRequired = errors.New("Code required")
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Enrollment is the result of a request of a second factor.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// URI of the secret, usually shown as a QR code.
+	URI string `json:"uri"`
+}
+
+// EnrollSecondFactor generates a new TOTP secret for the user of the "user" param. The secret is
+// only checked at login once it is confirmed by ConfirmSecondFactor.
+func EnrollSecondFactor(c context.Context, _ map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, fmt.Errorf("The second factor is already enabled")
+	}
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	before := *user
+	user.TOTPSecret = base32Encoding.EncodeToString(b)
+	if err = updateUser(c, userKey, &before, user); err != nil {
+		return nil, err
+	}
+	return &Enrollment{Secret: user.TOTPSecret, URI: provisioningURI(user.User, user.TOTPSecret)}, nil
+}
+
+// ConfirmSecondFactor enables the second factor of the user of the "user" param if the code of
+// the request is right, returning the recovery codes of the user.
+func ConfirmSecondFactor(c context.Context, m map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled || len(user.TOTPSecret) == 0 {
+		return nil, fmt.Errorf("The second factor must be requested first")
+	}
+	code, _ := m["code"].(string)
+	before := *user
+	if ok, err := user.checkTOTP(code, time.Now()); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("Wrong code")
+	}
+	codes := make([]string, RecoveryCodes)
+	user.RecoveryCodes = make([]string, RecoveryCodes)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32Encoding.EncodeToString(b))
+		codes[i] = s[:4] + "-" + s[4:]
+		user.RecoveryCodes[i] = tokenHash(codes[i])
+	}
+	user.TOTPEnabled = true
+	if err = updateUser(c, userKey, &before, user); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"recoveryCodes": codes}, nil
+}
+
+// ResetSecondFactor removes the second factor of the user of the "user" param, who logs in with
+// the password only until enrolling again. It is meant for the admins, when a user loses both the
+// authenticator and the recovery codes. The sessions of the user are revoked, as they may have been
+// opened by whoever holds the lost authenticator.
+func ResetSecondFactor(c context.Context, _ map[string]interface{}, param map[string]string,
+	userKey UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	before := *user
+	user.TOTPSecret, user.TOTPEnabled, user.TOTPCounter, user.RecoveryCodes = "", false, 0, nil
+	if err = updateUser(c, userKey, &before, user); err != nil {
+		return nil, err
+	}
+	return nil, revokeSessions(c, user.Key)
+}
+
+// checkSecondFactor reports whether the code is a TOTP code or a recovery code of the user, saving
+// the user so that the code is not accepted again.
+func (u *User) checkSecondFactor(c context.Context, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	ok, err := u.checkTOTP(code, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		for i, hash := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(tokenHash(code))) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		return false, nil
+	}
+	_, err = UserRepository.Save(c.Db, u, realm(c.Db), nil)
+	return err == nil, err
+}
+
+// checkTOTP reports whether the code is the TOTP code of the user at t, or of the periods around
+// it, and is newer than the last code accepted, which becomes the code's period.
+func (u *User) checkTOTP(code string, t time.Time) (bool, error) {
+	if len(code) != totpDigits {
+		return false, nil
+	}
+	secret, err := base32Encoding.DecodeString(u.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	counter := t.Unix() / totpPeriod
+	for i := counter - totpSkew; i <= counter+totpSkew; i++ {
+		if i > u.TOTPCounter &&
+			subtle.ConstantTimeCompare([]byte(totp(secret, i)), []byte(code)) == 1 {
+			u.TOTPCounter = i
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// totp returns the code of the secret for the counter, as defined by RFC 4226.
+func totp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func provisioningURI(login, secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + login)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
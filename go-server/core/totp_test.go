@@ -0,0 +1,107 @@
+package core
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	for _, test := range []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	} {
+		if code := totp(secret, test.time/totpPeriod); code != test.code {
+			t.Errorf("Code %v expected at %v got %v", test.code, test.time, code)
+		}
+	}
+}
+
+func TestSecondFactor(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	initAdmin(t, c)
+	_, _, admin := Login(c, "admin", "admin")
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "u", "password": "p"},
+		map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := UserKey(obj.(*User).Key)
+	param := map[string]string{"user": u.Encode()}
+	if obj, err = EnrollSecondFactor(c, nil, param, u); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32Encoding.DecodeString(obj.(*Enrollment).Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Login(c, "u", "p"); err != nil || !ok {
+		t.Error("The second factor must not be checked before it is confirmed", err)
+	}
+	counter := time.Now().Unix() / totpPeriod
+	if _, err = ConfirmSecondFactor(c, map[string]interface{}{"code": "000000"}, param,
+		u); err == nil {
+		t.Error("A wrong code must be rejected")
+	}
+	code := totp(secret, counter)
+	if obj, err = ConfirmSecondFactor(c, map[string]interface{}{"code": code}, param,
+		u); err != nil {
+		t.Fatal(err)
+	}
+	recoveryCodes := obj.(map[string]interface{})["recoveryCodes"].([]string)
+	if len(recoveryCodes) != RecoveryCodes {
+		t.Errorf("%v recovery codes expected got %v", RecoveryCodes, len(recoveryCodes))
+	}
+
+	if err, ok, _ := Login(c, "u", "p"); err != nil || ok {
+		t.Error("The password alone must be rejected", err)
+	}
+	if _, err = NewSession(c, "u", "p", ""); err != ErrCodeRequired {
+		t.Error("Code required expected got", err)
+	}
+	if _, err = NewSession(c, "u", "p", code); err != ErrUnauthorized {
+		t.Error("A code must not be used twice, got", err)
+	}
+	if _, err = NewSession(c, "u", "p", totp(secret, counter+1)); err != nil {
+		t.Error("The next code must be accepted", err)
+	}
+	if _, err = NewSession(c, "u", "wrong", totp(secret, counter+1)); err != ErrUnauthorized {
+		t.Error("A wrong password must be rejected, got", err)
+	}
+	tokens, err := NewSession(c, "u", "p", recoveryCodes[0])
+	if err != nil {
+		t.Fatal("A recovery code must be accepted", err)
+	}
+	if _, err = NewSession(c, "u", "p", recoveryCodes[0]); err != ErrUnauthorized {
+		t.Error("A recovery code must not be used twice, got", err)
+	}
+	if _, err = SaveUser(c, map[string]interface{}{"user": "u", "name": "u2"}, param,
+		u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSession(c, "u", "p", ""); err != ErrCodeRequired {
+		t.Error("The second factor must be kept when the user is changed, got", err)
+	}
+
+	if _, err = ResetSecondFactor(c, nil, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Login(c, "u", "p"); err != nil || !ok {
+		t.Error("The password alone must be accepted after a reset", err)
+	}
+	if _, err = Refresh(c, tokens.RefreshToken); err != ErrUnauthorized {
+		t.Error("The sessions opened before the reset must be revoked, got", err)
+	}
+}
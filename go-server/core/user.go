@@ -2,10 +2,15 @@ package core
 
 import (
 	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	//"log"
 	"github.com/mcesarhm/geek-accounting/go-server/context"
 	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"golang.org/x/crypto/bcrypt"
+	"os"
 	"strings"
 )
 
@@ -27,13 +32,49 @@ func (key UserKey) Encode() string {
 	return db.CKey(key).Encode()
 }
 
+func (key UserKey) GobEncode() ([]byte, error) {
+	return db.CKey(key).GobEncode()
+}
+
+func (key *UserKey) GobDecode(b []byte) error {
+	return (*db.CKey)(key).GobDecode(b)
+}
+
 type User struct {
 	db.Identifiable
 	User     string `json:"user"`
 	Name     string `json:"name"`
 	Password string `json:"-"`
+	// Admin users manage the users and have every permission on every chart of accounts.
+	Admin bool `json:"admin"`
+	// Organizations are the ones the user belongs to and Organization is the current one.
+	Organizations []db.CKey `json:"organizations"`
+	Organization  db.CKey   `json:"organization"`
+	// TOTPEnabled tells whether the user confirmed the TOTPSecret, the second factor. TOTPCounter
+	// is the period of the last code accepted and RecoveryCodes are the SHA-256 of the codes not
+	// used yet.
+	TOTPEnabled   bool     `json:"totp"`
+	TOTPSecret    string   `json:"-"`
+	TOTPCounter   int64    `json:"-"`
+	RecoveryCodes []string `json:"-"`
+	// MustChangePassword blocks every request of the user but the change of the password.
+	MustChangePassword bool `json:"mustChangePassword"`
 }
 
+var UserRepository = db.NewRepository[User]("User")
+
+func init() {
+	gob.Register((*User)(nil))
+	db.RegisterIndex("User", "User")
+	db.RegisterIndex("User", "Admin")
+}
+
+// ErrForbidden is returned when the user is authenticated but is not allowed to do something.
+var ErrForbidden = errors.New("Forbidden")
+
+// A Check returns ErrForbidden if the user is not allowed to call a handler with the params.
+type Check func(c context.Context, param map[string]string, userKey UserKey) error
+
 func (u *User) ValidationMessage(_ db.Db, _ map[string]string) string {
 	if len(strings.TrimSpace(u.User)) == 0 {
 		return "The login must be informed"
@@ -44,56 +85,198 @@ func (u *User) ValidationMessage(_ db.Db, _ map[string]string) string {
 	return ""
 }
 
-func InitUserManagement(c context.Context) (err error) {
+// AdminPasswordVariable is the environment variable with the password of the admin user created
+// on the first run.
+const AdminPasswordVariable = "GA_ADMIN_PASSWORD"
+
+// InitUserManagement creates the admin user on the first run, when there are no users. Its
+// password is the one of the GA_ADMIN_PASSWORD environment variable or else a random one, which is
+// returned to be shown once and must be changed on the first login.
+func InitUserManagement(c context.Context) (password string, err error) {
+	var users db.Keys
+	if users, err = UserRepository.Keys(c.Db, realm(c.Db), nil, 1); err != nil {
+		return
+	}
+	if len(users) == 0 {
+		admin := &User{User: "admin", Name: "admin", Admin: true}
+		generated := false
+		if password = os.Getenv(AdminPasswordVariable); len(password) == 0 {
+			if password, err = randomPassword(); err != nil {
+				return
+			}
+			generated, admin.MustChangePassword = true, true
+		}
+		if admin.Password, err = hash(password); err != nil {
+			return
+		}
+		if _, err = UserRepository.Save(c.Db, admin, realm(c.Db), nil); err != nil || !generated {
+			return "", err
+		}
+		return password, nil
+	}
 	var user *User
-	err, user, _ = userByLogin(c, "admin", true)
-	if err != nil {
+	if err, user, _ = userByLogin(c, "admin"); err != nil || user == nil {
 		return
 	}
-	if user == nil {
-		_, err = c.Db.Save(&User{User: "admin", Password: hash("admin"), Name: "admin"},
-			"User", realm(c.Db), nil)
-		if err != nil {
+	// The admin user of the databases created before the admin role keeps managing the users.
+	if !user.Admin {
+		var admins db.Keys
+		admins, err = UserRepository.Keys(c.Db, realm(c.Db), db.Field("Admin").Eq(true), 1)
+		if err != nil || len(admins) > 0 {
 			return
 		}
+		user.Admin = true
+		_, err = UserRepository.Save(c.Db, user, realm(c.Db), nil)
 	}
 	return
 }
 
-func Login(c context.Context, login, password string) (error, bool, UserKey) {
-	err, user, key := userByLogin(c, login, false)
+// IsAdmin reports whether the user has the admin role.
+func IsAdmin(c context.Context, userKey UserKey) (bool, error) {
+	if db.CKey(userKey).IsZero() {
+		return false, nil
+	}
+	user, err := UserRepository.Get(c.Db, userKey.Encode())
 	if err != nil {
+		return false, err
+	}
+	return user.Admin, nil
+}
+
+// AdminOnly allows only the admin users.
+func AdminOnly(c context.Context, _ map[string]string, userKey UserKey) error {
+	if ok, err := IsAdmin(c, userKey); err != nil {
+		return err
+	} else if !ok {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// SelfOrAdmin allows the user of the "user" param and the admin users.
+func SelfOrAdmin(c context.Context, param map[string]string, userKey UserKey) error {
+	if userKey.Encode() == param["user"] {
+		return nil
+	}
+	return AdminOnly(c, param, userKey)
+}
+
+// Login checks the login and password of the users without a second factor, who may send them on
+// every request. The users with a second factor open sessions instead.
+func Login(c context.Context, login, password string) (error, bool, UserKey) {
+	err, user, key := checkLogin(c, login, password)
+	if err != nil || user == nil || user.TOTPEnabled {
 		return err, false, UserKey{}
 	}
-	if user == nil || user.Password != hash(password) {
-		return nil, false, UserKey{}
+	if err = loginSucceeded(c, login); err != nil {
+		return err, false, UserKey{}
 	}
 	return nil, true, key
 }
 
+// checkLogin returns the user of the login if the password is right. The attempt is counted as a
+// failure until the caller calls loginSucceeded. It returns ErrLocked if the login or the address
+// are locked out.
+func checkLogin(c context.Context, login, password string) (error, *User, UserKey) {
+	if err := checkLockout(c, login); err != nil {
+		return err, nil, UserKey{}
+	}
+	err, user, key := userByLogin(c, login)
+	if err != nil {
+		return err, nil, UserKey{}
+	}
+	ok, upgrade := false, false
+	if user != nil {
+		ok, upgrade = checkPassword(user.Password, password)
+	}
+	if !ok {
+		return nil, nil, UserKey{}
+	}
+	if upgrade {
+		if user.Password, err = hash(password); err != nil {
+			return err, nil, UserKey{}
+		}
+		if _, err = UserRepository.Save(c.Db, user, realm(c.Db), nil); err != nil {
+			return err, nil, UserKey{}
+		}
+	}
+	return nil, user, key
+}
+
 func ChangePassword(c context.Context, m map[string]interface{}, _ map[string]string, userKey UserKey) (item interface{}, err error) {
-	user := User{}
-	_, err = c.Db.Get(&user, userKey.Encode())
+	user, err := UserRepository.Get(c.Db, userKey.Encode())
 	if err != nil {
 		return
 	}
-	if user.Password != hash(m["oldPassword"].(string)) {
+	if ok, _ := checkPassword(user.Password, m["oldPassword"].(string)); !ok {
 		return nil, fmt.Errorf("Wrong old password")
 	}
-	user.Password = hash(m["newPassword"].(string))
-	_, err = c.Db.Save(&user, "User", realm(c.Db), nil)
+	if user.MustChangePassword && m["newPassword"] == m["oldPassword"] {
+		return nil, fmt.Errorf("The new password must be different from the old one")
+	}
+	before := *user
+	if user.Password, err = hash(m["newPassword"].(string)); err != nil {
+		return
+	}
+	user.MustChangePassword = false
+	if err = updateUser(c, userKey, &before, user); err != nil {
+		return
+	}
+	if err = revokeSessions(c, user.Key); err != nil {
+		return
+	}
+	err = forgetPasswordChange(c, user.Key)
 	return
 }
 
+// updateUser saves the user changed from before on behalf of userKey, with the audit entry of the
+// change in the same transaction.
+func updateUser(c context.Context, userKey UserKey, before, user *User) error {
+	return c.Db.Execute(func(tdb db.Db) error {
+		if _, err := UserRepository.Save(tdb, user, realm(tdb), nil); err != nil {
+			return err
+		}
+		return auditUser(c, tdb, userKey, user.Key, before, user)
+	})
+}
+
+// AllUsers returns the users of the current organization of the user.
 func AllUsers(c context.Context, _ map[string]interface{}, _ map[string]string,
-	_ UserKey) (interface{}, error) {
-	users, _, err := c.Db.GetAll("User", realm(c.Db), &[]User{}, nil, []string{"User"})
-	return users, err
+	userKey UserKey) (interface{}, error) {
+	organization, err := CurrentOrganization(c, userKey)
+	if err != nil {
+		return nil, err
+	}
+	_, users, err := UserRepository.GetAll(c.Db, realm(c.Db), nil, []string{"User"})
+	if err != nil {
+		return nil, err
+	}
+	result := []*User{}
+	for _, u := range users {
+		if ok, err := u.belongsTo(c, organization.Encode()); err != nil {
+			return nil, err
+		} else if ok {
+			result = append(result, u)
+		}
+	}
+	return result, nil
 }
 
+// GetUser returns the user of the "user" param, with its failed logins if an admin asks.
 func GetUser(c context.Context, _ map[string]interface{}, param map[string]string,
-	_ UserKey) (interface{}, error) {
-	return c.Db.Get(&User{}, param["user"])
+	userKey UserKey) (interface{}, error) {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	if admin, err := IsAdmin(c, userKey); err != nil || !admin {
+		return user, err
+	}
+	l, err := lockout(c.Db, lockoutNames(c, user.User)[0])
+	if err != nil {
+		return nil, err
+	}
+	return &userWithLockout{user, l, l.Locked()}, nil
 }
 
 func SaveUser(c context.Context, m map[string]interface{}, param map[string]string, userKey UserKey) (item interface{}, err error) {
@@ -103,30 +286,74 @@ func SaveUser(c context.Context, m map[string]interface{}, param map[string]stri
 		Name: m["name"].(string),
 	}
 
+	var u *User
 	if userKeyAsString, ok := param["user"]; ok {
 		if k, err := c.Db.DecodeKey(userKeyAsString); err != nil {
 			return nil, err
 		} else {
 			user.SetKey(k)
 		}
+		if u, err = UserRepository.Get(c.Db, userKeyAsString); err != nil {
+			return
+		}
+		user.Admin = u.Admin
+		user.Organizations, user.Organization = u.Organizations, u.Organization
+		user.TOTPEnabled, user.TOTPSecret = u.TOTPEnabled, u.TOTPSecret
+		user.TOTPCounter, user.RecoveryCodes = u.TOTPCounter, u.RecoveryCodes
+		user.MustChangePassword = u.MustChangePassword
 		if password, ok := m["password"]; !ok || len(password.(string)) == 0 {
-			var u User
-			_, err = c.Db.Get(&u, userKeyAsString)
-			if err != nil {
-				return
-			}
 			user.Password = u.Password
-		} else {
-			user.Password = hash(password.(string))
+		} else if user.Password, err = hash(password.(string)); err != nil {
+			return
 		}
+	} else if user.Password, err = hash(m["password"].(string)); err != nil {
+		return
 	} else {
-		user.Password = hash(m["password"].(string))
+		// A new user belongs to the organization it was created in.
+		var organization db.CKey
+		if organization, err = CurrentOrganization(c, userKey); err != nil {
+			return
+		}
+		user.Organizations = []db.CKey{organization}
 	}
 
-	if k, err := c.Db.Save(user, "User", realm(c.Db), param); err != nil {
-		return nil, err
-	} else {
+	// Only the admins grant and revoke the admin role.
+	if admin, ok := m["admin"].(bool); ok && admin != user.Admin {
+		if err = AdminOnly(c, param, userKey); err != nil {
+			return
+		}
+		user.Admin = admin
+	}
+	// And only they make a user change the password they informed.
+	if mustChange, ok := m["mustChangePassword"].(bool); ok && mustChange != user.MustChangePassword {
+		if err = AdminOnly(c, param, userKey); err != nil {
+			return
+		}
+		user.MustChangePassword = mustChange
+	}
+
+	var before interface{}
+	if u != nil {
+		before = u
+	}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		k, err := UserRepository.Save(tdb, user, realm(tdb), param)
+		if err != nil {
+			return err
+		}
 		user.SetKey(k)
+		return auditUser(c, tdb, userKey, user.Key, before, user)
+	})
+	if err != nil {
+		return
+	}
+	if u != nil && user.Password != u.Password {
+		if err = revokeSessions(c, user.Key); err != nil {
+			return
+		}
+	}
+	if err = forgetPasswordChange(c, user.Key); err != nil {
+		return
 	}
 
 	item = user
@@ -135,37 +362,75 @@ func SaveUser(c context.Context, m map[string]interface{}, param map[string]stri
 }
 
 func DeleteUser(c context.Context, m map[string]interface{}, param map[string]string, userKey UserKey) (_ interface{}, err error) {
-	if key, err := c.Db.DecodeKey(param["user"]); err != nil {
+	user, err := UserRepository.Get(c.Db, param["user"])
+	if err != nil {
+		return nil, err
+	}
+	if err = deleteAPIKeys(c, userKey, user.Key); err != nil {
+		return nil, err
+	}
+	if err = deletePasswordResets(c, user.Key); err != nil {
+		return nil, err
+	}
+	if err = revokeSessions(c, user.Key); err != nil {
+		return nil, err
+	}
+	err = c.Db.Execute(func(tdb db.Db) error {
+		if err := UserRepository.Delete(tdb, user.Key); err != nil {
+			return err
+		}
+		return auditUser(c, tdb, userKey, user.Key, user, nil)
+	})
+	if err != nil {
 		return nil, err
+	}
+	return nil, forgetPasswordChange(c, user.Key)
+}
+
+// passwordCost is the bcrypt cost of the password hashes. Hashes of a lower cost are upgraded on
+// the next login.
+var passwordCost = bcrypt.DefaultCost
+
+// hash returns the bcrypt hash of the password, which embeds a random salt and the cost and
+// starts with the "$2a$" format prefix.
+func hash(password string) (string, error) {
+	if b, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost); err != nil {
+		return "", err
 	} else {
-		return nil, c.Db.Delete(key)
+		return string(b), nil
 	}
 }
 
-func hash(s string) string {
-	return fmt.Sprintf("%x", sha1.New().Sum([]byte(s)))
+// legacyHash is how passwords were stored before bcrypt: the hex of the password appended to the
+// SHA-1 of nothing, with no salt at all.
+func legacyHash(password string) string {
+	return fmt.Sprintf("%x", sha1.New().Sum([]byte(password)))
 }
 
-func userByLogin(c context.Context, login string, init bool) (err error, user *User, key UserKey) {
-	var users []User
-	keys, _, err := c.Db.GetAll("User", realm(c.Db), &users, map[string]interface{}{"User = ": login}, nil)
+// checkPassword reports whether the password matches the stored hash and, if so, whether the hash
+// must be replaced because it has a legacy format or a cost lower than passwordCost.
+func checkPassword(hashed, password string) (ok, upgrade bool) {
+	if !strings.HasPrefix(hashed, "$2") {
+		ok = subtle.ConstantTimeCompare([]byte(hashed), []byte(legacyHash(password))) == 1
+		return ok, ok
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hashed))
+	return true, err != nil || cost < passwordCost
+}
+
+func userByLogin(c context.Context, login string) (err error, user *User, key UserKey) {
+	keys, users, err := UserRepository.GetAll(c.Db, realm(c.Db), db.Field("User").Eq(login), nil)
 	if err != nil {
 		return
 	}
 	if len(users) == 0 {
-		if login == "admin" && !init {
-			if err = InitUserManagement(c); err != nil {
-				return
-			}
-			keys, _, err = c.Db.GetAll("User", realm(c.Db), &users, map[string]interface{}{"User = ": login}, nil)
-			if err != nil {
-				return
-			}
-		}
 		return
 	}
-	user = &users[0]
-	key = UserKey(keys.KeyAt(0).(db.CKey))
+	user = users[0]
+	key = UserKey(keys[0])
 	return
 }
 
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func init() {
+	passwordCost = bcrypt.MinCost
+}
+
+// initAdmin creates the admin user with the "admin" password.
+func initAdmin(t *testing.T, c context.Context) {
+	t.Setenv(AdminPasswordVariable, "admin")
+	if _, err := InitUserManagement(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveUser(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "n", "password": "p"},
+		map[string]string{}, NewUserKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := obj.(*User)
+	if !strings.HasPrefix(user.Password, "$2a$") {
+		t.Error("A bcrypt hash expected got", user.Password)
+	}
+	if other, err := hash("p"); err != nil {
+		t.Fatal(err)
+	} else if other == user.Password {
+		t.Error("Hashes of the same password must be salted")
+	}
+	key := user.Key.Encode()
+	if obj, err = SaveUser(c, map[string]interface{}{"user": "u", "name": "n2"},
+		map[string]string{"user": key}, NewUserKey()); err != nil {
+		t.Fatal(err)
+	} else if obj.(*User).Password != user.Password {
+		t.Error("The password must be kept when not informed")
+	}
+	if _, err = SaveUser(c, map[string]interface{}{"user": "u", "name": "n2", "password": "p2"},
+		map[string]string{"user": key}, NewUserKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Login(c, "u", "p"); err != nil || ok {
+		t.Error("The old password must be rejected", err)
+	}
+	if err, ok, _ := Login(c, "u", "p2"); err != nil || !ok {
+		t.Error("The new password must be accepted", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "n", "password": "p"},
+		map[string]string{}, NewUserKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := UserKey(obj.(*User).Key)
+	tokens, err := NewSession(c, "u", "p", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ChangePassword(c, map[string]interface{}{"oldPassword": "x", "newPassword": "p2"},
+		nil, key); err == nil {
+		t.Error("A wrong old password must be rejected")
+	}
+	if _, err = ChangePassword(c, map[string]interface{}{"oldPassword": "p", "newPassword": "p2"},
+		nil, key); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Login(c, "u", "p"); err != nil || ok {
+		t.Error("The old password must be rejected", err)
+	}
+	if err, ok, _ := Authenticate(c, tokens.AccessToken); err != nil || ok {
+		t.Error("The sessions opened with the old password must be revoked", err)
+	}
+	if _, err = Refresh(c, tokens.RefreshToken); err != ErrUnauthorized {
+		t.Error("The sessions opened with the old password must be revoked, got", err)
+	}
+	if err, ok, k := Login(c, "u", "p2"); err != nil || !ok {
+		t.Error("The new password must be accepted", err)
+	} else if k.Encode() != key.Encode() {
+		t.Errorf("Key %v expected got %v", key.Encode(), k.Encode())
+	}
+}
+
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	key, err := UserRepository.Save(c.Db, &User{User: "u", Name: "n", Password: legacyHash("p")},
+		realm(c.Db), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok, _ := Login(c, "u", "x"); err != nil || ok {
+		t.Error("A wrong password must be rejected", err)
+	}
+	if user, err := UserRepository.Get(c.Db, key.Encode()); err != nil {
+		t.Fatal(err)
+	} else if user.Password != legacyHash("p") {
+		t.Error("The hash must not be upgraded by a failed login")
+	}
+	if err, ok, _ := Login(c, "u", "p"); err != nil || !ok {
+		t.Fatal("The legacy password must be accepted", err)
+	}
+	if user, err := UserRepository.Get(c.Db, key.Encode()); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(user.Password, "$2a$") {
+		t.Error("The hash must be upgraded to bcrypt got", user.Password)
+	}
+	if err, ok, _ := Login(c, "u", "p"); err != nil || !ok {
+		t.Error("The password must still be accepted", err)
+	}
+}
+
+func TestAdminRole(t *testing.T) {
+	c := context.Context{}
+	ac, err := context.NewContext(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	// The admin of an older database, without the role.
+	adminKey, err := UserRepository.Save(c.Db, &User{User: "admin", Name: "admin",
+		Password: legacyHash("admin")}, realm(c.Db), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = InitUserManagement(c); err != nil {
+		t.Fatal(err)
+	}
+	admin := UserKey(adminKey.(db.CKey))
+	if ok, err := IsAdmin(c, admin); err != nil || !ok {
+		t.Fatal("The admin user must have the admin role", err)
+	}
+	obj, err := SaveUser(c, map[string]interface{}{"user": "u", "name": "u", "password": "u"},
+		map[string]string{}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := UserKey(obj.(*User).Key)
+	param := map[string]string{"user": u.Encode()}
+	if err = AdminOnly(c, param, u); err != ErrForbidden {
+		t.Error("Forbidden expected got", err)
+	}
+	if err = SelfOrAdmin(c, param, u); err != nil {
+		t.Error("A user must manage itself", err)
+	}
+	m := map[string]interface{}{"user": "u", "name": "u", "admin": true}
+	if _, err = SaveUser(c, m, param, u); err != ErrForbidden {
+		t.Error("A user must not grant itself the admin role, got", err)
+	}
+	if _, err = SaveUser(c, m, param, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err = AdminOnly(c, param, u); err != nil {
+		t.Error("The admin role must be granted", err)
+	}
+	if _, err = SaveUser(c, map[string]interface{}{"user": "u", "name": "u2"}, param,
+		u); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsAdmin(c, u); err != nil || !ok {
+		t.Error("The admin role must be kept when the user is changed", err)
+	}
+}
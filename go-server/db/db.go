@@ -4,22 +4,38 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 
 	"github.com/mcesarhm/geek-accounting/go-server/cache"
-	"github.com/mcesarhm/geek-accounting/go-server/extensions/collections"
-	//"log"
-
-	"strings"
-	"time"
+	xmath "github.com/mcesarhm/geek-accounting/go-server/extensions/math"
 )
 
 type Db interface {
 	Get(item interface{}, keyAsString string) (interface{}, error)
-	GetAll(kind string, ancestor string, items interface{}, filters M, orderKeys []string) (Keys, interface{}, error)
-	GetAllWithLimit(kind string, ancestor string, items interface{}, filters M, orderKeys []string, limit int) (Keys, interface{}, error)
-	GetAllFromCache(kind string, ancestor string, items interface{}, filters M, orderKeys []string, c cache.Cache, cacheKey string) (Keys, interface{}, error)
+	GetAll(kind string, ancestor string, items interface{}, query Query, orderKeys []string) (Keys, interface{}, error)
+	GetAllWithLimit(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int) (Keys, interface{}, error)
+	GetAllFromCache(kind string, ancestor string, items interface{}, query Query, orderKeys []string, c cache.Cache, cacheKey string) (Keys, interface{}, error)
+	// GetPage returns at most limit items after the cursor, in the order of orderKeys and then of
+	// their keys, and the cursor of the next page, which is empty after the last page. An empty
+	// cursor starts at the first item and a limit of 0 returns every item after the cursor.
+	GetPage(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int, cursor string) (Keys, interface{}, string, error)
+	// Iterate calls f with the key of each item satisfying the query and a pointer to the item, in
+	// the order of orderKeys, without loading every item in memory. The iteration stops at the
+	// first error returned by f, which is returned by Iterate.
+	Iterate(kind string, ancestor string, query Query, orderKeys []string, f func(Key, interface{}) error) error
+	// GetMulti loads the items of the keys into items, a pointer to a slice of structs or of
+	// pointers to them. If some of the items cannot be loaded, it returns a MultiError.
+	GetMulti(items interface{}, keys Keys) (interface{}, error)
 	Save(item interface{}, kind string, ancestor string, param map[string]string) (key Key, err error)
+	// SaveMulti saves the items, a slice of pointers to structs, and returns their keys. Unlike
+	// Save, it does not validate the items, which must have been validated before. If some of the
+	// items cannot be saved, it returns a MultiError and zero keys for them.
+	SaveMulti(items interface{}, kind string, ancestor string) (Keys, error)
 	Delete(Key) error
+	// DeleteMulti deletes the items of the keys. If some of them cannot be deleted, it returns a
+	// MultiError.
+	DeleteMulti(Keys) error
 	Execute(func(Db) error) error
 	DecodeKey(string) (Key, error)
 	NewKey() Key
@@ -30,6 +46,8 @@ type Key interface {
 	String() string
 	Encode() string
 	Parent() Key
+	// Kind returns the kind of the item of the key.
+	Kind() string
 	IsZero() bool
 	MarshalJSON() ([]byte, error)
 	UnmarshalJSON([]byte) error
@@ -37,6 +55,42 @@ type Key interface {
 
 type Keys []CKey
 
+// MultiError is returned by the operations on many items when some of them fail, with the error
+// of each item, or nil, at its position.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	var first error
+	n := 0
+	for _, err := range m {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "(0 errors)"
+	case 1:
+		return first.Error()
+	case 2:
+		return fmt.Sprintf("%v (and 1 other error)", first)
+	}
+	return fmt.Sprintf("%v (and %v other errors)", first, n-1)
+}
+
+// multiError returns nil if none of the errors is set, or a MultiError with them otherwise.
+func multiError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return MultiError(errs)
+		}
+	}
+	return nil
+}
+
 func (keys Keys) Len() int {
 	return len(keys)
 }
@@ -55,6 +109,33 @@ func (keys Keys) Swap(i, j int) {
 
 type M map[string]interface{}
 
+// Page is a page of items returned by a handler along with the cursor of the next page, which is
+// empty after the last page.
+type Page struct {
+	Items interface{}
+	Next  string
+}
+
+// PageParams returns the limit and cursor parameters of a list request. Without a limit every item
+// after the cursor is returned.
+func PageParams(param map[string]string) (limit int, cursor string, err error) {
+	if s := param["limit"]; len(s) > 0 {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return 0, "", fmt.Errorf("Invalid limit: %v", s)
+		}
+	}
+	return limit, param["cursor"], nil
+}
+
+// Paged returns the items and the cursor of the next page as a Page if a page was requested,
+// or just the items otherwise.
+func Paged(param map[string]string, items interface{}, next string) interface{} {
+	if len(param["limit"]) == 0 && len(param["cursor"]) == 0 {
+		return items
+	}
+	return Page{Items: items, Next: next}
+}
+
 type Identifiable struct {
 	Key CKey `datastore:"-" json:"_id"`
 }
@@ -77,6 +158,37 @@ type ValidationMessager interface {
 	ValidationMessage(Db, map[string]string) string
 }
 
+// Viewer is implemented by the databases that can run a function against a consistent snapshot of
+// their data without blocking writers.
+type Viewer interface {
+	View(func(Db) error) error
+}
+
+// View runs f against a consistent snapshot of d if it supports them, or against d otherwise.
+func View(d Db, f func(Db) error) error {
+	if v, ok := d.(Viewer); ok {
+		return v.View(f)
+	}
+	return f(d)
+}
+
+var kinds = map[string]reflect.Type{}
+
+// RegisterKind associates the kind with the struct type of its items. Databases that keep a schema
+// per kind, like the SQL one, create it from the registered types.
+func RegisterKind(kind string, item interface{}) {
+	kinds[kind] = reflect.Indirect(reflect.ValueOf(item)).Type()
+}
+
+var indexes = map[string][]string{}
+
+// RegisterIndex declares that the items of the kind are looked up by the field, which may be a
+// path like "Debits.Account". Databases that keep the items in memory maintain an index of the
+// field and use it for equality and range filters; the others rely on their own indexes.
+func RegisterIndex(kind string, field string) {
+	indexes[kind] = append(indexes[kind], field)
+}
+
 func keysAsStrings(keys Keys) []string {
 	result := []string{}
 	for i := 0; i < keys.Len(); i++ {
@@ -97,28 +209,6 @@ func stringsAsKeys(db Db, strings []string) (Keys, error) {
 	return result, nil
 }
 
-type comparable interface {
-	Less(i comparable) bool
-}
-
-type intComparable int
-
-func (a intComparable) Less(b comparable) bool {
-	return a < b.(intComparable)
-}
-
-type stringComparable string
-
-func (a stringComparable) Less(b comparable) bool {
-	return a < b.(stringComparable)
-}
-
-type timeComparable time.Time
-
-func (a timeComparable) Less(b comparable) bool {
-	return time.Time(a).Before(time.Time(b.(timeComparable)))
-}
-
 type byFields struct {
 	keys   Keys
 	values reflect.Value
@@ -134,20 +224,15 @@ func (a byFields) Swap(i, j int) {
 
 func (a byFields) Less(i, j int) bool {
 	for _, f := range a.fields {
-		less := "<"
-		greater := ">"
+		direction := 1
 		if f[0:1] == "-" {
 			f = f[1:len(f)]
-			less = ">"
-			greater = "<"
+			direction = -1
 		}
-		vi := reflect.Indirect(a.values.Index(i)).FieldByName(f).Interface()
-		vj := reflect.Indirect(a.values.Index(j)).FieldByName(f).Interface()
-		if ok, _ := compare(vi, vj, greater); ok {
-			return false
-		}
-		if ok, _ := compare(vi, vj, less); ok {
-			return true
+		vi := fieldByName(reflect.Indirect(a.values.Index(i)), f).Interface()
+		vj := fieldByName(reflect.Indirect(a.values.Index(j)), f).Interface()
+		if c, _ := compareValues(vi, vj); c != 0 {
+			return c*direction < 0
 		}
 	}
 	return false
@@ -159,10 +244,10 @@ func swap(arr reflect.Value, i, j int) {
 	arr.Index(j).Set(t)
 }
 
-func filter(d Db, keys Keys, items interface{}, filters map[string]interface{}) (Keys, interface{}, error) {
+func filter(d Db, keys Keys, items interface{}, query Query) (Keys, interface{}, error) {
 	resultKeys := Keys{}
 	iv := reflect.ValueOf(items)
-	if iv.IsNil() {
+	if !iv.IsValid() || iv.Kind() == reflect.Ptr && iv.IsNil() {
 		return nil, nil, errors.New("Invalid entity type")
 	}
 	iv = reflect.Indirect(iv)
@@ -173,7 +258,7 @@ func filter(d Db, keys Keys, items interface{}, filters map[string]interface{})
 		if ii.Type().Elem().Kind() != reflect.Ptr {
 			item = reflect.Indirect(item)
 		}
-		if ok, err := Matches(item.Interface(), filters); err != nil {
+		if ok, err := Matches(item.Interface(), query); err != nil {
 			return nil, nil, err
 		} else if ok {
 			resultKeys = resultKeys.Append(keys.KeyAt(i))
@@ -183,71 +268,144 @@ func filter(d Db, keys Keys, items interface{}, filters map[string]interface{})
 	return resultKeys, resultItems.Interface(), nil
 }
 
-func Matches(value interface{}, filters map[string]interface{}) (bool, error) {
-	item := reflect.Indirect(reflect.ValueOf(value))
-	for k, v := range filters {
-		keyArray := strings.Split(k, " ")
-		fn := keyArray[0]
-		operator := keyArray[1]
-		f := item.FieldByName(fn)
-		if f.Kind() == reflect.Slice {
-			if !strings.HasSuffix(k, " =") {
-				return false, fmt.Errorf("Operators other than equal are not allowed")
-			}
-			found := false
-			for j := 0; j < f.Len(); j++ {
-				if f.Index(j).Interface() == v {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return false, nil
-			}
-		} else if operator == "=" {
-			if f.Interface() != v {
-				return false, nil
-			}
-		} else if collections.Contains([]string{"<", ">", "<=", ">="}, operator) {
-			ok, err := compare(f.Interface(), v, operator)
-			if err != nil {
-				return false, err
-			}
-			if !ok {
-				return false, nil
-			}
+// filterSortAndLimit applies the query, ordering and limit to items already loaded in memory, as
+// done by the databases that cannot push them down to the storage.
+func filterSortAndLimit(d Db, keys Keys, items reflect.Value, query Query, orderKeys []string,
+	limit int) (Keys, reflect.Value, error) {
+	if query != nil {
+		if filteredKeys, filteredItems, err := filter(d, keys, items.Interface(), query); err != nil {
+			return nil, reflect.Value{}, err
 		} else {
-			return false, fmt.Errorf("Operator not allowed: " + operator)
+			keys = filteredKeys
+			items = reflect.ValueOf(filteredItems)
 		}
 	}
-	return true, nil
+	if orderKeys != nil {
+		sort.Sort(byFields{keys, items, orderKeys})
+	}
+	if limit > 0 {
+		limitedKeys := Keys{}
+		limitedItems := reflect.MakeSlice(items.Type(), 0, 0)
+		for i := 0; i < xmath.Min(limit, items.Len()); i++ {
+			limitedItems = reflect.Append(limitedItems, items.Index(i))
+			limitedKeys = limitedKeys.Append(keys.KeyAt(i))
+		}
+		keys = limitedKeys
+		items = limitedItems
+	}
+	return keys, items, nil
 }
 
-func compare(v1, v2 interface{}, operator string) (bool, error) {
-	var c1, c2 comparable
-	if intValue, ok := v1.(int); ok {
-		c1 = intComparable(intValue)
-		c2 = intComparable(v2.(int))
-	} else if stringValue, ok := v1.(string); ok {
-		c1 = stringComparable(stringValue)
-		c2 = stringComparable(v2.(string))
-	} else if timeValue, ok := v1.(time.Time); ok {
-		c1 = timeComparable(timeValue)
-		c2 = timeComparable(v2.(time.Time))
-	} else {
-		return false, fmt.Errorf("Type not allowed: %v", reflect.ValueOf(v1).Type())
+// newItems sets items, a pointer to a slice of structs or of pointers to them, to a slice of n
+// items and returns a function that returns a pointer to each of them.
+func newItems(items interface{}, n int) (func(int) interface{}, error) {
+	itemsValue := reflect.ValueOf(items)
+	if itemsValue.Kind() != reflect.Ptr || itemsValue.Elem().Kind() != reflect.Slice {
+		return nil, errors.New("Invalid entity type: " + itemsValue.Kind().String())
 	}
-	if (operator == "<") && !c1.Less(c2) {
-		return false, nil
+	itemsValue = itemsValue.Elem()
+	itemsValue.Set(reflect.MakeSlice(itemsValue.Type(), n, n))
+	isPtr := itemsValue.Type().Elem().Kind() == reflect.Ptr
+	return func(i int) interface{} {
+		v := itemsValue.Index(i)
+		if !isPtr {
+			return v.Addr().Interface()
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface()
+	}, nil
+}
+
+// getMulti implements GetMulti for the databases that get the items one by one.
+func getMulti(d Db, items interface{}, keys Keys) (interface{}, error) {
+	item, err := newItems(items, len(keys))
+	if err != nil {
+		return nil, err
 	}
-	if (operator == "<=") && c2.Less(c1) {
-		return false, nil
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		_, errs[i] = d.Get(item(i), key.Encode())
 	}
-	if (operator == ">") && !c2.Less(c1) {
-		return false, nil
+	return items, multiError(errs)
+}
+
+// saveMulti implements SaveMulti for the databases that save the items one by one with save, which
+// does not validate them.
+func saveMulti(save func(item interface{}) (Key, error), items interface{}) (Keys, error) {
+	itemsValue := reflect.ValueOf(items)
+	if itemsValue.Kind() != reflect.Slice {
+		return nil, errors.New("Invalid entity type: " + itemsValue.Kind().String())
 	}
-	if (operator == ">=") && c1.Less(c2) {
-		return false, nil
+	keys := make(Keys, itemsValue.Len())
+	errs := make([]error, itemsValue.Len())
+	for i := range keys {
+		if key, err := save(itemsValue.Index(i).Interface()); err != nil {
+			errs[i] = err
+		} else {
+			keys[i] = key.(CKey)
+		}
+	}
+	return keys, multiError(errs)
+}
+
+// deleteMulti implements DeleteMulti for the databases that delete the items one by one.
+func deleteMulti(d Db, keys Keys) error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = d.Delete(key)
+	}
+	return multiError(errs)
+}
+
+// getAllFromCache caches all items of the kind and ancestor and applies the query and ordering on
+// the cached items.
+func getAllFromCache(d Db, kind string, ancestor string, items interface{}, query Query,
+	orderKeys []string, c cache.Cache, cacheKey string) (Keys, interface{}, error) {
+	arr := []interface{}{}
+	err := c.Get(cacheKey, &arr)
+	if err == nil && len(arr) == 0 {
+		all := reflect.New(reflect.Indirect(reflect.ValueOf(items)).Type())
+		if keys, _, err := d.GetAll(kind, ancestor, all.Interface(), nil, nil); err != nil {
+			return nil, nil, err
+		} else {
+			arr = []interface{}{keysAsStrings(keys), all.Elem().Interface()}
+			if err := c.Set(cacheKey, arr); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	cachedKeys, err := stringsAsKeys(d, arr[0].([]string))
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, result, err := filter(d, cachedKeys, arr[1], query)
+	if err != nil {
+		return nil, nil, err
+	}
+	resultItems := reflect.ValueOf(result)
+	if orderKeys != nil {
+		sort.Sort(byFields{keys, resultItems, orderKeys})
+	}
+	reflect.Indirect(reflect.ValueOf(items)).Set(resultItems)
+	return keys, items, nil
+}
+
+func isValidEntityType(p reflect.Value) bool {
+	return p.Kind() == reflect.Ptr && !p.IsNil() && p.Elem().Kind() == reflect.Struct
+}
+
+// setItem sets the struct pointed by p to the one pointed by stored, unless they are of different
+// types, as when the key of an item of another kind is loaded.
+func setItem(p reflect.Value, stored interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(stored))
+	if !v.IsValid() || v.Type() != reflect.Indirect(p).Type() {
+		return fmt.Errorf("Invalid entity type: %v is not %v", reflect.TypeOf(stored),
+			reflect.Indirect(p).Type())
 	}
-	return true, nil
+	reflect.Indirect(p).Set(v)
+	return nil
 }
@@ -41,6 +41,13 @@ func (key CKey) Parent() Key {
 	return CKey{key.DsKey.Parent()}
 }
 
+func (key CKey) Kind() string {
+	if key.DsKey == nil {
+		return ""
+	}
+	return key.DsKey.Kind()
+}
+
 func (key CKey) IsZero() bool {
 	return key.DsKey == nil
 }
@@ -62,6 +69,22 @@ func (key CKey) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (key CKey) GobEncode() ([]byte, error) {
+	if key.DsKey == nil {
+		return []byte{}, nil
+	}
+	return key.DsKey.GobEncode()
+}
+
+func (key *CKey) GobDecode(b []byte) error {
+	if len(b) == 0 {
+		key.DsKey = nil
+		return nil
+	}
+	key.DsKey = new(datastore.Key)
+	return key.DsKey.GobDecode(b)
+}
+
 func (db appengineDb) Get(item interface{}, keyAsString string) (result interface{}, err error) {
 	key, err := datastore.DecodeKey(keyAsString)
 	if err != nil {
@@ -78,11 +101,78 @@ func (db appengineDb) Get(item interface{}, keyAsString string) (result interfac
 	return
 }
 
-func (db appengineDb) GetAll(kind string, ancestor string, items interface{}, filters M, orderKeys []string) (Keys, interface{}, error) {
-	return db.GetAllWithLimit(kind, ancestor, items, filters, orderKeys, 0)
+// maxItemsPerBatch is the maximum number of items in a call to the datastore multi operations.
+const maxItemsPerBatch = 500
+
+// batches calls f with the start and end of each batch of n items.
+func batches(n int, f func(start, end int) error) error {
+	for start := 0; start < n; start += maxItemsPerBatch {
+		if err := f(start, xmath.Min(start+maxItemsPerBatch, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchErrors copies the errors of a datastore multi operation on the items from start to errs,
+// or returns the error if it is not about the items.
+func batchErrors(err error, errs []error, start int) error {
+	if me, ok := err.(appengine.MultiError); ok {
+		copy(errs[start:], me)
+		return nil
+	}
+	return err
+}
+
+func (db appengineDb) GetMulti(items interface{}, keys Keys) (interface{}, error) {
+	if _, err := newItems(items, len(keys)); err != nil {
+		return nil, err
+	}
+	itemsValue := reflect.ValueOf(items).Elem()
+	errs := make([]error, len(keys))
+	err := batches(len(keys), func(start, end int) error {
+		dsKeys := make([]*datastore.Key, end-start)
+		for i := range dsKeys {
+			dsKeys[i] = keys[start+i].DsKey
+		}
+		err := datastore.GetMulti(db.c, dsKeys, itemsValue.Slice(start, end).Interface())
+		if err != nil {
+			logStackTrace(db.c, err)
+		}
+		return batchErrors(err, errs, start)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if errs[i] == nil {
+			item := itemsValue.Index(i)
+			if item.Kind() != reflect.Ptr {
+				item = item.Addr()
+			}
+			item.Interface().(Identifier).SetKey(key)
+		}
+	}
+	return items, multiError(errs)
 }
 
-func (db appengineDb) GetAllWithLimit(kind string, ancestor string, items interface{}, filters M, orderKeys []string, limit int) (Keys, interface{}, error) {
+func (db appengineDb) GetAll(kind string, ancestor string, items interface{}, query Query, orderKeys []string) (Keys, interface{}, error) {
+	return db.GetAllWithLimit(kind, ancestor, items, query, orderKeys, 0)
+}
+
+func (db appengineDb) GetAllWithLimit(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int) (Keys, interface{}, error) {
+	filters, rest, err := datastoreFilters(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	keysOnly := items == nil
+	if keysOnly && rest != nil {
+		if t, ok := kinds[kind]; !ok {
+			return nil, nil, fmt.Errorf("Kind '%v' not registered", kind)
+		} else {
+			items = reflect.New(reflect.SliceOf(reflect.PtrTo(t))).Interface()
+		}
+	}
 	q := datastore.NewQuery(kind)
 	if len(ancestor) > 0 {
 		ancestorKey, err := datastore.DecodeKey(ancestor)
@@ -96,18 +186,13 @@ func (db appengineDb) GetAllWithLimit(kind string, ancestor string, items interf
 			q = q.Order(o)
 		}
 	}
-	if filters != nil {
-		for k, v := range filters {
-			if _, ok := v.(CKey); ok {
-				v = v.(CKey).DsKey
-			}
-			q = q.Filter(k, v)
-		}
+	for _, f := range filters {
+		q = q.Filter(f.field+" "+string(f.op), datastoreValue(f.value))
 	}
 	if items == nil {
 		q = q.KeysOnly()
 	}
-	if limit > 0 {
+	if limit > 0 && rest == nil {
 		q = q.Limit(limit)
 	}
 	keys, err := q.GetAll(db.c, items)
@@ -126,10 +211,217 @@ func (db appengineDb) GetAllWithLimit(kind string, ancestor string, items interf
 			}
 		}
 	}
-	return toKeys(keys), items, err
+	if err != nil || rest == nil {
+		return toKeys(keys), items, err
+	}
+	itemsValue := reflect.Indirect(reflect.ValueOf(items))
+	resultKeys, resultItems, err := filterSortAndLimit(db, toKeys(keys), itemsValue, rest, nil, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keysOnly {
+		return resultKeys, nil, nil
+	}
+	itemsValue.Set(resultItems)
+	return resultKeys, items, nil
+}
+
+func (db appengineDb) GetPage(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int, cursor string) (Keys, interface{}, string, error) {
+	filters, rest, err := datastoreFilters(query)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	q := datastore.NewQuery(kind)
+	if len(ancestor) > 0 {
+		ancestorKey, err := datastore.DecodeKey(ancestor)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		q = q.Ancestor(ancestorKey)
+	}
+	for _, o := range orderKeys {
+		q = q.Order(o)
+	}
+	for _, f := range filters {
+		q = q.Filter(f.field+" "+string(f.op), datastoreValue(f.value))
+	}
+	if len(cursor) > 0 {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		q = q.Start(c)
+	}
+	var itemsValue reflect.Value
+	var itemType reflect.Type
+	if items != nil {
+		itemsValue = reflect.Indirect(reflect.ValueOf(items))
+		itemType = itemsValue.Type().Elem()
+	} else if rest != nil {
+		if t, ok := kinds[kind]; !ok {
+			return nil, nil, "", fmt.Errorf("Kind '%v' not registered", kind)
+		} else {
+			itemType = reflect.PtrTo(t)
+		}
+	} else {
+		q = q.KeysOnly()
+	}
+	it := q.Run(db.c)
+	// next returns the next item satisfying the rest of the query, or a nil key at the end.
+	next := func() (*datastore.Key, reflect.Value, error) {
+		for {
+			var item reflect.Value
+			var dst interface{}
+			if itemType != nil {
+				if itemType.Kind() == reflect.Ptr {
+					item = reflect.New(itemType.Elem())
+				} else {
+					item = reflect.New(itemType)
+				}
+				dst = item.Interface()
+			}
+			key, err := it.Next(dst)
+			if err == datastore.Done {
+				return nil, item, nil
+			} else if err != nil {
+				logStackTrace(db.c, err)
+				return nil, item, err
+			}
+			if rest == nil {
+				return key, item, nil
+			}
+			if ok, err := rest.Matches(dst); err != nil {
+				return nil, item, err
+			} else if ok {
+				return key, item, nil
+			}
+		}
+	}
+	keys := Keys{}
+	var resultItems reflect.Value
+	if items != nil {
+		resultItems = reflect.MakeSlice(itemsValue.Type(), 0, 0)
+	}
+	for limit <= 0 || keys.Len() < limit {
+		key, item, err := next()
+		if err != nil {
+			return nil, nil, "", err
+		} else if key == nil {
+			if items != nil {
+				itemsValue.Set(resultItems)
+			}
+			return keys, items, "", nil
+		}
+		keys = keys.Append(CKey{key})
+		if items != nil {
+			item.Interface().(Identifier).SetKey(CKey{key})
+			if itemType.Kind() != reflect.Ptr {
+				item = item.Elem()
+			}
+			resultItems = reflect.Append(resultItems, item)
+		}
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if items != nil {
+		itemsValue.Set(resultItems)
+	}
+	// The cursor is returned only if there are more items after it.
+	if key, _, err := next(); err != nil {
+		return nil, nil, "", err
+	} else if key == nil {
+		return keys, items, "", nil
+	}
+	return keys, items, c.String(), nil
+}
+
+func (db appengineDb) Iterate(kind string, ancestor string, query Query, orderKeys []string, f func(Key, interface{}) error) error {
+	t, ok := kinds[kind]
+	if !ok {
+		return fmt.Errorf("Kind '%v' not registered", kind)
+	}
+	filters, rest, err := datastoreFilters(query)
+	if err != nil {
+		return err
+	}
+	q := datastore.NewQuery(kind)
+	if len(ancestor) > 0 {
+		ancestorKey, err := datastore.DecodeKey(ancestor)
+		if err != nil {
+			return err
+		}
+		q = q.Ancestor(ancestorKey)
+	}
+	for _, o := range orderKeys {
+		q = q.Order(o)
+	}
+	for _, f := range filters {
+		q = q.Filter(f.field+" "+string(f.op), datastoreValue(f.value))
+	}
+	it := q.Run(db.c)
+	for {
+		item := reflect.New(t).Interface()
+		key, err := it.Next(item)
+		if err == datastore.Done {
+			return nil
+		} else if err != nil {
+			logStackTrace(db.c, err)
+			return err
+		}
+		if ok, err := Matches(item, rest); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		item.(Identifier).SetKey(CKey{key})
+		if err := f(CKey{key}, item); err != nil {
+			return err
+		}
+	}
+}
+
+// datastoreFilters splits the query in the comparisons of a top level And, which the datastore
+// applies, and the rest, which is applied in memory.
+func datastoreFilters(query Query) (filters []condition, rest Query, err error) {
+	var queries []Query
+	switch q := query.(type) {
+	case nil:
+		return nil, nil, nil
+	case M:
+		if queries, err = q.query(); err != nil {
+			return
+		}
+	case and:
+		queries = q
+	default:
+		queries = []Query{q}
+	}
+	remaining := and{}
+	for _, q := range queries {
+		if c, ok := q.(condition); ok && c.op != in && c.op != prefix {
+			filters = append(filters, c)
+		} else {
+			remaining = append(remaining, q)
+		}
+	}
+	if len(remaining) > 0 {
+		rest = remaining
+	}
+	return
 }
 
-func (db appengineDb) GetAllFromCache(kind string, ancestor string, items interface{}, filters M, order []string, c cache.Cache, cacheKey string) (Keys, interface{}, error) {
+// datastoreValue converts keys, including types defined as keys, to datastore keys.
+func datastoreValue(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Struct && v.Type().ConvertibleTo(keyType) {
+		return v.Convert(keyType).Interface().(CKey).DsKey
+	}
+	return value
+}
+
+func (db appengineDb) GetAllFromCache(kind string, ancestor string, items interface{}, query Query, order []string, c cache.Cache, cacheKey string) (Keys, interface{}, error) {
 	arr := []interface{}{}
 	err := c.Get(cacheKey, &arr)
 	if err == nil && len(arr) == 0 {
@@ -188,11 +480,11 @@ func (db appengineDb) GetAllFromCache(kind string, ancestor string, items interf
 			return nil, nil, err
 		}
 		var chunkItemsValue reflect.Value
-		if filters == nil {
+		if query == nil {
 			chunkItemsValue = reflect.ValueOf(arr[1])
 		} else {
 			var filteredItems interface{}
-			if chunkKeys, filteredItems, err = filter(db, chunkKeys, arr[1], filters); err != nil {
+			if chunkKeys, filteredItems, err = filter(db, chunkKeys, arr[1], query); err != nil {
 				return nil, nil, err
 			}
 			chunkItemsValue = reflect.ValueOf(filteredItems)
@@ -252,14 +544,87 @@ func (db appengineDb) Save(item interface{}, kind string, ancestor string, param
 	return
 }
 
+func (db appengineDb) SaveMulti(items interface{}, kind string, ancestor string) (Keys, error) {
+	itemsValue := reflect.ValueOf(items)
+	if itemsValue.Kind() != reflect.Slice {
+		return nil, errors.New("Invalid entity type: " + itemsValue.Kind().String())
+	}
+	var ancestorKey *datastore.Key
+	if len(ancestor) > 0 {
+		var err error
+		if ancestorKey, err = datastore.DecodeKey(ancestor); err != nil {
+			return nil, err
+		}
+	}
+	keys := make(Keys, itemsValue.Len())
+	errs := make([]error, len(keys))
+	err := batches(len(keys), func(start, end int) error {
+		dsKeys := make([]*datastore.Key, end-start)
+		for i := range dsKeys {
+			if key := itemsValue.Index(start + i).Interface().(Identifier).GetKey(); !key.IsZero() {
+				dsKeys[i] = key.(CKey).DsKey
+			} else {
+				dsKeys[i] = datastore.NewIncompleteKey(db.c, kind, ancestorKey)
+			}
+		}
+		dsKeys, err := datastore.PutMulti(db.c, dsKeys, itemsValue.Slice(start, end).Interface())
+		if err != nil {
+			logStackTrace(db.c, err)
+			if err = batchErrors(err, errs, start); err != nil {
+				return err
+			}
+		}
+		// The datastore returns no keys if it rejects some of the items before saving them.
+		if dsKeys == nil {
+			for i := start; i < end; i++ {
+				if errs[i] == nil {
+					errs[i] = errors.New("Not saved because of the errors of other items")
+				}
+			}
+		}
+		for i, key := range dsKeys {
+			if errs[start+i] == nil {
+				keys[start+i] = CKey{key}
+				itemsValue.Index(start + i).Interface().(Identifier).SetKey(keys[start+i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, multiError(errs)
+}
+
 func (db appengineDb) Delete(key Key) error {
 	return datastore.Delete(db.c, key.(CKey).DsKey)
 }
 
+func (db appengineDb) DeleteMulti(keys Keys) error {
+	errs := make([]error, len(keys))
+	err := batches(len(keys), func(start, end int) error {
+		dsKeys := make([]*datastore.Key, end-start)
+		for i := range dsKeys {
+			dsKeys[i] = keys[start+i].DsKey
+		}
+		err := datastore.DeleteMulti(db.c, dsKeys)
+		if err != nil {
+			logStackTrace(db.c, err)
+		}
+		return batchErrors(err, errs, start)
+	})
+	if err != nil {
+		return err
+	}
+	return multiError(errs)
+}
+
 func (db appengineDb) Execute(f func(Db) error) error {
+	// The transactions span entity groups, as the audit entries of the organizations are kept under
+	// the users.
 	return datastore.RunInTransaction(db.c, func(tc appengine.Context) (err error) {
 		return f(NewAppengineDb(tc))
-	}, nil)
+	}, &datastore.TransactionOptions{XG: true})
 }
 
 func (db appengineDb) DecodeKey(keyAsString string) (Key, error) {
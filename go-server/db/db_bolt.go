@@ -0,0 +1,444 @@
+// +build !appengine
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/cache"
+	xmath "github.com/mcesarhm/geek-accounting/go-server/extensions/math"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltDb stores every kind in a bucket of a bolt file, keyed by the id of the item. The items
+// are gob encoded as interface values, so their types must be registered with gob.Register.
+type boltDb struct {
+	b  *bolt.DB
+	tx *bolt.Tx
+}
+
+type boltRecord struct {
+	Parent string
+	Item   []byte
+}
+
+func NewBoltDb(path string) (Db, error) {
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return boltDb{b: b}, nil
+}
+
+func (db boltDb) Get(item interface{}, keyAsString string) (interface{}, error) {
+	p := reflect.ValueOf(item)
+	if !isValidEntityType(p) {
+		return nil, errors.New("Invalid Entity Type: " + p.Kind().String())
+	}
+	key, err := db.DecodeKey(keyAsString)
+	if err != nil {
+		return nil, err
+	}
+	ckey := key.(CKey)
+	err = db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ckey.kind))
+		if b == nil {
+			return fmt.Errorf("Kind '%v' not found", ckey.kind)
+		}
+		v := b.Get(boltId(ckey.id))
+		if v == nil {
+			return fmt.Errorf("Id '%v' not found", ckey.id)
+		}
+		_, stored, err := decodeBoltRecord(v)
+		if err != nil {
+			return err
+		}
+		return setItem(p, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (db boltDb) GetAll(kind string, ancestor string, items interface{}, query Query, orderKeys []string) (Keys, interface{}, error) {
+	return db.GetAllWithLimit(kind, ancestor, items, query, orderKeys, 0)
+}
+
+func (db boltDb) GetAllWithLimit(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int) (Keys, interface{}, error) {
+	var itemsValue, resultItems reflect.Value
+	if items != nil {
+		itemsValue = reflect.ValueOf(items)
+		if itemsValue.Kind() != reflect.Ptr {
+			return nil, nil, errors.New("Invalid entity type: " + itemsValue.Kind().String())
+		}
+		itemsValue = reflect.Indirect(itemsValue)
+		resultItems = reflect.MakeSlice(itemsValue.Type(), 0, 0)
+	}
+	keys := Keys{}
+	err := db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			parent, item, err := decodeBoltRecord(v)
+			if err != nil {
+				return err
+			}
+			if len(ancestor) > 0 && parent != ancestor {
+				return nil
+			}
+			if !resultItems.IsValid() {
+				resultItems = reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(item)), 0, 0)
+			}
+			iv := reflect.ValueOf(item)
+			if resultItems.Type().Elem().Kind() != reflect.Ptr {
+				iv = reflect.Indirect(iv)
+			}
+			resultItems = reflect.Append(resultItems, iv)
+			keys = keys.Append(item.(Identifier).GetKey())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !resultItems.IsValid() {
+		return Keys{}, items, nil
+	}
+	keys, resultItems, err = filterSortAndLimit(db, keys, resultItems, query, orderKeys, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if items != nil {
+		itemsValue.Set(resultItems)
+	}
+	return keys, items, nil
+}
+
+func (db boltDb) GetAllFromCache(kind string, ancestor string, items interface{}, query Query, orderKeys []string, c cache.Cache, cacheKey string) (Keys, interface{}, error) {
+	return getAllFromCache(db, kind, ancestor, items, query, orderKeys, c, cacheKey)
+}
+
+func (db boltDb) GetPage(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int, cursor string) (Keys, interface{}, string, error) {
+	return getPage(db, kind, ancestor, items, query, orderKeys, limit, cursor)
+}
+
+// boltBatchSize is the number of items read by each transaction of Iterate.
+const boltBatchSize = 100
+
+// Iterate reads the items in batches, and calls f between the read transactions, so that f may
+// write to the database. Ordered iterations keep the order values of every item in memory.
+func (db boltDb) Iterate(kind string, ancestor string, query Query, orderKeys []string, f func(Key, interface{}) error) error {
+	matches := func(parent string, item interface{}) (bool, error) {
+		if len(ancestor) > 0 && parent != ancestor {
+			return false, nil
+		}
+		return Matches(item, query)
+	}
+	if len(orderKeys) > 0 {
+		return db.iterateOrdered(kind, matches, orderKeys, f)
+	}
+	next := boltId(0)
+	for next != nil {
+		keys := Keys{}
+		items := []interface{}{}
+		err := db.view(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(kind))
+			if b == nil {
+				next = nil
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.Seek(next)
+			for ; k != nil && len(items) < boltBatchSize; k, v = c.Next() {
+				parent, item, err := decodeBoltRecord(v)
+				if err != nil {
+					return err
+				}
+				if ok, err := matches(parent, item); err != nil {
+					return err
+				} else if ok {
+					keys = keys.Append(item.(Identifier).GetKey())
+					items = append(items, item)
+				}
+			}
+			next = nil
+			if k != nil {
+				next = append([]byte{}, k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, item := range items {
+			if err := f(keys[i], item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// iterateOrdered sorts the positions of the items satisfying matches and then reads the items in
+// batches in that order. Items removed in the meantime are skipped.
+func (db boltDb) iterateOrdered(kind string, matches func(string, interface{}) (bool, error),
+	orderKeys []string, f func(Key, interface{}) error) error {
+	positions := []position{}
+	err := db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			parent, item, err := decodeBoltRecord(v)
+			if err != nil {
+				return err
+			}
+			if ok, err := matches(parent, item); err != nil || !ok {
+				return err
+			}
+			key := item.(Identifier).GetKey().(CKey)
+			positions = append(positions, positionOf(reflect.ValueOf(item), key, orderKeys))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(byPosition{make(Keys, len(positions)), reflect.Value{}, positions, orderKeys})
+	for start := 0; start < len(positions); start += boltBatchSize {
+		batch := positions[start:xmath.Min(start+boltBatchSize, len(positions))]
+		items := []interface{}{}
+		err := db.view(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(kind))
+			if b == nil {
+				return nil
+			}
+			for _, p := range batch {
+				if v := b.Get(boltId(p.key.id)); v != nil {
+					_, item, err := decodeBoltRecord(v)
+					if err != nil {
+						return err
+					}
+					items = append(items, item)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := f(item.(Identifier).GetKey(), item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db boltDb) Save(item interface{}, kind string, ancestor string, param map[string]string) (key Key, err error) {
+	p := reflect.ValueOf(item)
+	if !isValidEntityType(p) {
+		return nil, errors.New("Invalid Entity Type: " + p.Kind().String())
+	}
+	if _, ok := item.(ValidationMessager); ok {
+		vm := item.(ValidationMessager).ValidationMessage(db, param)
+		if len(vm) > 0 {
+			return CKey{}, errors.New(vm)
+		}
+	}
+	return db.save(item, kind, ancestor)
+}
+
+// SaveMulti saves the items in a single transaction, which is committed even if some of them fail.
+func (db boltDb) SaveMulti(items interface{}, kind string, ancestor string) (keys Keys, err error) {
+	var saveErr error
+	err = db.Execute(func(tdb Db) error {
+		keys, saveErr = saveMulti(func(item interface{}) (Key, error) {
+			return tdb.(boltDb).save(item, kind, ancestor)
+		}, items)
+		if _, ok := saveErr.(MultiError); !ok {
+			return saveErr
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, saveErr
+}
+
+func (db boltDb) save(item interface{}, kind string, ancestor string) (Key, error) {
+	p := reflect.ValueOf(item)
+	if !isValidEntityType(p) {
+		return nil, errors.New("Invalid Entity Type: " + p.Kind().String())
+	}
+	identifier := item.(Identifier)
+	err := db.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		var ckey CKey
+		if identifier.GetKey().IsZero() {
+			var parent *CKey
+			if len(ancestor) > 0 {
+				if k, err := db.DecodeKey(ancestor); err != nil {
+					return err
+				} else {
+					ancestorKey := k.(CKey)
+					parent = &ancestorKey
+				}
+			}
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			ckey = CKey{id: int(id), parent: parent, kind: kind}
+		} else if ckey = identifier.GetKey().(CKey); ckey.name != "" {
+			// The records are keyed by id only.
+			return fmt.Errorf("Keys with names are not supported: %v", ckey)
+		} else if uint64(ckey.id) > b.Sequence() {
+			// The ids of the new items must come after the ones saved explicitly.
+			if err := b.SetSequence(uint64(ckey.id)); err != nil {
+				return err
+			}
+		}
+		identifier.SetKey(ckey)
+		v, err := encodeBoltRecord(ckey, item)
+		if err != nil {
+			return err
+		}
+		return b.Put(boltId(ckey.id), v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return identifier.GetKey(), nil
+}
+
+func (db boltDb) GetMulti(items interface{}, keys Keys) (interface{}, error) {
+	return getMulti(db, items, keys)
+}
+
+func (db boltDb) Delete(key Key) error {
+	ckey := key.(CKey)
+	return db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ckey.kind))
+		if b == nil {
+			return fmt.Errorf("Kind '%v' not found", ckey.kind)
+		}
+		if b.Get(boltId(ckey.id)) == nil {
+			return fmt.Errorf("Id '%v' not found", ckey.id)
+		}
+		return b.Delete(boltId(ckey.id))
+	})
+}
+
+// DeleteMulti deletes the items in a single transaction, which is committed even if some of them
+// fail.
+func (db boltDb) DeleteMulti(keys Keys) (err error) {
+	var deleteErr error
+	if err = db.Execute(func(tdb Db) error {
+		deleteErr = deleteMulti(tdb, keys)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// Execute runs f in a read-write bolt transaction, which is committed only if f returns nil.
+func (db boltDb) Execute(f func(Db) error) error {
+	if db.tx != nil {
+		return f(db)
+	}
+	return db.b.Update(func(tx *bolt.Tx) error {
+		return f(boltDb{db.b, tx})
+	})
+}
+
+// View runs f in a read-only bolt transaction.
+func (db boltDb) View(f func(Db) error) error {
+	if db.tx != nil {
+		return f(db)
+	}
+	return db.b.View(func(tx *bolt.Tx) error {
+		return f(boltDb{db.b, tx})
+	})
+}
+
+func (db boltDb) DecodeKey(s string) (Key, error) {
+	return decodeKey(s)
+}
+
+func (db boltDb) NewKey() Key {
+	return CKey{}
+}
+
+func (db boltDb) NewStringKey(kind, key string) Key {
+	return CKey{name: key, kind: kind}
+}
+
+func (db boltDb) Close() error {
+	return db.b.Close()
+}
+
+func (db boltDb) view(f func(*bolt.Tx) error) error {
+	if db.tx != nil {
+		return f(db.tx)
+	}
+	return db.b.View(f)
+}
+
+func (db boltDb) update(f func(*bolt.Tx) error) error {
+	if db.tx != nil {
+		return f(db.tx)
+	}
+	return db.b.Update(f)
+}
+
+func boltId(id int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+func encodeBoltRecord(key CKey, item interface{}) ([]byte, error) {
+	var itemBuf, recordBuf bytes.Buffer
+	if err := gob.NewEncoder(&itemBuf).Encode(&item); err != nil {
+		return nil, err
+	}
+	var parent string
+	if key.parent != nil {
+		parent = key.parent.Encode()
+	}
+	record := boltRecord{Parent: parent, Item: itemBuf.Bytes()}
+	if err := gob.NewEncoder(&recordBuf).Encode(record); err != nil {
+		return nil, err
+	}
+	return recordBuf.Bytes(), nil
+}
+
+func decodeBoltRecord(v []byte) (parent string, item interface{}, err error) {
+	var record boltRecord
+	if err = gob.NewDecoder(bytes.NewReader(v)).Decode(&record); err != nil {
+		return
+	}
+	if err = gob.NewDecoder(bytes.NewReader(record.Item)).Decode(&item); err != nil {
+		return
+	}
+	parent = record.Parent
+	return
+}
@@ -0,0 +1,154 @@
+// +build inmemory
+
+package db
+
+import (
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	gob.Register((*S)(nil))
+	gob.Register((*T)(nil))
+}
+
+func newBoltTestDb(t *testing.T) (Db, func()) {
+	dir, err := ioutil.TempDir("", "db_bolt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewBoltDb(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.(io.Closer).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltGetAll(t *testing.T) {
+	db, done := newBoltTestDb(t)
+	defer done()
+	keys, err := save(db, "T", "", &T{Name: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := save(db, "S", "", &S{Name: "b"}, &S{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := save(db, "S", keys.KeyAt(0).Encode(), &S{Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	var s []S
+	if _, _, err := db.GetAll("S", "", &s, M{"Name >=": "b"}, []string{"-Name"}); err != nil {
+		t.Fatal(err)
+	} else if len(s) != 2 {
+		t.Error("2 expected got", len(s))
+	} else if s[0].Name != "c" || s[1].Name != "b" {
+		t.Error("c, b expected got", s[0].Name, s[1].Name)
+	}
+	var s_ []*S
+	if sk, _, err := db.GetAll("S", keys.KeyAt(0).Encode(), &s_, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(s_) != 1 || s_[0].Name != "c" {
+		t.Error("c expected got", s_)
+	} else if sk.KeyAt(0).Parent().Encode() != keys.KeyAt(0).Encode() {
+		t.Error(keys.KeyAt(0), "expected got", sk.KeyAt(0).Parent())
+	}
+	if sk, _, err := db.GetAllWithLimit("S", "", nil, M{"Name =": "a"}, nil, 1); err != nil {
+		t.Fatal(err)
+	} else if sk.Len() != 1 {
+		t.Error("1 expected got", sk.Len())
+	}
+	if sk, _, err := db.GetAll("U", "", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if sk.Len() != 0 {
+		t.Error("0 expected got", sk.Len())
+	}
+}
+
+func TestBoltPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db_bolt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+	db, err := NewBoltDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := save(db, "S", "", &S{Name: "a"}, &S{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(keys.KeyAt(0)); err != nil {
+		t.Fatal(err)
+	}
+	db.(io.Closer).Close()
+	if db, err = NewBoltDb(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.(io.Closer).Close()
+	var s S
+	if _, err := db.Get(&s, keys.KeyAt(1).Encode()); err != nil {
+		t.Fatal(err)
+	} else if s.Name != "b" {
+		t.Error("b expected got", s.Name)
+	} else if s.Key.Encode() != keys.KeyAt(1).Encode() {
+		t.Error(keys.KeyAt(1), "expected got", s.Key)
+	}
+	if _, err := db.Get(&s, keys.KeyAt(0).Encode()); err == nil {
+		t.Error("Deleted item must not be found")
+	}
+	if k, err := db.Save(&S{Name: "c"}, "S", "", nil); err != nil {
+		t.Fatal(err)
+	} else if k.Encode() == keys.KeyAt(1).Encode() {
+		t.Error("Ids must not be reused after reopening the database")
+	}
+}
+
+func TestBoltExecute(t *testing.T) {
+	db, done := newBoltTestDb(t)
+	defer done()
+	err := db.Execute(func(tdb Db) error {
+		if _, err := tdb.Save(&S{Name: "a"}, "S", "", nil); err != nil {
+			return err
+		}
+		return io.EOF
+	})
+	if err != io.EOF {
+		t.Fatal("EOF expected got", err)
+	}
+	var s []S
+	if _, _, err := db.GetAll("S", "", &s, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(s) != 0 {
+		t.Error("0 expected got", len(s))
+	}
+}
+
+func TestBoltExplicitKeys(t *testing.T) {
+	db, done := newBoltTestDb(t)
+	defer done()
+	s := &S{Name: "a"}
+	s.SetKey(CKey{id: 100, kind: "S"})
+	if _, err := db.Save(s, "S", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := db.Save(&S{Name: "b"}, "S", "", nil); err != nil {
+		t.Fatal(err)
+	} else if key.(CKey).id <= 100 {
+		t.Errorf("The id %v must be after the one saved explicitly", key)
+	}
+	s = &S{Name: "c"}
+	s.SetKey(db.NewStringKey("S", "c"))
+	if _, err := db.Save(s, "S", "", nil); err == nil {
+		t.Error("Keys with names must not be saved")
+	}
+}
@@ -0,0 +1,98 @@
+// +build !appengine
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CKey is the key of the databases that run outside App Engine. It is encoded as
+// "id-parent-kind", where the parent is encoded as "id.parent.kind".
+type CKey struct {
+	id     int
+	name   string
+	parent *CKey
+	kind   string
+}
+
+func (key CKey) String() string {
+	return key.stringSep("-")
+}
+
+func (key CKey) Encode() string {
+	return key.String()
+}
+
+func (key CKey) Parent() Key {
+	if key.parent == nil {
+		return CKey{}
+	}
+	return *key.parent
+}
+
+func (key CKey) Kind() string {
+	return key.kind
+}
+
+func (key CKey) IsZero() bool {
+	return key.id == 0 && key.name == "" && key.parent == nil && key.kind == ""
+}
+
+func (key CKey) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%v\"", key.String())), nil
+}
+
+func (key CKey) UnmarshalJSON(b []byte) (err error) {
+	return key.unmarshalJSONSep([]byte(b[1:len(string(b))-1]), "-")
+}
+
+func (key *CKey) unmarshalJSONSep(b []byte, separator string) (err error) {
+	arr := strings.Split(string(b), separator)
+	if len(arr) != 3 {
+		return fmt.Errorf("Invalid key: %v", string(b))
+	}
+	if key.id, err = strconv.Atoi(arr[0]); err != nil {
+		key.id, key.name = 0, arr[0]
+	}
+	if len(arr[1]) > 0 {
+		key.parent = &CKey{}
+		if err := key.parent.unmarshalJSONSep([]byte(arr[1]), "."); err != nil {
+			return err
+		}
+	} else {
+		key.parent = nil
+	}
+	key.kind = arr[2]
+	return nil
+}
+
+func (key CKey) stringSep(separator string) string {
+	var p string
+	if key.parent == nil {
+		p = ""
+	} else {
+		p = key.parent.stringSep(".")
+	}
+	var id interface{} = key.id
+	if key.name != "" {
+		id = key.name
+	}
+	return fmt.Sprintf("%v%v%v%v%v", id, separator, p, separator, key.kind)
+}
+func (key CKey) GobEncode() ([]byte, error) {
+	return []byte(key.String()), nil
+}
+
+func (key *CKey) GobDecode(b []byte) error {
+	return key.unmarshalJSONSep(b, "-")
+}
+
+func decodeKey(s string) (Key, error) {
+	result := CKey{}
+	if err := result.unmarshalJSONSep([]byte(s), "-"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,191 @@
+// +build !appengine
+
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// position is the place of an item in a page ordering: the values of its order fields and its
+// key, which breaks ties.
+type position struct {
+	values []interface{}
+	key    CKey
+}
+
+// cursor is the encoded form of the position of the last item of a page.
+type cursor struct {
+	Values []json.RawMessage `json:"v"`
+	Key    string            `json:"k"`
+}
+
+func positionOf(item reflect.Value, key CKey, orderKeys []string) position {
+	p := position{key: key}
+	for _, o := range orderKeys {
+		p.values = append(p.values,
+			reflect.Indirect(item).FieldByName(strings.TrimPrefix(o, "-")).Interface())
+	}
+	return p
+}
+
+// compare returns -1, 0 or 1 if p comes before, at or after other in the order of orderKeys.
+func (p position) compare(other position, orderKeys []string) int {
+	for i, o := range orderKeys {
+		c, _ := compareValues(p.values[i], other.values[i])
+		if strings.HasPrefix(o, "-") {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if p.key.id != other.key.id {
+		return compareOrdered(p.key.id < other.key.id, p.key.id > other.key.id)
+	}
+	return strings.Compare(p.key.name, other.key.name)
+}
+
+func encodeCursor(p position) (string, error) {
+	c := cursor{Key: p.key.Encode()}
+	for _, v := range p.values {
+		if key, ok := keyOf(v); ok {
+			v = key.Encode()
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		c.Values = append(c.Values, b)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor returns the position encoded in s, whose values are decoded as the fields of the
+// struct type t.
+func decodeCursor(s string, t reflect.Type, orderKeys []string) (p position, err error) {
+	var c cursor
+	if b, err := base64.RawURLEncoding.DecodeString(s); err != nil {
+		return p, fmt.Errorf("Invalid cursor: %v", s)
+	} else if err := json.Unmarshal(b, &c); err != nil || len(c.Values) != len(orderKeys) {
+		return p, fmt.Errorf("Invalid cursor: %v", s)
+	}
+	if key, err := decodeKey(c.Key); err != nil {
+		return p, fmt.Errorf("Invalid cursor: %v", s)
+	} else {
+		p.key = key.(CKey)
+	}
+	for i, o := range orderKeys {
+		f, ok := t.FieldByName(strings.TrimPrefix(o, "-"))
+		if !ok {
+			return p, fmt.Errorf("Field not found: %v", o)
+		}
+		v := reflect.New(f.Type)
+		if f.Type.Kind() == reflect.Struct && f.Type.ConvertibleTo(keyType) {
+			var s string
+			if err := json.Unmarshal(c.Values[i], &s); err != nil {
+				return p, err
+			}
+			key, err := decodeKey(s)
+			if err != nil {
+				return p, err
+			}
+			v.Elem().Set(reflect.ValueOf(key).Convert(f.Type))
+		} else if err := json.Unmarshal(c.Values[i], v.Interface()); err != nil {
+			return p, err
+		}
+		p.values = append(p.values, v.Elem().Interface())
+	}
+	return p, nil
+}
+
+func keyOf(v interface{}) (CKey, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Struct && rv.Type().ConvertibleTo(keyType) {
+		return rv.Convert(keyType).Interface().(CKey), true
+	}
+	return CKey{}, false
+}
+
+type byPosition struct {
+	keys      Keys
+	values    reflect.Value
+	positions []position
+	orderKeys []string
+}
+
+func (a byPosition) Len() int { return len(a.positions) }
+
+func (a byPosition) Swap(i, j int) {
+	a.keys.Swap(i, j)
+	if a.values.IsValid() {
+		swap(a.values, i, j)
+	}
+	a.positions[i], a.positions[j] = a.positions[j], a.positions[i]
+}
+
+func (a byPosition) Less(i, j int) bool {
+	return a.positions[i].compare(a.positions[j], a.orderKeys) < 0
+}
+
+// getPage implements GetPage for the databases that load every item of the query in memory.
+func getPage(d Db, kind string, ancestor string, items interface{}, query Query,
+	orderKeys []string, limit int, cursor string) (Keys, interface{}, string, error) {
+	if items == nil && len(orderKeys) > 0 {
+		return nil, nil, "", errors.New("Items are required to order a page")
+	}
+	keys, _, err := d.GetAll(kind, ancestor, items, query, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var itemsValue reflect.Value
+	if items != nil {
+		itemsValue = reflect.Indirect(reflect.ValueOf(items))
+	}
+	positions := make([]position, len(keys))
+	for i, k := range keys {
+		if len(orderKeys) > 0 {
+			positions[i] = positionOf(itemsValue.Index(i), k, orderKeys)
+		} else {
+			positions[i] = position{key: k}
+		}
+	}
+	sort.Sort(byPosition{keys, itemsValue, positions, orderKeys})
+	start := 0
+	if len(cursor) > 0 {
+		var t reflect.Type
+		if items != nil {
+			t = itemsValue.Type().Elem()
+			if t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+		}
+		after, err := decodeCursor(cursor, t, orderKeys)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		start = sort.Search(len(positions), func(i int) bool {
+			return positions[i].compare(after, orderKeys) > 0
+		})
+	}
+	end, next := len(keys), ""
+	if limit > 0 && start+limit < end {
+		end = start + limit
+		if next, err = encodeCursor(positions[end-1]); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	if items != nil {
+		itemsValue.Set(itemsValue.Slice(start, end))
+	}
+	return keys[start:end], items, next, nil
+}
@@ -0,0 +1,95 @@
+// +build inmemory
+
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPage(t *testing.T) {
+	sqlDbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(sqlDbs)
+	boltDb, closeBoltDb := newBoltTestDb(t)
+	defer closeBoltDb()
+	dbs := map[string]Db{"inmemory": NewInMemoryDb(), "bolt": boltDb}
+	for name, db := range sqlDbs {
+		dbs[name] = db
+	}
+	for name, db := range dbs {
+		date := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+		keys, err := save(db, "U", "",
+			&U{Name: "a", Date: date}, &U{Name: "b", Date: date.AddDate(0, 0, 1)},
+			&U{Name: "c", Date: date}, &U{Name: "d", Date: date.AddDate(0, 0, 2)},
+			&U{Name: "e", Date: date}, &U{Name: "f", Date: date.AddDate(0, 0, 1), Removed: true})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		pages := func(query Query, orderKeys []string, limit int) (result []string) {
+			cursor := ""
+			for {
+				var items []*U
+				keys, _, next, err := db.GetPage("U", "", &items, query, orderKeys, limit, cursor)
+				if err != nil {
+					t.Fatal(name, err)
+				}
+				page := ""
+				for i, u := range items {
+					if keys[i].Encode() != u.Key.Encode() {
+						t.Errorf("%v: key %v expected got %v", name, u.Key, keys[i])
+					}
+					page += u.Name
+				}
+				result = append(result, page)
+				if len(next) == 0 {
+					return
+				}
+				cursor = next
+			}
+		}
+		for _, tc := range []struct {
+			query     Query
+			orderKeys []string
+			limit     int
+			pages     string
+		}{
+			{nil, nil, 0, "abcdef"},
+			{nil, nil, 4, "abcd ef"},
+			{nil, nil, 3, "abc def"},
+			{nil, []string{"Date"}, 2, "ac eb fd"},
+			{nil, []string{"-Date", "Name"}, 2, "db fa ce"},
+			{Field("Removed").Eq(false), []string{"-Date"}, 2, "db ac e"},
+		} {
+			pages := pages(tc.query, tc.orderKeys, tc.limit)
+			if s := strings.Join(pages, " "); s != tc.pages {
+				t.Errorf("%v: %v %v %v returned %q, want %q", name, tc.query, tc.orderKeys, tc.limit,
+					s, tc.pages)
+			}
+		}
+
+		// A page starts after the last item of the previous one even if it was removed or items
+		// were added before it.
+		var items []*U
+		_, _, next, err := db.GetPage("U", "", &items, nil, []string{"Date"}, 2, "")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if err := db.Delete(keys[2]); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := save(db, "U", "", &U{Name: "g", Date: date.AddDate(0, 0, -1)}); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, _, _, err = db.GetPage("U", "", &items, nil, []string{"Date"}, 2, next); err != nil {
+			t.Fatal(name, err)
+		}
+		if len(items) != 2 || items[0].Name != "e" || items[1].Name != "b" {
+			t.Errorf("%v: e and b expected got %v", name, items)
+		}
+
+		if _, _, _, err = db.GetPage("U", "", &items, nil, []string{"Date"}, 2, "x"); err == nil {
+			t.Errorf("%v: invalid cursor accepted", name)
+		}
+	}
+}
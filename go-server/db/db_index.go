@@ -0,0 +1,201 @@
+// +build !appengine
+
+package db
+
+import (
+	"reflect"
+	"sort"
+)
+
+// index keeps the ids of the items of a kind sorted by the values of one of their fields. Items
+// whose field is a slice have an entry for each element.
+type index struct {
+	field string
+	// entries are sorted by value and id.
+	entries treap[indexEntry]
+}
+
+type indexEntry struct {
+	value interface{}
+	id    int
+}
+
+// bound is a lower or upper limit of the values of a range lookup.
+type bound struct {
+	value     interface{}
+	inclusive bool
+}
+
+func newIndexes(kind string) map[string]*index {
+	result := map[string]*index{}
+	for _, field := range indexes[kind] {
+		result[field] = &index{field, newTreap(compareEntries)}
+	}
+	return result
+}
+
+func compareEntries(a, b indexEntry) int {
+	if c, _ := compareValues(a.value, b.value); c != 0 {
+		return c
+	}
+	return a.id - b.id
+}
+
+// clone returns a copy of the index, which shares the treap of the entries with x.
+func (x *index) clone() *index {
+	return &index{x.field, x.entries}
+}
+
+// values returns the values of the field of the item that can be compared, which are the only ones
+// a query can match.
+func (x *index) values(item interface{}) (result []interface{}) {
+	values, _ := fieldValues(reflect.Indirect(reflect.ValueOf(item)), x.field)
+	for _, v := range values {
+		if _, err := normalize(v); err == nil {
+			result = append(result, v)
+		}
+	}
+	return
+}
+
+func (x *index) add(id int, item interface{}) {
+	for _, v := range x.values(item) {
+		x.entries = x.entries.add(indexEntry{v, id})
+	}
+}
+
+func (x *index) remove(id int, item interface{}) {
+	for _, v := range x.values(item) {
+		x.entries = x.entries.remove(indexEntry{v, id})
+	}
+}
+
+// lookup returns the entries whose values are within the bounds, which may be nil, or false if
+// the bounds cannot be compared with the values of the index.
+func (x *index) lookup(lower, upper *bound) ([]indexEntry, bool) {
+	ok := true
+	// after reports whether the entry is after the value of the bound, or at it unless strictly.
+	after := func(e indexEntry, b *bound, strictly bool) bool {
+		c, err := compareValues(e.value, b.value)
+		if err != nil {
+			ok = false
+		}
+		return c > 0 || c == 0 && !strictly
+	}
+	from := func(e indexEntry) bool { return lower == nil || after(e, lower, !lower.inclusive) }
+	past := func(e indexEntry) bool { return upper != nil && after(e, upper, upper.inclusive) }
+	entries := []indexEntry{}
+	ascend(x.entries.root, from, past, func(e indexEntry) { entries = append(entries, e) })
+	if !ok {
+		return nil, false
+	}
+	return entries, true
+}
+
+// indexedIds returns, in ascending order, the ids of the items selected by the most selective
+// index usable by the top level conditions of the query, or false if no index is usable. The
+// query must still be applied to the selected items.
+func (k *kindItems) indexedIds(query Query) ([]int, bool) {
+	var queries []Query
+	switch q := query.(type) {
+	case M:
+		conditions, err := q.query()
+		if err != nil {
+			return nil, false
+		}
+		queries = conditions
+	case and:
+		queries = q
+	case condition:
+		queries = []Query{q}
+	default:
+		return nil, false
+	}
+	type bounds struct{ lower, upper *bound }
+	ranges := map[string]*bounds{}
+	var best []indexEntry
+	found := false
+	choose := func(entries []indexEntry) {
+		if !found || len(entries) < len(best) {
+			best, found = entries, true
+		}
+	}
+	tighter := func(b, other *bound, sign int) (*bound, bool) {
+		if b == nil {
+			return other, true
+		}
+		c, err := compareValues(other.value, b.value)
+		if err != nil {
+			return nil, false
+		}
+		if c*sign > 0 || c == 0 && !other.inclusive {
+			return other, true
+		}
+		return b, true
+	}
+	for _, q := range queries {
+		c, ok := q.(condition)
+		if !ok || k.indexes[c.field] == nil {
+			continue
+		}
+		if c.op == in {
+			values, ok := c.value.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			entries := []indexEntry{}
+			for _, v := range values {
+				if e, ok := k.indexes[c.field].lookup(&bound{v, true}, &bound{v, true}); !ok {
+					return nil, false
+				} else {
+					entries = append(entries, e...)
+				}
+			}
+			choose(entries)
+			continue
+		}
+		r := ranges[c.field]
+		if r == nil {
+			r = &bounds{}
+			ranges[c.field] = r
+		}
+		ok1, ok2 := true, true
+		switch c.op {
+		case eq:
+			r.lower, ok1 = tighter(r.lower, &bound{c.value, true}, 1)
+			r.upper, ok2 = tighter(r.upper, &bound{c.value, true}, -1)
+		case gt, ge:
+			r.lower, ok1 = tighter(r.lower, &bound{c.value, c.op == ge}, 1)
+		case lt, le:
+			r.upper, ok2 = tighter(r.upper, &bound{c.value, c.op == le}, -1)
+		case prefix:
+			// Strings with the prefix are not before it.
+			r.lower, ok1 = tighter(r.lower, &bound{c.value, true}, 1)
+		}
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+	}
+	for field, r := range ranges {
+		if entries, ok := k.indexes[field].lookup(r.lower, r.upper); !ok {
+			return nil, false
+		} else {
+			choose(entries)
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	ids := make([]int, 0, len(best))
+	for _, e := range best {
+		ids = append(ids, e.id)
+	}
+	sort.Ints(ids)
+	result := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			result = append(result, id)
+		}
+	}
+	return result, true
+}
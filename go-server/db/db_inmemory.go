@@ -1,4 +1,4 @@
-// +build inmemory
+// +build !appengine
 
 package db
 
@@ -7,85 +7,147 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
-	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/mcesarhm/geek-accounting/go-server/cache"
-	"github.com/mcesarhm/geek-accounting/go-server/db"
-	xmath "github.com/mcesarhm/geek-accounting/go-server/extensions/math"
 )
 
+// inMemoryDb keeps copies of the saved items in treaps that are never changed once published: every
+// write runs in a transaction that copies the kinds it changes and publishes them on commit. So
+// readers are never blocked and see a consistent snapshot, while writers are serialized.
 type inMemoryDb struct {
+	store *inMemoryStore
+	// data is the snapshot read and written by a transaction or view, and is nil outside of them.
 	data map[string]*kindItems
+	// written holds the kinds copied by the transaction, and is nil outside of transactions.
+	written map[string]bool
+}
+
+type inMemoryStore struct {
+	sync.Mutex // guards data
+	data       map[string]*kindItems
+	writer     sync.Mutex
 }
 
 type kindItems struct {
-	items  map[int]interface{}
-	lastId int
+	// items holds the items by id.
+	items   treap[storedItem]
+	lastId  int
+	indexes map[string]*index
 }
 
-func NewInMemoryDb() Db {
-	return inMemoryDb{map[string]*kindItems{}}
+type storedItem struct {
+	id   int
+	item interface{}
 }
 
-type CKey struct {
-	id     int
-	parent *CKey
-	kind   string
+func newKindItems(kind string) *kindItems {
+	return &kindItems{items: newTreap(func(a, b storedItem) int { return a.id - b.id }),
+		indexes: newIndexes(kind)}
 }
 
-func (key CKey) String() string {
-	return key.stringSep("-")
+// ids returns the ids of the items in the order they were created.
+func (k *kindItems) ids() []int {
+	ids := make([]int, 0, k.items.len())
+	k.items.ascend(func(s storedItem) { ids = append(ids, s.id) })
+	return ids
 }
 
-func (key CKey) Encode() string {
-	return key.String()
+// item returns the item of the id.
+func (k *kindItems) item(id int) (interface{}, bool) {
+	s, ok := k.items.get(storedItem{id: id})
+	return s.item, ok
 }
 
-func (key CKey) Parent() Key {
-	if key.parent == nil {
-		return CKey{}
+// idsFor returns the ids of the items that may satisfy the query, in the order they were created.
+func (k *kindItems) idsFor(query Query) []int {
+	if ids, ok := k.indexedIds(query); ok {
+		return ids
 	}
-	return *key.parent
+	return k.ids()
 }
 
-func (key CKey) IsZero() bool {
-	return key.id == 0 && key.parent == nil && key.kind == ""
+// clone returns a copy of the items, which share the treap of the items with k.
+func (k *kindItems) clone() *kindItems {
+	indexes := make(map[string]*index, len(k.indexes))
+	for field, x := range k.indexes {
+		indexes[field] = x.clone()
+	}
+	return &kindItems{items: k.items, lastId: k.lastId, indexes: indexes}
 }
 
-func (key CKey) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf("\"%v\"", key.String())), nil
+func (k *kindItems) put(id int, item interface{}) {
+	k.remove(id)
+	k.items = k.items.add(storedItem{id, item})
+	for _, x := range k.indexes {
+		x.add(id, item)
+	}
 }
 
-func (key CKey) UnmarshalJSON(b []byte) (err error) {
-	return key.unmarshalJSONSep([]byte(b[1:len(string(b))-1]), "-")
+func (k *kindItems) remove(id int) {
+	if old, ok := k.item(id); ok {
+		for _, x := range k.indexes {
+			x.remove(id, old)
+		}
+		k.items = k.items.remove(storedItem{id: id})
+	}
 }
 
-func (key *CKey) unmarshalJSONSep(b []byte, separator string) (err error) {
-	arr := strings.Split(string(b), separator)
-	if key.id, err = strconv.Atoi(arr[0]); err != nil {
-		return err
-	}
-	if len(arr[1]) > 0 {
-		key.parent = &CKey{}
-		if err := key.parent.unmarshalJSONSep([]byte(arr[1]), "."); err != nil {
-			return err
+// copyItem returns a pointer to a copy of the struct pointed by item, with its slices copied too.
+func copyItem(item interface{}) interface{} {
+	v := reflect.Indirect(reflect.ValueOf(item))
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	for i := 0; i < v.NumField(); i++ {
+		if f := c.Elem().Field(i); f.Kind() == reflect.Slice && !f.IsNil() && f.CanSet() {
+			s := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			reflect.Copy(s, f)
+			f.Set(s)
 		}
-	} else {
-		key.parent = nil
 	}
-	key.kind = arr[2]
-	return nil
+	return c.Interface()
 }
 
-func (key CKey) stringSep(separator string) string {
-	var p string
-	if key.parent == nil {
-		p = ""
-	} else {
-		p = key.parent.stringSep(".")
+func NewInMemoryDb() Db {
+	return inMemoryDb{store: &inMemoryStore{data: map[string]*kindItems{}}}
+}
+
+// snapshot returns the data of the transaction or view, or the last published data.
+func (db inMemoryDb) snapshot() map[string]*kindItems {
+	if db.data != nil {
+		return db.data
+	}
+	db.store.Lock()
+	defer db.store.Unlock()
+	return db.store.data
+}
+
+// kindForWrite returns the items of the kind in the transaction, copying them first if they are
+// still shared with the published data.
+func (db inMemoryDb) kindForWrite(kind string) *kindItems {
+	if db.written[kind] {
+		return db.data[kind]
+	}
+	k := newKindItems(kind)
+	if items, ok := db.data[kind]; ok {
+		k = items.clone()
 	}
-	return fmt.Sprintf("%v%v%v%v%v", key.id, separator, p, separator, key.kind)
+	db.data[kind] = k
+	db.written[kind] = true
+	return k
+}
+
+// write runs f in the current transaction, or in a new one outside of transactions.
+func (db inMemoryDb) write(f func(inMemoryDb) error) error {
+	if db.written != nil {
+		return f(db)
+	}
+	if db.data != nil {
+		return errors.New("Writes are not allowed in a view")
+	}
+	return db.Execute(func(tdb Db) error {
+		return f(tdb.(inMemoryDb))
+	})
 }
 
 func (db inMemoryDb) Get(item interface{}, keyAsString string) (interface{}, error) {
@@ -96,37 +158,35 @@ func (db inMemoryDb) Get(item interface{}, keyAsString string) (interface{}, err
 	if key, err := db.DecodeKey(keyAsString); err != nil {
 		return nil, err
 	} else {
-		ckey := key.(CKey)
-		if kind, ok := db.data[ckey.kind]; !ok {
-			return nil, errors.New(fmt.Sprintf("Kind '%v' not found", ckey.kind))
+		if v, err := getItem(db.snapshot(), key.(CKey)); err != nil {
+			return nil, err
+		} else if err = setItem(p, v); err != nil {
+			return nil, err
 		} else {
-			if v, ok := kind.items[ckey.id]; !ok {
-				return nil, errors.New(fmt.Sprintf("Id '%v' not found", ckey.id))
-			} else {
-				reflect.Indirect(p).Set(reflect.Indirect(reflect.ValueOf(v)))
-				return v, nil
-			}
+			return item, nil
 		}
 	}
 }
 
-func (db inMemoryDb) GetAll(kind string, ancestor string, items interface{}, filters M, orderKeys []string) (Keys, interface{}, error) {
-	return db.GetAllWithLimit(kind, ancestor, items, filters, orderKeys, 0)
+func (db inMemoryDb) GetAll(kind string, ancestor string, items interface{}, query Query, orderKeys []string) (Keys, interface{}, error) {
+	return db.GetAllWithLimit(kind, ancestor, items, query, orderKeys, 0)
 }
 
-func (db inMemoryDb) GetAllWithLimit(kind string, ancestor string, items interface{}, filters M, orderKeys []string, limit int) (Keys, interface{}, error) {
-	if _, ok := db.data[kind]; !ok {
-		return nil, nil, errors.New(fmt.Sprintf("Kind '%v' not found", kind))
+func (db inMemoryDb) GetAllWithLimit(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int) (Keys, interface{}, error) {
+	data := db.snapshot()
+	if k, ok := data[kind]; !ok || k.items.len() == 0 {
+		if items != nil {
+			itemsValue := reflect.Indirect(reflect.ValueOf(items))
+			itemsValue.Set(reflect.MakeSlice(itemsValue.Type(), 0, 0))
+		}
+		return Keys{}, items, nil
 	} else {
 		keys := Keys{}
 		var itemsValue, resultItems reflect.Value
 		if items == nil {
-			for _, item := range db.data[kind].items {
-				t := reflect.ValueOf(item).Type()
-				resultItems = reflect.MakeSlice(reflect.SliceOf(t), 0, 0)
-				itemsValue = resultItems
-				break
-			}
+			t := reflect.TypeOf(data[kind].items.root.value.item)
+			resultItems = reflect.MakeSlice(reflect.SliceOf(t), 0, 0)
+			itemsValue = resultItems
 		} else {
 			itemsValue = reflect.ValueOf(items)
 			if itemsValue.Kind() != reflect.Ptr {
@@ -135,7 +195,8 @@ func (db inMemoryDb) GetAllWithLimit(kind string, ancestor string, items interfa
 			itemsValue = reflect.Indirect(itemsValue)
 			resultItems = reflect.MakeSlice(itemsValue.Type(), 0, 0)
 		}
-		for _, item := range db.data[kind].items {
+		for _, id := range data[kind].idsFor(query) {
+			item, _ := data[kind].item(id)
 			mustAppend := true
 			if len(ancestor) > 0 {
 				parent := item.(Identifier).GetKey().Parent()
@@ -144,7 +205,7 @@ func (db inMemoryDb) GetAllWithLimit(kind string, ancestor string, items interfa
 				}
 			}
 			if mustAppend {
-				iv := reflect.ValueOf(item)
+				iv := reflect.ValueOf(copyItem(item))
 				if itemsValue.Type().Elem().Kind() != reflect.Ptr {
 					iv = reflect.Indirect(iv)
 				}
@@ -152,26 +213,9 @@ func (db inMemoryDb) GetAllWithLimit(kind string, ancestor string, items interfa
 				keys = keys.Append(item.(Identifier).GetKey())
 			}
 		}
-		if filters != nil {
-			if filteredKeys, filteredItems, err := filter(db, keys, resultItems.Interface(), filters); err != nil {
-				return nil, nil, err
-			} else {
-				keys = filteredKeys
-				resultItems = reflect.ValueOf(filteredItems)
-			}
-		}
-		if orderKeys != nil {
-			sort.Sort(byFields{keys, resultItems, orderKeys})
-		}
-		if limit > 0 {
-			limitedKeys := Keys{}
-			limitedItems := reflect.MakeSlice(itemsValue.Type(), 0, 0)
-			for i := 0; i < xmath.Min(limit, resultItems.Len()); i++ {
-				limitedItems = reflect.Append(limitedItems, resultItems.Index(i))
-				limitedKeys = limitedKeys.Append(keys.KeyAt(i))
-			}
-			keys = limitedKeys
-			resultItems = limitedItems
+		keys, resultItems, err := filterSortAndLimit(db, keys, resultItems, query, orderKeys, limit)
+		if err != nil {
+			return nil, nil, err
 		}
 		if items != nil {
 			itemsValue.Set(resultItems)
@@ -180,78 +224,219 @@ func (db inMemoryDb) GetAllWithLimit(kind string, ancestor string, items interfa
 	}
 }
 
-func (db inMemoryDb) GetAllFromCache(kind string, ancestor string, items interface{}, filters M, orderKeys []string, c cache.Cache, cacheKey string) (Keys, interface{}, error) {
-	arr := []interface{}{}
-	err := c.Get(cacheKey, &arr)
-	if err == nil && len(arr) == 0 {
-		if keys, _, err := db.GetAll(kind, ancestor, items, filters, orderKeys); err != nil {
-			return nil, nil, err
-		} else {
-			c.Set(cacheKey, []interface{}{keys, items})
+// GetAllFromCache queries the items directly, which are already in memory and indexed, instead of
+// copies of them in the cache.
+func (db inMemoryDb) GetAllFromCache(kind string, ancestor string, items interface{}, query Query, orderKeys []string, c cache.Cache, cacheKey string) (Keys, interface{}, error) {
+	return db.GetAll(kind, ancestor, items, query, orderKeys)
+}
+
+func (db inMemoryDb) GetPage(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int, cursor string) (Keys, interface{}, string, error) {
+	return getPage(db, kind, ancestor, items, query, orderKeys, limit, cursor)
+}
+
+// Iterate runs on a snapshot, so f may write to the database without affecting the iteration.
+func (db inMemoryDb) Iterate(kind string, ancestor string, query Query, orderKeys []string, f func(Key, interface{}) error) error {
+	k, ok := db.snapshot()[kind]
+	if !ok || k.items.len() == 0 {
+		return nil
+	}
+	keys := Keys{}
+	var items reflect.Value
+	for _, id := range k.idsFor(query) {
+		item, _ := k.item(id)
+		if len(ancestor) > 0 {
+			parent := item.(Identifier).GetKey().Parent()
+			if parent == nil || parent.Encode() != ancestor {
+				continue
+			}
+		}
+		if ok, err := Matches(item, query); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if !items.IsValid() {
+			items = reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(item)), 0, 0)
 		}
-	} else if err != nil {
-		return nil, nil, err
+		items = reflect.Append(items, reflect.ValueOf(item))
+		keys = keys.Append(item.(Identifier).GetKey())
 	}
-	if err := c.Get(cacheKey, &arr); err != nil {
-		return nil, nil, err
+	if len(keys) == 0 {
+		return nil
 	}
-	reflect.Indirect(reflect.ValueOf(items)).Set(reflect.Indirect(reflect.ValueOf(arr[1])))
-	return arr[0].(Keys), arr[1], nil
+	if orderKeys != nil {
+		sort.Stable(byFields{keys, items, orderKeys})
+	}
+	for i, key := range keys {
+		if err := f(key, copyItem(items.Index(i).Interface())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getItem returns a copy of the item of the key in the data.
+func getItem(data map[string]*kindItems, ckey CKey) (interface{}, error) {
+	if kind, ok := data[ckey.kind]; !ok {
+		return nil, errors.New(fmt.Sprintf("Kind '%v' not found", ckey.kind))
+	} else if v, ok := kind.item(ckey.id); !ok {
+		return nil, errors.New(fmt.Sprintf("Id '%v' not found", ckey.id))
+	} else {
+		return copyItem(v), nil
+	}
+}
+
+// GetMulti loads all the items from the same snapshot.
+func (db inMemoryDb) GetMulti(items interface{}, keys Keys) (interface{}, error) {
+	item, err := newItems(items, len(keys))
+	if err != nil {
+		return nil, err
+	}
+	data := db.snapshot()
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		if v, err := getItem(data, key); err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = setItem(reflect.ValueOf(item(i)), v)
+		}
+	}
+	return items, multiError(errs)
 }
 
 func (db inMemoryDb) Save(item interface{}, kind string, ancestor string, param map[string]string) (key Key, err error) {
+	err = db.write(func(tdb inMemoryDb) error {
+		key, err = tdb.save(item, kind, ancestor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SaveMulti saves the items in a single transaction, which is committed even if some of them fail.
+func (db inMemoryDb) SaveMulti(items interface{}, kind string, ancestor string) (keys Keys, err error) {
+	var saveErr error
+	err = db.write(func(tdb inMemoryDb) error {
+		keys, saveErr = saveMulti(func(item interface{}) (Key, error) {
+			return tdb.save(item, kind, ancestor)
+		}, items)
+		if _, ok := saveErr.(MultiError); !ok {
+			return saveErr
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, saveErr
+}
+
+// save saves the item in the transaction of db.
+func (db inMemoryDb) save(item interface{}, kind string, ancestor string) (key Key, err error) {
 	p := reflect.ValueOf(item)
 	if !isValidEntityType(p) {
 		return nil, errors.New("Invalid Entity Type: " + p.Kind().String())
 	}
-	if _, ok := db.data[kind]; !ok {
-		db.data[kind] = &kindItems{items: map[int]interface{}{}}
+	var parent *CKey
+	if item.(Identifier).GetKey().IsZero() && len(ancestor) > 0 {
+		if k, err := db.DecodeKey(ancestor); err != nil {
+			return nil, err
+		} else {
+			ckey := k.(CKey)
+			parent = &ckey
+		}
 	}
-	items := db.data[kind]
+	items := db.kindForWrite(kind)
 	if item.(Identifier).GetKey().IsZero() {
 		items.lastId++
-		items.items[items.lastId] = item
-		var parent *CKey
-		if len(ancestor) > 0 {
-			if k, err := db.DecodeKey(ancestor); err != nil {
-				return nil, err
-			} else {
-				ckey := k.(CKey)
-				parent = &ckey
-			}
-		}
-		key = CKey{items.lastId, parent, kind}
+		key = CKey{id: items.lastId, parent: parent, kind: kind}
 		item.(Identifier).SetKey(key)
+	} else if ckey := item.(Identifier).GetKey().(CKey); ckey.name != "" {
+		// The items are kept by id only.
+		return nil, fmt.Errorf("Keys with names are not supported: %v", ckey)
 	} else {
-		key = item.(Identifier).GetKey()
-		items.items[key.(CKey).id] = item
+		if ckey.id > items.lastId {
+			// The ids of the new items must come after the ones saved explicitly.
+			items.lastId = ckey.id
+		}
+		key = ckey
 	}
+	items.put(key.(CKey).id, copyItem(item))
 	return key, nil
 }
 
 func (db inMemoryDb) Delete(key Key) error {
-	ckey := key.(CKey)
+	return db.write(func(tdb inMemoryDb) error {
+		return tdb.delete(key.(CKey))
+	})
+}
+
+// DeleteMulti deletes the items in a single transaction, which is committed even if some of them
+// fail.
+func (db inMemoryDb) DeleteMulti(keys Keys) error {
+	var deleteErr error
+	if err := db.write(func(tdb inMemoryDb) error {
+		errs := make([]error, len(keys))
+		for i, key := range keys {
+			errs[i] = tdb.delete(key)
+		}
+		deleteErr = multiError(errs)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// delete deletes the item of the key in the transaction of db.
+func (db inMemoryDb) delete(ckey CKey) error {
 	if kind, ok := db.data[ckey.kind]; !ok {
 		return errors.New(fmt.Sprintf("Kind '%v' not found", ckey.kind))
-	} else {
-		if _, ok := kind.items[ckey.id]; !ok {
-			return errors.New(fmt.Sprintf("Id '%v' not found", ckey.id))
-		}
-		delete(kind.items, ckey.id)
+	} else if _, ok := kind.item(ckey.id); !ok {
+		return errors.New(fmt.Sprintf("Id '%v' not found", ckey.id))
 	}
+	db.kindForWrite(ckey.kind).remove(ckey.id)
 	return nil
 }
 
-func (db inMemoryDb) Execute(f func(db.Db) error) error {
-	return f(db)
+// Execute runs f against a copy-on-write snapshot of the database, which is published only if f
+// returns nil. Transactions run one at a time.
+func (db inMemoryDb) Execute(f func(Db) error) error {
+	if db.written != nil {
+		return f(db)
+	}
+	if db.data != nil {
+		return errors.New("Transactions are not allowed in a view")
+	}
+	db.store.writer.Lock()
+	defer db.store.writer.Unlock()
+	data := db.snapshot()
+	tdb := inMemoryDb{db.store, make(map[string]*kindItems, len(data)), map[string]bool{}}
+	for kind, items := range data {
+		tdb.data[kind] = items
+	}
+	if err := f(tdb); err != nil {
+		return err
+	}
+	db.store.Lock()
+	db.store.data = tdb.data
+	db.store.Unlock()
+	return nil
 }
 
-func (db inMemoryDb) DecodeKey(s string) (Key, error) {
-	result := CKey{}
-	if err := result.unmarshalJSONSep([]byte(s), "-"); err != nil {
-		return nil, err
+// View runs f against the snapshot of the database taken when it is called, without blocking
+// writers.
+func (db inMemoryDb) View(f func(Db) error) error {
+	if db.data != nil {
+		return f(db)
 	}
-	return result, nil
+	return f(inMemoryDb{store: db.store, data: db.snapshot()})
+}
+
+func (db inMemoryDb) DecodeKey(s string) (Key, error) {
+	return decodeKey(s)
 }
 
 func (db inMemoryDb) NewKey() Key {
@@ -259,9 +444,5 @@ func (db inMemoryDb) NewKey() Key {
 }
 
 func (db inMemoryDb) NewStringKey(kind, key string) Key {
-	return nil
-}
-
-func isValidEntityType(p reflect.Value) bool {
-	return p.Kind() == reflect.Ptr && !p.IsNil() && p.Elem().Kind() == reflect.Struct
+	return CKey{name: key, kind: kind}
 }
@@ -3,8 +3,11 @@
 package db
 
 import (
+	"encoding/gob"
+	"errors"
 	"github.com/mcesarhm/geek-accounting/go-server/cache"
 	"testing"
+	"time"
 )
 
 type S struct {
@@ -17,6 +20,13 @@ type T struct {
 	Name string
 }
 
+func init() {
+	gob.Register(([]S)(nil))
+	for _, field := range []string{"Name", "Date", "Value", "Tags", "Entries.Ref"} {
+		RegisterIndex("U", field)
+	}
+}
+
 func TestGet(t *testing.T) {
 	db := NewInMemoryDb()
 	if key, err := db.Save(&S{Name: "a"}, "S", "", nil); err != nil {
@@ -165,6 +175,289 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestExplicitKeys(t *testing.T) {
+	db := NewInMemoryDb()
+	s := &S{Name: "a"}
+	s.SetKey(CKey{id: 100, kind: "S"})
+	if _, err := db.Save(s, "S", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := db.Save(&S{Name: "b"}, "S", "", nil); err != nil {
+		t.Fatal(err)
+	} else if key.(CKey).id <= 100 {
+		t.Errorf("The id %v must be after the one saved explicitly", key)
+	}
+	var result []S
+	if _, _, err := db.GetAll("S", "", &result, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(result) != 2 {
+		t.Error("2 expected got", result)
+	}
+	s = &S{Name: "c"}
+	s.SetKey(db.NewStringKey("S", "c"))
+	if _, err := db.Save(s, "S", "", nil); err == nil {
+		t.Error("Keys with names must not be saved")
+	}
+}
+
+func TestExecuteCommit(t *testing.T) {
+	db := NewInMemoryDb()
+	keys, err := save(db, "S", "", &S{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Execute(func(tdb Db) error {
+		if _, err := save(tdb, "S", "", &S{Name: "b"}); err != nil {
+			return err
+		}
+		if err := tdb.Delete(keys.KeyAt(0)); err != nil {
+			return err
+		}
+		if keys, _, err := db.GetAll("S", "", nil, nil, nil); err != nil {
+			return err
+		} else if len(keys) != 1 {
+			t.Error("Writes must not be visible outside of the transaction before commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []S
+	if _, _, err := db.GetAll("S", "", &s, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 1 || s[0].Name != "b" {
+		t.Error("[b] expected got", s)
+	}
+}
+
+func TestExecuteRollback(t *testing.T) {
+	db := NewInMemoryDb()
+	a := &S{Name: "a"}
+	if _, err := save(db, "S", "", a); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Execute(func(tdb Db) error {
+		a.Name = "a2"
+		if _, err := tdb.Save(a, "S", "", nil); err != nil {
+			return err
+		}
+		if _, err := save(tdb, "S", "", &S{Name: "b"}); err != nil {
+			return err
+		}
+		if _, err := save(tdb, "T", "", &T{Name: "t"}); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	if err == nil || err.Error() != "rollback" {
+		t.Fatal("rollback expected got", err)
+	}
+	var s []S
+	if _, _, err := db.GetAll("S", "", &s, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 1 || s[0].Name != "a" {
+		t.Error("[a] expected got", s)
+	}
+	if keys, _, err := db.GetAll("T", "", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Error("0 expected got", len(keys))
+	}
+	if keys, err := save(db, "S", "", &S{Name: "c"}); err != nil {
+		t.Fatal(err)
+	} else if keys.KeyAt(0).(CKey).id != 2 {
+		t.Error("Id 2 expected got", keys.KeyAt(0))
+	}
+}
+
+func TestView(t *testing.T) {
+	db := NewInMemoryDb()
+	if _, err := save(db, "S", "", &S{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	err := View(db, func(vdb Db) error {
+		if _, err := save(db, "S", "", &S{Name: "b"}); err != nil {
+			return err
+		}
+		if keys, _, err := vdb.GetAll("S", "", nil, nil, nil); err != nil {
+			return err
+		} else if len(keys) != 1 {
+			t.Error("Writes after the view is taken must not be visible in it")
+		}
+		if _, err := save(vdb, "S", "", &S{Name: "c"}); err == nil {
+			t.Error("Writes must not be allowed in a view")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _, err := db.GetAll("S", "", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 2 {
+		t.Error("2 expected got", len(keys))
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	db := NewInMemoryDb()
+	refs, err := save(db, "T", "", &T{Name: "x"}, &T{Name: "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+	items := []*U{}
+	for i := 0; i < 50; i++ {
+		u := &U{Name: string(rune('a' + i%26)), Date: date.AddDate(0, 0, i%10), Value: float64(i),
+			Tags: []string{string(rune('p' + i%3)), "z"}, Entries: []E{{refs[i%2], 1}}}
+		items = append(items, u)
+		if _, err := db.Save(u, "U", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Updates and deletes must be reflected in the indexes, and rolled back transactions must not.
+	for i := 0; i < 50; i += 5 {
+		items[i].Name, items[i].Tags = "k", nil
+		if _, err := db.Save(items[i], "U", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < 50; i += 7 {
+		if err := db.Delete(items[i].Key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Execute(func(tdb Db) error {
+		if _, err := tdb.Save(&U{Name: "k", Date: date}, "U", "", nil); err != nil {
+			return err
+		}
+		items[2].Name = "k"
+		if _, err := tdb.Save(items[2], "U", "", nil); err != nil {
+			return err
+		}
+		if err := tdb.Delete(items[3].Key); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Fatal("rollback expected")
+	}
+	items[2].Name = "c"
+	var all []*U
+	if _, _, err := db.GetAll("U", "", &all, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	k := db.(inMemoryDb).snapshot()["U"]
+	for _, tc := range []struct {
+		query   Query
+		indexed bool
+	}{
+		{Field("Name").Eq("k"), true},
+		{Field("Name").In("c", "k", "zz"), true},
+		{Field("Name").HasPrefix("c"), true},
+		{And(Field("Date").Ge(date.AddDate(0, 0, 3)), Field("Date").Lt(date.AddDate(0, 0, 5))), true},
+		{And(Field("Date").Gt(date.AddDate(0, 0, 5)), Field("Date").Le(date.AddDate(0, 0, 2))), true},
+		{And(Field("Value").Gt(10), Field("Value").Ge(20), Field("Value").Lt(30)), true},
+		{M{"Date >=": date.AddDate(0, 0, 8), "Removed =": false}, true},
+		{Field("Tags").Eq("q"), true},
+		{Field("Tags").Eq("z"), true},
+		{Field("Entries.Ref").Eq(refs[1]), true},
+		{And(Field("Name").Eq("k"), Field("Value").Lt(3)), true},
+		{Field("Removed").Eq(false), false},
+		{Or(Field("Name").Eq("k"), Field("Value").Lt(3)), false},
+	} {
+		if _, ok := k.indexedIds(tc.query); ok != tc.indexed {
+			t.Errorf("%v: indexed %v expected got %v", tc.query, tc.indexed, ok)
+		}
+		expected := ""
+		for _, u := range all {
+			if ok, err := Matches(u, tc.query); err != nil {
+				t.Fatal(err)
+			} else if ok {
+				expected += u.Key.String() + " "
+			}
+		}
+		var result []*U
+		if _, _, err := db.GetAll("U", "", &result, tc.query, nil); err != nil {
+			t.Fatal(err)
+		}
+		actual := ""
+		for _, u := range result {
+			actual += u.Key.String() + " "
+		}
+		if actual != expected {
+			t.Errorf("%v: %q expected got %q", tc.query, expected, actual)
+		}
+	}
+	if _, _, err := db.GetAll("U", "", &all, Field("Date").Eq("2014-03-01"), nil); err == nil {
+		t.Error("Type mismatch expected")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	sqlDbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(sqlDbs)
+	boltDb, closeBoltDb := newBoltTestDb(t)
+	defer closeBoltDb()
+	dbs := map[string]Db{"inmemory": NewInMemoryDb(), "bolt": boltDb}
+	for name, db := range sqlDbs {
+		dbs[name] = db
+	}
+	for name, db := range dbs {
+		items := []*U{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+		keys, err := db.SaveMulti(items, "U", "")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for i, u := range items {
+			if u.Key.IsZero() || keys[i].Encode() != u.Key.Encode() {
+				t.Errorf("%v: key %v expected got %v", name, u.Key, keys[i])
+			}
+		}
+		items[1].Name = "b2"
+		if _, err := db.SaveMulti(items[1:2], "U", ""); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := db.Delete(keys[2]); err != nil {
+			t.Fatal(name, err)
+		}
+		var result []U
+		_, err = db.GetMulti(&result, keys)
+		if me, ok := err.(MultiError); !ok || len(me) != 3 || me[0] != nil || me[1] != nil ||
+			me[2] == nil {
+			t.Errorf("%v: error of the third item expected got %v", name, err)
+		}
+		if len(result) != 3 || result[0].Name != "a" || result[1].Name != "b2" ||
+			result[1].Key.Encode() != keys[1].Encode() {
+			t.Errorf("%v: a and b2 expected got %v", name, result)
+		}
+		keys, err = db.SaveMulti([]interface{}{&U{Name: "d"}, U{Name: "e"}}, "U", "")
+		if me, ok := err.(MultiError); !ok || me[0] != nil || me[1] == nil {
+			t.Errorf("%v: error of the second item expected got %v", name, err)
+		} else if keys[0].IsZero() || !keys[1].IsZero() {
+			t.Errorf("%v: only the first item must be saved, got %v", name, keys)
+		}
+		err = db.DeleteMulti(Keys{keys[0], items[2].Key, items[0].Key})
+		if me, ok := err.(MultiError); !ok || me[0] != nil || me[1] == nil || me[2] != nil {
+			t.Errorf("%v: error of the second key expected got %v", name, err)
+		}
+		var names []string
+		if err := db.Iterate("U", "", nil, nil, func(_ Key, item interface{}) error {
+			names = append(names, item.(*U).Name)
+			return nil
+		}); err != nil {
+			t.Fatal(name, err)
+		}
+		if len(names) != 1 || names[0] != "b2" {
+			t.Errorf("%v: b2 expected got %v", name, names)
+		}
+	}
+}
+
 func save(db Db, kind, ancestor string, items ...interface{}) (Keys, error) {
 	keys := Keys{}
 	for _, i := range items {
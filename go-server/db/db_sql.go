@@ -0,0 +1,999 @@
+// +build !appengine
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mcesarhm/geek-accounting/go-server/cache"
+)
+
+// sqlDb stores every registered kind in a table named after the kind, with one column per field
+// of the kind's type. Slice fields are stored in child tables named "<Kind>_<Field>", one row per
+// element, so that filters on them become indexed subqueries.
+type sqlDb struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	dialect sqlDialect
+	tables  map[string]*sqlTable
+}
+
+type sqlDialect struct {
+	idColumn  string
+	timestamp string
+	blob      string
+	numbered  bool
+	returning bool
+	// sequence, if not empty, is the statement that moves the sequence of the ids of a table past
+	// an id inserted explicitly, which the database does not do by itself.
+	sequence     string
+	maxOpenConns int
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite3": {"INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP", "BLOB", false, false, "", 1},
+	"postgres": {"BIGSERIAL PRIMARY KEY", "TIMESTAMP WITH TIME ZONE", "BYTEA", true, true,
+		`SELECT setval(s::regclass, GREATEST(?, ` +
+			`COALESCE(pg_sequence_last_value(s::regclass), 1))) ` +
+			`FROM pg_get_serial_sequence('"%v"', '_id') s`, 0},
+}
+
+type sqlTable struct {
+	name     string
+	t        reflect.Type
+	columns  []sqlColumn
+	children []*sqlTable
+	index    []int
+}
+
+type sqlColumn struct {
+	name  string
+	t     reflect.Type
+	index []int
+}
+
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// NewSqlDb opens the database and creates the tables of the registered kinds that do not exist
+// yet. The supported drivers are sqlite3 and postgres.
+func NewSqlDb(driverName, dataSourceName string) (Db, error) {
+	dialect, ok := sqlDialects[driverName]
+	if !ok {
+		return nil, fmt.Errorf("Driver not supported: %v", driverName)
+	}
+	d, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.maxOpenConns > 0 {
+		d.SetMaxOpenConns(dialect.maxOpenConns)
+	}
+	db := sqlDb{db: d, dialect: dialect, tables: map[string]*sqlTable{}}
+	for kind, t := range kinds {
+		table, err := newSqlTable(kind, t, nil)
+		if err != nil {
+			return nil, err
+		}
+		db.tables[kind] = table
+		if err := db.createTable(table); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func newSqlTable(name string, t reflect.Type, index []int) (*sqlTable, error) {
+	table := &sqlTable{name: name, t: t, index: index}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("datastore") == "-" || f.Type.Kind() == reflect.Interface {
+			continue
+		}
+		if f.Anonymous && f.Type == reflect.TypeOf(Identifiable{}) {
+			continue
+		}
+		if isSqlScalar(f.Type) {
+			table.columns = append(table.columns, sqlColumn{f.Name, f.Type, []int{i}})
+		} else if f.Type.Kind() == reflect.Slice && index == nil {
+			var child *sqlTable
+			if isSqlScalar(f.Type.Elem()) {
+				child = &sqlTable{name: name + "_" + f.Name, t: f.Type.Elem(), index: []int{i},
+					columns: []sqlColumn{{"value", f.Type.Elem(), nil}}}
+			} else if f.Type.Elem().Kind() == reflect.Struct {
+				var err error
+				if child, err = newSqlTable(name+"_"+f.Name, f.Type.Elem(), []int{i}); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, fmt.Errorf("Type not allowed: %v.%v", name, f.Name)
+			}
+			table.children = append(table.children, child)
+		} else {
+			return nil, fmt.Errorf("Type not allowed: %v.%v", name, f.Name)
+		}
+	}
+	return table, nil
+}
+
+func isSqlScalar(t reflect.Type) bool {
+	_, ok := sqlType(sqlDialect{}, t)
+	return ok
+}
+
+func sqlType(d sqlDialect, t reflect.Type) (string, bool) {
+	if t == timeType {
+		return d.timestamp, true
+	}
+	if t.Kind() == reflect.Struct && t.ConvertibleTo(keyType) {
+		return "TEXT", true
+	}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		return d.blob, true
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "TEXT", true
+	case reflect.Bool:
+		return "BOOLEAN", true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "BIGINT", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// Unsigned integers are stored as the signed ones of the same bits, as the drivers do not
+		// take the ones above the largest int64.
+		return "BIGINT", true
+	case reflect.Float32, reflect.Float64:
+		return "DOUBLE PRECISION", true
+	}
+	return "", false
+}
+
+func (db sqlDb) createTable(table *sqlTable) error {
+	columns := []string{`"_id" ` + db.dialect.idColumn, `"_parent" TEXT NOT NULL`}
+	indexes := [][]string{{"_parent"}}
+	for _, c := range table.columns {
+		t, _ := sqlType(db.dialect, c.t)
+		columns = append(columns, fmt.Sprintf(`"%v" %v`, c.name, t))
+		if t == "TEXT" || c.t == timeType {
+			indexes = append(indexes, []string{"_parent", c.name})
+		}
+	}
+	if err := db.createTableAndIndexes(table.name, columns, indexes); err != nil {
+		return err
+	}
+	for _, child := range table.children {
+		columns := []string{`"_owner" BIGINT NOT NULL`, `"_position" INTEGER NOT NULL`}
+		indexes := [][]string{{"_owner"}}
+		for _, c := range child.columns {
+			t, _ := sqlType(db.dialect, c.t)
+			columns = append(columns, fmt.Sprintf(`"%v" %v`, c.name, t))
+			indexes = append(indexes, []string{c.name})
+		}
+		if err := db.createTableAndIndexes(child.name, columns, indexes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db sqlDb) createTableAndIndexes(name string, columns []string, indexes [][]string) error {
+	if _, err := db.ex().Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%v" (%v)`, name,
+		strings.Join(columns, ", "))); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if _, err := db.ex().Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%v_%v_idx" ON "%v" ("%v")`,
+			name, strings.Join(index, "_"), name, strings.Join(index, `", "`))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db sqlDb) Get(item interface{}, keyAsString string) (interface{}, error) {
+	p := reflect.ValueOf(item)
+	if !isValidEntityType(p) {
+		return nil, errors.New("Invalid Entity Type: " + p.Kind().String())
+	}
+	key, err := db.DecodeKey(keyAsString)
+	if err != nil {
+		return nil, err
+	}
+	ckey := key.(CKey)
+	table, err := db.table(ckey.kind)
+	if err != nil {
+		return nil, err
+	}
+	_, items, err := db.load(table, true, `t."_id" = ?`, []interface{}{ckey.id}, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("Id '%v' not found", ckey.id)
+	}
+	if err = setItem(p, items[0].Interface()); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (db sqlDb) GetAll(kind string, ancestor string, items interface{}, query Query, orderKeys []string) (Keys, interface{}, error) {
+	return db.GetAllWithLimit(kind, ancestor, items, query, orderKeys, 0)
+}
+
+func (db sqlDb) GetAllWithLimit(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int) (Keys, interface{}, error) {
+	var itemsValue reflect.Value
+	if items != nil {
+		itemsValue = reflect.ValueOf(items)
+		if itemsValue.Kind() != reflect.Ptr {
+			return nil, nil, errors.New("Invalid entity type: " + itemsValue.Kind().String())
+		}
+		itemsValue = reflect.Indirect(itemsValue)
+	}
+	table, err := db.table(kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	where, args, err := db.where(table, ancestor, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderBy, err := db.orderBy(table, orderKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, values, err := db.load(table, items != nil, where, args, orderBy, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if items != nil {
+		setItems(itemsValue, values)
+	}
+	return keys, items, nil
+}
+
+func (db sqlDb) GetPage(kind string, ancestor string, items interface{}, query Query, orderKeys []string, limit int, cursor string) (Keys, interface{}, string, error) {
+	var itemsValue reflect.Value
+	if items != nil {
+		itemsValue = reflect.ValueOf(items)
+		if itemsValue.Kind() != reflect.Ptr {
+			return nil, nil, "", errors.New("Invalid entity type: " + itemsValue.Kind().String())
+		}
+		itemsValue = reflect.Indirect(itemsValue)
+	}
+	table, err := db.table(kind)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	where, args, err := db.where(table, ancestor, query)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(cursor) > 0 {
+		after, err := decodeCursor(cursor, table.t, orderKeys)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		condition, afterArgs, err := sqlAfter(table, orderKeys, after)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if len(where) > 0 {
+			where += " AND "
+		}
+		where += condition
+		args = append(args, afterArgs...)
+	}
+	orderBy, err := db.orderBy(table, orderKeys)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	// One more row than the limit tells whether there is a next page.
+	fetch := limit
+	if limit > 0 {
+		fetch++
+	}
+	keys, values, err := db.load(table, items != nil || len(orderKeys) > 0, where, args, orderBy,
+		fetch)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	next := ""
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		if len(values) > 0 {
+			values = values[:limit]
+		}
+		last := position{key: keys[limit-1]}
+		if len(orderKeys) > 0 {
+			last = positionOf(values[limit-1], keys[limit-1], orderKeys)
+		}
+		if next, err = encodeCursor(last); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	if items != nil {
+		setItems(itemsValue, values)
+	}
+	return keys, items, next, nil
+}
+
+// sqlBatchSize is the number of rows loaded by each query of Iterate.
+const sqlBatchSize = 100
+
+// Iterate loads the items in pages, so that f may use the database between them.
+func (db sqlDb) Iterate(kind string, ancestor string, query Query, orderKeys []string, f func(Key, interface{}) error) error {
+	table, err := db.table(kind)
+	if err != nil {
+		return err
+	}
+	cursor := ""
+	for {
+		items := reflect.New(reflect.SliceOf(reflect.PtrTo(table.t)))
+		keys, _, next, err := db.GetPage(kind, ancestor, items.Interface(), query, orderKeys,
+			sqlBatchSize, cursor)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if err := f(key, items.Elem().Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// setItems sets the slice of structs or pointers to the loaded items.
+func setItems(itemsValue reflect.Value, values []reflect.Value) {
+	resultItems := reflect.MakeSlice(itemsValue.Type(), 0, len(values))
+	for _, v := range values {
+		if itemsValue.Type().Elem().Kind() != reflect.Ptr {
+			v = reflect.Indirect(v)
+		}
+		resultItems = reflect.Append(resultItems, v)
+	}
+	itemsValue.Set(resultItems)
+}
+
+func (db sqlDb) GetAllFromCache(kind string, ancestor string, items interface{}, query Query, orderKeys []string, c cache.Cache, cacheKey string) (Keys, interface{}, error) {
+	return getAllFromCache(db, kind, ancestor, items, query, orderKeys, c, cacheKey)
+}
+
+func (db sqlDb) Save(item interface{}, kind string, ancestor string, param map[string]string) (key Key, err error) {
+	p := reflect.ValueOf(item)
+	if !isValidEntityType(p) {
+		return nil, errors.New("Invalid Entity Type: " + p.Kind().String())
+	}
+	if _, ok := item.(ValidationMessager); ok {
+		vm := item.(ValidationMessager).ValidationMessage(db, param)
+		if len(vm) > 0 {
+			return CKey{}, errors.New(vm)
+		}
+	}
+	return db.save(item, kind, ancestor)
+}
+
+// SaveMulti saves each item in its own transaction, so that the failure of one of them does not
+// abort the others.
+func (db sqlDb) SaveMulti(items interface{}, kind string, ancestor string) (Keys, error) {
+	return saveMulti(func(item interface{}) (Key, error) {
+		return db.save(item, kind, ancestor)
+	}, items)
+}
+
+func (db sqlDb) save(item interface{}, kind string, ancestor string) (Key, error) {
+	p := reflect.ValueOf(item)
+	if !isValidEntityType(p) {
+		return nil, errors.New("Invalid Entity Type: " + p.Kind().String())
+	}
+	table, err := db.table(kind)
+	if err != nil {
+		return nil, err
+	}
+	identifier := item.(Identifier)
+	err = db.Execute(func(d Db) error {
+		tdb := d.(sqlDb)
+		var ckey CKey
+		if identifier.GetKey().IsZero() {
+			ckey = CKey{kind: kind}
+			if len(ancestor) > 0 {
+				if k, err := tdb.DecodeKey(ancestor); err != nil {
+					return err
+				} else {
+					parent := k.(CKey)
+					ckey.parent = &parent
+				}
+			}
+		} else if ckey = identifier.GetKey().(CKey); ckey.name != "" {
+			return fmt.Errorf("Keys with names are not supported: %v", ckey)
+		}
+		id, err := tdb.saveRow(table, ckey, reflect.Indirect(p))
+		if err != nil {
+			return err
+		}
+		ckey.id = id
+		for _, child := range table.children {
+			if err := tdb.saveChildRows(child, id, reflect.Indirect(p).FieldByIndex(child.index)); err != nil {
+				return err
+			}
+		}
+		identifier.SetKey(ckey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return identifier.GetKey(), nil
+}
+
+func (db sqlDb) saveRow(table *sqlTable, key CKey, v reflect.Value) (int, error) {
+	var parent string
+	if key.parent != nil {
+		parent = key.parent.Encode()
+	}
+	names := []string{`"_parent"`}
+	values := []interface{}{parent}
+	for _, c := range table.columns {
+		names = append(names, `"`+c.name+`"`)
+		values = append(values, sqlValue(v.FieldByIndex(c.index)))
+	}
+	if key.id != 0 {
+		sets := make([]string, len(names))
+		for i, n := range names {
+			sets[i] = n + " = ?"
+		}
+		r, err := db.exec(fmt.Sprintf(`UPDATE "%v" SET %v WHERE "_id" = ?`, table.name,
+			strings.Join(sets, ", ")), append(values, key.id)...)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := r.RowsAffected(); err != nil {
+			return 0, err
+		} else if n > 0 {
+			return key.id, nil
+		}
+		names = append(names, `"_id"`)
+		values = append(values, key.id)
+	}
+	q := fmt.Sprintf(`INSERT INTO "%v" (%v) VALUES (%v)`, table.name, strings.Join(names, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "))
+	if key.id != 0 {
+		if _, err := db.exec(q, values...); err != nil {
+			return 0, err
+		}
+		if len(db.dialect.sequence) > 0 {
+			if _, err := db.exec(fmt.Sprintf(db.dialect.sequence, table.name), key.id); err != nil {
+				return 0, err
+			}
+		}
+		return key.id, nil
+	}
+	if db.dialect.returning {
+		var id int
+		err := db.ex().QueryRow(db.rebind(q+` RETURNING "_id"`), values...).Scan(&id)
+		return id, err
+	}
+	r, err := db.exec(q, values...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := r.LastInsertId()
+	return int(id), err
+}
+
+func (db sqlDb) saveChildRows(child *sqlTable, owner int, v reflect.Value) error {
+	if _, err := db.exec(fmt.Sprintf(`DELETE FROM "%v" WHERE "_owner" = ?`, child.name),
+		owner); err != nil {
+		return err
+	}
+	names := []string{`"_owner"`, `"_position"`}
+	for _, c := range child.columns {
+		names = append(names, `"`+c.name+`"`)
+	}
+	q := fmt.Sprintf(`INSERT INTO "%v" (%v) VALUES (%v)`, child.name, strings.Join(names, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "))
+	for i := 0; i < v.Len(); i++ {
+		values := []interface{}{owner, i}
+		for _, c := range child.columns {
+			e := v.Index(i)
+			if c.index != nil {
+				e = e.FieldByIndex(c.index)
+			}
+			values = append(values, sqlValue(e))
+		}
+		if _, err := db.exec(q, values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db sqlDb) GetMulti(items interface{}, keys Keys) (interface{}, error) {
+	return getMulti(db, items, keys)
+}
+
+func (db sqlDb) DeleteMulti(keys Keys) error {
+	return deleteMulti(db, keys)
+}
+
+func (db sqlDb) Delete(key Key) error {
+	ckey := key.(CKey)
+	table, err := db.table(ckey.kind)
+	if err != nil {
+		return err
+	}
+	return db.Execute(func(d Db) error {
+		tdb := d.(sqlDb)
+		for _, child := range table.children {
+			if _, err := tdb.exec(fmt.Sprintf(`DELETE FROM "%v" WHERE "_owner" = ?`, child.name),
+				ckey.id); err != nil {
+				return err
+			}
+		}
+		r, err := tdb.exec(fmt.Sprintf(`DELETE FROM "%v" WHERE "_id" = ?`, table.name), ckey.id)
+		if err != nil {
+			return err
+		}
+		if n, err := r.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("Id '%v' not found", ckey.id)
+		}
+		return nil
+	})
+}
+
+// Execute runs f in a database transaction, which is committed only if f returns nil.
+func (db sqlDb) Execute(f func(Db) error) error {
+	if db.tx != nil {
+		return f(db)
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(sqlDb{db.db, tx, db.dialect, db.tables}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db sqlDb) DecodeKey(s string) (Key, error) {
+	return decodeKey(s)
+}
+
+func (db sqlDb) NewKey() Key {
+	return CKey{}
+}
+
+func (db sqlDb) NewStringKey(kind, key string) Key {
+	return CKey{name: key, kind: kind}
+}
+
+func (db sqlDb) Close() error {
+	return db.db.Close()
+}
+
+func (db sqlDb) table(kind string) (*sqlTable, error) {
+	if table, ok := db.tables[kind]; ok {
+		return table, nil
+	}
+	return nil, fmt.Errorf("Kind '%v' not registered", kind)
+}
+
+func (db sqlDb) ex() sqlExecutor {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.db
+}
+
+func (db sqlDb) exec(q string, args ...interface{}) (sql.Result, error) {
+	return db.ex().Exec(db.rebind(q), args...)
+}
+
+func (db sqlDb) query(q string, args ...interface{}) (*sql.Rows, error) {
+	return db.ex().Query(db.rebind(q), args...)
+}
+
+// rebind replaces the question mark placeholders by numbered ones if the dialect requires them.
+func (db sqlDb) rebind(q string) string {
+	if !db.dialect.numbered {
+		return q
+	}
+	var buf strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// where translates the ancestor and the query to a SQL condition on the table aliased as t.
+func (db sqlDb) where(table *sqlTable, ancestor string, query Query) (string, []interface{}, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	if len(ancestor) > 0 {
+		conditions = append(conditions, `t."_parent" = ?`)
+		args = append(args, ancestor)
+	}
+	if query != nil {
+		condition, queryArgs, err := sqlCondition(table, query)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+		args = append(args, queryArgs...)
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+func sqlCondition(table *sqlTable, query Query) (string, []interface{}, error) {
+	switch q := query.(type) {
+	case M:
+		conditions, err := q.query()
+		if err != nil {
+			return "", nil, err
+		}
+		return sqlCondition(table, conditions)
+	case and, or:
+		var (
+			queries   []Query
+			separator string
+		)
+		if a, ok := q.(and); ok {
+			queries, separator = a, " AND "
+		} else {
+			queries, separator = q.(or), " OR "
+		}
+		if len(queries) == 0 {
+			if separator == " AND " {
+				return "1 = 1", nil, nil
+			}
+			return "1 = 0", nil, nil
+		}
+		conditions := []string{}
+		args := []interface{}{}
+		for _, c := range queries {
+			condition, cArgs, err := sqlCondition(table, c)
+			if err != nil {
+				return "", nil, err
+			}
+			conditions = append(conditions, condition)
+			args = append(args, cArgs...)
+		}
+		return "(" + strings.Join(conditions, separator) + ")", args, nil
+	case not:
+		condition, args, err := sqlCondition(table, q.q)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT " + condition, args, nil
+	case condition:
+		path := strings.SplitN(q.field, ".", 2)
+		if c := table.column(path[0]); c != nil && len(path) == 1 {
+			return sqlComparison(fmt.Sprintf(`t."%v"`, c.name), q)
+		} else if child := table.child(path[0]); child != nil {
+			column := "value"
+			if len(path) > 1 {
+				column = path[1]
+			}
+			if child.column(column) == nil {
+				return "", nil, fmt.Errorf("Field not found: %v", q.field)
+			}
+			comparison, args, err := sqlComparison(fmt.Sprintf(`c."%v"`, column), q)
+			if err != nil {
+				return "", nil, err
+			}
+			return fmt.Sprintf(`EXISTS (SELECT 1 FROM "%v" c WHERE c."_owner" = t."_id" AND %v)`,
+				child.name, comparison), args, nil
+		}
+		return "", nil, fmt.Errorf("Field not found: %v", q.field)
+	}
+	return "", nil, fmt.Errorf("Query not supported: %T", query)
+}
+
+func sqlComparison(column string, q condition) (string, []interface{}, error) {
+	switch q.op {
+	case eq, lt, le, gt, ge:
+		if _, err := normalize(q.value); err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%v %v ?", column, q.op), []interface{}{sqlValue(reflect.ValueOf(q.value))}, nil
+	case in:
+		values, ok := q.value.([]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("Invalid values for in: %v", q.value)
+		}
+		if len(values) == 0 {
+			return "1 = 0", nil, nil
+		}
+		args := []interface{}{}
+		for _, v := range values {
+			if _, err := normalize(v); err != nil {
+				return "", nil, err
+			}
+			args = append(args, sqlValue(reflect.ValueOf(v)))
+		}
+		return fmt.Sprintf("%v IN (%v)", column,
+			strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")), args, nil
+	case prefix:
+		s := q.value.(string)
+		return fmt.Sprintf("substr(%v, 1, ?) = ?", column),
+			[]interface{}{utf8.RuneCountInString(s), s}, nil
+	}
+	return "", nil, fmt.Errorf("Operator not allowed: %v", q.op)
+}
+
+// sqlAfter returns the condition satisfied by the rows after the position in the order of
+// orderKeys and then of their ids.
+func sqlAfter(table *sqlTable, orderKeys []string, after position) (string, []interface{}, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	equal := ""
+	equalArgs := []interface{}{}
+	for i, o := range orderKeys {
+		op := ">"
+		if strings.HasPrefix(o, "-") {
+			o, op = o[1:], "<"
+		}
+		if table.column(o) == nil {
+			return "", nil, fmt.Errorf("Field not found: %v", o)
+		}
+		value := sqlValue(reflect.ValueOf(after.values[i]))
+		conditions = append(conditions, fmt.Sprintf(`(%vt."%v" %v ?)`, equal, o, op))
+		args = append(append(args, equalArgs...), value)
+		equal += fmt.Sprintf(`t."%v" = ? AND `, o)
+		equalArgs = append(equalArgs, value)
+	}
+	conditions = append(conditions, fmt.Sprintf(`(%vt."_id" > ?)`, equal))
+	args = append(append(args, equalArgs...), after.key.id)
+	return "(" + strings.Join(conditions, " OR ") + ")", args, nil
+}
+
+func (db sqlDb) orderBy(table *sqlTable, orderKeys []string) (string, error) {
+	terms := []string{}
+	for _, o := range orderKeys {
+		direction := ""
+		if strings.HasPrefix(o, "-") {
+			o = o[1:]
+			direction = " DESC"
+		}
+		if table.column(o) == nil {
+			return "", fmt.Errorf("Field not found: %v", o)
+		}
+		terms = append(terms, fmt.Sprintf(`t."%v"%v`, o, direction))
+	}
+	return strings.Join(append(terms, `t."_id"`), ", "), nil
+}
+
+// load returns the keys, and the items as pointers if withItems is true, of the rows of the table
+// satisfying the condition.
+func (db sqlDb) load(table *sqlTable, withItems bool, where string, args []interface{},
+	orderBy string, limit int) (Keys, []reflect.Value, error) {
+	selection := `SELECT t."_id", t."_parent"`
+	if withItems {
+		for _, c := range table.columns {
+			selection += fmt.Sprintf(`, t."%v"`, c.name)
+		}
+	}
+	from := fmt.Sprintf(` FROM "%v" t`, table.name)
+	if len(where) > 0 {
+		from += " WHERE " + where
+	}
+	if len(orderBy) > 0 {
+		from += " ORDER BY " + orderBy
+	}
+	if limit > 0 {
+		from += fmt.Sprintf(" LIMIT %v", limit)
+	}
+	rows, err := db.query(selection+from, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := Keys{}
+	items := []reflect.Value{}
+	byId := map[int]reflect.Value{}
+	for rows.Next() {
+		var (
+			id     int
+			parent string
+		)
+		dest := []interface{}{&id, &parent}
+		if withItems {
+			for _, c := range table.columns {
+				dest = append(dest, sqlScanDest(c.t))
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		key := CKey{id: id, kind: table.name}
+		if len(parent) > 0 {
+			if k, err := decodeKey(parent); err != nil {
+				rows.Close()
+				return nil, nil, err
+			} else {
+				p := k.(CKey)
+				key.parent = &p
+			}
+		}
+		keys = keys.Append(key)
+		if withItems {
+			item := reflect.New(table.t)
+			for i, c := range table.columns {
+				setSqlValue(item.Elem().FieldByIndex(c.index), dest[i+2])
+			}
+			item.Interface().(Identifier).SetKey(key)
+			items = append(items, item)
+			byId[id] = item
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if !withItems || len(items) == 0 {
+		return keys, items, nil
+	}
+	for _, child := range table.children {
+		if err := db.loadChildRows(child, `SELECT t."_id"`+from, args, byId); err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys, items, nil
+}
+
+func (db sqlDb) loadChildRows(child *sqlTable, owners string, args []interface{},
+	byId map[int]reflect.Value) error {
+	selection := `SELECT c."_owner"`
+	for _, c := range child.columns {
+		selection += fmt.Sprintf(`, c."%v"`, c.name)
+	}
+	rows, err := db.query(fmt.Sprintf(
+		`%v FROM "%v" c WHERE c."_owner" IN (%v) ORDER BY c."_owner", c."_position"`,
+		selection, child.name, owners), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var owner int
+		dest := []interface{}{&owner}
+		for _, c := range child.columns {
+			dest = append(dest, sqlScanDest(c.t))
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		item, ok := byId[owner]
+		if !ok {
+			continue
+		}
+		slice := item.Elem().FieldByIndex(child.index)
+		e := reflect.New(child.t).Elem()
+		for i, c := range child.columns {
+			if c.index == nil {
+				setSqlValue(e, dest[i+1])
+			} else {
+				setSqlValue(e.FieldByIndex(c.index), dest[i+1])
+			}
+		}
+		slice.Set(reflect.Append(slice, e))
+	}
+	return rows.Err()
+}
+
+func (table *sqlTable) column(name string) *sqlColumn {
+	for i, c := range table.columns {
+		if c.name == name {
+			return &table.columns[i]
+		}
+	}
+	return nil
+}
+
+func (table *sqlTable) child(name string) *sqlTable {
+	for _, c := range table.children {
+		if c.name == table.name+"_"+name {
+			return c
+		}
+	}
+	return nil
+}
+
+func sqlValue(v reflect.Value) interface{} {
+	t := v.Type()
+	if t == timeType {
+		return v.Interface().(time.Time).UTC()
+	}
+	if t.Kind() == reflect.Struct && t.ConvertibleTo(keyType) {
+		if key := v.Convert(keyType).Interface().(CKey); !key.IsZero() {
+			return key.Encode()
+		}
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Slice:
+		return v.Bytes()
+	}
+	return v.Interface()
+}
+
+func sqlScanDest(t reflect.Type) interface{} {
+	if t == timeType {
+		return new(time.Time)
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return new(bool)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(int64)
+	case reflect.Float32, reflect.Float64:
+		return new(float64)
+	case reflect.Slice:
+		return new([]byte)
+	}
+	return new(sql.NullString)
+}
+
+func setSqlValue(f reflect.Value, dest interface{}) {
+	switch d := dest.(type) {
+	case *time.Time:
+		f.Set(reflect.ValueOf(*d))
+	case *bool:
+		f.SetBool(*d)
+	case *int64:
+		if f.CanUint() {
+			f.SetUint(uint64(*d))
+		} else {
+			f.SetInt(*d)
+		}
+	case *float64:
+		f.SetFloat(*d)
+	case *[]byte:
+		f.SetBytes(*d)
+	case *sql.NullString:
+		if f.Kind() == reflect.String {
+			f.SetString(d.String)
+		} else if len(d.String) > 0 {
+			if k, err := decodeKey(d.String); err == nil {
+				f.Set(reflect.ValueOf(k).Convert(f.Type()))
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// +build inmemory
+
+package db
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type U struct {
+	Identifiable
+	Name    string
+	Date    time.Time
+	Value   float64
+	Removed bool
+	Ref     CKey
+	Tags    []string
+	Entries []E
+}
+
+type E struct {
+	Ref   CKey
+	Value float64
+}
+
+type B struct {
+	Identifiable
+	Data    []byte
+	Counter uint64
+	Small   uint8
+}
+
+func init() {
+	RegisterKind("S", S{})
+	RegisterKind("T", T{})
+	RegisterKind("U", U{})
+	RegisterKind("B", B{})
+}
+
+func newSqlTestDbs(t *testing.T) map[string]Db {
+	dbs := map[string]Db{}
+	d, err := NewSqlDb("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs["sqlite3"] = d
+	// GA_TEST_POSTGRES is the data source of an empty local database, e.g.
+	// "dbname=ga_test sslmode=disable"
+	if source := os.Getenv("GA_TEST_POSTGRES"); source != "" {
+		d, err := NewSqlDb("postgres", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range []string{"S", "T", "U", "U_Tags", "U_Entries", "B"} {
+			if _, err := d.(sqlDb).exec(`DELETE FROM "` + table + `"`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dbs["postgres"] = d
+	}
+	return dbs
+}
+
+func closeSqlTestDbs(dbs map[string]Db) {
+	for _, d := range dbs {
+		d.(io.Closer).Close()
+	}
+}
+
+func TestSqlGetAll(t *testing.T) {
+	dbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(dbs)
+	for name, db := range dbs {
+		keys, err := save(db, "T", "", &T{Name: "t"})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		keys, err = save(db, "S", keys[0].Encode(), &S{Name: "a"}, &S{Name: "b"})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		var items []S
+		if _, _, err := db.GetAll("S", keys[0].Parent().Encode(), &items, M{"Name =": "b"}, nil); err != nil {
+			t.Fatal(name, err)
+		}
+		if len(items) != 1 || items[0].Name != "b" || items[0].Key.Encode() != keys[1].Encode() {
+			t.Errorf("%v: GetAll returned %v", name, items)
+		}
+		var item S
+		if _, err := db.Get(&item, keys[0].Encode()); err != nil {
+			t.Fatal(name, err)
+		}
+		if item.Name != "a" || item.Key.Parent().Encode() != keys[0].Parent().Encode() {
+			t.Errorf("%v: Get returned %v", name, item)
+		}
+	}
+}
+
+func TestSqlFieldsAndFilters(t *testing.T) {
+	dbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(dbs)
+	for name, db := range dbs {
+		refs, err := save(db, "T", "", &T{Name: "x"}, &T{Name: "y"})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		date := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+		_, err = save(db, "U", "",
+			&U{Name: "a", Date: date, Value: 1.5, Ref: refs[0], Tags: []string{"p", "q"},
+				Entries: []E{{refs[0], 1}, {refs[1], 2}}},
+			&U{Name: "b", Date: date.AddDate(0, 1, 0), Removed: true, Tags: []string{"q"},
+				Entries: []E{{refs[1], 3}}})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		var items []*U
+		if _, _, err := db.GetAll("U", "", &items, nil, []string{"-Date"}); err != nil {
+			t.Fatal(name, err)
+		}
+		if len(items) != 2 || items[0].Name != "b" {
+			t.Fatalf("%v: GetAll returned %v", name, items)
+		}
+		a := items[1]
+		if !a.Date.Equal(date) || a.Value != 1.5 || a.Removed || a.Ref != refs[0] ||
+			len(a.Tags) != 2 || a.Tags[1] != "q" || len(a.Entries) != 2 || a.Entries[1].Ref != refs[1] ||
+			a.Entries[1].Value != 2 || !items[0].Removed {
+			t.Errorf("%v: fields not stored: %+v", name, a)
+		}
+		for _, tc := range []struct {
+			filters M
+			count   int
+		}{
+			{M{"Date >=": date.AddDate(0, 0, 1)}, 1},
+			{M{"Tags =": "q"}, 2},
+			{M{"Tags =": "p"}, 1},
+			{M{"Entries.Ref =": refs[1]}, 2},
+			{M{"Entries.Ref =": refs[0], "Removed =": false}, 1},
+			{M{"Ref =": refs[1]}, 0},
+		} {
+			keys, _, err := db.GetAll("U", "", nil, tc.filters, nil)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if len(keys) != tc.count {
+				t.Errorf("%v: %v returned %v keys, want %v", name, tc.filters, len(keys), tc.count)
+			}
+		}
+		keys, _, err := db.GetAllWithLimit("U", "", &items, M{"Tags =": "q"}, []string{"Name"}, 1)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(keys) != 1 || items[0].Name != "a" || len(items[0].Entries) != 2 {
+			t.Errorf("%v: GetAllWithLimit returned %v", name, items)
+		}
+	}
+}
+
+func TestSqlUpdateAndDelete(t *testing.T) {
+	dbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(dbs)
+	for name, db := range dbs {
+		u := &U{Name: "a", Tags: []string{"p", "q"}}
+		keys, err := save(db, "U", "", u)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		u.Tags = []string{"r"}
+		if _, err := db.Save(u, "U", "", nil); err != nil {
+			t.Fatal(name, err)
+		}
+		var items []U
+		if _, _, err := db.GetAll("U", "", &items, nil, nil); err != nil {
+			t.Fatal(name, err)
+		}
+		if len(items) != 1 || len(items[0].Tags) != 1 || items[0].Tags[0] != "r" {
+			t.Errorf("%v: update returned %v", name, items)
+		}
+		if err := db.Delete(keys[0]); err != nil {
+			t.Fatal(name, err)
+		}
+		if keys, _, err := db.GetAll("U", "", nil, M{"Tags =": "r"}, nil); err != nil {
+			t.Fatal(name, err)
+		} else if len(keys) != 0 {
+			t.Errorf("%v: child rows not deleted", name)
+		}
+		if err := db.Delete(keys[0]); err == nil {
+			t.Errorf("%v: deleting a missing item must fail", name)
+		}
+	}
+}
+
+func TestSqlExecute(t *testing.T) {
+	dbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(dbs)
+	for name, db := range dbs {
+		err := db.Execute(func(db Db) error {
+			if _, err := db.Save(&S{Name: "a"}, "S", "", nil); err != nil {
+				return err
+			}
+			return errors.New("rollback")
+		})
+		if err == nil || err.Error() != "rollback" {
+			t.Fatal(name, err)
+		}
+		if keys, _, err := db.GetAll("S", "", nil, nil, nil); err != nil {
+			t.Fatal(name, err)
+		} else if len(keys) != 0 {
+			t.Errorf("%v: transaction not rolled back", name)
+		}
+	}
+}
+
+func TestSqlExplicitKeys(t *testing.T) {
+	dbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(dbs)
+	for name, db := range dbs {
+		s := &S{Name: "a"}
+		s.SetKey(CKey{id: 100, kind: "S"})
+		if _, err := db.Save(s, "S", "", nil); err != nil {
+			t.Fatal(name, err)
+		}
+		if key, err := db.Save(&S{Name: "b"}, "S", "", nil); err != nil {
+			t.Fatal(name, err)
+		} else if key.(CKey).id <= 100 {
+			t.Errorf("%v: the id %v must be after the one saved explicitly", name, key)
+		}
+		s = &S{Name: "c"}
+		s.SetKey(db.NewStringKey("S", "c"))
+		if _, err := db.Save(s, "S", "", nil); err == nil {
+			t.Errorf("%v: keys with names must not be saved", name)
+		}
+	}
+}
+
+func TestSqlBytesAndUnsigned(t *testing.T) {
+	dbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(dbs)
+	for name, db := range dbs {
+		key, err := db.Save(&B{Data: []byte{0, 1, 255}, Counter: 1<<64 - 1, Small: 200}, "B", "",
+			nil)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		var b B
+		if _, err := db.Get(&b, key.Encode()); err != nil {
+			t.Fatal(name, err)
+		}
+		if string(b.Data) != "\x00\x01\xff" || b.Counter != 1<<64-1 || b.Small != 200 {
+			t.Errorf("%v: the fields were loaded as %v", name, b)
+		}
+	}
+}
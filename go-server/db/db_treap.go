@@ -0,0 +1,130 @@
+// +build !appengine
+
+package db
+
+import "math/rand"
+
+// treap is a persistent balanced search tree of values in the order of compare. Adding and removing
+// values copy the nodes on the path to them instead of changing them, so a treap is never changed
+// once built and copying it takes constant time.
+type treap[T any] struct {
+	root    *treapNode[T]
+	compare func(a, b T) int
+}
+
+type treapNode[T any] struct {
+	value       T
+	priority    uint32
+	size        int
+	left, right *treapNode[T]
+}
+
+func newTreap[T any](compare func(a, b T) int) treap[T] {
+	return treap[T]{compare: compare}
+}
+
+func (n *treapNode[T]) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// with returns a copy of n whose children are left and right.
+func (n *treapNode[T]) with(left, right *treapNode[T]) *treapNode[T] {
+	return &treapNode[T]{n.value, n.priority, left.len() + right.len() + 1, left, right}
+}
+
+// split returns the nodes of n whose values are before, which must hold for a prefix of them, and
+// the other ones.
+func split[T any](n *treapNode[T], before func(T) bool) (*treapNode[T], *treapNode[T]) {
+	if n == nil {
+		return nil, nil
+	}
+	if before(n.value) {
+		left, right := split(n.right, before)
+		return n.with(n.left, left), right
+	}
+	left, right := split(n.left, before)
+	return left, n.with(right, n.right)
+}
+
+// merge returns the nodes of left followed by the ones of right.
+func merge[T any](left, right *treapNode[T]) *treapNode[T] {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.priority > right.priority {
+		return left.with(left.left, merge(left.right, right))
+	}
+	return right.with(merge(left, right.left), right.right)
+}
+
+// ascend calls f in order with the values of n that are from the first one for which from holds up
+// to the one before the first one for which past holds.
+func ascend[T any](n *treapNode[T], from, past func(T) bool, f func(T)) {
+	if n == nil {
+		return
+	}
+	in := from(n.value)
+	if in {
+		ascend(n.left, from, past, f)
+	}
+	if past(n.value) {
+		return
+	}
+	if in {
+		f(n.value)
+	}
+	ascend(n.right, from, past, f)
+}
+
+// around returns the nodes of t before the value, the ones equal to it and the ones after it.
+func (t treap[T]) around(value T) (before, equal, after *treapNode[T]) {
+	before, after = split(t.root, func(v T) bool { return t.compare(v, value) < 0 })
+	equal, after = split(after, func(v T) bool { return t.compare(v, value) <= 0 })
+	return
+}
+
+// len returns the number of values of t.
+func (t treap[T]) len() int {
+	return t.root.len()
+}
+
+// get returns the value of t equal to the value.
+func (t treap[T]) get(value T) (T, bool) {
+	for n := t.root; n != nil; {
+		switch c := t.compare(value, n.value); {
+		case c < 0:
+			n = n.left
+		case c > 0:
+			n = n.right
+		default:
+			return n.value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// add returns a copy of t with the value, in place of the one equal to it.
+func (t treap[T]) add(value T) treap[T] {
+	before, _, after := t.around(value)
+	n := &treapNode[T]{value: value, priority: rand.Uint32(), size: 1}
+	return treap[T]{merge(merge(before, n), after), t.compare}
+}
+
+// remove returns a copy of t without the value equal to the value.
+func (t treap[T]) remove(value T) treap[T] {
+	before, _, after := t.around(value)
+	return treap[T]{merge(before, after), t.compare}
+}
+
+// ascend calls f with the values of t in order.
+func (t treap[T]) ascend(f func(T)) {
+	always := func(T) bool { return true }
+	ascend(t.root, always, func(T) bool { return false }, f)
+}
@@ -0,0 +1,50 @@
+// +build !appengine
+
+package db
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTreap(t *testing.T) {
+	ints := newTreap(func(a, b int) int { return a - b })
+	values := rand.Perm(1000)
+	for _, v := range values {
+		ints = ints.add(v)
+	}
+	removed := ints
+	for _, v := range values[:500] {
+		removed = removed.remove(v)
+	}
+	if ints.len() != 1000 || removed.len() != 500 {
+		t.Fatal("Wrong lengths", ints.len(), removed.len())
+	}
+	var previous []int
+	removed.ascend(func(v int) { previous = append(previous, v) })
+	for i, v := range previous {
+		if i > 0 && v <= previous[i-1] {
+			t.Fatal("The values must be in order", previous)
+		}
+		if _, ok := ints.get(v); !ok {
+			t.Error("The value must be found in the treap it was copied from", v)
+		}
+	}
+	for _, v := range values[:500] {
+		if _, ok := removed.get(v); ok {
+			t.Error("The value must be removed", v)
+		}
+		if _, ok := ints.get(v); !ok {
+			t.Error("The treap the value was removed from must not change", v)
+		}
+	}
+	if ints.add(values[0]).len() != 1000 {
+		t.Error("The value must be replaced")
+	}
+	var between []int
+	ascend(ints.root, func(v int) bool { return v >= 10 }, func(v int) bool { return v > 20 },
+		func(v int) { between = append(between, v) })
+	if len(between) != 11 || between[0] != 10 || between[10] != 20 {
+		t.Error("The values from 10 to 20 expected", between)
+	}
+}
@@ -0,0 +1,430 @@
+// Package dbtest is a suite of tests of the behavior every implementation of db.Db must have. A
+// database is tested by running the suite against it:
+//
+//	func TestInMemoryDb(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) (db.Db, cache.Cache, func()) {
+//			return db.NewInMemoryDb(), cache.NewInMemoryCache(), func() {}
+//		})
+//	}
+package dbtest
+
+import (
+	"encoding/gob"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcesarhm/geek-accounting/go-server/cache"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+)
+
+// Parent is the kind of the ancestors of the items of the tests and of the keys they refer to.
+type Parent struct {
+	db.Identifiable
+	Name string
+}
+
+// Item is the kind whose items are saved and queried by the tests.
+type Item struct {
+	db.Identifiable
+	Name    string
+	Number  int
+	Value   float64
+	Date    time.Time
+	Removed bool
+	Ref     db.CKey
+	Tags    []string
+	Entries []Entry
+}
+
+type Entry struct {
+	Ref   db.CKey
+	Value float64
+}
+
+const (
+	parentKind = "DbtestParent"
+	itemKind   = "DbtestItem"
+	cacheKey   = "dbtest_items"
+)
+
+var parents = db.NewRepository[Parent](parentKind)
+
+func init() {
+	gob.Register((*Parent)(nil))
+	gob.Register((*Item)(nil))
+	gob.Register(([]Item)(nil))
+	db.RegisterKind(parentKind, Parent{})
+	db.RegisterKind(itemKind, Item{})
+}
+
+// Factory returns the database to test, the cache used to test GetAllFromCache and a function
+// that releases them. The same database may be returned to every test, since each test deletes
+// the items left by the previous ones.
+type Factory func(t *testing.T) (db.Db, cache.Cache, func())
+
+// Run runs each test of the suite against a database returned by newDb. The queries of the tests
+// are restricted to those every database supports: inequality filters on a single field, which is
+// also the only field they may be ordered by.
+func Run(t *testing.T, newDb Factory) {
+	for _, test := range []struct {
+		name string
+		f    func(*testing.T, db.Db, cache.Cache)
+	}{
+		{"Keys", testKeys},
+		{"Kinds", testKinds},
+		{"Filters", testFilters},
+		{"SliceFields", testSliceFields},
+		{"Order", testOrder},
+		{"Limit", testLimit},
+		{"Execute", testExecute},
+		{"GetAllFromCache", testGetAllFromCache},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			d, c, done := newDb(t)
+			defer done()
+			for _, kind := range []string{itemKind, parentKind} {
+				if keys, _, err := d.GetAll(kind, "", nil, nil, nil); err != nil {
+					t.Fatal(err)
+				} else if err := d.DeleteMulti(keys); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Delete(cacheKey); err != nil {
+				t.Fatal(err)
+			}
+			test.f(t, d, c)
+		})
+	}
+}
+
+func testKeys(t *testing.T, d db.Db, _ cache.Cache) {
+	parent := &Parent{Name: "p"}
+	parentKey, err := d.Save(parent, parentKind, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parentKey.IsZero() || parentKey.Encode() != parent.Key.Encode() {
+		t.Fatalf("Key %v expected got %v", parent.Key, parentKey)
+	}
+	if !parentKey.Parent().IsZero() {
+		t.Errorf("No parent expected got %v", parentKey.Parent())
+	}
+	children := save(t, d, parentKey.Encode(), &Item{Name: "a"}, &Item{Name: "b"})
+	save(t, d, "", &Item{Name: "c"})
+	for _, key := range children {
+		if key.Parent().Encode() != parentKey.Encode() {
+			t.Errorf("Parent %v expected got %v", parentKey, key.Parent())
+		}
+		decoded, err := d.DecodeKey(key.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Encode() != key.Encode() || decoded.String() != key.String() ||
+			decoded.Parent().Encode() != parentKey.Encode() {
+			t.Errorf("%v expected got %v", key, decoded)
+		}
+		var item Item
+		if _, err := d.Get(&item, key.Encode()); err != nil {
+			t.Fatal(err)
+		} else if item.Key.Encode() != key.Encode() {
+			t.Errorf("Key %v expected got %v", key, item.Key)
+		}
+	}
+	var items []Item
+	if _, _, err := d.GetAll(itemKind, parentKey.Encode(), &items, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if s := names(items, true); s != "a b" {
+		t.Errorf("The children of the parent expected, got %q", s)
+	}
+	if _, _, err := d.GetAll(itemKind, "", &items, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if s := names(items, true); s != "a b c" {
+		t.Errorf("Every item expected, got %q", s)
+	}
+}
+
+// testKinds checks that the key of an item of a kind is not loaded as an item of another one.
+func testKinds(t *testing.T, d db.Db, _ cache.Cache) {
+	keys := save(t, d, "", &Item{Name: "a"})
+	if keys[0].Kind() != itemKind {
+		t.Errorf("Kind %v expected got %v", itemKind, keys[0].Kind())
+	}
+	if p, err := parents.Get(d, keys[0].Encode()); err == nil {
+		t.Errorf("The item must not be loaded as a parent, got %v", p)
+	}
+	var parent Parent
+	if _, err := d.Get(&parent, keys[0].Encode()); err == nil {
+		t.Errorf("The item must not be loaded as a parent, got %v", parent)
+	}
+	var items []Parent
+	if _, err := d.GetMulti(&items, keys); err == nil {
+		t.Errorf("The item must not be loaded as a parent, got %v", items)
+	}
+}
+
+// saveSample saves the items most tests query, and the keys they refer to.
+func saveSample(t *testing.T, d db.Db) (refs db.Keys, date time.Time) {
+	refs = save(t, d, "", &Parent{Name: "x"}, &Parent{Name: "y"})
+	date = time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+	save(t, d, "",
+		&Item{Name: "ana", Number: 1, Value: 1.5, Date: date, Ref: refs[0],
+			Tags: []string{"x", "y"}, Entries: []Entry{{refs[0], 1}, {refs[1], 2}}},
+		&Item{Name: "anna", Number: 2, Value: 2.5, Date: date.AddDate(0, 1, 0), Removed: true,
+			Ref: refs[1], Tags: []string{"y"}, Entries: []Entry{{refs[1], 3}}},
+		&Item{Name: "bob", Number: 3, Value: 3, Date: date.AddDate(0, 2, 0), Ref: refs[1]},
+		&Item{Name: "carl", Number: 4, Value: 0.5, Date: date.AddDate(0, 3, 0), Ref: refs[0],
+			Tags: []string{"z"}})
+	return
+}
+
+func testFilters(t *testing.T, d db.Db, _ cache.Cache) {
+	refs, date := saveSample(t, d)
+	testQueries(t, d, []queryTest{
+		{db.Field("Name").Eq("bob"), "bob"},
+		{db.Field("Number").Lt(2), "ana"},
+		{db.Field("Number").Le(2), "ana anna"},
+		{db.Field("Number").Gt(3), "carl"},
+		{db.Field("Number").Ge(3), "bob carl"},
+		{db.Field("Value").Gt(1.5), "anna bob"},
+		{db.Field("Date").Ge(date.AddDate(0, 2, 0)), "bob carl"},
+		{db.Field("Removed").Eq(true), "anna"},
+		{db.Field("Ref").Eq(refs[1]), "anna bob"},
+		{db.Field("Name").In("bob", "carl", "dave"), "bob carl"},
+		{db.Field("Name").HasPrefix("an"), "ana anna"},
+		{db.Not(db.Field("Removed").Eq(true)), "ana bob carl"},
+		{db.Or(db.Field("Name").Eq("ana"), db.Field("Number").Eq(4)), "ana carl"},
+		{db.And(db.Field("Removed").Eq(false), db.Field("Number").Ge(2)), "bob carl"},
+		{db.And(db.Field("Ref").Eq(refs[0]), db.Field("Name").HasPrefix("c")), "carl"},
+		{db.M{"Removed =": false, "Number <": 4}, "ana bob"},
+		{db.Or(), ""},
+		{nil, "ana anna bob carl"},
+	})
+}
+
+func testSliceFields(t *testing.T, d db.Db, _ cache.Cache) {
+	refs, _ := saveSample(t, d)
+	testQueries(t, d, []queryTest{
+		{db.Field("Tags").Eq("y"), "ana anna"},
+		{db.Field("Tags").In("x", "z"), "ana carl"},
+		{db.Not(db.Field("Tags").Eq("y")), "bob carl"},
+		{db.Field("Entries.Ref").Eq(refs[1]), "ana anna"},
+		{db.Field("Entries.Value").Ge(2), "ana anna"},
+		{db.Field("Entries.Value").Gt(2), "anna"},
+		{db.And(db.Field("Tags").Eq("y"), db.Field("Entries.Ref").Eq(refs[0])), "ana"},
+	})
+}
+
+type queryTest struct {
+	query db.Query
+	names string
+}
+
+func testQueries(t *testing.T, d db.Db, tests []queryTest) {
+	for _, tc := range tests {
+		var items []Item
+		keys, _, err := d.GetAll(itemKind, "", &items, tc.query, nil)
+		if err != nil {
+			t.Errorf("%v: %v", tc.query, err)
+			continue
+		}
+		if s := names(items, true); s != tc.names {
+			t.Errorf("%v returned %q, want %q", tc.query, s, tc.names)
+		}
+		for i, item := range items {
+			if keys[i].Encode() != item.Key.Encode() {
+				t.Errorf("%v: key %v expected got %v", tc.query, item.Key, keys[i])
+			}
+		}
+		if keys, _, err := d.GetAll(itemKind, "", nil, tc.query, nil); err != nil {
+			t.Errorf("%v: %v", tc.query, err)
+		} else if len(keys) != len(items) {
+			t.Errorf("%v: %v keys expected got %v", tc.query, len(items), len(keys))
+		}
+	}
+}
+
+func testOrder(t *testing.T, d db.Db, _ cache.Cache) {
+	saveSample(t, d)
+	for _, tc := range []struct {
+		query     db.Query
+		orderKeys []string
+		names     string
+	}{
+		{nil, []string{"Number"}, "ana anna bob carl"},
+		{nil, []string{"-Number"}, "carl bob anna ana"},
+		{nil, []string{"-Value"}, "bob anna ana carl"},
+		{nil, []string{"Removed", "-Date"}, "carl bob ana anna"},
+		{db.Field("Value").Ge(1), []string{"Value"}, "ana anna bob"},
+		{db.Field("Removed").Eq(false), []string{"-Date"}, "carl bob ana"},
+	} {
+		var items []*Item
+		if _, _, err := d.GetAll(itemKind, "", &items, tc.query, tc.orderKeys); err != nil {
+			t.Errorf("%v %v: %v", tc.query, tc.orderKeys, err)
+		} else if s := pointerNames(items); s != tc.names {
+			t.Errorf("%v %v returned %q, want %q", tc.query, tc.orderKeys, s, tc.names)
+		}
+	}
+}
+
+func testLimit(t *testing.T, d db.Db, _ cache.Cache) {
+	saveSample(t, d)
+	for _, tc := range []struct {
+		query db.Query
+		limit int
+		names string
+	}{
+		{nil, 2, "ana anna"},
+		{nil, 10, "ana anna bob carl"},
+		{nil, 0, "ana anna bob carl"},
+		{db.Field("Removed").Eq(false), 2, "ana bob"},
+		{db.Field("Name").In("anna", "carl"), 1, "anna"},
+		{db.Not(db.Field("Name").Eq("ana")), 2, "anna bob"},
+	} {
+		var items []*Item
+		keys, _, err := d.GetAllWithLimit(itemKind, "", &items, tc.query, []string{"Number"},
+			tc.limit)
+		if err != nil {
+			t.Errorf("%v %v: %v", tc.query, tc.limit, err)
+		} else if s := pointerNames(items); s != tc.names || len(keys) != len(items) {
+			t.Errorf("%v %v returned %q and %v keys, want %q", tc.query, tc.limit, s, len(keys),
+				tc.names)
+		}
+	}
+}
+
+func testExecute(t *testing.T, d db.Db, _ cache.Cache) {
+	// The items are children of the same parent, so that databases with transactions limited to
+	// an entity group can write them together.
+	parentKey := save(t, d, "", &Parent{Name: "p"})[0].Encode()
+	a := &Item{Name: "a"}
+	save(t, d, parentKey, a, &Item{Name: "b"})
+	rollback := errors.New("rollback")
+	err := d.Execute(func(tdb db.Db) error {
+		a.Name = "a2"
+		if _, err := tdb.Save(a, itemKind, parentKey, nil); err != nil {
+			return err
+		}
+		if _, err := tdb.Save(&Item{Name: "c"}, itemKind, parentKey, nil); err != nil {
+			return err
+		}
+		if keys, _, err := tdb.GetAll(itemKind, parentKey, nil, db.Field("Name").Eq("b"),
+			nil); err != nil {
+			return err
+		} else if err := tdb.Delete(keys[0]); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatalf("%v expected got %v", rollback, err)
+	}
+	var items []Item
+	if _, _, err := d.GetAll(itemKind, parentKey, &items, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if s := names(items, true); s != "a b" {
+		t.Errorf("Nothing must be written by a transaction rolled back, got %q", s)
+	}
+	err = d.Execute(func(tdb db.Db) error {
+		a.Name = "a2"
+		if _, err := tdb.Save(a, itemKind, parentKey, nil); err != nil {
+			return err
+		}
+		_, err := tdb.Save(&Item{Name: "c"}, itemKind, parentKey, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.GetAll(itemKind, parentKey, &items, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if s := names(items, true); s != "a2 b c" {
+		t.Errorf("Everything must be written by a transaction committed, got %q", s)
+	}
+}
+
+func testGetAllFromCache(t *testing.T, d db.Db, c cache.Cache) {
+	// A kind without items is cached as such.
+	for i := 0; i < 2; i++ {
+		var items []Item
+		if keys, _, err := d.GetAllFromCache(itemKind, "", &items, nil, nil, c,
+			cacheKey); err != nil {
+			t.Fatal(err)
+		} else if len(keys) > 0 || len(items) > 0 {
+			t.Error("No items expected got", len(items))
+		}
+	}
+	if err := c.Delete(cacheKey); err != nil {
+		t.Fatal(err)
+	}
+	saveSample(t, d)
+	// The results are the same whether the items are loaded or were already in the cache.
+	for i := 0; i < 2; i++ {
+		var items []Item
+		keys, _, err := d.GetAllFromCache(itemKind, "", &items, db.Field("Removed").Eq(false),
+			[]string{"-Number"}, c, cacheKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := names(items, false); s != "carl bob ana" {
+			t.Errorf("carl bob ana expected got %q", s)
+		}
+		for i, item := range items {
+			if keys[i].Encode() != item.Key.Encode() {
+				t.Errorf("Key %v expected got %v", item.Key, keys[i])
+			}
+		}
+	}
+	save(t, d, "", &Item{Name: "dave", Number: 5})
+	if err := c.Delete(cacheKey); err != nil {
+		t.Fatal(err)
+	}
+	var items []Item
+	if _, _, err := d.GetAllFromCache(itemKind, "", &items, nil, []string{"Number"}, c,
+		cacheKey); err != nil {
+		t.Fatal(err)
+	} else if s := names(items, false); s != "ana anna bob carl dave" {
+		t.Errorf("Items saved after the cache was cleared must be loaded, got %q", s)
+	}
+}
+
+// save saves the items, which are either Parent or Item, and returns their keys.
+func save(t *testing.T, d db.Db, ancestor string, items ...interface{}) db.Keys {
+	keys := db.Keys{}
+	for _, item := range items {
+		kind := itemKind
+		if _, ok := item.(*Parent); ok {
+			kind = parentKind
+		}
+		if key, err := d.Save(item, kind, ancestor, nil); err != nil {
+			t.Fatal(err)
+		} else {
+			keys = keys.Append(key)
+		}
+	}
+	return keys
+}
+
+// names returns the names of the items separated by spaces, sorted if the order of the items is
+// not defined.
+func names(items []Item, sorted bool) string {
+	result := make([]string, len(items))
+	for i, item := range items {
+		result[i] = item.Name
+	}
+	if sorted {
+		sort.Strings(result)
+	}
+	return strings.Join(result, " ")
+}
+
+func pointerNames(items []*Item) string {
+	result := make([]string, len(items))
+	for i, item := range items {
+		result[i] = item.Name
+	}
+	return strings.Join(result, " ")
+}
@@ -0,0 +1,24 @@
+// +build appengine
+
+package dbtest
+
+import (
+	"testing"
+
+	"appengine/aetest"
+	"github.com/mcesarhm/geek-accounting/go-server/cache"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+)
+
+func TestAppengineDb(t *testing.T) {
+	// The development server is started once, since the tests delete the items they leave, and
+	// its datastore is strongly consistent so that the items are queried as soon as saved.
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	Run(t, func(t *testing.T) (db.Db, cache.Cache, func()) {
+		return db.NewAppengineDb(c), cache.NewAppengineCache(c), func() {}
+	})
+}
@@ -0,0 +1,66 @@
+// +build inmemory
+
+package dbtest
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mcesarhm/geek-accounting/go-server/cache"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestInMemoryDb(t *testing.T) {
+	Run(t, func(t *testing.T) (db.Db, cache.Cache, func()) {
+		return db.NewInMemoryDb(), cache.NewInMemoryCache(), func() {}
+	})
+}
+
+func TestBoltDb(t *testing.T) {
+	Run(t, func(t *testing.T) (db.Db, cache.Cache, func()) {
+		dir, err := ioutil.TempDir("", "dbtest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := db.NewBoltDb(filepath.Join(dir, "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d, cache.NewInMemoryCache(), func() {
+			d.(io.Closer).Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestSqliteDb(t *testing.T) {
+	Run(t, func(t *testing.T) (db.Db, cache.Cache, func()) {
+		return newSqlDb(t, "sqlite3", ":memory:")
+	})
+}
+
+func TestPostgresDb(t *testing.T) {
+	// GA_TEST_POSTGRES is the data source of a local database, e.g.
+	// "dbname=ga_test sslmode=disable"
+	source := os.Getenv("GA_TEST_POSTGRES")
+	if source == "" {
+		t.Skip("GA_TEST_POSTGRES is not set")
+	}
+	Run(t, func(t *testing.T) (db.Db, cache.Cache, func()) {
+		return newSqlDb(t, "postgres", source)
+	})
+}
+
+func newSqlDb(t *testing.T, driverName, dataSourceName string) (db.Db, cache.Cache, func()) {
+	d, err := db.NewSqlDb(driverName, dataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, cache.NewInMemoryCache(), func() { d.(io.Closer).Close() }
+}
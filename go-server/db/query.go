@@ -0,0 +1,345 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query is a condition on the fields of the items of a kind, built with Field, And, Or and Not:
+//
+//	db.And(db.Field("Date").Ge(from), db.Field("Tags").In("a", "b"))
+//
+// Databases translate queries to their native filters where they can and otherwise fall back to
+// Matches. M is a Query too, whose keys are a field name followed by a comparison operator.
+type Query interface {
+	Matches(item interface{}) (bool, error)
+}
+
+var (
+	keyType  = reflect.TypeOf(CKey{})
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+type operator string
+
+const (
+	eq     operator = "="
+	lt     operator = "<"
+	le     operator = "<="
+	gt     operator = ">"
+	ge     operator = ">="
+	in     operator = "in"
+	prefix operator = "prefix"
+)
+
+// condition compares a field with a value. The field may be a path into a slice of structs, like
+// "Debits.Account", and slice fields satisfy the condition if any of their elements does.
+type condition struct {
+	field string
+	op    operator
+	value interface{}
+}
+
+type and []Query
+
+type or []Query
+
+type not struct{ q Query }
+
+// Field names the field of a condition. Fields of slices of structs are named by paths like
+// "Debits.Account".
+type Field string
+
+func (f Field) Eq(value interface{}) Query { return condition{string(f), eq, value} }
+func (f Field) Lt(value interface{}) Query { return condition{string(f), lt, value} }
+func (f Field) Le(value interface{}) Query { return condition{string(f), le, value} }
+func (f Field) Gt(value interface{}) Query { return condition{string(f), gt, value} }
+func (f Field) Ge(value interface{}) Query { return condition{string(f), ge, value} }
+
+// In is satisfied if the field is equal to any of the values.
+func (f Field) In(values ...interface{}) Query { return condition{string(f), in, values} }
+
+// HasPrefix is satisfied if the string field starts with s.
+func (f Field) HasPrefix(s string) Query { return condition{string(f), prefix, s} }
+
+// And is satisfied if all the queries are. Nil queries are ignored.
+func And(queries ...Query) Query {
+	return and(nonNil(queries))
+}
+
+// Or is satisfied if any of the queries is. Nil queries are ignored.
+func Or(queries ...Query) Query {
+	return or(nonNil(queries))
+}
+
+func Not(q Query) Query {
+	return not{q}
+}
+
+func nonNil(queries []Query) []Query {
+	result := []Query{}
+	for _, q := range queries {
+		if q != nil {
+			result = append(result, q)
+		}
+	}
+	return result
+}
+
+// Matches reports whether the item, a struct or a pointer to one, satisfies the query. A nil query
+// is satisfied by every item.
+func Matches(item interface{}, q Query) (bool, error) {
+	if q == nil {
+		return true, nil
+	}
+	return q.Matches(item)
+}
+
+func (q and) Matches(item interface{}) (bool, error) {
+	for _, c := range q {
+		if ok, err := c.Matches(item); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (q or) Matches(item interface{}) (bool, error) {
+	for _, c := range q {
+		if ok, err := c.Matches(item); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (q not) Matches(item interface{}) (bool, error) {
+	ok, err := q.q.Matches(item)
+	return !ok && err == nil, err
+}
+
+func (q condition) Matches(item interface{}) (bool, error) {
+	values, err := fieldValues(reflect.Indirect(reflect.ValueOf(item)), q.field)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		if ok, err := q.matchesValue(v); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (q condition) matchesValue(v interface{}) (bool, error) {
+	switch q.op {
+	case in:
+		values, ok := q.value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("Invalid values for in: %v", q.value)
+		}
+		for _, value := range values {
+			if c, err := compareValues(v, value); err != nil {
+				return false, err
+			} else if c == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case prefix:
+		s, ok := v.(string)
+		if !ok {
+			return false, fmt.Errorf("Type not allowed for prefix: %v", reflect.TypeOf(v))
+		}
+		return strings.HasPrefix(s, q.value.(string)), nil
+	}
+	c, err := compareValues(v, q.value)
+	if err != nil {
+		return false, err
+	}
+	switch q.op {
+	case eq:
+		return c == 0, nil
+	case lt:
+		return c < 0, nil
+	case le:
+		return c <= 0, nil
+	case gt:
+		return c > 0, nil
+	case ge:
+		return c >= 0, nil
+	}
+	return false, fmt.Errorf("Operator not allowed: %v", q.op)
+}
+
+type fieldKey struct {
+	t    reflect.Type
+	name string
+}
+
+// fieldIndexes caches the indexes of the fields looked up by name, as FieldByName dominates the
+// cost of filtering and sorting items in memory.
+var fieldIndexes sync.Map
+
+// fieldByName is v.FieldByName with the lookup of the field cached by type.
+func fieldByName(v reflect.Value, name string) reflect.Value {
+	key := fieldKey{v.Type(), name}
+	if index, ok := fieldIndexes.Load(key); ok {
+		if index == nil {
+			return reflect.Value{}
+		}
+		return v.FieldByIndex(index.([]int))
+	}
+	f, ok := v.Type().FieldByName(name)
+	if !ok {
+		fieldIndexes.Store(key, nil)
+		return reflect.Value{}
+	}
+	fieldIndexes.Store(key, f.Index)
+	return v.FieldByIndex(f.Index)
+}
+
+// fieldValues returns the values of the field of the struct, or of its elements if the field is a
+// slice.
+func fieldValues(v reflect.Value, path string) ([]interface{}, error) {
+	names := strings.SplitN(path, ".", 2)
+	f := fieldByName(v, names[0])
+	if !f.IsValid() {
+		return nil, fmt.Errorf("Field not found: %v", path)
+	}
+	if f.Kind() != reflect.Slice {
+		if len(names) > 1 {
+			return fieldValues(f, names[1])
+		}
+		return []interface{}{f.Interface()}, nil
+	}
+	result := []interface{}{}
+	for i := 0; i < f.Len(); i++ {
+		if len(names) > 1 {
+			values, err := fieldValues(reflect.Indirect(f.Index(i)), names[1])
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, values...)
+		} else {
+			result = append(result, f.Index(i).Interface())
+		}
+	}
+	return result, nil
+}
+
+// Matches reports whether the item satisfies every filter of m.
+func (m M) Matches(item interface{}) (bool, error) {
+	q, err := m.query()
+	if err != nil {
+		return false, err
+	}
+	return q.Matches(item)
+}
+
+// query converts the filters to conditions, in the order of their keys.
+func (m M) query() (and, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := and{}
+	for _, k := range keys {
+		arr := strings.Fields(k)
+		if len(arr) != 2 {
+			return nil, fmt.Errorf("Invalid filter: %v", k)
+		}
+		switch op := operator(arr[1]); op {
+		case eq, lt, le, gt, ge:
+			result = append(result, condition{arr[0], op, m[k]})
+		default:
+			return nil, fmt.Errorf("Operator not allowed: %v", op)
+		}
+	}
+	return result, nil
+}
+
+// normalize converts the value to one of the types compared by compareValues: int64, float64,
+// string, bool, time.Time or keyValue.
+func normalize(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, fmt.Errorf("Nil values are not allowed")
+	}
+	v := reflect.ValueOf(value)
+	if t, ok := value.(time.Time); ok {
+		return t, nil
+	}
+	if v.Kind() == reflect.Struct && v.Type().ConvertibleTo(keyType) {
+		return keyValue(v.Convert(keyType).Interface().(CKey).String()), nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	}
+	return nil, fmt.Errorf("Type not allowed: %v", v.Type())
+}
+
+// keyValue is the normalized form of keys, which are compared by their string representation.
+type keyValue string
+
+// compareValues returns -1, 0 or 1 if a is less than, equal to or greater than b. Integers and
+// floats are comparable with each other; other values must be of the same type.
+func compareValues(a, b interface{}) (int, error) {
+	na, err := normalize(a)
+	if err != nil {
+		return 0, err
+	}
+	nb, err := normalize(b)
+	if err != nil {
+		return 0, err
+	}
+	if i, ok := na.(int64); ok {
+		if _, ok := nb.(float64); ok {
+			na = float64(i)
+		}
+	} else if _, ok := na.(float64); ok {
+		if i, ok := nb.(int64); ok {
+			nb = float64(i)
+		}
+	}
+	if reflect.TypeOf(na) != reflect.TypeOf(nb) {
+		return 0, fmt.Errorf("Type mismatch: %v and %v", reflect.TypeOf(a), reflect.TypeOf(b))
+	}
+	switch x := na.(type) {
+	case int64:
+		return compareOrdered(x < nb.(int64), x > nb.(int64)), nil
+	case float64:
+		return compareOrdered(x < nb.(float64), x > nb.(float64)), nil
+	case string:
+		return strings.Compare(x, nb.(string)), nil
+	case keyValue:
+		return strings.Compare(string(x), string(nb.(keyValue))), nil
+	case bool:
+		return compareOrdered(!x && nb.(bool), x && !nb.(bool)), nil
+	case time.Time:
+		return compareOrdered(x.Before(nb.(time.Time)), x.After(nb.(time.Time))), nil
+	}
+	return 0, fmt.Errorf("Type not allowed: %v", reflect.TypeOf(a))
+}
+
+func compareOrdered(less, greater bool) int {
+	if less {
+		return -1
+	} else if greater {
+		return 1
+	}
+	return 0
+}
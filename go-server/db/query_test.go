@@ -0,0 +1,191 @@
+// +build inmemory
+
+package db
+
+import (
+	"encoding/gob"
+	"errors"
+	"testing"
+	"time"
+)
+
+func init() {
+	gob.Register((*U)(nil))
+}
+
+func TestMatches(t *testing.T) {
+	ref := CKey{id: 1, kind: "T"}
+	date := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+	u := &U{Name: "abc", Date: date, Value: 1.5, Ref: ref, Tags: []string{"p", "q"},
+		Entries: []E{{ref, 1}, {CKey{id: 2, kind: "T"}, 2}}}
+	for _, tc := range []struct {
+		query Query
+		ok    bool
+	}{
+		{nil, true},
+		{And(), true},
+		{Or(), false},
+		{Field("Name").Eq("abc"), true},
+		{Field("Value").Gt(1), true},
+		{Field("Value").Le(1.4), false},
+		{Field("Removed").Eq(false), true},
+		{Field("Date").Lt(date), false},
+		{Field("Date").Ge(date), true},
+		{Field("Ref").Eq(ref), true},
+		{Field("Tags").Eq("q"), true},
+		{Field("Tags").In("x", "p"), true},
+		{Field("Tags").In("x", "y"), false},
+		{Field("Entries.Ref").Eq(CKey{id: 2, kind: "T"}), true},
+		{Field("Entries.Value").Gt(2), false},
+		{Field("Name").HasPrefix("ab"), true},
+		{Field("Name").HasPrefix("b"), false},
+		{Not(Field("Name").Eq("abc")), false},
+		{Or(Field("Name").Eq("x"), Field("Tags").Eq("p")), true},
+		{And(Field("Name").Eq("abc"), Not(Field("Value").Eq(1.5))), false},
+		{And(nil, Field("Name").Eq("abc")), true},
+		{M{"Name =": "abc", "Value >": 1}, true},
+	} {
+		if ok, err := Matches(u, tc.query); err != nil {
+			t.Errorf("%v: %v", tc.query, err)
+		} else if ok != tc.ok {
+			t.Errorf("%v: %v expected got %v", tc.query, tc.ok, ok)
+		}
+	}
+	for _, q := range []Query{
+		Field("Name").Eq(1),
+		Field("Date").Eq("2014-03-01"),
+		Field("Missing").Eq("a"),
+		Field("Value").HasPrefix("1"),
+		M{"Name": "abc"},
+		M{"Name !=": "abc"},
+	} {
+		if _, err := Matches(u, q); err == nil {
+			t.Errorf("%v: error expected", q)
+		}
+	}
+}
+
+func TestQueries(t *testing.T) {
+	sqlDbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(sqlDbs)
+	boltDb, closeBoltDb := newBoltTestDb(t)
+	defer closeBoltDb()
+	dbs := map[string]Db{"inmemory": NewInMemoryDb(), "bolt": boltDb}
+	for name, db := range sqlDbs {
+		dbs[name] = db
+	}
+	for name, db := range dbs {
+		refs, err := save(db, "T", "", &T{Name: "x"}, &T{Name: "y"})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		date := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+		_, err = save(db, "U", "",
+			&U{Name: "ab", Date: date, Value: 1.5, Ref: refs[0], Tags: []string{"p", "q"},
+				Entries: []E{{refs[0], 1}, {refs[1], 2}}},
+			&U{Name: "abc", Date: date.AddDate(0, 1, 0), Removed: true, Tags: []string{"q"},
+				Entries: []E{{refs[1], 3}}},
+			&U{Name: "b", Date: date.AddDate(0, 2, 0), Value: 3})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for _, tc := range []struct {
+			query Query
+			names string
+		}{
+			{Field("Name").In("b", "ab", "z"), "ab b"},
+			{Field("Name").HasPrefix("ab"), "ab abc"},
+			{Field("Value").Ge(1.5), "ab b"},
+			{Field("Removed").Eq(true), "abc"},
+			{Not(Field("Tags").Eq("q")), "b"},
+			{Field("Tags").In("p", "z"), "ab"},
+			{Field("Entries.Ref").In(refs[1]), "ab abc"},
+			{Or(Field("Date").Gt(date.AddDate(0, 1, 0)), Field("Entries.Value").Eq(3)), "abc b"},
+			{And(Field("Date").Ge(date), Not(Or(Field("Removed").Eq(true), Field("Value").Eq(3)))),
+				"ab"},
+			{Or(), ""},
+		} {
+			var items []U
+			if _, _, err := db.GetAll("U", "", &items, tc.query, []string{"Name"}); err != nil {
+				t.Fatal(name, err)
+			}
+			names := ""
+			for _, u := range items {
+				if names != "" {
+					names += " "
+				}
+				names += u.Name
+			}
+			if names != tc.names {
+				t.Errorf("%v: %v returned %q, want %q", name, tc.query, names, tc.names)
+			}
+		}
+	}
+}
+
+func TestIterate(t *testing.T) {
+	sqlDbs := newSqlTestDbs(t)
+	defer closeSqlTestDbs(sqlDbs)
+	boltDb, closeBoltDb := newBoltTestDb(t)
+	defer closeBoltDb()
+	dbs := map[string]Db{"inmemory": NewInMemoryDb(), "bolt": boltDb}
+	for name, db := range sqlDbs {
+		dbs[name] = db
+	}
+	const n = 250
+	for name, db := range dbs {
+		for i := 0; i < n; i++ {
+			if _, err := db.Save(&U{Name: "u", Value: float64(i % 7), Removed: i%2 == 0}, "U", "",
+				nil); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		count, last := 0, -1
+		err := db.Iterate("U", "", nil, nil, func(key Key, item interface{}) error {
+			u := item.(*U)
+			if key.Encode() != u.Key.Encode() || u.Key.id <= last {
+				t.Fatalf("%v: key %v after %v", name, u.Key, last)
+			}
+			last = u.Key.id
+			count++
+			// The database may be used while iterating.
+			_, err := db.Save(&T{Name: "t"}, "T", "", nil)
+			return err
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if count != n {
+			t.Errorf("%v: %v items expected got %v", name, n, count)
+		}
+		count, value := 0, 7.0
+		err = db.Iterate("U", "", Field("Removed").Eq(false), []string{"-Value"},
+			func(_ Key, item interface{}) error {
+				u := item.(*U)
+				if u.Removed || u.Value > value {
+					t.Fatalf("%v: %+v out of order or not filtered", name, u)
+				}
+				value = u.Value
+				count++
+				return nil
+			})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if count != n/2 {
+			t.Errorf("%v: %v items expected got %v", name, n/2, count)
+		}
+		stop := errors.New("stop")
+		count = 0
+		err = db.Iterate("U", "", nil, nil, func(Key, interface{}) error {
+			if count++; count == 3 {
+				return stop
+			}
+			return nil
+		})
+		if err != stop || count != 3 {
+			t.Errorf("%v: iteration must stop at the first error, got %v after %v items", name, err,
+				count)
+		}
+	}
+}
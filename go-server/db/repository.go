@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/mcesarhm/geek-accounting/go-server/cache"
+)
+
+// Repository gives typed access to the items of a kind, whose struct type is T, so that callers
+// get []*T instead of an interface{} to be cast. The database is passed to each method, so that
+// the same repository is used inside and outside of transactions:
+//
+//	var accounts = db.NewRepository[Account]("Account")
+//
+//	keys, items, err := accounts.GetAll(c.Db, coaKey, db.Field("Removed").Eq(false), nil)
+type Repository[T any] struct {
+	kind string
+}
+
+// NewRepository returns the repository of the kind and registers T as its type.
+func NewRepository[T any](kind string) Repository[T] {
+	var item T
+	if _, ok := interface{}(&item).(Identifier); !ok {
+		panic(fmt.Sprintf("%T does not embed db.Identifiable", &item))
+	}
+	RegisterKind(kind, item)
+	return Repository[T]{kind}
+}
+
+func (r Repository[T]) Kind() string {
+	return r.kind
+}
+
+// Get returns the item of the key, which must be of the kind of the repository.
+func (r Repository[T]) Get(d Db, keyAsString string) (*T, error) {
+	key, err := d.DecodeKey(keyAsString)
+	if err != nil {
+		return nil, err
+	}
+	if key.Kind() != r.kind {
+		return nil, fmt.Errorf("Key of kind '%v' instead of '%v'", key.Kind(), r.kind)
+	}
+	item := new(T)
+	if _, err := d.Get(item, keyAsString); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r Repository[T]) GetAll(d Db, ancestor string, query Query, orderKeys []string) (Keys, []*T, error) {
+	return r.GetAllWithLimit(d, ancestor, query, orderKeys, 0)
+}
+
+func (r Repository[T]) GetAllWithLimit(d Db, ancestor string, query Query, orderKeys []string, limit int) (Keys, []*T, error) {
+	var items []*T
+	keys, _, err := d.GetAllWithLimit(r.kind, ancestor, &items, query, orderKeys, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, items, nil
+}
+
+// Keys returns the keys of the items satisfying the query, without loading the items where the
+// database can avoid it.
+func (r Repository[T]) Keys(d Db, ancestor string, query Query, limit int) (Keys, error) {
+	keys, _, err := d.GetAllWithLimit(r.kind, ancestor, nil, query, nil, limit)
+	return keys, err
+}
+
+// GetAllFromCache caches the items as a []*T, which must be registered with gob.
+func (r Repository[T]) GetAllFromCache(d Db, ancestor string, query Query, orderKeys []string, c cache.Cache, cacheKey string) (Keys, []*T, error) {
+	var items []*T
+	keys, _, err := d.GetAllFromCache(r.kind, ancestor, &items, query, orderKeys, c, cacheKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, items, nil
+}
+
+func (r Repository[T]) GetPage(d Db, ancestor string, query Query, orderKeys []string, limit int, cursor string) (Keys, []*T, string, error) {
+	var items []*T
+	keys, _, next, err := d.GetPage(r.kind, ancestor, &items, query, orderKeys, limit, cursor)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return keys, items, next, nil
+}
+
+func (r Repository[T]) Iterate(d Db, ancestor string, query Query, orderKeys []string, f func(Key, *T) error) error {
+	return d.Iterate(r.kind, ancestor, query, orderKeys, func(key Key, item interface{}) error {
+		return f(key, item.(*T))
+	})
+}
+
+func (r Repository[T]) GetMulti(d Db, keys Keys) ([]*T, error) {
+	var items []*T
+	_, err := d.GetMulti(&items, keys)
+	return items, err
+}
+
+func (r Repository[T]) Save(d Db, item *T, ancestor string, param map[string]string) (Key, error) {
+	return d.Save(item, r.kind, ancestor, param)
+}
+
+func (r Repository[T]) SaveMulti(d Db, items []*T, ancestor string) (Keys, error) {
+	return d.SaveMulti(items, r.kind, ancestor)
+}
+
+func (r Repository[T]) Delete(d Db, key Key) error {
+	return d.Delete(key)
+}
+
+func (r Repository[T]) DeleteMulti(d Db, keys Keys) error {
+	return d.DeleteMulti(keys)
+}
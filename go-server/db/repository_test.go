@@ -0,0 +1,61 @@
+// +build inmemory
+
+package db
+
+import (
+	"testing"
+)
+
+type R struct {
+	Identifiable
+	Name  string
+	Value int
+}
+
+var rs = NewRepository[R]("R")
+
+func TestRepository(t *testing.T) {
+	db := NewInMemoryDb()
+	keys, err := rs.SaveMulti(db, []*R{{Name: "b", Value: 2}, {Name: "a", Value: 1}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rs.Save(db, &R{Name: "c", Value: 3}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := rs.Get(db, key.Encode()); err != nil {
+		t.Fatal(err)
+	} else if r.Name != "c" || r.Key.Encode() != key.Encode() {
+		t.Error("c expected got", r)
+	}
+	if keys, items, err := rs.GetAll(db, "", Field("Value").Lt(3), []string{"Name"}); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 2 || items[0].Name != "a" || items[1].Name != "b" ||
+		keys[0].Encode() != items[0].Key.Encode() {
+		t.Error("a and b expected got", items)
+	}
+	if items, err := rs.GetMulti(db, keys); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 2 || items[0].Name != "b" || items[1].Name != "a" {
+		t.Error("b and a expected got", items)
+	}
+	if err := rs.Delete(db, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	if err := rs.Iterate(db, "", nil, []string{"Name"}, func(_ Key, r *R) error {
+		names = append(names, r.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Error("a and c expected got", names)
+	}
+	if keys, err := rs.Keys(db, "", Field("Name").Eq("c"), 0); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 1 || keys[0].Encode() != key.Encode() {
+		t.Error("the key of c expected got", keys)
+	}
+}
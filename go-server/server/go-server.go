@@ -3,20 +3,10 @@
 package server
 
 import (
-	"encoding/base64"
-	"encoding/gob"
-	"encoding/json"
-	"io"
-	//"io/ioutil"
-	"log"
-	"net/http"
-	//"runtime/debug"
 	"fmt"
-	"strings"
+	"net/http"
 
-	"github.com/gorilla/mux"
 	"github.com/mcesarhm/geek-accounting/go-server/accounting"
-	"github.com/mcesarhm/geek-accounting/go-server/accounting/reporting"
 	"github.com/mcesarhm/geek-accounting/go-server/cache"
 	"github.com/mcesarhm/geek-accounting/go-server/context"
 	"github.com/mcesarhm/geek-accounting/go-server/core"
@@ -29,65 +19,25 @@ import (
 	"appengine/taskqueue"
 )
 
-const PathPrefix = "/charts-of-accounts"
-
-type readHandlerFunc func(context.Context, map[string]interface{}, map[string]string,
-	core.UserKey) (interface{}, error)
-
-type writeHandlerFunc func(context.Context, map[string]interface{}, map[string]string,
-	core.UserKey) (interface{}, error)
-
-type writeHandlerFuncMulti func(context.Context, []map[string]interface{}, map[string]string,
-	core.UserKey) (interface{}, error)
+type appengineEnvironment struct{}
 
 func init() {
-	gob.Register(([]*accounting.Account)(nil))
-	gob.Register((*accounting.Account)(nil))
-	gob.Register(([]*accounting.Transaction)(nil))
-	gob.Register(([]*accounting.ChartOfAccounts)(nil))
-	r := mux.NewRouter()
-	r.HandleFunc(PathPrefix, getAllHandler(accounting.AllChartsOfAccounts)).Methods("GET")
-	r.HandleFunc(PathPrefix, postHandler2(coaPostHandler, true)).Methods("POST")
-	r.HandleFunc(PathPrefix+"/{coa}", postHandler(accounting.SaveChartOfAccounts)).Methods("PUT")
-	r.HandleFunc(PathPrefix+"/{coa}/accounts", getAllHandler(accounting.AllAccounts)).
-		Methods("GET")
-	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}",
-		getAllHandler(accounting.GetAccount)).Methods("GET")
-	r.HandleFunc(PathPrefix+"/{coa}/accounts", postHandler(accounting.SaveAccount)).Methods("POST")
-	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}",
-		postHandler(accounting.SaveAccount)).Methods("PUT")
-	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}",
-		deleteHandler(accounting.DeleteAccount)).Methods("DELETE")
-	r.HandleFunc(PathPrefix+"/{coa}/transactions",
-		getAllHandler(accounting.AllTransactions)).Methods("GET")
-	r.HandleFunc(PathPrefix+"/{coa}/transactions",
-		postHandlerMulti(accounting.SaveTransaction, true)).Methods("POST")
-	r.HandleFunc(PathPrefix+"/{coa}/transactions/{transaction}",
-		postHandlerMulti(accounting.SaveTransaction, false)).Methods("PUT")
-	r.HandleFunc(PathPrefix+"/{coa}/transactions/{transaction}",
-		getAllHandler(accounting.GetTransaction)).Methods("GET")
-	r.HandleFunc(PathPrefix+"/{coa}/transactions/{transaction}",
-		deleteHandler(accounting.DeleteTransaction)).Methods("DELETE")
-	r.HandleFunc(PathPrefix+"/{coa}/balance-sheet", getAllHandler(reporting.Balance)).
-		Methods("GET")
-	r.HandleFunc(PathPrefix+"/{coa}/journal", getAllHandler(reporting.Journal)).Methods("GET")
-	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}/ledger",
-		getAllHandler(reporting.Ledger)).Methods("GET")
-	r.HandleFunc(PathPrefix+"/{coa}/income-statement",
-		getAllHandler(reporting.IncomeStatement)).Methods("GET")
+	env := appengineEnvironment{}
+	r := NewRouter(env)
 	r.HandleFunc(PathPrefix+"/{coa}/migration",
-		postHandler2(coaMigrationHandler, true)).Methods("POST")
+		postHandler2(env, allowed(migrationCheck, coaMigrationHandler), true)).Methods("POST")
 	r.HandleFunc(PathPrefix+"/{coa}/migration/to/{coa2}",
-		postHandler2(coaMigrationHandler, true)).Methods("POST")
+		postHandler2(env, allowed(migrationCheck, coaMigrationHandler), true)).Methods("POST")
 	r.HandleFunc(PathPrefix+"/{coa}/migration_enqueue",
-		postHandler2(coaMigrationEnqueueHandler, true)).Methods("POST")
-	r.HandleFunc(PathPrefix+"/{coa}/transactions/pop",
-		postHandler(accounting.PopTransaction)).Methods("POST")
+		postHandler2(env, allowed(migrationCheck, coaMigrationEnqueueHandler), true)).
+		Methods("POST")
 	r.HandleFunc("/_ah/warmup", func(w http.ResponseWriter, r *http.Request) {
 		ac := appengine.NewContext(r)
 		c := newContext(ac)
-		if err := core.InitUserManagement(c); err != nil {
+		if password, err := core.InitUserManagement(c); err != nil {
 			http.Error(w, "Internal error:"+err.Error(), http.StatusInternalServerError)
+		} else if len(password) > 0 {
+			ac.Infof("The password of the admin user is %s", password)
 		}
 		if err := accounting.UpdateSchema(ac); err != nil {
 			http.Error(w, "Internal error:"+err.Error(), http.StatusInternalServerError)
@@ -100,30 +50,48 @@ func init() {
 		}
 		return
 	})
-	r.HandleFunc("/ping",
-		errorHandler(func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
-			return nil
-		}))
-	r.HandleFunc("/password", postHandler(core.ChangePassword)).Methods("PUT")
-	r.HandleFunc("/users", getAllHandler(core.AllUsers)).Methods("GET")
-	r.HandleFunc("/users/{user}", getAllHandler(core.GetUser)).Methods("GET")
-	r.HandleFunc("/users", postHandler(core.SaveUser)).Methods("POST")
-	r.HandleFunc("/users/{user}", postHandler(core.SaveUser)).Methods("PUT")
-	r.HandleFunc("/users/{user}", deleteHandler(core.DeleteUser)).Methods("DELETE")
 	http.Handle("/", r)
 }
 
-func coaPostHandler(c context.Context, m map[string]interface{}, p map[string]string,
-	u core.UserKey) (interface{}, error) {
-	if _, ok := p["coa"]; !ok {
-		c := m["_appengine_context"].(appengine.Context)
-		_, key, err := debappengine.NewDatastoreSpace(c, nil)
-		if err != nil {
-			return nil, err
-		}
-		p["space"] = key.Encode()
+func (_ appengineEnvironment) NewContext(r *http.Request) context.Context {
+	return newContext(appengine.NewContext(r))
+}
+
+func (_ appengineEnvironment) Space(r *http.Request, c context.Context,
+	coaKey string) (deb.Space, error) {
+	s, _, err := space(c, appengine.NewContext(r), coaKey)
+	return s, err
+}
+
+func (_ appengineEnvironment) NewSpace(c context.Context, m map[string]interface{}) (db.Key,
+	error) {
+	ctx := m["_appengine_context"].(appengine.Context)
+	_, key, err := debappengine.NewDatastoreSpace(ctx, nil)
+	if err != nil {
+		return nil, err
 	}
-	return accounting.SaveChartOfAccounts(c, m, p, u)
+	return db.CKey{DsKey: key}, nil
+}
+
+func (_ appengineEnvironment) Extras(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{"_appengine_context": appengine.NewContext(r)}
+}
+
+func (_ appengineEnvironment) Infof(r *http.Request, format string, args ...interface{}) {
+	appengine.NewContext(r).Infof(format, args...)
+}
+
+// migrationCheck allows the owners of the chart of accounts, and of the one it is migrated to,
+// to migrate it.
+func migrationCheck(c context.Context, p map[string]string, u core.UserKey) error {
+	manage := accounting.Allowed(accounting.Manage)
+	if err := manage(c, p, u); err != nil {
+		return err
+	}
+	if coa2, ok := p["coa2"]; ok {
+		return manage(c, map[string]string{"coa": coa2}, u)
+	}
+	return nil
 }
 
 func coaMigrationEnqueueHandler(c context.Context, m map[string]interface{}, p map[string]string,
@@ -179,7 +147,7 @@ func coaMigrationHandler(c context.Context, m map[string]interface{}, p map[stri
 		}
 		s := deb.LargeSpaceBuilder(0).NewSpaceWithOffset(nil, 0, 0, nil)
 		if result, err := accounting.Migrate(c, coa, p["coa"], p["coa2"], s,
-			db.CKey{key}, u); err != nil {
+			db.CKey{DsKey: key}, u); err != nil {
 			return nil, err
 		} else {
 			if err = debappengine.CopySpaceToDatastore(ctx, key, s); err != nil {
@@ -192,207 +160,14 @@ func coaMigrationHandler(c context.Context, m map[string]interface{}, p map[stri
 	}
 }
 
-func getAllHandler(f readHandlerFunc) http.HandlerFunc {
-	return errorHandler(func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
-		params := mux.Vars(r)
-		for k, v := range r.URL.Query() {
-			params[k] = v[0]
-		}
-		ctx := appengine.NewContext(r)
-		c := newContext(ctx)
-		m := map[string]interface{}{}
-		if coaKey, ok := params["coa"]; ok {
-			space, _, err := space(c, ctx, coaKey)
-			if err != nil {
-				return err
-			}
-			m["space"] = space
-		}
-		items, err := f(c, m, params, userKey)
-		if err != nil {
-			return err
-		}
-		return json.NewEncoder(w).Encode(items)
-	})
-}
-
-func postHandler(f writeHandlerFunc) http.HandlerFunc {
-	return postHandler2(f, false)
-}
-
-func postHandler2(f writeHandlerFunc, includeContextInMap bool) http.HandlerFunc {
-	return errorHandler(func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
-		/*
-			b, _ := ioutil.ReadAll(r.Body)
-			log.Println(string(b))
-		*/
-		var req interface{}
-
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			return badRequest{err}
-		}
-
-		m := req.(map[string]interface{})
-		ctx := appengine.NewContext(r)
-		c := newContext(ctx)
-		if includeContextInMap {
-			m["_appengine_context"] = ctx
-		}
-		params := mux.Vars(r)
-		if coaKey, ok := params["coa"]; ok {
-			space, _, err := space(c, ctx, coaKey)
-			if err != nil {
-				return err
-			}
-			m["space"] = space
-		}
-		item, err := f(c, m, params, userKey)
-		if err != nil {
-			return badRequest{err}
-		}
-
-		json.NewEncoder(w).Encode(item)
-
-		return nil
-	})
-}
-
-func postHandlerMulti(f writeHandlerFuncMulti, includeContextInMap bool) http.HandlerFunc {
-	return errorHandler(func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
-		var (
-			s   deb.Space
-			err error
-		)
-		ctx := appengine.NewContext(r)
-		c := newContext(ctx)
-		params := mux.Vars(r)
-		if coaKey, ok := params["coa"]; ok {
-			if s, _, err = space(c, ctx, coaKey); err != nil {
-				return err
-			}
-		}
-		maps := []map[string]interface{}{}
-		var req interface{}
-		dec := json.NewDecoder(r.Body)
-		isMulti := false
-		var count int64
-		for {
-			if err = dec.Decode(&req); err == io.EOF {
-				break
-			} else if err != nil {
-				return badRequest{err}
-			}
-			m := req.(map[string]interface{})
-			if includeContextInMap {
-				m["_appengine_context"] = ctx
-			}
-			if s != nil {
-				m["space"] = s
-			}
-			if _, ok := m["__multi__"]; ok {
-				isMulti = true
-			} else if v, ok := m["__count__"]; ok {
-				count = int64(v.(float64))
-			} else {
-				maps = append(maps, m)
-			}
-		}
-		//ctx.Infof("******", isMulti, count)
-		if isMulti && int64(len(maps)) != count {
-			return badRequest{fmt.Errorf("Multi post with incorrect count %v != %v", len(maps), count)}
-		}
-		item, err := f(c, maps, params, userKey)
-		if err != nil {
-			return badRequest{err}
-		}
-		json.NewEncoder(w).Encode(item)
-		return nil
-	})
-}
-
-func deleteHandler(f writeHandlerFunc) http.HandlerFunc {
-	return errorHandler(func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
-		m := map[string]interface{}{}
-		params := mux.Vars(r)
-		ctx := appengine.NewContext(r)
-		c := newContext(ctx)
-		if coaKey, ok := params["coa"]; ok {
-			space, _, err := space(c, ctx, coaKey)
-			if err != nil {
-				return err
-			}
-			m["space"] = space
-		}
-		_, err := f(c, m, params, userKey)
-		if err != nil {
-			return badRequest{err}
-		}
-
-		return nil
-	})
-}
-
-type badRequest struct{ error }
-
-type notFound struct{ error }
-
-// errorHandler wraps a function returning an error by handling the error and
-// returning a http.Handler.
-// If the error is of the one of the types defined above, it is handled as described for every type.
-// If the error is of another type, it is considered as an internal error and its message is logged.
-func errorHandler(
-	f func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var credentials string
-		if _, ok := r.Header["Authorization"]; ok {
-			credentials = strings.Split(r.Header["Authorization"][0], " ")[1]
-		} else {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		b, err := base64.StdEncoding.DecodeString(credentials)
-		if err != nil {
-			http.Error(w, "Internal error(1):"+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		arr := strings.Split(string(b), ":")
-		ctx := appengine.NewContext(r)
-		c := newContext(ctx)
-		err, ok, userKey := core.Login(c, arr[0], arr[1])
-		if err != nil {
-			http.Error(w, "Internal error(2):"+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		err = f(w, r, userKey)
-		if err == nil {
-			return
-		}
-		switch err.(type) {
-		case badRequest:
-			ctx.Infof(err.Error())
-			http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
-		case notFound:
-			http.Error(w, "Error: item not found", http.StatusNotFound)
-		default:
-			log.Println(err)
-			http.Error(w, "Internal error(3):"+err.Error(), http.StatusInternalServerError)
-		}
-	}
-}
-
 func newContext(ac appengine.Context) context.Context {
 	return context.Context{Db: db.NewAppengineDb(ac), Cache: cache.NewAppengineCache(ac)}
 }
 
 func space(c context.Context, ctx appengine.Context, coaKey string) (deb.Space,
 	*accounting.ChartOfAccounts, error) {
-	var coas []*accounting.ChartOfAccounts
-	keys, _, err := c.Db.GetAllFromCache("ChartOfAccounts", "", &coas, nil, nil, c.Cache,
-		"ChartOfAccounts")
+	keys, coas, err := accounting.ChartOfAccountsRepository.GetAllFromCache(c.Db, "", nil, nil,
+		c.Cache, "ChartOfAccounts")
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,605 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mcesarhm/geek-accounting/go-server/accounting"
+	"github.com/mcesarhm/geek-accounting/go-server/accounting/reporting"
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/core"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"mcesar.io/deb"
+)
+
+const PathPrefix = "/charts-of-accounts"
+
+type readHandlerFunc func(context.Context, map[string]interface{}, map[string]string,
+	core.UserKey) (interface{}, error)
+
+type writeHandlerFunc func(context.Context, map[string]interface{}, map[string]string,
+	core.UserKey) (interface{}, error)
+
+type writeHandlerFuncMulti func(context.Context, []map[string]interface{}, map[string]string,
+	core.UserKey) (interface{}, error)
+
+// Environment provides the platform dependent services used by the handlers: the database and
+// cache bound to a request, the deb space of a chart of accounts and logging.
+type Environment interface {
+	NewContext(r *http.Request) context.Context
+	// Space returns the space of the chart of accounts, or nil if the chart is not backed by one.
+	Space(r *http.Request, c context.Context, coaKey string) (deb.Space, error)
+	// NewSpace creates the space of a new chart of accounts, or returns nil if spaces are not
+	// supported.
+	NewSpace(c context.Context, m map[string]interface{}) (db.Key, error)
+	// Extras returns the entries added to the request map of handlers that need platform values.
+	Extras(r *http.Request) map[string]interface{}
+	Infof(r *http.Request, format string, args ...interface{})
+}
+
+// NewRouter returns a router with the routes common to every environment.
+func NewRouter(env Environment) *mux.Router {
+	read := accounting.Allowed(accounting.Read)
+	write := accounting.Allowed(accounting.Write)
+	manage := accounting.Allowed(accounting.Manage)
+	audit := accounting.Allowed(accounting.Audit)
+	r := mux.NewRouter()
+	r.HandleFunc(PathPrefix, getAllHandler(env, accounting.AllChartsOfAccounts)).Methods("GET")
+	r.HandleFunc(PathPrefix, postHandler2(env, coaPostHandler(env), true)).Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}",
+		postHandler(env, allowed(manage, accounting.SaveChartOfAccounts))).Methods("PUT")
+	r.HandleFunc(PathPrefix+"/{coa}/accounts",
+		getAllHandler(env, allowed(read, accounting.AllAccounts))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}",
+		getAllHandler(env, allowed(read, accounting.GetAccount))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/accounts",
+		postHandler(env, allowed(write, accounting.SaveAccount))).Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}",
+		postHandler(env, allowed(write, accounting.SaveAccount))).Methods("PUT")
+	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}",
+		deleteHandler(env, allowed(write, accounting.DeleteAccount))).Methods("DELETE")
+	r.HandleFunc(PathPrefix+"/{coa}/transactions",
+		getAllHandler(env, allowed(read, accounting.AllTransactions))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/transactions",
+		postHandlerMulti(env, allowedMulti(write, accounting.SaveTransaction), true)).
+		Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}/transactions/{transaction}",
+		postHandlerMulti(env, allowedMulti(write, accounting.SaveTransaction), false)).
+		Methods("PUT")
+	r.HandleFunc(PathPrefix+"/{coa}/transactions/{transaction}",
+		getAllHandler(env, allowed(read, accounting.GetTransaction))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/transactions/{transaction}",
+		deleteHandler(env, allowed(write, accounting.DeleteTransaction))).Methods("DELETE")
+	r.HandleFunc(PathPrefix+"/{coa}/balance-sheet",
+		getAllHandler(env, allowed(read, reporting.Balance))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/journal",
+		getAllHandler(env, allowed(read, reporting.Journal))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/accounts/{account}/ledger",
+		getAllHandler(env, allowed(read, reporting.Ledger))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/income-statement",
+		getAllHandler(env, allowed(read, reporting.IncomeStatement))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/transactions/pop",
+		postHandler(env, allowed(write, accounting.PopTransaction))).Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}/exchange-rates",
+		getAllHandler(env, allowed(read, accounting.AllExchangeRates))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/exchange-rates",
+		csvHandler(env, allowed(write, accounting.ImportExchangeRates))).Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}/revaluation",
+		postHandler(env, allowed(write, accounting.Revalue))).Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}/periods",
+		getAllHandler(env, allowed(read, accounting.AllFiscalPeriods))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/periods",
+		postHandler(env, allowed(manage, accounting.SaveFiscalPeriod))).Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}/periods/{period}",
+		postHandler(env, allowed(manage, accounting.SaveFiscalPeriod))).Methods("PUT")
+	r.HandleFunc(PathPrefix+"/{coa}/periods/{period}/closing",
+		postHandler(env, allowed(manage, accounting.CloseFiscalPeriod))).Methods("POST")
+	r.HandleFunc(PathPrefix+"/{coa}/periods/{period}/closing",
+		deleteHandler(env, allowed(manage, accounting.ReopenFiscalPeriod))).Methods("DELETE")
+	r.HandleFunc(PathPrefix+"/{coa}/members",
+		getAllHandler(env, allowed(manage, accounting.AllMemberships))).Methods("GET")
+	r.HandleFunc(PathPrefix+"/{coa}/members/{user}",
+		postHandler(env, allowed(manage, accounting.GrantMembership))).Methods("PUT")
+	r.HandleFunc(PathPrefix+"/{coa}/members/{user}",
+		deleteHandler(env, allowed(manage, accounting.RevokeMembership))).Methods("DELETE")
+	r.HandleFunc(PathPrefix+"/{coa}/audit",
+		getAllHandler(env, allowed(audit, accounting.AuditLog))).Methods("GET")
+	r.HandleFunc("/ping",
+		errorHandler(env, func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
+			return nil
+		}))
+	r.HandleFunc("/login", publicHandler(env, loginHandler)).Methods("POST")
+	r.HandleFunc("/refresh", publicHandler(env, refreshHandler)).Methods("POST")
+	r.HandleFunc("/logout", publicHandler(env, logoutHandler)).Methods("POST")
+	r.HandleFunc("/password", postHandler(env, core.ChangePassword)).Methods("PUT")
+	r.HandleFunc("/password-reset", publicHandler(env, passwordResetHandler)).Methods("POST")
+	r.HandleFunc("/users", getAllHandler(env, allowed(core.AdminOnly, core.AllUsers))).
+		Methods("GET")
+	r.HandleFunc("/users/{user}", getAllHandler(env, allowed(core.SelfOrAdmin, core.GetUser))).
+		Methods("GET")
+	r.HandleFunc("/users", postHandler(env, allowed(core.AdminOnly, core.SaveUser))).
+		Methods("POST")
+	r.HandleFunc("/users/{user}", postHandler(env, allowed(core.SelfOrAdmin, core.SaveUser))).
+		Methods("PUT")
+	r.HandleFunc("/users/{user}", deleteHandler(env, allowed(core.AdminOnly, core.DeleteUser))).
+		Methods("DELETE")
+	r.HandleFunc("/users/{user}/api-keys",
+		getAllHandler(env, allowed(core.SelfOrAdmin, core.AllAPIKeys))).Methods("GET")
+	r.HandleFunc("/users/{user}/api-keys",
+		postHandler(env, allowed(core.SelfOrAdmin, core.SaveAPIKey))).Methods("POST")
+	r.HandleFunc("/users/{user}/api-keys/{apiKey}",
+		deleteHandler(env, allowed(core.SelfOrAdmin, core.DeleteAPIKey))).Methods("DELETE")
+	r.HandleFunc("/users/{user}/totp",
+		postHandler(env, allowed(core.SelfOrAdmin, core.EnrollSecondFactor))).Methods("POST")
+	r.HandleFunc("/users/{user}/totp",
+		postHandler(env, allowed(core.SelfOrAdmin, core.ConfirmSecondFactor))).Methods("PUT")
+	r.HandleFunc("/users/{user}/totp",
+		deleteHandler(env, allowed(core.AdminOnly, core.ResetSecondFactor))).Methods("DELETE")
+	r.HandleFunc("/users/{user}/password-reset",
+		postHandler(env, allowed(core.AdminOnly, core.IssuePasswordReset))).Methods("POST")
+	r.HandleFunc("/users/{user}/lockout",
+		deleteHandler(env, allowed(core.AdminOnly, core.UnlockUser))).Methods("DELETE")
+	r.HandleFunc("/organizations", getAllHandler(env, core.AllOrganizations)).Methods("GET")
+	r.HandleFunc("/organizations",
+		postHandler(env, allowed(core.AdminOnly, core.SaveOrganization))).Methods("POST")
+	r.HandleFunc("/organizations/{organization}",
+		postHandler(env, allowed(core.AdminOnly, core.SaveOrganization))).Methods("PUT")
+	r.HandleFunc("/organizations/{organization}/users/{user}",
+		postHandler(env, allowed(core.AdminOnly, core.AddUserToOrganization))).Methods("PUT")
+	r.HandleFunc("/organizations/{organization}/users/{user}",
+		deleteHandler(env, allowed(core.AdminOnly, core.RemoveUserFromOrganization))).
+		Methods("DELETE")
+	r.HandleFunc("/organization", postHandler(env, core.SwitchOrganization)).Methods("PUT")
+	r.HandleFunc("/audit", getAllHandler(env, allowed(core.AdminOnly, core.AllAuditEntries))).
+		Methods("GET")
+	return r
+}
+
+// allowed returns a handler function that calls f if the user passes the check.
+func allowed(check core.Check, f func(context.Context, map[string]interface{}, map[string]string,
+	core.UserKey) (interface{}, error)) func(context.Context, map[string]interface{},
+	map[string]string, core.UserKey) (interface{}, error) {
+	return func(c context.Context, m map[string]interface{}, p map[string]string,
+		u core.UserKey) (interface{}, error) {
+		if err := check(c, p, u); err != nil {
+			return nil, err
+		}
+		return f(c, m, p, u)
+	}
+}
+
+func allowedMulti(check core.Check, f writeHandlerFuncMulti) writeHandlerFuncMulti {
+	return func(c context.Context, maps []map[string]interface{}, p map[string]string,
+		u core.UserKey) (interface{}, error) {
+		if err := check(c, p, u); err != nil {
+			return nil, err
+		}
+		return f(c, maps, p, u)
+	}
+}
+
+func coaPostHandler(env Environment) writeHandlerFunc {
+	return func(c context.Context, m map[string]interface{}, p map[string]string,
+		u core.UserKey) (interface{}, error) {
+		if _, ok := p["coa"]; !ok {
+			key, err := env.NewSpace(c, m)
+			if err != nil {
+				return nil, err
+			}
+			if key != nil {
+				p["space"] = key.Encode()
+			}
+		}
+		return accounting.SaveChartOfAccounts(c, m, p, u)
+	}
+}
+
+func getAllHandler(env Environment, f readHandlerFunc) http.HandlerFunc {
+	return errorHandler(env, func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
+		params := mux.Vars(r)
+		for k, v := range r.URL.Query() {
+			params[k] = v[0]
+		}
+		c := env.NewContext(r)
+		m := map[string]interface{}{}
+		if coaKey, ok := params["coa"]; ok {
+			space, err := env.Space(r, c, coaKey)
+			if err != nil {
+				return err
+			}
+			if space != nil {
+				m["space"] = space
+			}
+		}
+		items, err := f(c, m, params, userKey)
+		if err != nil {
+			return err
+		}
+		if page, ok := items.(db.Page); ok {
+			if len(page.Next) > 0 {
+				next := *r.URL
+				q := next.Query()
+				q.Set("cursor", page.Next)
+				next.RawQuery = q.Encode()
+				w.Header().Set("Link", fmt.Sprintf("<%v>; rel=\"next\"", next.RequestURI()))
+			}
+			items = page.Items
+		}
+		if s, ok := items.(jsonWriter); ok {
+			return s.WriteJSON(w)
+		}
+		return json.NewEncoder(w).Encode(items)
+	})
+}
+
+func postHandler(env Environment, f writeHandlerFunc) http.HandlerFunc {
+	return postHandler2(env, f, false)
+}
+
+// csvHandler passes the body of a text/csv request to f as m["csv"], and handles the other requests
+// like postHandler.
+func csvHandler(env Environment, f writeHandlerFunc) http.HandlerFunc {
+	other := postHandler(env, f)
+	csv := errorHandler(env, func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return badRequest{err}
+		}
+		c := env.NewContext(r)
+		c.Endpoint = endpoint(r)
+		item, err := f(c, map[string]interface{}{"csv": string(b)}, mux.Vars(r), userKey)
+		if err != nil {
+			return badRequest{err}
+		}
+		json.NewEncoder(w).Encode(item)
+		return nil
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			csv(w, r)
+		} else {
+			other(w, r)
+		}
+	}
+}
+
+func postHandler2(env Environment, f writeHandlerFunc, includeContextInMap bool) http.HandlerFunc {
+	return errorHandler(env, func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
+		/*
+			b, _ := ioutil.ReadAll(r.Body)
+			log.Println(string(b))
+		*/
+		var req interface{}
+
+		// The numbers are kept as written, so that amounts are converted to money exactly.
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			return badRequest{err}
+		}
+
+		m := req.(map[string]interface{})
+		c := env.NewContext(r)
+		c.Endpoint = endpoint(r)
+		if includeContextInMap {
+			for k, v := range env.Extras(r) {
+				m[k] = v
+			}
+		}
+		params := mux.Vars(r)
+		if coaKey, ok := params["coa"]; ok {
+			space, err := env.Space(r, c, coaKey)
+			if err != nil {
+				return err
+			}
+			if space != nil {
+				m["space"] = space
+			}
+		}
+		item, err := f(c, m, params, userKey)
+		if err != nil {
+			return badRequest{err}
+		}
+
+		json.NewEncoder(w).Encode(item)
+
+		return nil
+	})
+}
+
+func postHandlerMulti(env Environment, f writeHandlerFuncMulti,
+	includeContextInMap bool) http.HandlerFunc {
+	return errorHandler(env, func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
+		var (
+			s   deb.Space
+			err error
+		)
+		c := env.NewContext(r)
+		c.Endpoint = endpoint(r)
+		params := mux.Vars(r)
+		if coaKey, ok := params["coa"]; ok {
+			if s, err = env.Space(r, c, coaKey); err != nil {
+				return err
+			}
+		}
+		maps := []map[string]interface{}{}
+		var req interface{}
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		isMulti := false
+		var count int64
+		for {
+			if err = dec.Decode(&req); err == io.EOF {
+				break
+			} else if err != nil {
+				return badRequest{err}
+			}
+			m := req.(map[string]interface{})
+			if includeContextInMap {
+				for k, v := range env.Extras(r) {
+					m[k] = v
+				}
+			}
+			if s != nil {
+				m["space"] = s
+			}
+			if _, ok := m["__multi__"]; ok {
+				isMulti = true
+			} else if v, ok := m["__count__"]; ok {
+				n, _ := v.(json.Number)
+				if count, err = n.Int64(); err != nil {
+					return badRequest{err}
+				}
+			} else {
+				maps = append(maps, m)
+			}
+		}
+		if isMulti && int64(len(maps)) != count {
+			return badRequest{fmt.Errorf("Multi post with incorrect count %v != %v", len(maps), count)}
+		}
+		item, err := f(c, maps, params, userKey)
+		if err != nil {
+			return badRequest{err}
+		}
+		json.NewEncoder(w).Encode(item)
+		return nil
+	})
+}
+
+func deleteHandler(env Environment, f writeHandlerFunc) http.HandlerFunc {
+	return errorHandler(env, func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error {
+		m := map[string]interface{}{}
+		params := mux.Vars(r)
+		c := env.NewContext(r)
+		c.Endpoint = endpoint(r)
+		if coaKey, ok := params["coa"]; ok {
+			space, err := env.Space(r, c, coaKey)
+			if err != nil {
+				return err
+			}
+			if space != nil {
+				m["space"] = space
+			}
+		}
+		_, err := f(c, m, params, userKey)
+		if err != nil {
+			return badRequest{err}
+		}
+
+		return nil
+	})
+}
+
+// endpoint returns the method and path of the request, recorded in the audit log.
+func endpoint(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// address returns the IP address of the client, without the port. Forwarding headers are not
+// trusted, as any client can send them.
+func address(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// loginHandler opens a session for the user, password and, for the users with a second factor,
+// code of the request body and returns its tokens. The access token is then sent in an "Authorization: Bearer" header.
+func loginHandler(env Environment, w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return badRequest{err}
+	}
+	c := env.NewContext(r)
+	c.Address = address(r)
+	tokens, err := core.NewSession(c, req.User, req.Password, req.Code)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(tokens)
+}
+
+// passwordResetHandler sets the password of the user of the password reset token of the request
+// body.
+func passwordResetHandler(env Environment, w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return badRequest{err}
+	}
+	if len(req.Password) == 0 {
+		return badRequest{errors.New("The password must be informed")}
+	}
+	c := env.NewContext(r)
+	c.Endpoint = endpoint(r)
+	return core.ResetPassword(c, req.Token, req.Password)
+}
+
+// refreshHandler returns new tokens for the refresh token of the request body. The refresh token
+// cannot be used again.
+func refreshHandler(env Environment, w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return badRequest{err}
+	}
+	tokens, err := core.Refresh(env.NewContext(r), req.RefreshToken)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(tokens)
+}
+
+// logoutHandler revokes the session of the bearer token, or of the refresh token of the request
+// body, if any.
+func logoutHandler(env Environment, w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			return badRequest{err}
+		}
+	}
+	token := req.RefreshToken
+	if scheme, credentials := authorization(r); strings.EqualFold(scheme, "Bearer") {
+		token = credentials
+	}
+	if len(token) == 0 {
+		return badRequest{errors.New("No token to revoke")}
+	}
+	return core.Logout(env.NewContext(r), token)
+}
+
+// jsonWriter is implemented by the results that write themselves to the response as they are read
+// from the database, instead of being loaded in memory.
+type jsonWriter interface {
+	WriteJSON(w io.Writer) error
+}
+
+type badRequest struct{ error }
+
+type notFound struct{ error }
+
+// errorHandler wraps a function returning an error by handling the error and
+// returning a http.Handler.
+// The user is authenticated by an "Authorization: Bearer" header with an access token issued by
+// /login or an API key or, for scripts, by an "Authorization: Basic" header with the user and
+// password.
+// Until users who must change the password do it, every request but the change is forbidden.
+// If the error is of the one of the types defined above, it is handled as described for every type.
+// If the error is of another type, it is considered as an internal error and its message is logged.
+func errorHandler(env Environment,
+	f func(w http.ResponseWriter, r *http.Request, userKey core.UserKey) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err     error
+			ok      bool
+			userKey core.UserKey
+		)
+		c := env.NewContext(r)
+		c.Address = address(r)
+		switch scheme, credentials := authorization(r); strings.ToLower(scheme) {
+		case "bearer":
+			if strings.HasPrefix(credentials, core.APIKeyPrefix) {
+				err, ok, userKey = core.AuthenticateAPIKey(c, credentials)
+			} else {
+				err, ok, userKey = core.Authenticate(c, credentials)
+			}
+		case "basic":
+			b, decodeErr := base64.StdEncoding.DecodeString(credentials)
+			if decodeErr != nil {
+				http.Error(w, "Internal error(1):"+decodeErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			if arr := strings.SplitN(string(b), ":", 2); len(arr) == 2 {
+				err, ok, userKey = core.Login(c, arr[0], arr[1])
+			}
+		}
+		if err == core.ErrLocked {
+			handleError(env, w, r, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal error(2):"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/password" {
+			if err = core.CheckPasswordChange(c, userKey); err != nil {
+				handleError(env, w, r, err)
+				return
+			}
+		}
+		handleError(env, w, r, f(w, r, userKey))
+	}
+}
+
+// publicHandler is like errorHandler, but for the functions that do not require the user to be
+// authenticated or check the credentials themselves.
+func publicHandler(env Environment,
+	f func(env Environment, w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleError(env, w, r, f(env, w, r))
+	}
+}
+
+func handleError(env Environment, w http.ResponseWriter, r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	if err == core.ErrUnauthorized || err == core.ErrCodeRequired {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err == core.ErrForbidden || err == (badRequest{core.ErrForbidden}) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err == core.ErrLocked {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err == core.ErrPasswordChangeRequired {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	switch err.(type) {
+	case badRequest:
+		env.Infof(r, "%v", err)
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+	case notFound:
+		http.Error(w, "Error: item not found", http.StatusNotFound)
+	default:
+		log.Println(err)
+		http.Error(w, "Internal error(3):"+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// authorization returns the scheme and credentials of the Authorization header.
+func authorization(r *http.Request) (scheme, credentials string) {
+	arr := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(arr) < 2 {
+		return "", ""
+	}
+	return arr[0], strings.TrimSpace(arr[1])
+}
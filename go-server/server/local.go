@@ -0,0 +1,38 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/mcesarhm/geek-accounting/go-server/context"
+	"github.com/mcesarhm/geek-accounting/go-server/db"
+	"mcesar.io/deb"
+)
+
+type localEnvironment struct{ c context.Context }
+
+// NewLocalEnvironment returns an environment that serves every request with the given database
+// and cache. Charts of accounts are not backed by deb spaces.
+func NewLocalEnvironment(c context.Context) Environment {
+	return localEnvironment{c}
+}
+
+func (env localEnvironment) NewContext(_ *http.Request) context.Context {
+	return env.c
+}
+
+func (_ localEnvironment) Space(_ *http.Request, _ context.Context, _ string) (deb.Space, error) {
+	return nil, nil
+}
+
+func (_ localEnvironment) NewSpace(_ context.Context, _ map[string]interface{}) (db.Key, error) {
+	return nil, nil
+}
+
+func (_ localEnvironment) Extras(_ *http.Request) map[string]interface{} {
+	return nil
+}
+
+func (_ localEnvironment) Infof(_ *http.Request, format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
@@ -5,12 +5,14 @@ package main
 import (
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -22,6 +24,8 @@ func main() {
 	account := flag.String("a", "", "account")
 	username := flag.String("u", "admin", "user name")
 	filename := flag.String("f", "", "file name")
+	config := flag.String("c", filepath.Join(os.Getenv("HOME"), ".geek-accounting.json"),
+		"configuration file with the API key")
 	flag.Parse()
 
 	url := flag.Arg(0)
@@ -89,10 +93,10 @@ func main() {
 		} else {
 			if sum < 0 {
 				debits = append(debits,
-					fmt.Sprintf("{\"account\":\"%v\", \"value\":%v}", *account, -sum))
+					fmt.Sprintf("{\"account\":\"%v\", \"value\":%.2f}", *account, -sum))
 			} else if sum > 0 {
 				credits = append(credits,
-					fmt.Sprintf("{\"account\":\"%v\", \"value\":%v}", *account, sum))
+					fmt.Sprintf("{\"account\":\"%v\", \"value\":%.2f}", *account, sum))
 			}
 		}
 		fmt.Fprintf(&buf, `{ "debits": [`)
@@ -113,17 +117,6 @@ func main() {
 		count++
 	}
 	fmt.Fprintf(&buf, `{ "__count__": %v}`, count)
-	oldState, err := terminal.MakeRaw(1)
-	if err != nil {
-		panic(err)
-	}
-	defer terminal.Restore(1, oldState)
-	fmt.Print("Password: ")
-	pw, err := terminal.ReadPassword(1)
-	if err != nil {
-		panic(err)
-	}
-	password := string(pw)
 
 	req, err := http.NewRequest("POST", url+"/charts-of-accounts/"+coa+"/transactions", &buf)
 	if err != nil {
@@ -131,7 +124,14 @@ func main() {
 	}
 	req.Close = false
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(*username, password)
+	if apiKey, err := readAPIKey(*config); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading configuration:", err)
+		return
+	} else if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	} else {
+		req.SetBasicAuth(*username, readPassword())
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -144,6 +144,44 @@ func main() {
 	fmt.Println("response Body:", string(body))
 }
 
+// readAPIKey returns the API key of the GA_API_KEY environment variable or else of the
+// configuration file, which is like { "apiKey": "gak_..." }, or an empty string if there is none.
+func readAPIKey(config string) (string, error) {
+	if apiKey := os.Getenv("GA_API_KEY"); apiKey != "" {
+		return apiKey, nil
+	}
+	f, err := os.Open(config)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var cfg struct {
+		APIKey string `json:"apiKey"`
+	}
+	if err = json.NewDecoder(f).Decode(&cfg); err != nil {
+		return "", err
+	}
+	return cfg.APIKey, nil
+}
+
+func readPassword() string {
+	oldState, err := terminal.MakeRaw(1)
+	if err != nil {
+		panic(err)
+	}
+	defer terminal.Restore(1, oldState)
+	fmt.Print("Password: ")
+	pw, err := terminal.ReadPassword(1)
+	if err != nil {
+		panic(err)
+	}
+	return string(pw)
+}
+
 func printUsage() {
-	fmt.Println("usage: post url coa [-a account] [-u user] [-f filename]")
+	fmt.Println("usage: post url coa [-a account] [-u user] [-f filename] [-c config]")
+	fmt.Println("The API key is read from GA_API_KEY or the config file, like " +
+		`{ "apiKey": "gak_..." }; without one, the password of the user is asked.`)
 }